@@ -9,8 +9,16 @@ import (
 
 	"github.com/basemachina/bridge/bridgehttp"
 	"github.com/basemachina/bridge/internal/auth"
+	"github.com/basemachina/bridge/internal/bandwidth"
+	"github.com/basemachina/bridge/internal/bastion"
+	"github.com/basemachina/bridge/internal/concurrency"
 	"github.com/basemachina/bridge/internal/ctxtime"
+	"github.com/basemachina/bridge/internal/drain"
+	"github.com/basemachina/bridge/internal/egress"
+	"github.com/basemachina/bridge/internal/netguard"
+	"github.com/basemachina/bridge/internal/policy"
 	"github.com/basemachina/bridge/internal/proxy"
+	"github.com/basemachina/bridge/internal/target"
 	"github.com/go-logr/logr"
 )
 
@@ -41,6 +49,48 @@ type Env struct {
 
 	// TenantID is ID of tenant
 	TenantID string `envconfig:"TENANT_ID" default:"" description:"認可処理に利用します。設定されると指定されたテナント ID 以外からのリクエストを拒否します。"`
+	// ConfigFile is a path to the JSON config file.
+	ConfigFile string `envconfig:"CONFIG_FILE" default:"" description:"プロキシ先のポリシーなどを記述した JSON 形式の設定ファイルのパスです。"`
+
+	// UpstreamDialTimeout is timeout to dial to targets.
+	UpstreamDialTimeout time.Duration `envconfig:"UPSTREAM_DIAL_TIMEOUT" default:"30s" description:"プロキシ先への接続のタイムアウトです。"`
+	// UpstreamTLSHandshakeTimeout is timeout of TLS handshake with HTTPS targets.
+	UpstreamTLSHandshakeTimeout time.Duration `envconfig:"UPSTREAM_TLS_HANDSHAKE_TIMEOUT" default:"10s" description:"HTTPS のプロキシ先との TLS ハンドシェイクのタイムアウトです。"`
+	// UpstreamResponseHeaderTimeout is timeout to wait for response headers from HTTP targets. Zero means no timeout.
+	UpstreamResponseHeaderTimeout time.Duration `envconfig:"UPSTREAM_RESPONSE_HEADER_TIMEOUT" default:"0s" description:"HTTP のプロキシ先からレスポンスヘッダーを受け取るまでのタイムアウトです。0 の場合はタイムアウトしません。"`
+	// UpstreamMaxIdleConns is the maximum number of idle connections across all HTTP targets.
+	UpstreamMaxIdleConns int `envconfig:"UPSTREAM_MAX_IDLE_CONNS" default:"100" description:"HTTP のプロキシ先全体で保持するアイドル接続の最大数です。"`
+	// UpstreamMaxIdleConnsPerHost is the maximum number of idle connections per HTTP target.
+	UpstreamMaxIdleConnsPerHost int `envconfig:"UPSTREAM_MAX_IDLE_CONNS_PER_HOST" default:"2" description:"HTTP のプロキシ先ごとに保持するアイドル接続の最大数です。"`
+	// UpstreamIdleConnTimeout is how long an idle connection remains idle before closing itself.
+	UpstreamIdleConnTimeout time.Duration `envconfig:"UPSTREAM_IDLE_CONN_TIMEOUT" default:"90s" description:"HTTP のプロキシ先とのアイドル接続を閉じるまでの時間です。"`
+	// UpstreamHTTP2 enables HTTP/2 to HTTPS targets.
+	UpstreamHTTP2 bool `envconfig:"UPSTREAM_HTTP2" default:"true" description:"HTTPS のプロキシ先に HTTP/2 で接続するかどうかです。"`
+	// ProxyFlushInterval is the flush interval to the client while copying the response body.
+	ProxyFlushInterval time.Duration `envconfig:"PROXY_FLUSH_INTERVAL" default:"0s" description:"レスポンスボディをクライアントへフラッシュする間隔です。負の値の場合は書き込みごとにフラッシュします。"`
+	// UDPIdleTimeout is how long a udp relay session remains idle before closing itself.
+	UDPIdleTimeout time.Duration `envconfig:"UDP_IDLE_TIMEOUT" default:"60s" description:"UDP のリレーでデータグラムの送受信がないセッションを閉じるまでの時間です。"`
+	// TunnelIdleTimeout is how long a tcp tunnel remains idle before closing itself. Zero means no timeout.
+	TunnelIdleTimeout time.Duration `envconfig:"TUNNEL_IDLE_TIMEOUT" default:"0s" description:"TCP のトンネルでデータの送受信がない場合に閉じるまでの時間です。0 の場合は閉じません。"`
+	// TunnelMaxDuration is the maximum duration of a tcp tunnel. Zero means unlimited.
+	TunnelMaxDuration time.Duration `envconfig:"TUNNEL_MAX_DURATION" default:"0s" description:"TCP のトンネルを開いてから閉じるまでの最大の時間です。0 の場合は制限しません。"`
+	// TunnelMaxBytesToTarget is the maximum bytes sent to the target over a tcp tunnel. Zero means unlimited.
+	TunnelMaxBytesToTarget int64 `envconfig:"TUNNEL_MAX_BYTES_TO_TARGET" default:"0" description:"TCP のトンネルでプロキシ先へ送信できる最大のバイト数です。超えるとトンネルを閉じます。0 の場合は制限しません。"`
+	// TunnelMaxBytesFromTarget is the maximum bytes received from the target over a tcp tunnel. Zero means unlimited.
+	TunnelMaxBytesFromTarget int64 `envconfig:"TUNNEL_MAX_BYTES_FROM_TARGET" default:"0" description:"TCP のトンネルでプロキシ先から受信できる最大のバイト数です。超えるとトンネルを閉じます。0 の場合は制限しません。"`
+	// EnableH2C accepts HTTP/2 without TLS (h2c).
+	EnableH2C bool `envconfig:"ENABLE_H2C" default:"false" description:"TLS なしの HTTP/2 (h2c) を受け付けるかどうかです。HTTP/2 で中継するフロントエンドから extended CONNECT でトンネルを開く場合に有効にします。"`
+	// DrainTimeout is how long to wait for the live tunnels on shutdown before closing them.
+	DrainTimeout time.Duration `envconfig:"DRAIN_TIMEOUT" default:"5s" description:"終了時に新しいトンネルの受け付けを止めてから、接続中のトンネルが閉じられるのを待つ時間です。過ぎると残りのトンネルを切断します。"`
+	// DrainDelay is how long to keep serving after /ok starts to fail on shutdown, so that the load balancer notices it.
+	DrainDelay time.Duration `envconfig:"DRAIN_DELAY" default:"5s" description:"終了時に /ok が 503 を返し始めてから、サーバーを止めるまで待つ時間です。ロードバランサーがヘルスチェックの失敗を検知して振り分けを止めるのを待ちます。"`
+
+	// RendezvousURL is an url of the rendezvous server. If set, bridge dials to it and serves requests over the connection.
+	RendezvousURL string `envconfig:"RENDEZVOUS_URL" default:"" description:"設定されると bridge からランデブーサーバーに接続し、その接続上でリクエストを受け付けます。インバウンドのポートを公開する必要がなくなります。"`
+	// RendezvousToken authenticates bridge to the rendezvous server.
+	RendezvousToken string `envconfig:"RENDEZVOUS_TOKEN" default:"" description:"ランデブーサーバーへの接続の認証に利用するトークンです。"`
+	// RendezvousListen makes bridge listen on Port even if RendezvousURL is set, e.g. for health checks.
+	RendezvousListen bool `envconfig:"RENDEZVOUS_LISTEN" default:"false" description:"RENDEZVOUS_URL が設定されていても PORT で HTTP サーバーを起動するかどうかです。ヘルスチェックなどで必要な場合に有効にします。"`
 }
 
 // HTTPHandlerConfig is a config to setup bridge http handler.
@@ -51,12 +101,41 @@ type HTTPHandlerConfig struct {
 	TenantID                  string
 	Middlewares               []bridgehttp.Middleware
 	CheckConnectionServerAddr string
+	// Policy restricts the targets. If nil, any targets are allowed.
+	Policy *policy.Policy
+	// DialGuard validates the addresses before dialing. If nil, any addresses are allowed.
+	DialGuard *netguard.Guard
+	// Targets resolves aliases of targets. If nil, any aliases cannot be resolved.
+	Targets *target.Registry
+	// Transport is settings of the transport to HTTP targets. If nil, the default settings is used.
+	Transport *proxy.TransportConfig
+	// EgressProxy is a proxy to dial to targets through. If nil, dials directly.
+	EgressProxy *egress.Proxy
+	// Bastions holds connections to the SSH bastions which some targets
+	// are dialed through.
+	Bastions *bastion.Pool
+	// UDPIdleTimeout is an idle timeout of each udp relay session. If zero, the default value is used.
+	UDPIdleTimeout time.Duration
+	// TunnelLimits limits each tcp tunnel. If nil, tcp tunnels are not limited.
+	TunnelLimits *proxy.TunnelLimits
+	// Tunnels tracks the tcp tunnels to drain on shutdown. While draining,
+	// the readiness check fails. If nil, tunnels are not tracked.
+	Tunnels *drain.Tracker
+	// Shaper shapes the bandwidth of tunnels and HTTP bodies. If nil, the bandwidth is not limited.
+	Shaper *bandwidth.Shaper
+	// Concurrency limits the number of in-flight requests and tunnels. If nil, it is not limited.
+	Concurrency *concurrency.Limiter
 }
 
 // NewHTTPHandler is a handler for handling any requests.
 func NewHTTPHandler(c *HTTPHandlerConfig) http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc(fmt.Sprintf("GET %s", OKPath), func(w http.ResponseWriter, r *http.Request) {
+		if c.Tunnels != nil && c.Tunnels.Draining() {
+			// lets the load balancer stop routing new requests.
+			http.Error(w, drain.ErrDraining.Error(), http.StatusServiceUnavailable)
+			return
+		}
 		w.Write([]byte(OKMessage))
 	})
 	mux.HandleFunc(fmt.Sprintf("GET %s", GetCheckConnectionServerAddrPath), func(w http.ResponseWriter, r *http.Request) {
@@ -71,26 +150,104 @@ func NewHTTPHandler(c *HTTPHandlerConfig) http.Handler {
 			RegisterUserObject: c.RegisterUserObject,
 		}),
 	)
-	mux.Handle(ProxyPath, bridgehttp.UseMiddlewares(
-		proxy.NewProxy(c.Logger.WithName("proxy")),
+	proxyHandler := bridgehttp.UseMiddlewares(
+		proxy.NewProxy(&proxy.Config{
+			Logger:                    c.Logger.WithName("proxy"),
+			Policy:                    c.Policy,
+			Targets:                   c.Targets,
+			CheckConnectionServerAddr: c.CheckConnectionServerAddr,
+			DialGuard:                 c.DialGuard,
+			Transport:                 c.Transport,
+			EgressProxy:               c.EgressProxy,
+			Bastions:                  c.Bastions,
+			UDPIdleTimeout:            c.UDPIdleTimeout,
+			TunnelLimits:              c.TunnelLimits,
+			Tunnels:                   c.Tunnels,
+			Shaper:                    c.Shaper,
+			Concurrency:               c.Concurrency,
+		}),
 		middlewares...,
-	))
-	return mux
+	)
+	mux.Handle(ProxyPath, proxyHandler)
+
+	// the standard proxy requests do not have the path of bridge.
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bridgehttp.IsForwardProxyRequest(r) {
+			proxyHandler.ServeHTTP(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
 }
 
-func NewHTTPServer(envPort string, handler http.Handler) (*http.Server, func(), error) {
+// HTTPServerConfig is a config to setup bridge http server.
+type HTTPServerConfig struct {
+	Logger  logr.Logger
+	Port    string
+	Handler http.Handler
+	// Tunnels is drained on shutdown. It should be the same as
+	// HTTPHandlerConfig.Tunnels. If nil, tunnels are closed at exit.
+	Tunnels *drain.Tracker
+	// DrainTimeout is how long to wait for the requests and tunnels on
+	// shutdown. If zero, DefaultDrainTimeout is used.
+	DrainTimeout time.Duration
+	// DrainDelay is how long to keep serving after Tunnels starts to
+	// drain, so that the load balancer notices the failure of OKPath.
+	DrainDelay time.Duration
+	// EnableH2C accepts HTTP/2 without TLS (h2c) from the front-ends which
+	// speak HTTP/2 end to end, to open tunnels by extended CONNECT.
+	EnableH2C bool
+}
+
+// DefaultDrainTimeout is used if the drain timeout is not specified.
+const DefaultDrainTimeout = 5 * time.Second
+
+// NewHTTPServer creates bridge http server. The returned function stops
+// accepting new tunnels so that OKPath fails, waits for the drain delay,
+// and shuts down the server. Then it waits for the live tunnels up to the
+// drain timeout.
+func NewHTTPServer(c *HTTPServerConfig) (*http.Server, func(), error) {
 	srv := &http.Server{
-		Addr:    ":" + envPort,
-		Handler: handler,
+		Addr:    ":" + c.Port,
+		Handler: c.Handler,
+	}
+	if c.EnableH2C {
+		protocols := new(http.Protocols)
+		protocols.SetHTTP1(true)
+		protocols.SetUnencryptedHTTP2(true)
+		srv.Protocols = protocols
+	}
+	drainTimeout := c.DrainTimeout
+	if drainTimeout <= 0 {
+		drainTimeout = DefaultDrainTimeout
 	}
 
 	return srv, func() {
+		if c.Tunnels != nil {
+			c.Tunnels.Stop()
+			if c.DrainDelay > 0 {
+				c.Logger.Info("waiting for load balancer", "delay", c.DrainDelay)
+				time.Sleep(c.DrainDelay)
+			}
+		}
+
 		ctx, cancel := context.WithTimeout(
 			context.Background(),
-			5*time.Second,
+			drainTimeout,
 		)
 		defer cancel()
 		srv.Shutdown(ctx)
+
+		// hijacked tunnels are not waited by Shutdown.
+		if c.Tunnels == nil {
+			return
+		}
+		c.Logger.Info("draining tunnels", "tunnels", c.Tunnels.Len(), "timeout", drainTimeout)
+		if err := c.Tunnels.Drain(ctx); err != nil {
+			c.Logger.Error(err, "failed to drain tunnels")
+			return
+		}
+		c.Logger.Info("drained tunnels")
 	}, nil
 }
 
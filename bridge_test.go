@@ -1,10 +1,14 @@
 package bridge
 
 import (
+	"context"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/basemachina/bridge/internal/drain"
 	"github.com/basemachina/bridge/internal/testlogr"
 )
 
@@ -27,6 +31,26 @@ func TestNewHTTPHandler(t *testing.T) {
 		}
 	})
 
+	t.Run("ok path while draining", func(t *testing.T) {
+		t.Parallel()
+
+		tunnels := drain.New()
+		h := NewHTTPHandler(&HTTPHandlerConfig{
+			Logger:  testlogr.Logger,
+			Tunnels: tunnels,
+		})
+		if err := tunnels.Drain(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", OKPath, nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("want status code %d but got %d", http.StatusServiceUnavailable, rec.Code)
+		}
+	})
+
 	t.Run("get check connection server addr path", func(t *testing.T) {
 		t.Parallel()
 
@@ -46,4 +70,99 @@ func TestNewHTTPHandler(t *testing.T) {
 			t.Fatalf("want message %q but got %q", addr, got)
 		}
 	})
+
+	t.Run("forward proxy requests", func(t *testing.T) {
+		t.Parallel()
+
+		h := NewHTTPHandler(&HTTPHandlerConfig{
+			Logger: testlogr.Logger,
+		})
+		for _, req := range []*http.Request{
+			httptest.NewRequest("CONNECT", "db.internal:5432", nil),
+			httptest.NewRequest("GET", "http://api.internal"+OKPath, nil),
+		} {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			// handled by the proxy which requires the credentials
+			if rec.Code != http.StatusProxyAuthRequired {
+				t.Fatalf("%s %s: want status code %d but got %d", req.Method, req.URL, http.StatusProxyAuthRequired, rec.Code)
+			}
+		}
+	})
+}
+
+func TestNewHTTPServer_h2c(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		srv, cleanup, err := NewHTTPServer(&HTTPServerConfig{
+			Logger:    testlogr.Logger,
+			Port:      "0",
+			Handler:   http.NotFoundHandler(),
+			EnableH2C: enabled,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cleanup()
+		if got := srv.Protocols != nil && srv.Protocols.UnencryptedHTTP2(); got != enabled {
+			t.Errorf("EnableH2C %v: want h2c %v, but got %v", enabled, enabled, got)
+		}
+	}
+}
+
+func TestNewHTTPServer_drain(t *testing.T) {
+	tunnels := drain.New()
+	srv, cleanup, err := NewHTTPServer(&HTTPServerConfig{
+		Logger: testlogr.Logger,
+		Port:   "0",
+		Handler: NewHTTPHandler(&HTTPHandlerConfig{
+			Logger:  testlogr.Logger,
+			Tunnels: tunnels,
+		}),
+		Tunnels:      tunnels,
+		DrainTimeout: 100 * time.Millisecond,
+		DrainDelay:   200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	tunnelCtx, done, err := tunnels.Track()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		cleanup()
+	}()
+	<-tunnels.Stopped()
+
+	// the server is still serving while the load balancer notices it.
+	resp, err := http.Get("http://" + ln.Addr().String() + OKPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("want status code %d but got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	if tunnelCtx.Err() != nil {
+		t.Fatal("the tunnel is closed before the drain delay")
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(3 * time.Second):
+		t.Fatal("not stopped")
+	}
+	if tunnelCtx.Err() == nil {
+		t.Fatal("want the tunnel is closed after the drain timeout")
+	}
 }
@@ -12,3 +12,13 @@ func UseMiddlewares(h http.Handler, middlewares ...Middleware) http.Handler {
 	}
 	return h
 }
+
+// IsForwardProxyRequest reports whether r is a standard proxy request, which
+// is CONNECT to host:port or a request to the absolute URL.
+func IsForwardProxyRequest(r *http.Request) bool {
+	if r.Method == http.MethodConnect {
+		// extended CONNECT (RFC 8441) opens the tunnel of bridge itself.
+		return r.Header.Get(":protocol") == ""
+	}
+	return r.URL.IsAbs()
+}
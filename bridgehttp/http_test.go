@@ -36,3 +36,42 @@ func TestUseMiddlewares(t *testing.T) {
 		t.Errorf("want %q, but got %q", want, got)
 	}
 }
+
+func TestIsForwardProxyRequest(t *testing.T) {
+	extendedConnect := httptest.NewRequest("CONNECT", "/htproxy", nil)
+	extendedConnect.Header.Set(":protocol", "websocket")
+
+	cases := []struct {
+		name string
+		req  *http.Request
+		want bool
+	}{
+		{
+			name: "connect",
+			req:  httptest.NewRequest("CONNECT", "db.internal:5432", nil),
+			want: true,
+		},
+		{
+			name: "absolute form",
+			req:  httptest.NewRequest("GET", "http://api.internal/v1/users", nil),
+			want: true,
+		},
+		{
+			name: "origin form",
+			req:  httptest.NewRequest("GET", "/htproxy", nil),
+			want: false,
+		},
+		{
+			name: "extended connect",
+			req:  extendedConnect,
+			want: false,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := IsForwardProxyRequest(tc.req); tc.want != got {
+				t.Errorf("want %v, but got %v", tc.want, got)
+			}
+		})
+	}
+}
@@ -1,15 +1,31 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
+	"sync"
 
 	"github.com/basemachina/bridge"
+	"github.com/basemachina/bridge/internal/agent"
 	"github.com/basemachina/bridge/internal/auth"
+	"github.com/basemachina/bridge/internal/bandwidth"
+	"github.com/basemachina/bridge/internal/bastion"
+	"github.com/basemachina/bridge/internal/concurrency"
+	"github.com/basemachina/bridge/internal/config"
+	"github.com/basemachina/bridge/internal/drain"
+	"github.com/basemachina/bridge/internal/egress"
+	"github.com/basemachina/bridge/internal/netguard"
+	"github.com/basemachina/bridge/internal/policy"
+	"github.com/basemachina/bridge/internal/target"
 	"github.com/go-logr/logr"
 )
 
 type Container struct {
-	HTTPServer  *http.Server
+	// HTTPServer is nil if RENDEZVOUS_URL is set, unless RENDEZVOUS_LISTEN
+	// is true.
+	HTTPServer *http.Server
+	// Agent is nil unless RENDEZVOUS_URL is set.
+	Agent       *agent.Agent
 	FetchWorker *FetchWorker
 	Logger      logr.Logger
 }
@@ -19,6 +35,38 @@ func BridgeContainerProvider() (*Container, func(), error) {
 	if err != nil {
 		return nil, nil, err
 	}
+	conf, err := config.Load(env.ConfigFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	pol, err := policy.New(conf.Policy)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create policy: %w", err)
+	}
+	guard, err := netguard.New(conf.DialGuard)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create dial guard: %w", err)
+	}
+	targets, err := target.NewRegistry(conf.Targets)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create target registry: %w", err)
+	}
+	egressProxy, err := egress.New(conf.EgressProxy)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create egress proxy: %w", err)
+	}
+	bastions, err := bastion.New(conf.Bastions)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create bastion pool: %w", err)
+	}
+	shaper, err := bandwidth.New(conf.Bandwidth)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create bandwidth shaper: %w", err)
+	}
+	limiter, err := concurrency.New(conf.Concurrency)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create concurrency limiter: %w", err)
+	}
 	logger, cleanup, err := NewLogger(env)
 	if err != nil {
 		return nil, nil, err
@@ -31,28 +79,67 @@ func BridgeContainerProvider() (*Container, func(), error) {
 	if err != nil {
 		return nil, nil, err
 	}
+	tunnels := drain.New()
 	httpHandlerConfig := &bridge.HTTPHandlerConfig{
 		Logger:                    logger,
 		PublicKeyGetter:           fetchWorker,
 		TenantID:                  env.TenantID,
 		RegisterUserObject:        auth.User{},
 		CheckConnectionServerAddr: checkConnectionServerAddr,
+		Policy:                    pol,
+		DialGuard:                 guard,
+		Targets:                   targets,
+		Transport:                 NewTransportConfig(env),
+		EgressProxy:               egressProxy,
+		Bastions:                  bastions,
+		UDPIdleTimeout:            env.UDPIdleTimeout,
+		TunnelLimits:              NewTunnelLimits(env),
+		Tunnels:                   tunnels,
+		Shaper:                    shaper,
+		Concurrency:               limiter,
 	}
 	handler := bridge.NewHTTPHandler(httpHandlerConfig)
-	server, cleanup3, err := bridge.NewHTTPServer(env.Port, handler)
+	rendezvousAgent, err := NewAgent(env, logger, handler, tunnels)
+	if err != nil {
+		cleanup2()
+		cleanup()
+		return nil, nil, err
+	}
+	server, cleanup3, err := bridge.NewHTTPServer(&bridge.HTTPServerConfig{
+		Logger:       logger,
+		Port:         env.Port,
+		Handler:      handler,
+		Tunnels:      tunnels,
+		DrainTimeout: env.DrainTimeout,
+		DrainDelay:   env.DrainDelay,
+		EnableH2C:    env.EnableH2C,
+	})
 	if err != nil {
 		cleanup2()
 		cleanup()
 		return nil, nil, err
 	}
+	if rendezvousAgent != nil && !env.RendezvousListen {
+		// serves only over the agent without any inbound port. The server
+		// is still shut down by cleanup3 to drain the tunnels.
+		server = nil
+	}
 	container := &Container{
 		HTTPServer:  server,
+		Agent:       rendezvousAgent,
 		FetchWorker: fetchWorker,
 		Logger:      logger,
 	}
+	// run calls it both after the signal and on return, so that it runs
+	// only once not to wait for the drain twice.
+	var once sync.Once
 	return container, func() {
-		cleanup3()
-		cleanup2()
-		cleanup()
+		once.Do(func() {
+			cleanup3()
+			// closes after the server is shut down because tunnels use them.
+			bastions.Close()
+			cleanup2()
+			cleanup()
+		})
 	}, nil
 }
@@ -2,8 +2,14 @@ package main
 
 import (
 	"fmt"
+	"net/http"
+	"net/url"
 
 	"github.com/basemachina/bridge"
+	"github.com/basemachina/bridge/internal/agent"
+	"github.com/basemachina/bridge/internal/drain"
+	"github.com/basemachina/bridge/internal/proxy"
+	"github.com/go-logr/logr"
 	"github.com/kelseyhightower/envconfig"
 )
 
@@ -16,3 +22,55 @@ func ReadFromEnv() (*bridge.Env, error) {
 	}
 	return &env, nil
 }
+
+// NewTransportConfig creates settings of the transport to HTTP targets
+// from env.
+func NewTransportConfig(env *bridge.Env) *proxy.TransportConfig {
+	return &proxy.TransportConfig{
+		DialTimeout:           env.UpstreamDialTimeout,
+		TLSHandshakeTimeout:   env.UpstreamTLSHandshakeTimeout,
+		ResponseHeaderTimeout: env.UpstreamResponseHeaderTimeout,
+		MaxIdleConns:          env.UpstreamMaxIdleConns,
+		MaxIdleConnsPerHost:   env.UpstreamMaxIdleConnsPerHost,
+		IdleConnTimeout:       env.UpstreamIdleConnTimeout,
+		EnableHTTP2:           env.UpstreamHTTP2,
+		FlushInterval:         env.ProxyFlushInterval,
+	}
+}
+
+// NewTunnelLimits creates limits of each tcp tunnel from env.
+func NewTunnelLimits(env *bridge.Env) *proxy.TunnelLimits {
+	return &proxy.TunnelLimits{
+		IdleTimeout:        env.TunnelIdleTimeout,
+		MaxDuration:        env.TunnelMaxDuration,
+		MaxBytesToTarget:   env.TunnelMaxBytesToTarget,
+		MaxBytesFromTarget: env.TunnelMaxBytesFromTarget,
+	}
+}
+
+// NewAgent creates the agent which serves handler over the connection to
+// the rendezvous server. The tunnels are drained on shutdown. If
+// RENDEZVOUS_URL is not set, returns nil.
+func NewAgent(env *bridge.Env, logger logr.Logger, handler http.Handler, tunnels *drain.Tracker) (*agent.Agent, error) {
+	if env.RendezvousURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(env.RendezvousURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %w", env.RendezvousURL, err)
+	}
+	a, err := agent.New(&agent.Config{
+		Logger:  logger.WithName("agent"),
+		URL:     u,
+		Token:   env.RendezvousToken,
+		Handler: handler,
+		// the requests over the agent are drained as the ones of the
+		// HTTP server.
+		ShutdownTimeout: env.DrainTimeout,
+		Tunnels:         tunnels,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create agent: %w", err)
+	}
+	return a, nil
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"net/http"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/basemachina/bridge/internal/proxy"
+	"github.com/basemachina/bridge/internal/testlogr"
 )
 
 func TestReadFromEnv(t *testing.T) {
@@ -22,6 +27,116 @@ func TestReadFromEnv(t *testing.T) {
 	}
 }
 
+func TestNewTransportConfig(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		env, err := ReadFromEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := NewTransportConfig(env)
+		want := proxy.DefaultTransportConfig()
+		if *got != *want {
+			t.Fatalf("want %+v, but got %+v", want, got)
+		}
+	})
+
+	t.Run("override", func(t *testing.T) {
+		reset := setenvs(t, map[string]string{
+			"UPSTREAM_RESPONSE_HEADER_TIMEOUT": "2m",
+			"UPSTREAM_HTTP2":                   "false",
+			"PROXY_FLUSH_INTERVAL":             "-1ns",
+		})
+		t.Cleanup(reset)
+
+		env, err := ReadFromEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := NewTransportConfig(env)
+		if want := 2 * time.Minute; got.ResponseHeaderTimeout != want {
+			t.Errorf("want ResponseHeaderTimeout %v, but got %v", want, got.ResponseHeaderTimeout)
+		}
+		if got.EnableHTTP2 {
+			t.Error("want EnableHTTP2 is false")
+		}
+		if want := -time.Nanosecond; got.FlushInterval != want {
+			t.Errorf("want FlushInterval %v, but got %v", want, got.FlushInterval)
+		}
+	})
+}
+
+func TestNewTunnelLimits(t *testing.T) {
+	reset := setenvs(t, map[string]string{
+		"TUNNEL_IDLE_TIMEOUT":          "10m",
+		"TUNNEL_MAX_BYTES_FROM_TARGET": "1048576",
+	})
+	t.Cleanup(reset)
+
+	env, err := ReadFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := NewTunnelLimits(env)
+	want := proxy.TunnelLimits{
+		IdleTimeout:        10 * time.Minute,
+		MaxBytesFromTarget: 1 << 20,
+	}
+	if *got != want {
+		t.Fatalf("want %+v, but got %+v", want, *got)
+	}
+}
+
+func TestNewAgent(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		env, err := ReadFromEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := NewAgent(env, testlogr.Logger, http.NotFoundHandler(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a != nil {
+			t.Fatal("want nil agent")
+		}
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		reset := setenvs(t, map[string]string{
+			"RENDEZVOUS_URL":   "wss://rendezvous.example.com/agent",
+			"RENDEZVOUS_TOKEN": "token",
+		})
+		t.Cleanup(reset)
+
+		env, err := ReadFromEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := NewAgent(env, testlogr.Logger, http.NotFoundHandler(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a == nil {
+			t.Fatal("want agent")
+		}
+	})
+
+	t.Run("no token", func(t *testing.T) {
+		reset := setenvs(t, map[string]string{
+			"RENDEZVOUS_URL": "wss://rendezvous.example.com/agent",
+		})
+		t.Cleanup(reset)
+
+		env, err := ReadFromEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewAgent(env, testlogr.Logger, http.NotFoundHandler(), nil); err == nil {
+			t.Fatal("want error")
+		}
+	})
+}
+
 func setenv(t *testing.T, k, v string) func() {
 	t.Helper()
 
@@ -9,6 +9,7 @@ import (
 	"syscall"
 
 	"github.com/basemachina/bridge"
+	_ "github.com/basemachina/bridge/internal/xconnect"
 	"github.com/go-logr/logr"
 	"github.com/go-logr/zapr"
 	"go.uber.org/zap"
@@ -50,15 +51,24 @@ func run(ctx context.Context) error {
 
 	eg, ctx := errgroup.WithContext(ctx)
 
-	eg.Go(func() error {
-		l.Info("http server is booting...")
-		defer l.Info("finished running http server")
-		err := container.HTTPServer.ListenAndServe()
-		if err != nil && err != http.ErrServerClosed {
-			return err
-		}
-		return nil
-	})
+	if container.HTTPServer != nil {
+		eg.Go(func() error {
+			l.Info("http server is booting...")
+			defer l.Info("finished running http server")
+			err := container.HTTPServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				return err
+			}
+			return nil
+		})
+	}
+	if container.Agent != nil {
+		eg.Go(func() error {
+			l.Info("agent is connecting to rendezvous server...")
+			defer l.Info("finished running agent")
+			return container.Agent.Run(ctx)
+		})
+	}
 
 	<-ctx.Done()
 	cleanup()
@@ -0,0 +1,340 @@
+// Package agent connects bridge to the rendezvous server from the inside of
+// the private network, so that bridge serves requests without any inbound
+// port.
+//
+// The agent dials to the rendezvous server and keeps the websocket
+// connection. The rendezvous server opens streams of the multiplexed
+// session over the connection, and each stream is served as an HTTP
+// connection to bridge.
+package agent
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	mathrand "math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/basemachina/bridge/internal/drain"
+	"github.com/basemachina/bridge/internal/mux"
+	"github.com/basemachina/bridge/internal/websocket"
+	"github.com/go-logr/logr"
+)
+
+const (
+	// Subprotocol is the websocket subprotocol of the connection to the
+	// rendezvous server.
+	Subprotocol = "bridge-agent"
+
+	defaultMinBackoff       = time.Second
+	defaultMaxBackoff       = time.Minute
+	defaultHandshakeTimeout = 30 * time.Second
+	defaultShutdownTimeout  = 5 * time.Second
+	pingInterval            = 30 * time.Second
+)
+
+// DialContextFunc dials to the rendezvous server.
+type DialContextFunc = func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Config is a config of the agent.
+type Config struct {
+	Logger logr.Logger
+	// URL is the endpoint of the rendezvous server. The scheme is one of
+	// "ws", "wss", "http" and "https".
+	URL *url.URL
+	// Token authenticates bridge to the rendezvous server.
+	Token string
+	// Handler serves requests over the streams.
+	Handler http.Handler
+	// DialContext is an optional. If nil, net.Dialer is used.
+	DialContext DialContextFunc
+	// TLSConfig is an optional config to connect to the "wss" or "https" URL.
+	TLSConfig *tls.Config
+	// MinBackoff and MaxBackoff are the range of the interval to reconnect.
+	// If zero, 1s and 1m are used.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// ShutdownTimeout is how long to wait for the requests and tunnels on
+	// shutdown. If zero, 5s is used.
+	ShutdownTimeout time.Duration
+	// Tunnels is an optional. If specified, the tunnels over the agent are
+	// drained on shutdown before the connection is closed.
+	Tunnels *drain.Tracker
+}
+
+// Agent keeps the connection to the rendezvous server.
+type Agent struct {
+	logger          logr.Logger
+	url             *url.URL
+	token           string
+	dialContext     DialContextFunc
+	tlsConfig       *tls.Config
+	minBackoff      time.Duration
+	maxBackoff      time.Duration
+	shutdownTimeout time.Duration
+	tunnels         *drain.Tracker
+	server          *http.Server
+}
+
+// New creates a new agent.
+func New(c *Config) (*Agent, error) {
+	if c.URL == nil {
+		return nil, errors.New("rendezvous url is required")
+	}
+	switch c.URL.Scheme {
+	case "ws", "wss", "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported scheme of rendezvous url: %q", c.URL.Scheme)
+	}
+	if c.Token == "" {
+		return nil, errors.New("rendezvous token is required")
+	}
+	a := &Agent{
+		logger:          c.Logger,
+		url:             c.URL,
+		token:           c.Token,
+		dialContext:     c.DialContext,
+		tlsConfig:       c.TLSConfig,
+		minBackoff:      c.MinBackoff,
+		maxBackoff:      c.MaxBackoff,
+		shutdownTimeout: c.ShutdownTimeout,
+		tunnels:         c.Tunnels,
+		server:          &http.Server{Handler: c.Handler},
+	}
+	if a.dialContext == nil {
+		a.dialContext = (&net.Dialer{}).DialContext
+	}
+	if a.minBackoff <= 0 {
+		a.minBackoff = defaultMinBackoff
+	}
+	if a.maxBackoff <= 0 {
+		a.maxBackoff = defaultMaxBackoff
+	}
+	a.maxBackoff = max(a.minBackoff, a.maxBackoff)
+	if a.shutdownTimeout <= 0 {
+		a.shutdownTimeout = defaultShutdownTimeout
+	}
+	return a, nil
+}
+
+// Run connects to the rendezvous server and serves requests until ctx is
+// done. It reconnects with the exponential backoff when the connection is
+// lost. When ctx is done, it stops accepting new streams, and waits for
+// the requests and the tunnels up to the shutdown timeout before closing
+// the connection.
+func (a *Agent) Run(ctx context.Context) error {
+	shutdown := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(shutdown)
+		ctx, cancel := context.WithTimeout(context.Background(), a.shutdownTimeout)
+		defer cancel()
+		a.server.Shutdown(ctx)
+		// hijacked tunnels are not waited by Shutdown.
+		if a.tunnels != nil {
+			if err := a.tunnels.Drain(ctx); err != nil {
+				a.logger.Error(err, "failed to drain tunnels")
+			}
+		}
+	})
+	defer stop()
+
+	backoff := a.minBackoff
+	for {
+		session, err := a.connect(ctx)
+		if err == nil {
+			a.logger.Info("connected to rendezvous server", "url", a.url.Redacted())
+			backoff = a.minBackoff
+			err = a.server.Serve(newListener(session))
+		}
+		if ctx.Err() != nil || errors.Is(err, http.ErrServerClosed) {
+			<-shutdown
+			if session != nil {
+				session.Close()
+			}
+			return nil
+		}
+		if session != nil {
+			session.Close()
+		}
+
+		// waits the half to the full of backoff to avoid reconnecting at once
+		wait := backoff/2 + mathrand.N(backoff/2+1)
+		a.logger.Error(err, "disconnected from rendezvous server", "retry after", wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, a.maxBackoff)
+	}
+}
+
+// connect opens the connection to the rendezvous server and starts the
+// session over it.
+func (a *Agent) connect(ctx context.Context) (*mux.Session, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultHandshakeTimeout)
+	defer cancel()
+
+	secure := a.url.Scheme == "wss" || a.url.Scheme == "https"
+	addr := a.url.Host
+	if a.url.Port() == "" {
+		port := "80"
+		if secure {
+			port = "443"
+		}
+		addr = net.JoinHostPort(a.url.Hostname(), port)
+	}
+	conn, err := a.dialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial to rendezvous server: %w", err)
+	}
+	// aborts the handshake when ctx is done
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	wsConn, err := a.handshake(ctx, conn, secure)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+
+	session := mux.Server(wsConn)
+	stopPing := wsConn.KeepAlive(pingInterval)
+	go func() {
+		<-session.Done()
+		stopPing()
+	}()
+	return session, nil
+}
+
+func (a *Agent) handshake(ctx context.Context, conn net.Conn, secure bool) (*websocket.Conn, error) {
+	if secure {
+		cfg := &tls.Config{}
+		if a.tlsConfig != nil {
+			cfg = a.tlsConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = a.url.Hostname()
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, fmt.Errorf("failed to handshake tls with rendezvous server: %w", err)
+		}
+		conn = tlsConn
+	}
+
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	u := *a.url
+	u.Scheme = "http"
+	if secure {
+		u.Scheme = "https"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", Subprotocol)
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("failed to write handshake request: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read handshake response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("rendezvous server rejected the connection: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != websocket.AcceptKey(key) {
+		return nil, errors.New("unexpected challenge response from rendezvous server")
+	}
+	if resp.Header.Get("Sec-WebSocket-Protocol") != Subprotocol {
+		return nil, fmt.Errorf("unexpected subprotocol: %q", resp.Header.Get("Sec-WebSocket-Protocol"))
+	}
+	// the rendezvous server may open streams right after the response
+	return websocket.NewConn(&bufConn{Conn: conn, reader: br}, true), nil
+}
+
+// bufConn reads the data buffered while reading the handshake response first.
+type bufConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// listener accepts the streams opened by the rendezvous server as
+// connections to bridge. Closing it stops accepting the streams, but the
+// session is kept for the accepted ones.
+type listener struct {
+	session *mux.Session
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+var _ net.Listener = (*listener)(nil)
+
+func newListener(session *mux.Session) *listener {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &listener{session: session, ctx: ctx, cancel: cancel}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		stream, err := l.session.AcceptContext(l.ctx)
+		if l.ctx.Err() != nil {
+			if stream != nil {
+				stream.Reject(http.StatusServiceUnavailable, "agent is closed")
+			}
+			return nil, net.ErrClosed
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := stream.Ack(); err != nil {
+			stream.Close()
+			continue
+		}
+		return stream, nil
+	}
+}
+
+func (l *listener) Close() error {
+	l.cancel()
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return agentAddr{}
+}
+
+// agentAddr is the address of the listener over the session.
+type agentAddr struct{}
+
+func (agentAddr) Network() string { return "agent" }
+func (agentAddr) String() string  { return "agent" }
@@ -0,0 +1,329 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/basemachina/bridge/internal/mux"
+	"github.com/basemachina/bridge/internal/proxy"
+	"github.com/basemachina/bridge/internal/testlogr"
+	"github.com/basemachina/bridge/internal/websocket"
+)
+
+const testToken = "rendezvous-token"
+
+// rendezvous is a stand-in of the rendezvous server. It rejects the first
+// attempts with 503 as many as specified, and sends the sessions of the
+// agent to sessions.
+type rendezvous struct {
+	*httptest.Server
+	attempts atomic.Int32
+	sessions chan *mux.Session
+}
+
+func newRendezvous(t *testing.T, rejects int32) *rendezvous {
+	t.Helper()
+	r := &rendezvous{sessions: make(chan *mux.Session, 1)}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.attempts.Add(1) <= rejects {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if req.Header.Get("Authorization") != "Bearer "+testToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.Header.Get("Sec-WebSocket-Protocol") != Subprotocol {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// writes the response directly because net/http does not write it
+		// after the connection is hijacked.
+		resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + websocket.AcceptKey(req.Header.Get("Sec-WebSocket-Key")) + "\r\n" +
+			"Sec-WebSocket-Protocol: " + Subprotocol + "\r\n\r\n"
+		if _, err := io.WriteString(conn, resp); err != nil {
+			conn.Close()
+			return
+		}
+		if brw.Reader.Buffered() > 0 {
+			t.Error("unexpected data before the session")
+		}
+		r.sessions <- mux.Client(websocket.NewConn(conn, false))
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *rendezvous) session(t *testing.T) *mux.Session {
+	t.Helper()
+	select {
+	case s := <-r.sessions:
+		t.Cleanup(func() { s.Close() })
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent is not connected")
+		return nil
+	}
+}
+
+// client returns the HTTP client which sends requests over session.
+func client(session *mux.Session) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return session.Open(ctx, nil)
+			},
+		},
+		Timeout: 3 * time.Second,
+	}
+}
+
+func runAgent(t *testing.T, c *Config) {
+	t.Helper()
+	c.Logger = testlogr.Logger
+	c.Token = testToken
+	c.MinBackoff = 10 * time.Millisecond
+	c.MaxBackoff = 50 * time.Millisecond
+	a, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- a.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestAgent(t *testing.T) {
+	r := newRendezvous(t, 2)
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runAgent(t, &Config{
+		URL: u,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			io.WriteString(w, "hello, "+req.URL.Path)
+		}),
+	})
+
+	// retries after the rejected attempts.
+	session := r.session(t)
+	if got := r.attempts.Load(); got != 3 {
+		t.Fatalf("want 3 attempts, but got %d", got)
+	}
+
+	get := func(t *testing.T, session *mux.Session) {
+		t.Helper()
+		resp, err := client(session).Get("http://bridge/ok")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "hello, /ok"; string(body) != want {
+			t.Fatalf("want %q, but got %q", want, body)
+		}
+	}
+	get(t, session)
+
+	// reconnects after the connection is lost.
+	session.Close()
+	get(t, r.session(t))
+}
+
+func TestAgent_shutdown(t *testing.T) {
+	r := newRendezvous(t, 0)
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	a, err := New(&Config{
+		Logger: testlogr.Logger,
+		URL:    u,
+		Token:  testToken,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			close(started)
+			<-release
+			io.WriteString(w, "finished")
+		}),
+		ShutdownTimeout: 3 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- a.Run(ctx) }()
+	session := r.session(t)
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := client(session).Get("http://bridge/slow")
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		results <- result{body: string(body), err: err}
+	}()
+	<-started
+
+	// the request in flight is kept while shutting down.
+	cancel()
+	select {
+	case err := <-done:
+		t.Fatalf("returned before the request is finished: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	select {
+	case <-session.Done():
+		t.Fatal("the session is closed before the request is finished")
+	default:
+	}
+
+	close(release)
+	res := <-results
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res.body != "finished" {
+		t.Fatalf("want %q, but got %q", "finished", res.body)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("not returned after shutdown")
+	}
+}
+
+func TestAgent_tunnel(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	r := newRendezvous(t, 0)
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runAgent(t, &Config{
+		URL:     u,
+		Handler: proxy.NewProxy(&proxy.Config{Logger: testlogr.Logger}),
+	})
+	session := r.session(t)
+
+	// upgrades the stream to the tunnel like the client of bridge.
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	conn, err := session.Open(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	req, err := http.NewRequest(http.MethodGet, "http://bridge/htproxy", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(proxy.TargetURLHeaderKey, "tcp://"+echo.Addr().String())
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("want 101, but got %d", resp.StatusCode)
+	}
+
+	const want = "hello, tunnel over agent"
+	if _, err := io.WriteString(conn, want); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(br, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("want %q, but got %q", want, got)
+	}
+}
+
+func TestNew(t *testing.T) {
+	cases := []struct {
+		name string
+		conf *Config
+	}{
+		{
+			name: "no url",
+			conf: &Config{Token: testToken},
+		},
+		{
+			name: "unsupported scheme",
+			conf: &Config{URL: &url.URL{Scheme: "tcp", Host: "rendezvous:443"}, Token: testToken},
+		},
+		{
+			name: "no token",
+			conf: &Config{URL: &url.URL{Scheme: "wss", Host: "rendezvous"}},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := New(tc.conf); err == nil {
+				t.Fatal("want error")
+			}
+		})
+	}
+}
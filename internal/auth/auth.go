@@ -1,7 +1,10 @@
 package auth
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
@@ -17,6 +20,9 @@ import (
 const (
 	issuerKey                     = "basemachina.com"
 	XBridgeAuthorizationHeaderKey = "X-Bridge-Authorization"
+	// ProxyAuthorizationHeaderKey is used by the standard proxy requests
+	// instead of XBridgeAuthorizationHeaderKey.
+	ProxyAuthorizationHeaderKey = "Proxy-Authorization"
 )
 
 func parseBearer(headerKey string, header http.Header) (string, error) {
@@ -26,6 +32,28 @@ func parseBearer(headerKey string, header http.Header) (string, error) {
 	return "", errors.New("bearer token not found")
 }
 
+// parseToken parses the jwt from X-Bridge-Authorization or
+// Proxy-Authorization. Proxy-Authorization also accepts the jwt as the
+// password of Basic, so that clients can specify it in HTTP_PROXY.
+func parseToken(header http.Header) (string, error) {
+	if bearer, err := parseBearer(XBridgeAuthorizationHeaderKey, header); err == nil {
+		return bearer, nil
+	}
+	if bearer, err := parseBearer(ProxyAuthorizationHeaderKey, header); err == nil {
+		return bearer, nil
+	}
+	if h := header.Get(ProxyAuthorizationHeaderKey); len(h) > 6 && strings.EqualFold(h[0:6], "BASIC ") {
+		decoded, err := base64.StdEncoding.DecodeString(h[6:])
+		if err != nil {
+			return "", fmt.Errorf("invalid basic credentials: %w", err)
+		}
+		if _, password, ok := strings.Cut(string(decoded), ":"); ok && password != "" {
+			return password, nil
+		}
+	}
+	return "", errors.New("bearer token not found")
+}
+
 // User is included in payload of the jwt which is coming from basemachina API.
 type User struct {
 	Tenant Tenant `json:"tenant"`
@@ -45,6 +73,21 @@ type TenantIDGetter interface {
 	GetTenantID() string
 }
 
+type tenantIDContextKey struct{}
+
+// WithTenantID returns a copy of ctx which carries the tenant ID of the
+// authenticated request.
+func WithTenantID(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, tenantIDContextKey{}, tenantID)
+}
+
+// TenantIDFromContext returns the tenant ID set by Middleware. It returns
+// empty if the request is not authenticated.
+func TenantIDFromContext(ctx context.Context) string {
+	tenantID, _ := ctx.Value(tenantIDContextKey{}).(string)
+	return tenantID
+}
+
 // MiddlewareConfig is a config for Middleware function.
 type MiddlewareConfig struct {
 	TenantID string
@@ -67,9 +110,18 @@ func Middleware(c *MiddlewareConfig) bridgehttp.Middleware {
 	}
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			bearer, err := parseBearer(XBridgeAuthorizationHeaderKey, r.Header)
+			// the standard proxy clients retry with the credentials on 407.
+			writeError := func(code int) {
+				if bridgehttp.IsForwardProxyRequest(r) {
+					w.Header().Set("Proxy-Authenticate", `Basic realm="bridge"`)
+					code = http.StatusProxyAuthRequired
+				}
+				w.WriteHeader(code)
+			}
+
+			bearer, err := parseToken(r.Header)
 			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
+				writeError(http.StatusBadRequest)
 				return
 			}
 
@@ -86,7 +138,7 @@ func Middleware(c *MiddlewareConfig) bridgehttp.Middleware {
 			)
 			if err != nil {
 				c.Logger.Error(err, "jwt unauthorized error")
-				w.WriteHeader(http.StatusUnauthorized)
+				writeError(http.StatusUnauthorized)
 				return
 			}
 
@@ -99,14 +151,15 @@ func Middleware(c *MiddlewareConfig) bridgehttp.Middleware {
 
 			if c.TenantID != "" && tenantID != c.TenantID {
 				c.Logger.Info("mismatch tenant ID", tenantID, c.TenantID)
-				w.WriteHeader(http.StatusUnauthorized)
+				writeError(http.StatusUnauthorized)
 				return
 			}
 
 			// must not forward to proxy
 			r.Header.Del(XBridgeAuthorizationHeaderKey)
+			r.Header.Del(ProxyAuthorizationHeaderKey)
 
-			next.ServeHTTP(w, r)
+			next.ServeHTTP(w, r.WithContext(WithTenantID(r.Context(), tenantID)))
 		})
 	}
 }
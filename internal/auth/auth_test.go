@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"encoding/base64"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -105,11 +106,56 @@ func TestMiddleware(t *testing.T) {
 			tenantID:   tenantID,
 			wantStatus: http.StatusBadRequest,
 		},
+		{
+			name: "valid proxy authorization (bearer)",
+			req: func() *http.Request {
+				req := httptest.NewRequest("CONNECT", "db.internal:5432", nil)
+				req.Header.Add(ProxyAuthorizationHeaderKey, "Bearer "+string(accessToken))
+				ctx := ctxtime.WithTime(req.Context(), tm.Add(time.Second))
+				return req.WithContext(ctx)
+			}(),
+			tenantID:   tenantID,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "valid proxy authorization (basic)",
+			req: func() *http.Request {
+				req := httptest.NewRequest("GET", "http://api.internal/", nil)
+				req.Header.Add(ProxyAuthorizationHeaderKey, "Basic "+base64.StdEncoding.EncodeToString([]byte("bridge:"+accessToken)))
+				ctx := ctxtime.WithTime(req.Context(), tm.Add(time.Second))
+				return req.WithContext(ctx)
+			}(),
+			tenantID:   tenantID,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "invalid proxy request without authorization",
+			req:        httptest.NewRequest("CONNECT", "db.internal:5432", nil),
+			tenantID:   tenantID,
+			wantStatus: http.StatusProxyAuthRequired,
+		},
+		{
+			name: "invalid proxy request expired",
+			req: func() *http.Request {
+				req := httptest.NewRequest("CONNECT", "db.internal:5432", nil)
+				req.Header.Add(ProxyAuthorizationHeaderKey, "Bearer "+string(accessToken))
+				ctx := ctxtime.WithTime(req.Context(), tm.Add(expireIn+time.Second))
+				return req.WithContext(ctx)
+			}(),
+			tenantID:   tenantID,
+			wantStatus: http.StatusProxyAuthRequired,
+		},
 	}
 	for _, tc := range cases {
 		tc := tc
 		t.Run(tc.name, func(t *testing.T) {
 			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get(ProxyAuthorizationHeaderKey) != "" {
+					t.Error("proxy authorization header must not be forwarded")
+				}
+				if got := TenantIDFromContext(r.Context()); got != tenantID {
+					t.Errorf("want tenant ID %q in context, but got %q", tenantID, got)
+				}
 				w.WriteHeader(http.StatusOK)
 			})
 			rec := httptest.NewRecorder()
@@ -125,6 +171,9 @@ func TestMiddleware(t *testing.T) {
 			if tc.wantStatus != rec.Code {
 				t.Fatalf("want %d, but got %d", tc.wantStatus, rec.Code)
 			}
+			if rec.Code == http.StatusProxyAuthRequired && rec.Header().Get("Proxy-Authenticate") == "" {
+				t.Fatal("want Proxy-Authenticate header")
+			}
 		})
 	}
 }
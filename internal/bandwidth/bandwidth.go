@@ -0,0 +1,206 @@
+// Package bandwidth shapes the bandwidth of tunnels and HTTP bodies by token
+// buckets per tenant, per target and globally.
+package bandwidth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// maxChunk is the maximum bytes to wait for at once, so that a large read
+// does not hold the bucket for a long time.
+const maxChunk = 32 * 1024
+
+// Limit is a config of the token bucket.
+type Limit struct {
+	// BytesPerSecond is the rate to refill the bucket.
+	BytesPerSecond int `json:"bytesPerSecond"`
+	// Burst is the size of the bucket. If zero, BytesPerSecond is used,
+	// which allows a burst for one second.
+	Burst int `json:"burst"`
+}
+
+// Config is a config of Shaper. All of the limits which match the tenant
+// and the target are applied at the same time.
+type Config struct {
+	// Global limits the total bandwidth of bridge.
+	Global *Limit `json:"global"`
+	// Tenants is keyed by the tenant ID in the claim of the JWT.
+	Tenants map[string]*Limit `json:"tenants"`
+	// Targets is keyed by the alias of the target.
+	Targets map[string]*Limit `json:"targets"`
+}
+
+// Shaper holds the token buckets.
+type Shaper struct {
+	global  *rate.Limiter
+	tenants map[string]*rate.Limiter
+	targets map[string]*rate.Limiter
+}
+
+// New creates a new shaper. If c is nil, returns nil which shapes nothing.
+func New(c *Config) (*Shaper, error) {
+	if c == nil {
+		return nil, nil
+	}
+	s := &Shaper{
+		tenants: make(map[string]*rate.Limiter, len(c.Tenants)),
+		targets: make(map[string]*rate.Limiter, len(c.Targets)),
+	}
+	if c.Global != nil {
+		l, err := newLimiter(c.Global)
+		if err != nil {
+			return nil, fmt.Errorf("global: %w", err)
+		}
+		s.global = l
+	}
+	for id, limit := range c.Tenants {
+		l, err := newLimiter(limit)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %q: %w", id, err)
+		}
+		s.tenants[id] = l
+	}
+	for alias, limit := range c.Targets {
+		l, err := newLimiter(limit)
+		if err != nil {
+			return nil, fmt.Errorf("target %q: %w", alias, err)
+		}
+		s.targets[alias] = l
+	}
+	return s, nil
+}
+
+func newLimiter(l *Limit) (*rate.Limiter, error) {
+	if l == nil {
+		return nil, errors.New("limit must not be empty")
+	}
+	if l.BytesPerSecond <= 0 {
+		return nil, fmt.Errorf("bytesPerSecond must be positive: %d", l.BytesPerSecond)
+	}
+	if l.Burst < 0 {
+		return nil, fmt.Errorf("burst must not be negative: %d", l.Burst)
+	}
+	burst := l.Burst
+	if burst == 0 {
+		burst = l.BytesPerSecond
+	}
+	return rate.NewLimiter(rate.Limit(l.BytesPerSecond), burst), nil
+}
+
+// Bucket returns the bucket which applies the limits for the tenant and the
+// target alias. It returns nil if no limits match.
+func (s *Shaper) Bucket(tenantID, alias string) *Bucket {
+	if s == nil {
+		return nil
+	}
+	var limiters []*rate.Limiter
+	if s.global != nil {
+		limiters = append(limiters, s.global)
+	}
+	if l, ok := s.tenants[tenantID]; ok && tenantID != "" {
+		limiters = append(limiters, l)
+	}
+	if l, ok := s.targets[alias]; ok && alias != "" {
+		limiters = append(limiters, l)
+	}
+	if len(limiters) == 0 {
+		return nil
+	}
+	chunk := maxChunk
+	for _, l := range limiters {
+		chunk = min(chunk, l.Burst())
+	}
+	return &Bucket{limiters: limiters, chunk: chunk}
+}
+
+// Bucket shapes a tunnel or an HTTP request. It records how long the
+// transfer is throttled.
+type Bucket struct {
+	limiters  []*rate.Limiter
+	chunk     int
+	throttled atomic.Int64
+}
+
+// Wait blocks until n bytes are allowed by all of the limits.
+func (b *Bucket) Wait(ctx context.Context, n int) error {
+	for n > 0 {
+		size := min(n, b.chunk)
+		if err := b.wait(ctx, size); err != nil {
+			return err
+		}
+		n -= size
+	}
+	return nil
+}
+
+func (b *Bucket) wait(ctx context.Context, n int) error {
+	now := time.Now()
+	var delay time.Duration
+	reservations := make([]*rate.Reservation, 0, len(b.limiters))
+	for _, l := range b.limiters {
+		// never fails because n is not larger than the burst.
+		r := l.ReserveN(now, n)
+		reservations = append(reservations, r)
+		delay = max(delay, r.DelayFrom(now))
+	}
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		b.throttled.Add(int64(delay))
+		return nil
+	case <-ctx.Done():
+		for _, r := range reservations {
+			r.Cancel()
+		}
+		return ctx.Err()
+	}
+}
+
+// Throttled returns the total time spent waiting for the limits.
+func (b *Bucket) Throttled() time.Duration {
+	return time.Duration(b.throttled.Load())
+}
+
+// Reader returns the reader which waits for the limits after reading.
+func (b *Bucket) Reader(ctx context.Context, r io.Reader) io.Reader {
+	return &reader{ctx: ctx, r: r, b: b}
+}
+
+// ReadCloser is the same as Reader, but it keeps Close of rc.
+func (b *Bucket) ReadCloser(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{b.Reader(ctx, rc), rc}
+}
+
+type reader struct {
+	ctx context.Context
+	r   io.Reader
+	b   *Bucket
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > r.b.chunk {
+		p = p[:r.b.chunk]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.b.wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,142 @@
+package bandwidth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	cases := []struct {
+		name    string
+		config  *Config
+		wantErr bool
+	}{
+		{
+			name:   "nil",
+			config: nil,
+		},
+		{
+			name: "valid",
+			config: &Config{
+				Global:  &Limit{BytesPerSecond: 1 << 20, Burst: 1 << 16},
+				Tenants: map[string]*Limit{"tenant": {BytesPerSecond: 1 << 10}},
+				Targets: map[string]*Limit{"orders-db": {BytesPerSecond: 1 << 10}},
+			},
+		},
+		{
+			name:    "zero rate",
+			config:  &Config{Global: &Limit{}},
+			wantErr: true,
+		},
+		{
+			name:    "negative burst",
+			config:  &Config{Tenants: map[string]*Limit{"tenant": {BytesPerSecond: 1, Burst: -1}}},
+			wantErr: true,
+		},
+		{
+			name:    "empty limit",
+			config:  &Config{Targets: map[string]*Limit{"orders-db": nil}},
+			wantErr: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := New(tc.config)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("want error %v, but got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestShaper_Bucket(t *testing.T) {
+	s, err := New(&Config{
+		Tenants: map[string]*Limit{"tenant": {BytesPerSecond: 1 << 10, Burst: 100}},
+		Targets: map[string]*Limit{"orders-db": {BytesPerSecond: 1 << 20}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name         string
+		tenantID     string
+		alias        string
+		wantLimiters int
+	}{
+		{name: "no match", tenantID: "other", alias: "other-db", wantLimiters: 0},
+		{name: "tenant", tenantID: "tenant", wantLimiters: 1},
+		{name: "target", alias: "orders-db", wantLimiters: 1},
+		{name: "both", tenantID: "tenant", alias: "orders-db", wantLimiters: 2},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := s.Bucket(tc.tenantID, tc.alias)
+			if tc.wantLimiters == 0 {
+				if b != nil {
+					t.Fatal("want nil bucket")
+				}
+				return
+			}
+			if got := len(b.limiters); got != tc.wantLimiters {
+				t.Fatalf("want %d limiters, but got %d", tc.wantLimiters, got)
+			}
+		})
+	}
+
+	// the chunk is not larger than the smallest burst.
+	if got := s.Bucket("tenant", "orders-db").chunk; got != 100 {
+		t.Fatalf("want chunk 100, but got %d", got)
+	}
+	var nilShaper *Shaper
+	if nilShaper.Bucket("tenant", "orders-db") != nil {
+		t.Fatal("want nil bucket from nil shaper")
+	}
+}
+
+func TestBucket_Reader(t *testing.T) {
+	s, err := New(&Config{
+		Global: &Limit{BytesPerSecond: 10 * 1024, Burst: 1024},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := s.Bucket("", "")
+
+	// 1KiB is allowed by the burst and the rest takes 200ms.
+	payload := bytes.Repeat([]byte("a"), 3*1024)
+	start := time.Now()
+	got, err := io.ReadAll(b.Reader(context.Background(), bytes.NewReader(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	if !bytes.Equal(payload, got) {
+		t.Fatal("unexpected payload")
+	}
+	if elapsed < 150*time.Millisecond {
+		t.Fatalf("want throttled, but finished in %v", elapsed)
+	}
+	if b.Throttled() < 150*time.Millisecond {
+		t.Fatalf("want throttled time is recorded, but got %v", b.Throttled())
+	}
+}
+
+func TestBucket_Wait(t *testing.T) {
+	s, err := New(&Config{
+		Global: &Limit{BytesPerSecond: 1, Burst: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := s.Bucket("", "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := b.Wait(ctx, 10); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want DeadlineExceeded, but got %v", err)
+	}
+}
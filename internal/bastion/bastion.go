@@ -0,0 +1,345 @@
+package bastion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/basemachina/bridge/internal/jsontime"
+	"golang.org/x/crypto/ssh"
+)
+
+// DialContextFunc is the same signature as net.Dialer.DialContext.
+type DialContextFunc = func(ctx context.Context, network string, address string) (net.Conn, error)
+
+// ErrUnknownBastion is returned when the bastion is not registered.
+var ErrUnknownBastion = errors.New("unknown bastion")
+
+// Config is settings of the SSH bastion (jump host) which bridge dials
+// to targets through.
+type Config struct {
+	// Addr is an address of the SSH server, e.g. "bastion.example.com:22".
+	Addr string `json:"addr"`
+	// User is a user name to log in.
+	User string `json:"user"`
+	// KeyFile is a path to the unencrypted private key to authenticate.
+	KeyFile string `json:"keyFile"`
+	// HostKey is the pinned public key of the SSH server in the
+	// authorized_keys format, e.g. "ssh-ed25519 AAAA...".
+	HostKey string `json:"hostKey"`
+	// KeepAliveInterval is an interval to send keepalive requests.
+	// If zero, 30 seconds is used.
+	KeepAliveInterval jsontime.Duration `json:"keepAliveInterval"`
+}
+
+const (
+	defaultDialTimeout       = 30 * time.Second
+	defaultKeepAliveInterval = 30 * time.Second
+)
+
+// Pool holds SSH client connections to the bastions. Each bastion has
+// at most one connection and channels to targets are multiplexed over it.
+type Pool struct {
+	clients map[string]*client
+}
+
+// New creates a new pool from configs keyed by the bastion name.
+// If configs is empty, returns nil.
+func New(configs map[string]*Config) (*Pool, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	dial := (&net.Dialer{
+		Timeout:   defaultDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	clients := make(map[string]*client, len(configs))
+	for name, c := range configs {
+		if name == "" {
+			return nil, errors.New("bastion name must not be empty")
+		}
+		if c == nil {
+			return nil, fmt.Errorf("bastion %q: config is empty", name)
+		}
+		cl, err := newClient(c, dial)
+		if err != nil {
+			return nil, fmt.Errorf("bastion %q: %w", name, err)
+		}
+		clients[name] = cl
+	}
+	return &Pool{clients: clients}, nil
+}
+
+func newClient(c *Config, dial DialContextFunc) (*client, error) {
+	if c.Addr == "" {
+		return nil, errors.New("addr is empty")
+	}
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		return nil, fmt.Errorf("invalid addr: %w", err)
+	}
+	if c.User == "" {
+		return nil, errors.New("user is empty")
+	}
+	if c.HostKey == "" {
+		return nil, errors.New("host key is empty")
+	}
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(c.HostKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid host key: %w", err)
+	}
+	pem, err := os.ReadFile(c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key file: %w", err)
+	}
+	keepAliveInterval := time.Duration(c.KeepAliveInterval)
+	if keepAliveInterval <= 0 {
+		keepAliveInterval = defaultKeepAliveInterval
+	}
+	return &client{
+		addr: c.Addr,
+		config: &ssh.ClientConfig{
+			User:            c.User,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.FixedHostKey(hostKey),
+			// The server may prefer another type of host key than the
+			// pinned one, so that requests only the pinned type.
+			HostKeyAlgorithms: hostKeyAlgorithms(hostKey.Type()),
+			Timeout:           defaultDialTimeout,
+		},
+		keepAliveInterval: keepAliveInterval,
+		dial:              dial,
+	}, nil
+}
+
+func hostKeyAlgorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
+
+// Has reports whether the bastion of name is registered.
+func (p *Pool) Has(name string) bool {
+	if p == nil {
+		return false
+	}
+	_, ok := p.clients[name]
+	return ok
+}
+
+// DialContext opens a direct-tcpip channel to address through the bastion
+// of name. If the connection to the bastion is broken, it reconnects once.
+func (p *Pool) DialContext(ctx context.Context, name, network, address string) (net.Conn, error) {
+	var cl *client
+	if p != nil {
+		cl = p.clients[name]
+	}
+	if cl == nil {
+		return nil, fmt.Errorf("%q: %w", name, ErrUnknownBastion)
+	}
+	return cl.dialContext(ctx, network, address)
+}
+
+type nameContextKey struct{}
+
+// WithName returns a copy of ctx which makes the dial go through the
+// bastion of name.
+func WithName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, nameContextKey{}, name)
+}
+
+func nameFromContext(ctx context.Context) string {
+	v, _ := ctx.Value(nameContextKey{}).(string)
+	return v
+}
+
+// DialContextFunc returns a function which dials through the bastion if
+// it is specified by WithName. Otherwise, it dials with next.
+//
+// The address is resolved and validated on the bastion, so that the
+// dial guard and the egress proxy are not applied to it.
+func (p *Pool) DialContextFunc(next DialContextFunc) DialContextFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if name := nameFromContext(ctx); name != "" {
+			return p.DialContext(ctx, name, network, address)
+		}
+		return next(ctx, network, address)
+	}
+}
+
+// Close closes all connections to the bastions.
+func (p *Pool) Close() error {
+	if p == nil {
+		return nil
+	}
+	names := make([]string, 0, len(p.clients))
+	for name := range p.clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []error
+	for _, name := range names {
+		if err := p.clients[name].close(); err != nil {
+			errs = append(errs, fmt.Errorf("bastion %q: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type client struct {
+	addr              string
+	config            *ssh.ClientConfig
+	keepAliveInterval time.Duration
+	dial              DialContextFunc
+
+	mu     sync.Mutex
+	conn   *ssh.Client
+	closed bool
+}
+
+func (c *client) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tc, err := conn.DialContext(ctx, network, address)
+	if err == nil {
+		return tc, nil
+	}
+	var openErr *ssh.OpenChannelError
+	if errors.As(err, &openErr) || ctx.Err() != nil {
+		// the bastion is alive but rejected the channel.
+		return nil, fmt.Errorf("failed to dial through bastion: %w", err)
+	}
+
+	// the connection may be broken without notice, so that reconnects.
+	c.drop(conn)
+	conn, err = c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tc, err = conn.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial through bastion: %w", err)
+	}
+	return tc, nil
+}
+
+// get returns the connection to the bastion. It connects if there is no
+// connection yet.
+func (c *client) get(ctx context.Context) (*ssh.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, net.ErrClosed
+	}
+	if c.conn != nil {
+		return c.conn, nil
+	}
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to bastion %q: %w", c.addr, err)
+	}
+	c.conn = conn
+	go c.keepAlive(conn)
+	return conn, nil
+}
+
+func (c *client) connect(ctx context.Context) (*ssh.Client, error) {
+	conn, err := c.dial(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	// aborts the handshake if ctx is done.
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, c.addr, c.config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !stop() {
+		sshConn.Close()
+		return nil, ctx.Err()
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// keepAlive sends keepalive requests until the connection is closed.
+// If the bastion does not respond, the connection is closed so that the
+// next dial reconnects.
+func (c *client) keepAlive(conn *ssh.Client) {
+	done := make(chan struct{})
+	go func() {
+		conn.Wait()
+		close(done)
+		c.drop(conn)
+	}()
+
+	ticker := time.NewTicker(c.keepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if !c.ping(conn) {
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (c *client) ping(conn *ssh.Client) bool {
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+		result <- err
+	}()
+	timer := time.NewTimer(c.keepAliveInterval)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err == nil
+	case <-timer.C:
+		return false
+	}
+}
+
+// drop forgets conn if it is the current connection.
+func (c *client) drop(conn *ssh.Client) {
+	c.mu.Lock()
+	if c.conn == conn {
+		c.conn = nil
+	}
+	c.mu.Unlock()
+	conn.Close()
+}
+
+func (c *client) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
@@ -0,0 +1,385 @@
+package bastion
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type sshServer struct {
+	addr    string
+	hostKey ssh.Signer
+	// accepted is the number of the accepted SSH connections.
+	accepted atomic.Int32
+
+	mu    sync.Mutex
+	conns []*ssh.ServerConn
+}
+
+// newSSHServer starts the SSH server which accepts only clientKey and
+// forwards direct-tcpip channels.
+func newSSHServer(t *testing.T, clientKey ssh.PublicKey) *sshServer {
+	t.Helper()
+	hostKey := newSigner(t)
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "bridge" && string(key.Marshal()) == string(clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unauthorized")
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &sshServer{
+		addr:    ln.Addr().String(),
+		hostKey: hostKey,
+	}
+	t.Cleanup(func() {
+		ln.Close()
+		s.closeConns()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config)
+		}
+	}()
+	return s
+}
+
+func (s *sshServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	s.accepted.Add(1)
+	s.mu.Lock()
+	s.conns = append(s.conns, sshConn)
+	s.mu.Unlock()
+
+	go func() {
+		for req := range reqs {
+			if req.WantReply {
+				req.Reply(req.Type == "keepalive@openssh.com", nil)
+			}
+		}
+	}()
+	for newCh := range chans {
+		if newCh.ChannelType() != "direct-tcpip" {
+			newCh.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		var payload struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		if err := ssh.Unmarshal(newCh.ExtraData(), &payload); err != nil {
+			newCh.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		target, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+		if err != nil {
+			newCh.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			target.Close()
+			continue
+		}
+		go ssh.DiscardRequests(chReqs)
+		go func() {
+			defer ch.Close()
+			defer target.Close()
+			go io.Copy(target, ch)
+			io.Copy(ch, target)
+		}()
+	}
+}
+
+// closeConns closes the SSH connections from the server side.
+func (s *sshServer) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *sshServer) authorizedHostKey() string {
+	return string(ssh.MarshalAuthorizedKey(s.hostKey.PublicKey()))
+}
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// writeClientKey writes a new private key to the file and returns the
+// path and the public key.
+func writeClientKey(t *testing.T) (string, ssh.PublicKey) {
+	t.Helper()
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, sshPub
+}
+
+func newEchoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	want := "hello"
+	if _, err := conn.Write([]byte(want)); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("want %q, but got %q", want, got)
+	}
+}
+
+func TestPool(t *testing.T) {
+	keyFile, clientKey := writeClientKey(t)
+	server := newSSHServer(t, clientKey)
+	echoAddr := newEchoServer(t)
+
+	newPool := func(t *testing.T, hostKey string) *Pool {
+		t.Helper()
+		pool, err := New(map[string]*Config{
+			"legacy": {
+				Addr:    server.addr,
+				User:    "bridge",
+				KeyFile: keyFile,
+				HostKey: hostKey,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { pool.Close() })
+		return pool
+	}
+
+	t.Run("reuses the connection", func(t *testing.T) {
+		server.accepted.Store(0)
+		pool := newPool(t, server.authorizedHostKey())
+		for i := 0; i < 3; i++ {
+			conn, err := pool.DialContext(context.Background(), "legacy", "tcp", echoAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEcho(t, conn)
+			conn.Close()
+		}
+		if got := server.accepted.Load(); got != 1 {
+			t.Fatalf("want 1 ssh connection, but got %d", got)
+		}
+	})
+
+	t.Run("reconnects", func(t *testing.T) {
+		server.accepted.Store(0)
+		pool := newPool(t, server.authorizedHostKey())
+		conn, err := pool.DialContext(context.Background(), "legacy", "tcp", echoAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEcho(t, conn)
+		conn.Close()
+
+		server.closeConns()
+
+		conn, err = pool.DialContext(context.Background(), "legacy", "tcp", echoAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEcho(t, conn)
+		conn.Close()
+		if got := server.accepted.Load(); got != 2 {
+			t.Fatalf("want 2 ssh connections, but got %d", got)
+		}
+	})
+
+	t.Run("host key mismatch", func(t *testing.T) {
+		other := newSigner(t)
+		pool := newPool(t, string(ssh.MarshalAuthorizedKey(other.PublicKey())))
+		_, err := pool.DialContext(context.Background(), "legacy", "tcp", echoAddr)
+		if err == nil {
+			t.Fatal("want error")
+		}
+	})
+
+	t.Run("rejected channel", func(t *testing.T) {
+		pool := newPool(t, server.authorizedHostKey())
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		closedAddr := ln.Addr().String()
+		ln.Close()
+
+		_, err = pool.DialContext(context.Background(), "legacy", "tcp", closedAddr)
+		var openErr *ssh.OpenChannelError
+		if !errors.As(err, &openErr) {
+			t.Fatalf("want OpenChannelError, but got %v", err)
+		}
+	})
+
+	t.Run("unknown bastion", func(t *testing.T) {
+		pool := newPool(t, server.authorizedHostKey())
+		_, err := pool.DialContext(context.Background(), "unknown", "tcp", echoAddr)
+		if !errors.Is(err, ErrUnknownBastion) {
+			t.Fatalf("want ErrUnknownBastion, but got %v", err)
+		}
+	})
+
+	t.Run("DialContextFunc", func(t *testing.T) {
+		pool := newPool(t, server.authorizedHostKey())
+		var direct atomic.Int32
+		dial := pool.DialContextFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			direct.Add(1)
+			return (&net.Dialer{}).DialContext(ctx, network, address)
+		})
+
+		conn, err := dial(WithName(context.Background(), "legacy"), "tcp", echoAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEcho(t, conn)
+		conn.Close()
+		if got := direct.Load(); got != 0 {
+			t.Fatalf("want no direct dial, but got %d", got)
+		}
+
+		conn, err = dial(context.Background(), "tcp", echoAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if got := direct.Load(); got != 1 {
+			t.Fatalf("want 1 direct dial, but got %d", got)
+		}
+	})
+}
+
+func TestNew(t *testing.T) {
+	keyFile, _ := writeClientKey(t)
+	hostKey := string(ssh.MarshalAuthorizedKey(newSigner(t).PublicKey()))
+
+	t.Run("empty", func(t *testing.T) {
+		pool, err := New(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pool != nil {
+			t.Fatalf("want nil, but got %v", pool)
+		}
+	})
+
+	cases := []struct {
+		name   string
+		config *Config
+	}{
+		{
+			name:   "nil config",
+			config: nil,
+		},
+		{
+			name:   "invalid addr",
+			config: &Config{Addr: "bastion", User: "bridge", KeyFile: keyFile, HostKey: hostKey},
+		},
+		{
+			name:   "empty user",
+			config: &Config{Addr: "bastion:22", KeyFile: keyFile, HostKey: hostKey},
+		},
+		{
+			name:   "empty host key",
+			config: &Config{Addr: "bastion:22", User: "bridge", KeyFile: keyFile},
+		},
+		{
+			name:   "invalid host key",
+			config: &Config{Addr: "bastion:22", User: "bridge", KeyFile: keyFile, HostKey: "ssh-ed25519 invalid"},
+		},
+		{
+			name:   "key file not found",
+			config: &Config{Addr: "bastion:22", User: "bridge", KeyFile: filepath.Join(t.TempDir(), "not_found"), HostKey: hostKey},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := New(map[string]*Config{"legacy": tc.config}); err == nil {
+				t.Fatal("want error")
+			}
+		})
+	}
+}
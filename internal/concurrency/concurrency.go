@@ -0,0 +1,260 @@
+// Package concurrency limits the number of the in-flight proxy requests and
+// tunnels globally, per tenant and per target. The requests over the limits
+// wait in the queue for a while, and the waiting tenants are served in
+// round-robin order so that a tenant cannot starve the others.
+package concurrency
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/basemachina/bridge/internal/jsontime"
+)
+
+// DefaultRetryAfter is used if the retry after is not specified.
+const DefaultRetryAfter = time.Second
+
+// ErrLimited is returned when the request is over the limits.
+var ErrLimited = errors.New("too many concurrent requests")
+
+// Config is a config of Limiter. Zero limits mean unlimited.
+type Config struct {
+	// Global limits the total number of the in-flight requests and tunnels.
+	Global int `json:"global"`
+	// Tenants is keyed by the tenant ID in the claim of the JWT.
+	Tenants map[string]int `json:"tenants"`
+	// Targets is keyed by the alias of the target.
+	Targets map[string]int `json:"targets"`
+	// QueueTimeout is how long the request over the limits waits. If
+	// zero, the request is rejected at once.
+	QueueTimeout jsontime.Duration `json:"queueTimeout"`
+	// MaxQueue limits the number of the waiting requests. If zero, it is
+	// not limited.
+	MaxQueue int `json:"maxQueue"`
+	// RetryAfter is sent to the rejected clients. If zero,
+	// DefaultRetryAfter is used.
+	RetryAfter jsontime.Duration `json:"retryAfter"`
+}
+
+// Limiter limits the concurrency.
+type Limiter struct {
+	global       int
+	tenants      map[string]int
+	targets      map[string]int
+	queueTimeout time.Duration
+	maxQueue     int
+	retryAfter   time.Duration
+
+	mu              sync.Mutex
+	inflight        int
+	inflightTenants map[string]int
+	inflightTargets map[string]int
+	// queues holds the waiters of each tenant in FIFO order.
+	queues map[string][]*waiter
+	// order is the tenants which have waiters in round-robin order.
+	order  []string
+	next   int
+	queued int
+}
+
+type waiter struct {
+	tenantID string
+	alias    string
+	ready    chan struct{}
+	admitted bool
+}
+
+// New creates a new limiter. If c is nil, returns nil which limits nothing.
+func New(c *Config) (*Limiter, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if c.Global < 0 {
+		return nil, fmt.Errorf("global must not be negative: %d", c.Global)
+	}
+	for id, n := range c.Tenants {
+		if n <= 0 {
+			return nil, fmt.Errorf("tenant %q: limit must be positive: %d", id, n)
+		}
+	}
+	for alias, n := range c.Targets {
+		if n <= 0 {
+			return nil, fmt.Errorf("target %q: limit must be positive: %d", alias, n)
+		}
+	}
+	if c.QueueTimeout < 0 || c.MaxQueue < 0 || c.RetryAfter < 0 {
+		return nil, errors.New("queueTimeout, maxQueue and retryAfter must not be negative")
+	}
+	l := &Limiter{
+		global:          c.Global,
+		tenants:         c.Tenants,
+		targets:         c.Targets,
+		queueTimeout:    time.Duration(c.QueueTimeout),
+		maxQueue:        c.MaxQueue,
+		retryAfter:      time.Duration(c.RetryAfter),
+		inflightTenants: make(map[string]int),
+		inflightTargets: make(map[string]int),
+		queues:          make(map[string][]*waiter),
+	}
+	if l.retryAfter == 0 {
+		l.retryAfter = DefaultRetryAfter
+	}
+	return l, nil
+}
+
+// RetryAfter returns how long the rejected clients should wait.
+func (l *Limiter) RetryAfter() time.Duration {
+	if l == nil {
+		return DefaultRetryAfter
+	}
+	return l.retryAfter
+}
+
+// Acquire takes a slot for the request of the tenant to the target alias.
+// If the limits are reached, it waits in the queue up to the queue timeout
+// and returns ErrLimited. release must be called when the request or the
+// tunnel is finished.
+func (l *Limiter) Acquire(ctx context.Context, tenantID, alias string) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	// the waiters never fit here because they are admitted on every release.
+	if l.fits(tenantID, alias) {
+		l.take(tenantID, alias)
+		l.mu.Unlock()
+		return l.releaseFunc(tenantID, alias), nil
+	}
+	if l.queueTimeout <= 0 || (l.maxQueue > 0 && l.queued >= l.maxQueue) {
+		l.mu.Unlock()
+		return nil, ErrLimited
+	}
+	w := &waiter{tenantID: tenantID, alias: alias, ready: make(chan struct{})}
+	l.enqueue(w)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+		return l.releaseFunc(tenantID, alias), nil
+	case <-timer.C:
+		err = ErrLimited
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w.admitted {
+		// admitted while giving up
+		return l.releaseFunc(tenantID, alias), nil
+	}
+	l.dequeue(w)
+	// the next waiter of the tenant may fit.
+	l.dispatch()
+	return nil, err
+}
+
+// fits reports whether a new request fits in the limits. l.mu must be held.
+func (l *Limiter) fits(tenantID, alias string) bool {
+	if l.global > 0 && l.inflight >= l.global {
+		return false
+	}
+	if n, ok := l.tenants[tenantID]; ok && l.inflightTenants[tenantID] >= n {
+		return false
+	}
+	if n, ok := l.targets[alias]; ok && l.inflightTargets[alias] >= n {
+		return false
+	}
+	return true
+}
+
+// take counts a new request. l.mu must be held.
+func (l *Limiter) take(tenantID, alias string) {
+	l.inflight++
+	l.inflightTenants[tenantID]++
+	l.inflightTargets[alias]++
+}
+
+func (l *Limiter) releaseFunc(tenantID, alias string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.inflight--
+			if l.inflightTenants[tenantID]--; l.inflightTenants[tenantID] == 0 {
+				delete(l.inflightTenants, tenantID)
+			}
+			if l.inflightTargets[alias]--; l.inflightTargets[alias] == 0 {
+				delete(l.inflightTargets, alias)
+			}
+			l.dispatch()
+		})
+	}
+}
+
+// enqueue adds w to the queue of its tenant. l.mu must be held.
+func (l *Limiter) enqueue(w *waiter) {
+	if len(l.queues[w.tenantID]) == 0 {
+		l.order = append(l.order, w.tenantID)
+	}
+	l.queues[w.tenantID] = append(l.queues[w.tenantID], w)
+	l.queued++
+}
+
+// dequeue removes w from the queue of its tenant. l.mu must be held.
+func (l *Limiter) dequeue(w *waiter) {
+	q := l.queues[w.tenantID]
+	i := slices.Index(q, w)
+	if i < 0 {
+		return
+	}
+	q = slices.Delete(q, i, i+1)
+	l.queued--
+	if len(q) > 0 {
+		l.queues[w.tenantID] = q
+		return
+	}
+	delete(l.queues, w.tenantID)
+	j := slices.Index(l.order, w.tenantID)
+	l.order = slices.Delete(l.order, j, j+1)
+	if j < l.next {
+		l.next--
+	}
+	if l.next >= len(l.order) {
+		l.next = 0
+	}
+}
+
+// dispatch admits the head waiters of the tenants in round-robin order
+// while they fit. l.mu must be held.
+func (l *Limiter) dispatch() {
+	for {
+		var admitted *waiter
+		for i := range l.order {
+			tenantID := l.order[(l.next+i)%len(l.order)]
+			w := l.queues[tenantID][0]
+			if l.fits(w.tenantID, w.alias) {
+				admitted = w
+				break
+			}
+		}
+		if admitted == nil {
+			return
+		}
+		// serves the next tenant after this.
+		idx := slices.Index(l.order, admitted.tenantID)
+		l.next = idx + 1
+		l.dequeue(admitted)
+		l.take(admitted.tenantID, admitted.alias)
+		admitted.admitted = true
+		close(admitted.ready)
+	}
+}
@@ -0,0 +1,186 @@
+package concurrency
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/basemachina/bridge/internal/jsontime"
+)
+
+func newLimiter(t *testing.T, c *Config) *Limiter {
+	t.Helper()
+	l, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func acquire(t *testing.T, l *Limiter, tenantID, alias string) func() {
+	t.Helper()
+	release, err := l.Acquire(context.Background(), tenantID, alias)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return release
+}
+
+func TestNew(t *testing.T) {
+	cases := []struct {
+		name    string
+		config  *Config
+		wantErr bool
+	}{
+		{name: "nil"},
+		{name: "valid", config: &Config{Global: 100, Tenants: map[string]int{"tenant": 10}, Targets: map[string]int{"orders-db": 5}}},
+		{name: "negative global", config: &Config{Global: -1}, wantErr: true},
+		{name: "zero tenant", config: &Config{Tenants: map[string]int{"tenant": 0}}, wantErr: true},
+		{name: "zero target", config: &Config{Targets: map[string]int{"orders-db": 0}}, wantErr: true},
+		{name: "negative queue timeout", config: &Config{QueueTimeout: -1}, wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := New(tc.config)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("want error %v, but got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLimiter_Acquire(t *testing.T) {
+	t.Run("rejects over the limits", func(t *testing.T) {
+		l := newLimiter(t, &Config{
+			Global:  3,
+			Tenants: map[string]int{"tenant-a": 1},
+			Targets: map[string]int{"orders-db": 1},
+		})
+		releaseA := acquire(t, l, "tenant-a", "")
+		if _, err := l.Acquire(context.Background(), "tenant-a", ""); !errors.Is(err, ErrLimited) {
+			t.Fatalf("tenant: want ErrLimited, but got %v", err)
+		}
+		releaseDB := acquire(t, l, "tenant-b", "orders-db")
+		if _, err := l.Acquire(context.Background(), "tenant-c", "orders-db"); !errors.Is(err, ErrLimited) {
+			t.Fatalf("target: want ErrLimited, but got %v", err)
+		}
+		release := acquire(t, l, "tenant-b", "")
+		if _, err := l.Acquire(context.Background(), "tenant-c", ""); !errors.Is(err, ErrLimited) {
+			t.Fatalf("global: want ErrLimited, but got %v", err)
+		}
+
+		release()
+		releaseA()
+		releaseA() // release is idempotent
+		releaseDB()
+		acquire(t, l, "tenant-a", "orders-db")()
+	})
+
+	t.Run("queue timeout", func(t *testing.T) {
+		l := newLimiter(t, &Config{
+			Global:       1,
+			QueueTimeout: jsontime.Duration(50 * time.Millisecond),
+		})
+		defer acquire(t, l, "tenant", "")()
+		if _, err := l.Acquire(context.Background(), "tenant", ""); !errors.Is(err, ErrLimited) {
+			t.Fatalf("want ErrLimited, but got %v", err)
+		}
+	})
+
+	t.Run("max queue", func(t *testing.T) {
+		l := newLimiter(t, &Config{
+			Global:       1,
+			QueueTimeout: jsontime.Duration(time.Minute),
+			MaxQueue:     1,
+		})
+		defer acquire(t, l, "tenant", "")()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go l.Acquire(ctx, "tenant", "")
+		for l.waiting() != 1 {
+			time.Sleep(time.Millisecond)
+		}
+		if _, err := l.Acquire(context.Background(), "tenant", ""); !errors.Is(err, ErrLimited) {
+			t.Fatalf("want ErrLimited, but got %v", err)
+		}
+	})
+
+	t.Run("canceled while waiting", func(t *testing.T) {
+		l := newLimiter(t, &Config{
+			Global:       1,
+			QueueTimeout: jsontime.Duration(time.Minute),
+		})
+		defer acquire(t, l, "tenant", "")()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if _, err := l.Acquire(ctx, "tenant", ""); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("want DeadlineExceeded, but got %v", err)
+		}
+		if got := l.waiting(); got != 0 {
+			t.Fatalf("want no waiters, but got %d", got)
+		}
+	})
+
+	t.Run("nil limiter", func(t *testing.T) {
+		var l *Limiter
+		acquire(t, l, "tenant", "orders-db")()
+	})
+}
+
+func TestLimiter_fairness(t *testing.T) {
+	l := newLimiter(t, &Config{
+		Global:       1,
+		QueueTimeout: jsontime.Duration(5 * time.Second),
+	})
+	release := acquire(t, l, "busy", "")
+
+	// tenant-a queues many requests before tenant-b.
+	admitted := make(chan string, 4)
+	enqueue := func(tenantID string) {
+		want := l.waiting() + 1
+		go func() {
+			release, err := l.Acquire(context.Background(), tenantID, "")
+			if err != nil {
+				admitted <- err.Error()
+				return
+			}
+			admitted <- tenantID
+			release()
+		}()
+		for l.waiting() != want {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	enqueue("tenant-a")
+	enqueue("tenant-a")
+	enqueue("tenant-a")
+	enqueue("tenant-b")
+
+	// the slot is passed to the next waiter one by one.
+	release()
+	var got []string
+	for range 4 {
+		select {
+		case tenantID := <-admitted:
+			got = append(got, tenantID)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("not admitted: %v", got)
+		}
+	}
+	want := []string{"tenant-a", "tenant-b", "tenant-a", "tenant-a"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("want %v, but got %v", want, got)
+		}
+	}
+}
+
+// waiting returns the number of the waiting requests.
+func (l *Limiter) waiting() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.queued
+}
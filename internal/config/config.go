@@ -0,0 +1,99 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/basemachina/bridge/internal/bandwidth"
+	"github.com/basemachina/bridge/internal/bastion"
+	"github.com/basemachina/bridge/internal/concurrency"
+	"github.com/basemachina/bridge/internal/egress"
+	"github.com/basemachina/bridge/internal/netguard"
+	"github.com/basemachina/bridge/internal/policy"
+	"github.com/basemachina/bridge/internal/target"
+)
+
+// Config stores configuration settings which are hard to express
+// with environmental variables. It is loaded from a JSON file.
+type Config struct {
+	// Policy restricts the targets which bridge proxies to.
+	// If nil, any targets are allowed.
+	Policy *policy.Config `json:"policy"`
+
+	// DialGuard protects bridge from SSRF and DNS rebinding.
+	// If nil, the default settings is used.
+	DialGuard *netguard.Config `json:"dialGuard"`
+
+	// Targets maps aliases to real targets. API can specify the target
+	// by alias, e.g. "alias://orders-db".
+	Targets map[string]*target.Config `json:"targets"`
+
+	// EgressProxy is an optional. If specified, bridge dials to targets
+	// through the SOCKS5 or HTTP CONNECT proxy.
+	EgressProxy *egress.Config `json:"egressProxy"`
+
+	// Bastions maps names to SSH bastions. Targets can be dialed through
+	// them by specifying the name as "bastion".
+	Bastions map[string]*bastion.Config `json:"bastions"`
+
+	// Bandwidth is an optional. If specified, bridge shapes the bandwidth
+	// of tunnels and HTTP bodies per tenant, per target and globally.
+	Bandwidth *bandwidth.Config `json:"bandwidth"`
+
+	// Concurrency is an optional. If specified, bridge limits the number
+	// of in-flight HTTP requests and tunnels per tenant, per target and
+	// globally.
+	Concurrency *concurrency.Config `json:"concurrency"`
+}
+
+// Load loads the config from the JSON file of the specified path.
+// If path is empty, returns an empty config.
+func Load(path string) (*Config, error) {
+	var c Config
+	if path == "" {
+		return &c, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("failed to decode config file %q: %w", path, err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: %w", path, err)
+	}
+	return &c, nil
+}
+
+// validate validates the references between sections.
+func (c *Config) validate() error {
+	for alias, t := range c.Targets {
+		if t == nil || t.Bastion == "" {
+			continue
+		}
+		if _, ok := c.Bastions[t.Bastion]; !ok {
+			return fmt.Errorf("target %q: %q: %w", alias, t.Bastion, bastion.ErrUnknownBastion)
+		}
+	}
+	if c.Bandwidth != nil {
+		for alias := range c.Bandwidth.Targets {
+			if _, ok := c.Targets[alias]; !ok {
+				return fmt.Errorf("bandwidth of target %q: %w", alias, target.ErrUnknownAlias)
+			}
+		}
+	}
+	if c.Concurrency != nil {
+		for alias := range c.Concurrency.Targets {
+			if _, ok := c.Targets[alias]; !ok {
+				return fmt.Errorf("concurrency of target %q: %w", alias, target.ErrUnknownAlias)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/basemachina/bridge/internal/bastion"
+	"github.com/basemachina/bridge/internal/target"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	t.Run("empty path", func(t *testing.T) {
+		c, err := Load("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Policy != nil {
+			t.Fatalf("want nil policy, but got %+v", c.Policy)
+		}
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		path := writeConfigFile(t, `{
+			"policy": {
+				"allow": [{"schemes": ["tcp"], "cidrs": ["10.0.0.0/8"], "ports": ["5432"]}]
+			}
+		}`)
+		c, err := Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Policy == nil || len(c.Policy.Allow) != 1 {
+			t.Fatalf("unexpected policy: %+v", c.Policy)
+		}
+	})
+
+	t.Run("unknown field", func(t *testing.T) {
+		path := writeConfigFile(t, `{"polic": {}}`)
+		if _, err := Load(path); err == nil {
+			t.Fatal("want error")
+		}
+	})
+
+	t.Run("unknown bastion", func(t *testing.T) {
+		path := writeConfigFile(t, `{
+			"targets": {
+				"legacy-db": {"url": "tcp://10.1.2.3:5432", "bastion": "legacy"}
+			}
+		}`)
+		if _, err := Load(path); !errors.Is(err, bastion.ErrUnknownBastion) {
+			t.Fatalf("want ErrUnknownBastion, but got %v", err)
+		}
+	})
+
+	t.Run("bandwidth", func(t *testing.T) {
+		path := writeConfigFile(t, `{
+			"targets": {
+				"orders-db": {"url": "tcp://10.1.2.3:5432"}
+			},
+			"bandwidth": {
+				"global": {"bytesPerSecond": 10485760, "burst": 1048576},
+				"targets": {"orders-db": {"bytesPerSecond": 1048576}}
+			}
+		}`)
+		c, err := Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Bandwidth == nil || c.Bandwidth.Global == nil || c.Bandwidth.Targets["orders-db"] == nil {
+			t.Fatalf("unexpected bandwidth: %+v", c.Bandwidth)
+		}
+	})
+
+	t.Run("bandwidth of unknown target", func(t *testing.T) {
+		path := writeConfigFile(t, `{
+			"bandwidth": {
+				"targets": {"orders-db": {"bytesPerSecond": 1048576}}
+			}
+		}`)
+		if _, err := Load(path); !errors.Is(err, target.ErrUnknownAlias) {
+			t.Fatalf("want ErrUnknownAlias, but got %v", err)
+		}
+	})
+
+	t.Run("concurrency of unknown target", func(t *testing.T) {
+		path := writeConfigFile(t, `{
+			"concurrency": {
+				"global": 100,
+				"targets": {"orders-db": 10},
+				"queueTimeout": "500ms"
+			}
+		}`)
+		if _, err := Load(path); !errors.Is(err, target.ErrUnknownAlias) {
+			t.Fatalf("want ErrUnknownAlias, but got %v", err)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		if _, err := Load(filepath.Join(t.TempDir(), "not_found.json")); err == nil {
+			t.Fatal("want error")
+		}
+	})
+}
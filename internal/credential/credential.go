@@ -0,0 +1,211 @@
+// Package credential attaches the credentials which bridge holds to the
+// requests to the HTTP targets, so that the clients do not need to know
+// them.
+package credential
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// Supported types of the credentials.
+const (
+	Bearer = "bearer"
+	Basic  = "basic"
+	Header = "header"
+	Query  = "query"
+	OAuth2 = "oauth2"
+	SigV4  = "sigv4"
+)
+
+// Config is a config of the credentials of the target.
+type Config struct {
+	// Type is one of "bearer", "basic", "header", "query", "oauth2" and
+	// "sigv4".
+	Type string `json:"type"`
+	// Name is a name of the header for "header", or a name of the query
+	// parameter for "query", e.g. "X-API-Key", "api_key". The header and
+	// the query parameter of Name which arrived with the request are
+	// removed for all the types.
+	Name string `json:"name"`
+	// User is a user name for "basic".
+	User string `json:"user"`
+	// Secret is the token for "bearer", the password for "basic", the
+	// value for "header" and "query", or the client secret for "oauth2".
+	Secret *Secret `json:"secret"`
+	// TokenURL is the token endpoint of the authorization server for
+	// "oauth2", e.g. "https://idp.internal/oauth2/token". It is requested
+	// through the same egress proxy and bastion as the target.
+	TokenURL string `json:"tokenURL"`
+	// ClientID is the client identifier for "oauth2".
+	ClientID string `json:"clientID"`
+	// Scopes are the scopes which are requested for "oauth2".
+	Scopes []string `json:"scopes"`
+	// Region and Service are the scope of the signature for "sigv4",
+	// e.g. "ap-northeast-1" and "execute-api".
+	Region  string `json:"region"`
+	Service string `json:"service"`
+	// CredentialsFile is a path to the shared credentials file of AWS for
+	// "sigv4". If empty, AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+	// AWS_SESSION_TOKEN are used.
+	CredentialsFile string `json:"credentialsFile"`
+	// Profile is a profile in CredentialsFile. If empty, "default" is used.
+	Profile string `json:"profile"`
+}
+
+// Secret is a value which bridge holds locally.
+type Secret struct {
+	// File is a path to the file which has the value. The trailing newline
+	// is trimmed.
+	File string `json:"file"`
+	// Env is a name of the environment variable which has the value.
+	// Either File or Env is required.
+	Env string `json:"env"`
+}
+
+// Value reads the value. It is read for each request, so that the rotated
+// value is used without restarting bridge.
+func (s *Secret) Value() (string, error) {
+	if s.Env != "" {
+		v, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %q is not set", s.Env)
+		}
+		return v, nil
+	}
+	b, err := os.ReadFile(s.File)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %w", err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+func (s *Secret) validate() error {
+	if s == nil {
+		return errors.New("secret is required")
+	}
+	if (s.File == "") == (s.Env == "") {
+		return errors.New("either file or env of secret is required")
+	}
+	if _, err := s.Value(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Injector attaches the credentials to the requests.
+type Injector interface {
+	// Inject removes the credentials of the client from req, and attaches
+	// the credentials of the target.
+	Inject(req *http.Request) error
+}
+
+// New creates a new injector from c.
+func New(c *Config) (Injector, error) {
+	switch c.Type {
+	case SigV4:
+		return newSigV4(c)
+	case Bearer, Basic, Header, Query, OAuth2:
+	case "":
+		return nil, errors.New("credentials type is required")
+	default:
+		return nil, fmt.Errorf("unsupported credentials type: %q", c.Type)
+	}
+	if err := c.Secret.validate(); err != nil {
+		return nil, err
+	}
+	switch c.Type {
+	case Basic:
+		if c.User == "" {
+			return nil, errors.New("user is required for basic")
+		}
+	case Header:
+		if !httpguts.ValidHeaderFieldName(c.Name) {
+			return nil, fmt.Errorf("invalid header name: %q", c.Name)
+		}
+	case Query:
+		if c.Name == "" {
+			return nil, errors.New("name is required for query")
+		}
+	case OAuth2:
+		return newOAuth2(c)
+	}
+	return &static{config: c}, nil
+}
+
+// stripCredentials removes the credentials which arrived with the request,
+// that is, the authorization headers, the cookies, and the header and the
+// query parameter of c.Name.
+func stripCredentials(req *http.Request, c *Config) {
+	req.Header.Del("Authorization")
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Cookie")
+	if c.Name == "" {
+		return
+	}
+	req.Header.Del(c.Name)
+	if rawQuery := removeQuery(req.URL.RawQuery, c.Name); rawQuery != req.URL.RawQuery {
+		// the URL may be shared with the target, so that it is copied.
+		u := *req.URL
+		u.RawQuery = rawQuery
+		req.URL = &u
+	}
+}
+
+// static attaches the secret as is.
+type static struct {
+	config *Config
+}
+
+func (s *static) Inject(req *http.Request) error {
+	c := s.config
+	stripCredentials(req, c)
+	v, err := c.Secret.Value()
+	if err != nil {
+		return err
+	}
+	switch c.Type {
+	case Bearer:
+		req.Header.Set("Authorization", "Bearer "+v)
+	case Basic:
+		req.SetBasicAuth(c.User, v)
+	case Header:
+		req.Header.Set(c.Name, v)
+	case Query:
+		// the URL may be shared with the target, so that it is copied.
+		u := *req.URL
+		u.RawQuery = setQuery(u.RawQuery, c.Name, v)
+		req.URL = &u
+	}
+	return nil
+}
+
+// setQuery replaces the parameter of name in the raw query. The order and
+// the encoding of the other parameters are kept.
+func setQuery(rawQuery, name, value string) string {
+	param := url.QueryEscape(name) + "=" + url.QueryEscape(value)
+	if rawQuery = removeQuery(rawQuery, name); rawQuery == "" {
+		return param
+	}
+	return rawQuery + "&" + param
+}
+
+// removeQuery removes the parameter of name from the raw query. The order
+// and the encoding of the other parameters are kept.
+func removeQuery(rawQuery, name string) string {
+	var params []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		key, _, _ := strings.Cut(param, "=")
+		if k, err := url.QueryUnescape(key); param == "" || (err == nil && k == name) {
+			continue
+		}
+		params = append(params, param)
+	}
+	return strings.Join(params, "&")
+}
@@ -0,0 +1,191 @@
+package credential
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// tokenRequestTimeout limits a request to the token endpoint. It is
+	// independent of the requests which wait for the token, so that the
+	// canceled request does not fail the others.
+	tokenRequestTimeout = 30 * time.Second
+	// maxRefreshAhead is the max duration to refresh the token before it
+	// expires. The token which lives shorter is refreshed at the half of
+	// its lifetime.
+	maxRefreshAhead = time.Minute
+	// defaultTokenLifetime is used if the response has no expires_in.
+	defaultTokenLifetime = 5 * time.Minute
+	// maxTokenResponseSize limits the response of the token endpoint.
+	maxTokenResponseSize = 1 << 20
+)
+
+// oauth2 attaches the access token which is acquired by the client
+// credentials grant of OAuth 2.0. The token is cached until it expires,
+// and refreshed in the background before that.
+//
+// See: https://www.rfc-editor.org/rfc/rfc6749#section-4.4
+type oauth2 struct {
+	config *Config
+	now    func() time.Time
+	group  singleflight.Group
+
+	mu          sync.Mutex
+	accessToken string
+	refreshAt   time.Time
+	expiry      time.Time
+}
+
+func newOAuth2(c *Config) (Injector, error) {
+	u, err := url.Parse(c.TokenURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid token url: %q", c.TokenURL)
+	}
+	if c.ClientID == "" {
+		return nil, errors.New("clientID is required for oauth2")
+	}
+	return &oauth2{
+		config: c,
+		now:    time.Now,
+	}, nil
+}
+
+type transportContextKey struct{}
+
+// WithTransport returns a copy of ctx which carries the transport to
+// request the token endpoint for "oauth2", so that it is dialed in the
+// same way as the target. If ctx has no transport, http.DefaultTransport
+// is used.
+func WithTransport(ctx context.Context, rt http.RoundTripper) context.Context {
+	return context.WithValue(ctx, transportContextKey{}, rt)
+}
+
+func transportFromContext(ctx context.Context) http.RoundTripper {
+	rt, _ := ctx.Value(transportContextKey{}).(http.RoundTripper)
+	return rt
+}
+
+func (o *oauth2) Inject(req *http.Request) error {
+	stripCredentials(req, o.config)
+	token, err := o.token(req.Context())
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// token returns the cached token, or waits for the new one if the cached
+// one is expired.
+func (o *oauth2) token(ctx context.Context) (string, error) {
+	o.mu.Lock()
+	token, refreshAt, expiry := o.accessToken, o.refreshAt, o.expiry
+	o.mu.Unlock()
+
+	now := o.now()
+	if token != "" && now.Before(expiry) {
+		if !now.Before(refreshAt) {
+			// the result is used by the following requests.
+			o.refresh(ctx)
+		}
+		return token, nil
+	}
+	select {
+	case r := <-o.refresh(ctx):
+		if r.Err != nil {
+			return "", r.Err
+		}
+		return r.Val.(string), nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// refresh fetches the new token through the transport in ctx. The
+// concurrent calls share the request. The error is logged to the logger in
+// ctx, because nobody receives it if the token is refreshed in the
+// background.
+func (o *oauth2) refresh(ctx context.Context) <-chan singleflight.Result {
+	client := &http.Client{Transport: transportFromContext(ctx)}
+	logger := logr.FromContextOrDiscard(ctx)
+	return o.group.DoChan("token", func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), tokenRequestTimeout)
+		defer cancel()
+		token, err := o.fetch(ctx, client)
+		if err != nil {
+			logger.Error(err, "failed to refresh token", "tokenURL", o.config.TokenURL)
+		}
+		return token, err
+	})
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (o *oauth2) fetch(ctx context.Context, client *http.Client) (string, error) {
+	secret, err := o.config.Secret.Value()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(o.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(o.config.Scopes, " "))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// client_secret_basic encodes the credentials before Basic.
+	req.SetBasicAuth(url.QueryEscape(o.config.ClientID), url.QueryEscape(secret))
+
+	start := o.now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request token: %w", err)
+	}
+	defer resp.Body.Close()
+	var tr tokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxTokenResponseSize)).Decode(&tr); err != nil && resp.StatusCode == http.StatusOK {
+		return "", fmt.Errorf("failed to decode token response: %w", err)
+	}
+	switch {
+	case resp.StatusCode != http.StatusOK && tr.Error != "":
+		return "", fmt.Errorf("token endpoint responded %d: %s: %s", resp.StatusCode, tr.Error, tr.ErrorDescription)
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("token endpoint responded %d", resp.StatusCode)
+	case tr.AccessToken == "":
+		return "", errors.New("token response has no access_token")
+	case tr.TokenType != "" && !strings.EqualFold(tr.TokenType, "bearer"):
+		return "", fmt.Errorf("unsupported token type: %q", tr.TokenType)
+	}
+
+	lifetime := defaultTokenLifetime
+	if tr.ExpiresIn > 0 {
+		lifetime = time.Duration(tr.ExpiresIn) * time.Second
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.accessToken = tr.AccessToken
+	// the lifetime starts before the request.
+	o.expiry = start.Add(lifetime)
+	o.refreshAt = o.expiry.Add(-min(maxRefreshAhead, lifetime/2))
+	return tr.AccessToken, nil
+}
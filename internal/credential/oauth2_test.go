@@ -0,0 +1,151 @@
+package credential
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is the clock which is advanced by the test.
+type fakeClock struct {
+	base    time.Time
+	elapsed atomic.Int64
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.base.Add(time.Duration(c.elapsed.Load()))
+}
+
+func (c *fakeClock) set(d time.Duration) {
+	c.elapsed.Store(int64(d))
+}
+
+// newTokenServer starts the token endpoint which issues "token-1",
+// "token-2", ... for 2 minutes.
+func newTokenServer(t *testing.T, requests *atomic.Int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if id, secret, _ := req.BasicAuth(); id != "bridge" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"invalid_client","error_description":"client authentication failed"}`)
+			return
+		}
+		if req.Method != http.MethodPost || req.PostFormValue("grant_type") != "client_credentials" || req.PostFormValue("scope") != "read write" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_request"}`)
+			return
+		}
+		n := requests.Add(1)
+		// makes the concurrent requests wait for the same token.
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"Bearer","expires_in":120}`, n)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestOAuth2(t *testing.T, tokenURL, secretEnv string, clock *fakeClock) *oauth2 {
+	t.Helper()
+	injector, err := New(&Config{
+		Type:     OAuth2,
+		TokenURL: tokenURL,
+		ClientID: "bridge",
+		Secret:   &Secret{Env: secretEnv},
+		Scopes:   []string{"read", "write"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := injector.(*oauth2)
+	o.now = clock.now
+	return o
+}
+
+func injectToken(t *testing.T, injector Injector) string {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "http://internal-api/v1/users", nil)
+	req.Header.Set("Authorization", "Bearer client")
+	if err := injector.Inject(req); err != nil {
+		t.Fatal(err)
+	}
+	return req.Header.Get("Authorization")
+}
+
+func TestOAuth2(t *testing.T) {
+	t.Setenv("TEST_CLIENT_SECRET", "s3cret")
+	var requests atomic.Int32
+	srv := newTokenServer(t, &requests)
+	clock := &fakeClock{base: time.Now()}
+	o := newTestOAuth2(t, srv.URL, "TEST_CLIENT_SECRET", clock)
+
+	// the concurrent requests share the request to the token endpoint.
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "http://internal-api/", nil)
+			if err := o.Inject(req); err != nil {
+				t.Error(err)
+				return
+			}
+			if got := req.Header.Get("Authorization"); got != "Bearer token-1" {
+				t.Errorf("want token-1, but got %q", got)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := requests.Load(); got != 1 {
+		t.Fatalf("want 1 token request, but got %d", got)
+	}
+
+	// the cached token
+	clock.set(30 * time.Second)
+	if got := injectToken(t, o); got != "Bearer token-1" {
+		t.Fatalf("want token-1, but got %q", got)
+	}
+
+	// the token is refreshed in the background a minute before it expires.
+	clock.set(90 * time.Second)
+	if got := injectToken(t, o); got != "Bearer token-1" {
+		t.Fatalf("want token-1, but got %q", got)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for injectToken(t, o) != "Bearer token-2" {
+		if time.Now().After(deadline) {
+			t.Fatal("the token is not refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the expired token is not used.
+	clock.set(time.Hour)
+	if got := injectToken(t, o); got != "Bearer token-3" {
+		t.Fatalf("want token-3, but got %q", got)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Fatalf("want 3 token requests, but got %d", got)
+	}
+}
+
+func TestOAuth2_error(t *testing.T) {
+	t.Setenv("TEST_WRONG_CLIENT_SECRET", "wrong")
+	var requests atomic.Int32
+	srv := newTokenServer(t, &requests)
+	o := newTestOAuth2(t, srv.URL, "TEST_WRONG_CLIENT_SECRET", &fakeClock{base: time.Now()})
+
+	req := httptest.NewRequest(http.MethodGet, "http://internal-api/", nil)
+	err := o.Inject(req)
+	if err == nil || !strings.Contains(err.Error(), "invalid_client") {
+		t.Fatalf("want invalid_client error, but got %v", err)
+	}
+	if strings.Contains(err.Error(), "wrong") {
+		t.Fatalf("the error has the secret: %v", err)
+	}
+}
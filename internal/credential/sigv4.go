@@ -0,0 +1,340 @@
+package credential
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	amzDateFormat   = "20060102T150405Z"
+	amzDateHeader   = "X-Amz-Date"
+	amzTokenHeader  = "X-Amz-Security-Token"
+	amzSHA256Header = "X-Amz-Content-Sha256"
+
+	// unsignedPayload is sent instead of the hash of the payload to S3,
+	// so that the body is streamed without reading it in advance.
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+
+	// maxMemoryBody is the max size of the body which is kept in memory
+	// while it is hashed. The larger body is spooled to a temporary file.
+	maxMemoryBody = 1 << 20
+	// maxSignedBody limits the body which is hashed.
+	maxSignedBody = 256 << 20
+)
+
+// emptySHA256 is the hash of the empty payload.
+var emptySHA256 = hex.EncodeToString(sha256.New().Sum(nil))
+
+// ErrBodyTooLarge is returned if the body is too large to be hashed.
+var ErrBodyTooLarge = errors.New("request body is too large to sign")
+
+// awsCredentials is a set of the AWS security credentials.
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+// loadAWSCredentials reads the credentials from the shared credentials
+// file if file is not empty. Otherwise, it reads them from the standard
+// environment variables.
+func loadAWSCredentials(file, profile string) (*awsCredentials, error) {
+	if file == "" {
+		c := &awsCredentials{
+			accessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		if c.accessKeyID == "" || c.secretAccessKey == "" {
+			return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required")
+		}
+		return c, nil
+	}
+	if profile == "" {
+		profile = "default"
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open credentials file: %w", err)
+	}
+	defer f.Close()
+
+	c := &awsCredentials{}
+	var section string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+		case line[0] == '[' && line[len(line)-1] == ']':
+			section = strings.TrimSpace(line[1 : len(line)-1])
+		case section == profile:
+			key, value, _ := strings.Cut(line, "=")
+			switch strings.TrimSpace(key) {
+			case "aws_access_key_id":
+				c.accessKeyID = strings.TrimSpace(value)
+			case "aws_secret_access_key":
+				c.secretAccessKey = strings.TrimSpace(value)
+			case "aws_session_token":
+				c.sessionToken = strings.TrimSpace(value)
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read credentials file: %w", err)
+	}
+	if c.accessKeyID == "" || c.secretAccessKey == "" {
+		return nil, fmt.Errorf("profile %q has no aws_access_key_id or aws_secret_access_key", profile)
+	}
+	return c, nil
+}
+
+// sigV4 signs the requests with AWS Signature Version 4.
+//
+// The body of S3 is not signed (UNSIGNED-PAYLOAD) if its length is known,
+// so that it is streamed. The other services require the hash of the body,
+// so that the body is read in advance up to maxSignedBody, and spooled to a
+// temporary file if it is larger than maxMemoryBody.
+//
+// See: https://docs.aws.amazon.com/IAM/latest/UserGuide/reference_sigv-create-signed-request.html
+type sigV4 struct {
+	config *Config
+	now    func() time.Time
+}
+
+func newSigV4(c *Config) (Injector, error) {
+	if c.Region == "" || c.Service == "" {
+		return nil, errors.New("region and service are required for sigv4")
+	}
+	if _, err := loadAWSCredentials(c.CredentialsFile, c.Profile); err != nil {
+		return nil, err
+	}
+	return &sigV4{config: c, now: time.Now}, nil
+}
+
+func (s *sigV4) Inject(req *http.Request) error {
+	stripCredentials(req, s.config)
+	req.Header.Del(amzDateHeader)
+	req.Header.Del(amzTokenHeader)
+	req.Header.Del(amzSHA256Header)
+
+	creds, err := loadAWSCredentials(s.config.CredentialsFile, s.config.Profile)
+	if err != nil {
+		return err
+	}
+	payloadHash := unsignedPayload
+	// S3 requires the length of the body which is not signed.
+	if s.config.Service != "s3" || req.ContentLength < 0 || (req.ContentLength == 0 && req.Body != nil && req.Body != http.NoBody) {
+		payloadHash, err = hashBody(req)
+		if err != nil {
+			return err
+		}
+	}
+	s.sign(req, creds, payloadHash, s.now().UTC())
+	return nil
+}
+
+// sign adds the headers of the signature to req.
+func (s *sigV4) sign(req *http.Request, creds *awsCredentials, payloadHash string, now time.Time) {
+	amzDate := now.Format(amzDateFormat)
+	req.Header.Set(amzDateHeader, amzDate)
+	if creds.sessionToken != "" {
+		req.Header.Set(amzTokenHeader, creds.sessionToken)
+	}
+	if s.config.Service == "s3" {
+		req.Header.Set(amzSHA256Header, payloadHash)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.Join(values, ",")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.Join(strings.Fields(headers[name]), " ") + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if req.URL.Opaque != "" {
+		path = req.URL.Opaque
+	}
+	if path == "" {
+		path = "/"
+	}
+	if s.config.Service != "s3" {
+		// the path is encoded twice except for S3.
+		path = awsEscape(path, false)
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.RawQuery),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	date := amzDate[:8]
+	scope := date + "/" + s.config.Region + "/" + s.config.Service + "/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := sigV4Algorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := signingKey(creds.secretAccessKey, date, s.config.Region, s.config.Service)
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", sigV4Algorithm+
+		" Credential="+creds.accessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+
+		", Signature="+signature)
+}
+
+func signingKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+// canonicalQuery sorts the query parameters by the name and the value,
+// and encodes them.
+func canonicalQuery(rawQuery string) string {
+	var params [][2]string
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(param, "=")
+		if k, err := url.QueryUnescape(key); err == nil {
+			key = k
+		}
+		if v, err := url.QueryUnescape(value); err == nil {
+			value = v
+		}
+		params = append(params, [2]string{awsEscape(key, true), awsEscape(value, true)})
+	}
+	slices.SortFunc(params, func(a, b [2]string) int {
+		if c := strings.Compare(a[0], b[0]); c != 0 {
+			return c
+		}
+		return strings.Compare(a[1], b[1])
+	})
+	encoded := make([]string, len(params))
+	for i, p := range params {
+		encoded[i] = p[0] + "=" + p[1]
+	}
+	return strings.Join(encoded, "&")
+}
+
+// awsEscape encodes s except for the unreserved characters of RFC 3986,
+// and "/" if encodeSlash is false.
+func awsEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~',
+			c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// hashBody reads the body to hash, and replaces it with the one which can
+// be read again. The streaming body whose length is unknown is sent with
+// Content-Length after it is hashed.
+func hashBody(req *http.Request) (string, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return emptySHA256, nil
+	}
+	defer req.Body.Close()
+
+	h := sha256.New()
+	var buf bytes.Buffer
+	n, err := io.CopyN(io.MultiWriter(h, &buf), req.Body, maxMemoryBody+1)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read request body: %w", err)
+	}
+	req.TransferEncoding = nil
+	if n <= maxMemoryBody {
+		req.ContentLength = n
+		if n == 0 {
+			req.Body, req.GetBody = http.NoBody, nil
+			return emptySHA256, nil
+		}
+		body := buf.Bytes()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+
+	f, err := os.CreateTemp("", "bridge-sigv4-*")
+	if err != nil {
+		return "", err
+	}
+	spooled := &tempFile{f}
+	size := n
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		var rest int64
+		rest, err = io.Copy(io.MultiWriter(h, f), io.LimitReader(req.Body, maxSignedBody-n+1))
+		size += rest
+	}
+	if err == nil && size > maxSignedBody {
+		err = ErrBodyTooLarge
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spooled.Close()
+		return "", err
+	}
+	req.Body, req.GetBody, req.ContentLength = spooled, nil, size
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// tempFile removes the file when it is closed.
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
@@ -0,0 +1,197 @@
+package credential
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecretAccessKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+
+func TestSigningKey(t *testing.T) {
+	// https://docs.aws.amazon.com/general/latest/gr/signature-v4-examples.html
+	want := "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d"
+	if got := hex.EncodeToString(signingKey(testSecretAccessKey, "20120215", "us-east-1", "iam")); got != want {
+		t.Fatalf("want %s, but got %s", want, got)
+	}
+}
+
+func newTestSigV4(t *testing.T, c *Config) *sigV4 {
+	t.Helper()
+	c.Type = SigV4
+	injector, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := injector.(*sigV4)
+	s.now = func() time.Time {
+		return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	}
+	return s
+}
+
+func TestSigV4(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", testSecretAccessKey)
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	s := newTestSigV4(t, &Config{Region: "us-east-1", Service: "service"})
+
+	// the cases of the signature test suite of AWS.
+	cases := []struct {
+		name          string
+		method        string
+		url           string
+		wantSignature string
+	}{
+		{
+			name:          "get-vanilla",
+			method:        http.MethodGet,
+			url:           "http://example.amazonaws.com/",
+			wantSignature: "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name:          "get-vanilla-query-order-key-case",
+			method:        http.MethodGet,
+			url:           "http://example.amazonaws.com/?Param2=value2&Param1=value1",
+			wantSignature: "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+		{
+			name:          "post-vanilla",
+			method:        http.MethodPost,
+			url:           "http://example.amazonaws.com/",
+			wantSignature: "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.url, nil)
+			req.Header = http.Header{
+				"Authorization": {"Bearer client"},
+				"X-Amz-Date":    {"20000101T000000Z"},
+			}
+			if err := s.Inject(req); err != nil {
+				t.Fatal(err)
+			}
+			want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=" + tc.wantSignature
+			if got := req.Header.Get("Authorization"); got != want {
+				t.Fatalf("want %q, but got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestSigV4_credentialsFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "credentials")
+	content := "[default]\naws_access_key_id = AKIDDEFAULT\naws_secret_access_key = secret\n\n" +
+		"# bridge\n[bridge]\naws_access_key_id=AKIDBRIDGE\naws_secret_access_key=secret\naws_session_token=session\n"
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestSigV4(t, &Config{Region: "ap-northeast-1", Service: "es", CredentialsFile: file, Profile: "bridge"})
+
+	req := httptest.NewRequest(http.MethodGet, "https://search.internal/_search", nil)
+	if err := s.Inject(req); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("X-Amz-Security-Token"); got != "session" {
+		t.Fatalf("want session token, but got %q", got)
+	}
+	if got := req.Header.Get("Authorization"); !strings.Contains(got, "Credential=AKIDBRIDGE/20150830/ap-northeast-1/es/aws4_request, SignedHeaders=host;x-amz-date;x-amz-security-token,") {
+		t.Fatalf("unexpected authorization %q", got)
+	}
+}
+
+// streamingBody hides the length of the body.
+type streamingBody struct {
+	io.Reader
+	closed bool
+}
+
+func (b *streamingBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestSigV4_body(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", testSecretAccessKey)
+	// S3 sends the hash of the body in the header.
+	s := newTestSigV4(t, &Config{Region: "us-east-1", Service: "s3"})
+
+	cases := []struct {
+		name string
+		size int
+	}{
+		{name: "empty", size: 0},
+		{name: "in memory", size: 1024},
+		{name: "spooled", size: maxMemoryBody + 1024},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			content := bytes.Repeat([]byte("bridge"), tc.size/6)
+			body := &streamingBody{Reader: bytes.NewReader(content)}
+			req := httptest.NewRequest(http.MethodPut, "https://bucket.s3.amazonaws.com/key", nil)
+			req.Body, req.ContentLength, req.TransferEncoding = body, -1, []string{"chunked"}
+			if err := s.Inject(req); err != nil {
+				t.Fatal(err)
+			}
+			if !body.closed {
+				t.Error("the original body is not closed")
+			}
+
+			hash := sha256.Sum256(content)
+			if got, want := req.Header.Get("X-Amz-Content-Sha256"), hex.EncodeToString(hash[:]); got != want {
+				t.Errorf("want hash %s, but got %s", want, got)
+			}
+			if req.ContentLength != int64(len(content)) || req.TransferEncoding != nil {
+				t.Errorf("want content length %d, but got %d %v", len(content), req.ContentLength, req.TransferEncoding)
+			}
+			got, err := io.ReadAll(req.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("want %d bytes, but got %d bytes", len(content), len(got))
+			}
+			if err := req.Body.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if f, ok := req.Body.(*tempFile); ok {
+				if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+					t.Errorf("the temporary file is not removed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestSigV4_unsignedPayload(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", testSecretAccessKey)
+	s := newTestSigV4(t, &Config{Region: "us-east-1", Service: "s3"})
+
+	// the body whose length is known is streamed without reading it.
+	body := &streamingBody{Reader: strings.NewReader("hello, bridge")}
+	req := httptest.NewRequest(http.MethodPut, "https://bucket.s3.amazonaws.com/key", nil)
+	req.Body, req.ContentLength = body, 13
+	if err := s.Inject(req); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("X-Amz-Content-Sha256"); got != "UNSIGNED-PAYLOAD" {
+		t.Errorf("want UNSIGNED-PAYLOAD, but got %s", got)
+	}
+	if req.Body != body || req.ContentLength != 13 {
+		t.Errorf("want the original body, but got %T of %d bytes", req.Body, req.ContentLength)
+	}
+	if got := req.Header.Get("Authorization"); !strings.Contains(got, "SignedHeaders=host;x-amz-content-sha256;x-amz-date,") {
+		t.Errorf("unexpected authorization %q", got)
+	}
+}
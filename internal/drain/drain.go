@@ -0,0 +1,120 @@
+// Package drain tracks the live tunnels to close them gracefully on shutdown.
+//
+// The tunnels are hijacked from net/http or served over the streams, so
+// http.Server.Shutdown does not wait for them.
+package drain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrDraining is returned when a new tunnel is opened after draining is
+// started.
+var ErrDraining = errors.New("bridge is draining")
+
+// Tracker tracks the live tunnels.
+type Tracker struct {
+	mu        sync.Mutex
+	draining  bool
+	next      uint64
+	tunnels   map[uint64]context.CancelFunc
+	stopped   chan struct{}
+	idle      chan struct{}
+	closeIdle sync.Once
+}
+
+// New creates a new tracker.
+func New() *Tracker {
+	return &Tracker{
+		tunnels: make(map[uint64]context.CancelFunc),
+		stopped: make(chan struct{}),
+		idle:    make(chan struct{}),
+	}
+}
+
+// Track registers a new tunnel. The returned context is canceled when the
+// tunnel must be closed because the drain period is over, and done must be
+// called when the tunnel is finished. It returns ErrDraining after Drain is
+// called.
+func (t *Tracker) Track() (ctx context.Context, done func(), err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return nil, nil, ErrDraining
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	id := t.next
+	t.next++
+	t.tunnels[id] = cancel
+
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() {
+			cancel()
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			delete(t.tunnels, id)
+			t.signalIdle()
+		})
+	}, nil
+}
+
+// signalIdle notifies Drain that all tunnels are finished. t.mu must be held.
+func (t *Tracker) signalIdle() {
+	if t.draining && len(t.tunnels) == 0 {
+		t.closeIdle.Do(func() { close(t.idle) })
+	}
+}
+
+// Len returns the number of the live tunnels.
+func (t *Tracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.tunnels)
+}
+
+// Draining reports whether Stop or Drain is called.
+func (t *Tracker) Draining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// Stopped returns a channel which is closed when Stop or Drain is called.
+func (t *Tracker) Stopped() <-chan struct{} {
+	return t.stopped
+}
+
+// Stop stops accepting new tunnels without waiting for the live ones.
+func (t *Tracker) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.draining {
+		t.draining = true
+		close(t.stopped)
+	}
+	t.signalIdle()
+}
+
+// Drain stops accepting new tunnels and waits until all the tunnels are
+// finished. If ctx is done before that, it closes the remaining tunnels
+// and returns the error.
+func (t *Tracker) Drain(ctx context.Context) error {
+	t.Stop()
+
+	select {
+	case <-t.idle:
+		return nil
+	case <-ctx.Done():
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, cancel := range t.tunnels {
+		cancel()
+	}
+	return fmt.Errorf("closed %d tunnels forcibly: %w", len(t.tunnels), ctx.Err())
+}
@@ -0,0 +1,111 @@
+package drain
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTracker_Drain(t *testing.T) {
+	t.Run("waits for tunnels", func(t *testing.T) {
+		tracker := New()
+		_, done, err := tracker.Track()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		drained := make(chan error, 1)
+		go func() { drained <- tracker.Drain(context.Background()) }()
+
+		// rejects new tunnels while draining.
+		for !tracker.Draining() {
+			time.Sleep(time.Millisecond)
+		}
+		if _, _, err := tracker.Track(); !errors.Is(err, ErrDraining) {
+			t.Fatalf("want ErrDraining, but got %v", err)
+		}
+		select {
+		case err := <-drained:
+			t.Fatalf("drained before the tunnel is finished: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		done()
+		select {
+		case err := <-drained:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("not drained")
+		}
+	})
+
+	t.Run("closes tunnels after timeout", func(t *testing.T) {
+		tracker := New()
+		ctx1, done1, err := tracker.Track()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer done1()
+		ctx2, done2, err := tracker.Track()
+		if err != nil {
+			t.Fatal(err)
+		}
+		done2()
+		if got := tracker.Len(); got != 1 {
+			t.Fatalf("want 1 tunnel, but got %d", got)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := tracker.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("want DeadlineExceeded, but got %v", err)
+		}
+		select {
+		case <-ctx1.Done():
+		default:
+			t.Fatal("want the remaining tunnel is closed")
+		}
+		if ctx2.Err() == nil {
+			t.Fatal("want the context of the finished tunnel is canceled")
+		}
+	})
+
+	t.Run("no tunnels", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		if err := New().Drain(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestTracker_Stop(t *testing.T) {
+	tracker := New()
+	ctx, done, err := tracker.Track()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	tracker.Stop()
+	select {
+	case <-tracker.Stopped():
+	default:
+		t.Fatal("want Stopped is closed")
+	}
+	if _, _, err := tracker.Track(); !errors.Is(err, ErrDraining) {
+		t.Fatalf("want ErrDraining, but got %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("want the live tunnel is kept")
+	}
+	// Drain can be called after Stop.
+	tracker.Stop()
+	done()
+	if err := tracker.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
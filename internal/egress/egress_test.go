@@ -0,0 +1,343 @@
+package egress
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeProxy is a SOCKS5 or HTTP CONNECT proxy server for testing.
+type fakeProxy struct {
+	net.Listener
+	username string
+	password string
+
+	mu        sync.Mutex
+	requested []string
+}
+
+func newFakeProxy(t *testing.T, serve func(p *fakeProxy, conn net.Conn) (string, error), username, password string) *fakeProxy {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeProxy{Listener: ln, username: username, password: password}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				address, err := serve(p, conn)
+				if err != nil {
+					return
+				}
+				p.mu.Lock()
+				p.requested = append(p.requested, address)
+				p.mu.Unlock()
+
+				upstream, err := net.Dial("tcp", address)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return p
+}
+
+func (p *fakeProxy) lastRequested() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.requested) == 0 {
+		return ""
+	}
+	return p.requested[len(p.requested)-1]
+}
+
+func serveSOCKS5(p *fakeProxy, conn net.Conn) (string, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return "", err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	if p.username == "" {
+		conn.Write([]byte{socks5Version, socks5AuthNone})
+	} else {
+		conn.Write([]byte{socks5Version, socks5AuthPassword})
+		var ver [2]byte
+		if _, err := io.ReadFull(conn, ver[:]); err != nil {
+			return "", err
+		}
+		username := make([]byte, ver[1])
+		io.ReadFull(conn, username)
+		var l [1]byte
+		io.ReadFull(conn, l[:])
+		password := make([]byte, l[0])
+		io.ReadFull(conn, password)
+		if string(username) != p.username || string(password) != p.password {
+			conn.Write([]byte{socks5PasswordVersion, 0x01})
+			return "", errors.New("unauthorized")
+		}
+		conn.Write([]byte{socks5PasswordVersion, 0x00})
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch req[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		n := net.IPv4len
+		if req[3] == socks5AddrIPv6 {
+			n = net.IPv6len
+		}
+		b := make([]byte, n)
+		io.ReadFull(conn, b)
+		addr, _ := netip.AddrFromSlice(b)
+		host = addr.String()
+	case socks5AddrDomain:
+		var l [1]byte
+		io.ReadFull(conn, l[:])
+		b := make([]byte, l[0])
+		io.ReadFull(conn, b)
+		host = string(b)
+	}
+	var port [2]byte
+	io.ReadFull(conn, port[:])
+	conn.Write([]byte{socks5Version, 0x00, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+func serveHTTPConnect(p *fakeProxy, conn net.Conn) (string, error) {
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return "", err
+	}
+	if p.username != "" {
+		want := "Basic " + base64.StdEncoding.EncodeToString([]byte(p.username+":"+p.password))
+		if req.Header.Get("Proxy-Authorization") != want {
+			conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return "", errors.New("unauthorized")
+		}
+	}
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	return req.Host, nil
+}
+
+func newEchoListener(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+func testEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	want := "hello, egress"
+	if _, err := conn.Write([]byte(want)); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("want %q, but got %q", want, got)
+	}
+}
+
+func TestProxy_DialContextFunc(t *testing.T) {
+	echoListener := newEchoListener(t)
+	_, echoPort, _ := net.SplitHostPort(echoListener.Addr().String())
+
+	socks5Proxy := newFakeProxy(t, serveSOCKS5, "user", "p@ss")
+	httpProxy := newFakeProxy(t, serveHTTPConnect, "user", "p@ss")
+
+	dial := (&net.Dialer{Timeout: 3 * time.Second}).DialContext
+	errDirect := errors.New("direct")
+	direct := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errDirect
+	}
+	resolve := func(ctx context.Context, host string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("127.0.0.1")}, nil
+	}
+
+	cases := []struct {
+		name          string
+		config        *Config
+		proxy         *fakeProxy
+		address       string
+		resolve       ResolveFunc
+		wantRequested string
+		wantErr       error
+	}{
+		{
+			name:          "socks5",
+			config:        &Config{URL: "socks5://user:p%40ss@" + socks5Proxy.Addr().String()},
+			proxy:         socks5Proxy,
+			address:       echoListener.Addr().String(),
+			wantRequested: echoListener.Addr().String(),
+		},
+		{
+			name:          "socks5 (hostname)",
+			config:        &Config{URL: "socks5://user:p%40ss@" + socks5Proxy.Addr().String()},
+			proxy:         socks5Proxy,
+			address:       net.JoinHostPort("localhost", echoPort),
+			wantRequested: net.JoinHostPort("localhost", echoPort),
+		},
+		{
+			name:          "socks5 (resolved)",
+			config:        &Config{URL: "socks5://user:p%40ss@" + socks5Proxy.Addr().String()},
+			proxy:         socks5Proxy,
+			address:       net.JoinHostPort("data-source.internal", echoPort),
+			resolve:       resolve,
+			wantRequested: echoListener.Addr().String(),
+		},
+		{
+			name:    "socks5 (invalid credentials)",
+			config:  &Config{URL: "socks5://user:invalid@" + socks5Proxy.Addr().String()},
+			address: echoListener.Addr().String(),
+			wantErr: errors.New("any"),
+		},
+		{
+			name:          "http connect",
+			config:        &Config{URL: "http://user:p%40ss@" + httpProxy.Addr().String()},
+			proxy:         httpProxy,
+			address:       net.JoinHostPort("localhost", echoPort),
+			wantRequested: net.JoinHostPort("localhost", echoPort),
+		},
+		{
+			name:    "http connect (invalid credentials)",
+			config:  &Config{URL: "http://" + httpProxy.Addr().String()},
+			address: echoListener.Addr().String(),
+			wantErr: errors.New("any"),
+		},
+		{
+			name: "bypass (host)",
+			config: &Config{
+				URL:    "http://" + httpProxy.Addr().String(),
+				Bypass: []string{"*.internal"},
+			},
+			address: "db.internal:5432",
+			wantErr: errDirect,
+		},
+		{
+			name: "bypass (cidr)",
+			config: &Config{
+				URL:    "http://" + httpProxy.Addr().String(),
+				Bypass: []string{"10.0.0.0/8"},
+			},
+			address: "10.1.2.3:5432",
+			wantErr: errDirect,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := New(tc.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+
+			conn, err := p.DialContextFunc(direct, dial, tc.resolve)(ctx, "tcp", tc.address)
+			if tc.wantErr != nil {
+				if err == nil {
+					conn.Close()
+					t.Fatal("want error")
+				}
+				if tc.wantErr == errDirect && !errors.Is(err, errDirect) {
+					t.Fatalf("want error %v, but got %v", errDirect, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			testEcho(t, conn)
+			if got := tc.proxy.lastRequested(); got != tc.wantRequested {
+				t.Fatalf("want requested %q, but got %q", tc.wantRequested, got)
+			}
+		})
+	}
+
+	t.Run("bypass (context)", func(t *testing.T) {
+		p, err := New(&Config{URL: "socks5://" + socks5Proxy.Addr().String()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = p.DialContextFunc(direct, dial, nil)(WithBypass(context.Background()), "tcp", "10.1.2.3:5432")
+		if !errors.Is(err, errDirect) {
+			t.Fatalf("want error %v, but got %v", errDirect, err)
+		}
+	})
+
+	t.Run("bypass (unix)", func(t *testing.T) {
+		p, err := New(&Config{URL: "socks5://" + socks5Proxy.Addr().String()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = p.DialContextFunc(direct, dial, nil)(context.Background(), "unix", "/var/run/postgresql/.s.PGSQL.5432")
+		if !errors.Is(err, errDirect) {
+			t.Fatalf("want error %v, but got %v", errDirect, err)
+		}
+	})
+}
+
+func TestNew_invalid(t *testing.T) {
+	cases := []struct {
+		name   string
+		config *Config
+	}{
+		{name: "unsupported scheme", config: &Config{URL: "ftp://proxy:21"}},
+		{name: "empty host", config: &Config{URL: "socks5://"}},
+		{name: "invalid bypass cidr", config: &Config{URL: "socks5://proxy", Bypass: []string{"10.0.0.0/33"}}},
+		{name: "invalid bypass host", config: &Config{URL: "socks5://proxy", Bypass: []string{"[a-"}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := New(tc.config); err == nil {
+				t.Fatal("want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package egress
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+func httpConnect(ctx context.Context, conn net.Conn, proxyURL *url.URL, address string) (net.Conn, error) {
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			ServerName: proxyURL.Hostname(),
+		})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	if br.Buffered() == 0 {
+		return conn, nil
+	}
+	return &bufConn{Conn: conn, reader: io.MultiReader(br, conn)}, nil
+}
+
+// bufConn reads the data buffered while reading the CONNECT response first.
+type bufConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *bufConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *bufConn) CloseWrite() error {
+	if v, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return v.CloseWrite()
+	}
+	return nil
+}
+
+func (c *bufConn) CloseRead() error {
+	if v, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return v.CloseRead()
+	}
+	return nil
+}
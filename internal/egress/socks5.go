@@ -0,0 +1,155 @@
+package egress
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	aLongTimeAgo = time.Unix(1, 0)
+	noDeadline   = time.Time{}
+)
+
+// https://datatracker.ietf.org/doc/html/rfc1928
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthNoAcceptable = 0xff
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	// https://datatracker.ietf.org/doc/html/rfc1929
+	socks5PasswordVersion = 0x01
+)
+
+var socks5Replies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+func socks5Connect(conn net.Conn, user *url.Userinfo, address string) error {
+	method := byte(socks5AuthNone)
+	if user != nil {
+		method = socks5AuthPassword
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[0] != socks5Version {
+		return fmt.Errorf("unexpected socks version %d", resp[0])
+	}
+	if resp[1] == socks5AuthNoAcceptable || resp[1] != method {
+		return errors.New("no acceptable authentication methods")
+	}
+
+	if method == socks5AuthPassword {
+		password, _ := user.Password()
+		username := user.Username()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("too long username or password")
+		}
+		req := []byte{socks5PasswordVersion, byte(len(username))}
+		req = append(req, username...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp[:]); err != nil {
+			return err
+		}
+		if resp[1] != 0x00 {
+			return errors.New("username/password authentication failed")
+		}
+	}
+
+	req, err := socks5ConnectRequest(address)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// VER, REP, RSV, ATYP
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		if msg, ok := socks5Replies[header[1]]; ok {
+			return errors.New(msg)
+		}
+		return fmt.Errorf("unknown socks reply %d", header[1])
+	}
+	// discards BND.ADDR and BND.PORT
+	var n int
+	switch header[3] {
+	case socks5AddrIPv4:
+		n = net.IPv4len + 2
+	case socks5AddrIPv6:
+		n = net.IPv6len + 2
+	case socks5AddrDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return err
+		}
+		n = int(l[0]) + 2
+	default:
+		return fmt.Errorf("unknown address type %d", header[3])
+	}
+	_, err = io.CopyN(io.Discard, conn, int64(n))
+	return err
+}
+
+func socks5ConnectRequest(address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0x00}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		if addr.Is4() {
+			req = append(req, socks5AddrIPv4)
+		} else {
+			req = append(req, socks5AddrIPv6)
+		}
+		req = append(req, addr.AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("too long hostname %q", host)
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	return binary.BigEndian.AppendUint16(req, uint16(port)), nil
+}
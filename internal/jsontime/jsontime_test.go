@@ -0,0 +1,42 @@
+package jsontime
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDuration_UnmarshalJSON(t *testing.T) {
+	cases := []struct {
+		input   string
+		want    Duration
+		wantErr bool
+	}{
+		{input: `"30s"`, want: Duration(30 * time.Second)},
+		{input: `"1m30s"`, want: Duration(90 * time.Second)},
+		{input: `30`, wantErr: true},
+		{input: `"30"`, wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.input, func(t *testing.T) {
+			var got Duration
+			err := json.Unmarshal([]byte(tc.input), &got)
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("wantErr %v, but got err: %v", tc.wantErr, err)
+			}
+			if got != tc.want {
+				t.Fatalf("want %v, but got %v", time.Duration(tc.want), time.Duration(got))
+			}
+		})
+	}
+}
+
+func TestDuration_MarshalJSON(t *testing.T) {
+	b, err := json.Marshal(Duration(90 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"1m30s"`; string(b) != want {
+		t.Fatalf("want %s, but got %s", want, b)
+	}
+}
@@ -0,0 +1,93 @@
+package mux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// version is a version of the frame format.
+const version = 1
+
+// frameType is a type of the frame.
+//
+//	SYN:           opens a stream. The payload is the metadata of the stream.
+//	ACK:           accepts the stream opened by SYN.
+//	RST:           rejects or aborts the stream. The payload is the 2-byte
+//	               code and the reason.
+//	DATA:          carries the payload of the stream.
+//	WINDOW_UPDATE: increases the send window of the peer. The payload is
+//	               the 4-byte increment.
+//	FIN:           closes the write side of the stream.
+type frameType uint8
+
+const (
+	frameSYN frameType = iota + 1
+	frameACK
+	frameRST
+	frameDATA
+	frameWindowUpdate
+	frameFIN
+)
+
+func (t frameType) String() string {
+	switch t {
+	case frameSYN:
+		return "SYN"
+	case frameACK:
+		return "ACK"
+	case frameRST:
+		return "RST"
+	case frameDATA:
+		return "DATA"
+	case frameWindowUpdate:
+		return "WINDOW_UPDATE"
+	case frameFIN:
+		return "FIN"
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", uint8(t))
+}
+
+// headerSize is the size of the frame header:
+//
+//	| version (1) | type (1) | stream id (4) | length (4) |
+const headerSize = 10
+
+const (
+	// maxPayloadSize is the maximum size of the payload of each frame.
+	maxPayloadSize = 32 * 1024
+	// maxMetadataSize is the maximum size of the payload of SYN.
+	maxMetadataSize = 4 * 1024
+)
+
+type frameHeader struct {
+	typ      frameType
+	streamID uint32
+	length   uint32
+}
+
+func readFrameHeader(r io.Reader) (frameHeader, error) {
+	var b [headerSize]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return frameHeader{}, err
+	}
+	if b[0] != version {
+		return frameHeader{}, fmt.Errorf("mux: unsupported version %d", b[0])
+	}
+	h := frameHeader{
+		typ:      frameType(b[1]),
+		streamID: binary.BigEndian.Uint32(b[2:6]),
+		length:   binary.BigEndian.Uint32(b[6:10]),
+	}
+	if h.length > maxPayloadSize {
+		return frameHeader{}, fmt.Errorf("mux: too large %s frame: %d bytes", h.typ, h.length)
+	}
+	return h, nil
+}
+
+func appendFrame(buf []byte, typ frameType, streamID uint32, payload []byte) []byte {
+	buf = append(buf, version, byte(typ))
+	buf = binary.BigEndian.AppendUint32(buf, streamID)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+	return append(buf, payload...)
+}
@@ -0,0 +1,304 @@
+// Package mux multiplexes many streams over one connection.
+//
+// Each stream is opened with metadata (e.g. the target URL), has its own
+// flow control window and can be closed independently of the others.
+package mux
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	// initialWindow is the initial size of the receive window of each stream.
+	initialWindow = 256 * 1024
+	// maxWindow is the maximum size of the send window.
+	maxWindow = 1<<31 - 1
+	// acceptBacklog is the maximum number of the streams which are opened
+	// by the peer and have not been accepted yet.
+	acceptBacklog = 128
+)
+
+// streamClosedReason is sent with RST when the data arrives after the
+// stream is closed.
+const streamClosedReason = "stream is closed"
+
+// ErrSessionClosed is returned when the session is closed.
+var ErrSessionClosed = errors.New("mux: session is closed")
+
+// StreamError is returned when the stream is rejected or reset by the peer.
+type StreamError struct {
+	// Code is defined by the application, e.g. bridge uses HTTP status codes.
+	Code   int
+	Reason string
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("mux: stream is reset (%d): %s", e.Code, e.Reason)
+}
+
+// Session multiplexes streams over conn. Both sides can open streams;
+// the streams opened by the client side have odd IDs and the ones opened
+// by the server side have even IDs.
+type Session struct {
+	conn   net.Conn
+	client bool
+
+	wmu  sync.Mutex
+	wbuf []byte
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error
+
+	acceptCh  chan *Stream
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Client creates the client side of the session.
+func Client(conn net.Conn) *Session {
+	return newSession(conn, true)
+}
+
+// Server creates the server side of the session.
+func Server(conn net.Conn) *Session {
+	return newSession(conn, false)
+}
+
+func newSession(conn net.Conn, client bool) *Session {
+	s := &Session{
+		conn:     conn,
+		client:   client,
+		streams:  make(map[uint32]*Stream),
+		nextID:   2,
+		acceptCh: make(chan *Stream, acceptBacklog),
+		done:     make(chan struct{}),
+	}
+	if client {
+		s.nextID = 1
+	}
+	go s.readLoop()
+	return s
+}
+
+// Open opens a new stream with metadata, and waits until the peer
+// accepts it. If the peer rejects it, returns *StreamError.
+func (s *Session) Open(ctx context.Context, metadata []byte) (*Stream, error) {
+	if len(metadata) > maxMetadataSize {
+		return nil, fmt.Errorf("mux: too large metadata: %d bytes", len(metadata))
+	}
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(s, id, metadata)
+	st.ackCh = make(chan error, 1)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(frameSYN, id, metadata); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	select {
+	case err := <-st.ackCh:
+		if err != nil {
+			return nil, err
+		}
+		return st, nil
+	case <-ctx.Done():
+		st.reset(0, "canceled")
+		return nil, ctx.Err()
+	case <-s.done:
+		return nil, s.closeErr()
+	}
+}
+
+// Accept waits for the stream opened by the peer. The stream must be
+// accepted by Stream.Ack or rejected by Stream.Reject.
+func (s *Session) Accept() (*Stream, error) {
+	return s.AcceptContext(context.Background())
+}
+
+// AcceptContext is the same as Accept, but returns ctx.Err() when ctx is
+// done. The session is kept open.
+func (s *Session) AcceptContext(ctx context.Context) (*Stream, error) {
+	select {
+	case st := <-s.acceptCh:
+		return st, nil
+	case <-s.done:
+		return nil, s.closeErr()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Done returns a channel which is closed when the session is closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close closes the session and all streams.
+func (s *Session) Close() error {
+	s.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+func (s *Session) closeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Session) closeWithError(err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		if err == nil || errors.Is(err, io.EOF) {
+			err = ErrSessionClosed
+		} else if !errors.Is(err, ErrSessionClosed) {
+			err = fmt.Errorf("%w: %w", ErrSessionClosed, err)
+		}
+		s.err = err
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.mu.Unlock()
+
+		close(s.done)
+		s.conn.Close()
+		for _, st := range streams {
+			st.handleReset(err)
+		}
+	})
+}
+
+func (s *Session) stream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *Session) writeFrame(typ frameType, id uint32, payload []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	select {
+	case <-s.done:
+		return s.closeErr()
+	default:
+	}
+	s.wbuf = appendFrame(s.wbuf[:0], typ, id, payload)
+	if _, err := s.conn.Write(s.wbuf); err != nil {
+		go s.closeWithError(err)
+		return err
+	}
+	return nil
+}
+
+// writeReset sends RST of the stream with code and reason.
+func (s *Session) writeReset(id uint32, code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > maxPayloadSize {
+		payload = payload[:maxPayloadSize]
+	}
+	return s.writeFrame(frameRST, id, payload)
+}
+
+func (s *Session) readLoop() {
+	s.closeWithError(s.readFrames())
+}
+
+func (s *Session) readFrames() error {
+	r := bufio.NewReader(s.conn)
+	buf := make([]byte, maxPayloadSize)
+	for {
+		h, err := readFrameHeader(r)
+		if err != nil {
+			return err
+		}
+		payload := buf[:h.length]
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return err
+		}
+
+		if h.typ == frameSYN {
+			if err := s.handleSYN(h.streamID, payload); err != nil {
+				return err
+			}
+			continue
+		}
+		st := s.stream(h.streamID)
+		if st == nil {
+			// the stream has been closed already. The peer is told that
+			// nobody reads the data, or it would wait for the window.
+			if h.typ == frameDATA {
+				s.writeReset(h.streamID, 0, streamClosedReason)
+			}
+			continue
+		}
+		switch h.typ {
+		case frameACK:
+			st.handleACK()
+		case frameRST:
+			code, reason := 0, ""
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+				reason = string(payload[2:])
+			}
+			st.handleReset(&StreamError{Code: code, Reason: reason})
+		case frameDATA:
+			if err := st.handleData(payload); err != nil {
+				return err
+			}
+		case frameWindowUpdate:
+			if len(payload) != 4 {
+				return fmt.Errorf("mux: invalid %s frame", h.typ)
+			}
+			if err := st.handleWindowUpdate(binary.BigEndian.Uint32(payload)); err != nil {
+				return err
+			}
+		case frameFIN:
+			st.handleFIN()
+		default:
+			return fmt.Errorf("mux: unexpected frame %s", h.typ)
+		}
+	}
+}
+
+func (s *Session) handleSYN(id uint32, metadata []byte) error {
+	if id == 0 || (id%2 == 1) == s.client {
+		return fmt.Errorf("mux: invalid stream id %d", id)
+	}
+	st := newStream(s, id, append([]byte(nil), metadata...))
+	s.mu.Lock()
+	if _, ok := s.streams[id]; ok {
+		s.mu.Unlock()
+		return fmt.Errorf("mux: stream id %d is already used", id)
+	}
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	select {
+	case s.acceptCh <- st:
+	default:
+		st.reset(503, "too many pending streams")
+	}
+	return nil
+}
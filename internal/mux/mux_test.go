@@ -0,0 +1,261 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newSessions returns the client and server sessions connected each other.
+func newSessions(t *testing.T) (client, server *Session) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	clientConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn := <-accepted
+	if serverConn == nil {
+		t.Fatal("failed to accept")
+	}
+	client, server = Client(clientConn), Server(serverConn)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// serveEcho accepts streams and echoes the data of each stream.
+func serveEcho(s *Session) {
+	for {
+		st, err := s.Accept()
+		if err != nil {
+			return
+		}
+		if string(st.Metadata()) == "reject" {
+			st.Reject(403, "rejected")
+			continue
+		}
+		if err := st.Ack(); err != nil {
+			return
+		}
+		go func() {
+			defer st.Close()
+			io.Copy(st, st)
+		}()
+	}
+}
+
+func open(t *testing.T, s *Session, metadata string) *Stream {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	st, err := s.Open(ctx, []byte(metadata))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.SetDeadline(time.Now().Add(5 * time.Second))
+	return st
+}
+
+func TestSession_streams(t *testing.T) {
+	client, server := newSessions(t)
+	go serveEcho(server)
+
+	// larger than the initial window to test the flow control.
+	payload := bytes.Repeat([]byte("0123456789"), 100*1024)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st, err := client.Open(context.Background(), []byte("echo"))
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer st.Close()
+			st.SetDeadline(time.Now().Add(5 * time.Second))
+			go func() {
+				st.Write(payload)
+				st.CloseWrite()
+			}()
+			got, err := io.ReadAll(st)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(payload, got) {
+				errs <- errors.New("unexpected payload")
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestSession_reject(t *testing.T) {
+	client, server := newSessions(t)
+	go serveEcho(server)
+
+	_, err := client.Open(context.Background(), []byte("reject"))
+	var streamErr *StreamError
+	if !errors.As(err, &streamErr) {
+		t.Fatalf("want StreamError, but got %v", err)
+	}
+	if streamErr.Code != 403 || streamErr.Reason != "rejected" {
+		t.Fatalf("unexpected error: %+v", streamErr)
+	}
+
+	// the session is still available.
+	st := open(t, client, "echo")
+	defer st.Close()
+	if _, err := st.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(st, got); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSession_independentClose(t *testing.T) {
+	client, server := newSessions(t)
+	go serveEcho(server)
+
+	st1 := open(t, client, "echo")
+	st2 := open(t, client, "echo")
+	defer st2.Close()
+
+	st1.Close()
+	if _, err := st1.Write([]byte("hello")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("want ErrClosedPipe, but got %v", err)
+	}
+
+	if _, err := st2.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(st2, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("want %q, but got %q", "hello", got)
+	}
+}
+
+func TestSession_deadline(t *testing.T) {
+	client, server := newSessions(t)
+	go serveEcho(server)
+
+	st := open(t, client, "echo")
+	defer st.Close()
+	st.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("want ErrDeadlineExceeded, but got %v", err)
+	}
+}
+
+func TestSession_close(t *testing.T) {
+	client, server := newSessions(t)
+	go serveEcho(server)
+
+	st := open(t, client, "echo")
+	server.Close()
+
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, ErrSessionClosed) {
+		t.Fatalf("want ErrSessionClosed, but got %v", err)
+	}
+	select {
+	case <-client.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatal("client session is not closed")
+	}
+	if _, err := client.Open(context.Background(), nil); !errors.Is(err, ErrSessionClosed) {
+		t.Fatalf("want ErrSessionClosed, but got %v", err)
+	}
+}
+
+func TestSession_openCanceled(t *testing.T) {
+	client, server := newSessions(t)
+	// the server never accepts the stream.
+	_ = server
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.Open(ctx, []byte("echo")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want DeadlineExceeded, but got %v", err)
+	}
+}
+
+func numStreams(s *Session) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func TestSession_closeWithoutPeerFIN(t *testing.T) {
+	client, server := newSessions(t)
+	accepted := make(chan *Stream, 1)
+	go func() {
+		// the server never closes the stream.
+		st, err := server.Accept()
+		if err != nil {
+			return
+		}
+		st.Ack()
+		accepted <- st
+	}()
+
+	st := open(t, client, "hold")
+	st.Close()
+	if n := numStreams(client); n != 0 {
+		t.Fatalf("want the closed stream to be removed, but %d streams are left", n)
+	}
+
+	// the data which arrives after the close is rejected.
+	peer := <-accepted
+	peer.SetDeadline(time.Now().Add(3 * time.Second))
+	var streamErr *StreamError
+	for deadline := time.Now().Add(3 * time.Second); ; {
+		_, err := peer.Write([]byte("hello"))
+		if errors.As(err, &streamErr) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want StreamError, but got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if streamErr.Reason != streamClosedReason {
+		t.Fatalf("unexpected error: %+v", streamErr)
+	}
+	if n := numStreams(server); n != 0 {
+		t.Fatalf("want the reset stream to be removed, but %d streams are left", n)
+	}
+}
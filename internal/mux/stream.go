@@ -0,0 +1,318 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is a logical connection in the session.
+type Stream struct {
+	id       uint32
+	session  *Session
+	metadata []byte
+	// ackCh receives the result of Open.
+	ackCh chan error
+
+	mu          sync.Mutex
+	readBuf     bytes.Buffer
+	recvWindow  uint32
+	consumed    uint32
+	sendWindow  uint32
+	finSent     bool
+	finReceived bool
+	localClosed bool
+	resetErr    error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readNotify    chan struct{}
+	writeNotify   chan struct{}
+}
+
+var _ interface {
+	net.Conn
+	CloseWrite() error
+} = (*Stream)(nil)
+
+func newStream(s *Session, id uint32, metadata []byte) *Stream {
+	return &Stream{
+		id:          id,
+		session:     s,
+		metadata:    metadata,
+		recvWindow:  initialWindow,
+		sendWindow:  initialWindow,
+		readNotify:  make(chan struct{}, 1),
+		writeNotify: make(chan struct{}, 1),
+	}
+}
+
+// ID returns the stream ID.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Metadata returns the metadata specified by the peer which opened the stream.
+func (st *Stream) Metadata() []byte {
+	return st.metadata
+}
+
+// Ack accepts the stream opened by the peer.
+func (st *Stream) Ack() error {
+	return st.session.writeFrame(frameACK, st.id, nil)
+}
+
+// Reject rejects the stream opened by the peer. The peer receives
+// *StreamError with code and reason.
+func (st *Stream) Reject(code int, reason string) error {
+	return st.reset(code, reason)
+}
+
+// reset sends RST and discards the stream.
+func (st *Stream) reset(code int, reason string) error {
+	st.handleReset(fmt.Errorf("mux: stream is reset by local: %w", io.ErrClosedPipe))
+	return st.session.writeReset(st.id, code, reason)
+}
+
+// Read reads the data sent by the peer.
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.readBuf.Len() > 0 {
+			n, _ := st.readBuf.Read(b)
+			st.consumed += uint32(n)
+			var update uint32
+			if st.consumed >= initialWindow/2 {
+				update = st.consumed
+				st.recvWindow += update
+				st.consumed = 0
+			}
+			st.mu.Unlock()
+			if update > 0 {
+				var payload [4]byte
+				binary.BigEndian.PutUint32(payload[:], update)
+				st.session.writeFrame(frameWindowUpdate, st.id, payload[:])
+			}
+			return n, nil
+		}
+		if st.resetErr != nil {
+			err := st.resetErr
+			st.mu.Unlock()
+			return 0, err
+		}
+		if st.finReceived {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		if st.localClosed {
+			st.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := wait(st.readNotify, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write writes b to the peer. It blocks while the send window is full.
+func (st *Stream) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		st.mu.Lock()
+		if st.resetErr != nil {
+			err := st.resetErr
+			st.mu.Unlock()
+			return written, err
+		}
+		if st.finSent || st.localClosed {
+			st.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := wait(st.writeNotify, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := min(len(b), int(st.sendWindow), maxPayloadSize)
+		st.sendWindow -= uint32(n)
+		st.mu.Unlock()
+
+		if err := st.session.writeFrame(frameDATA, st.id, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite sends FIN. The peer reads io.EOF after the data which has
+// been written.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.finSent || st.resetErr != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.finSent = true
+	st.mu.Unlock()
+	notify(st.writeNotify)
+
+	err := st.session.writeFrame(frameFIN, st.id, nil)
+	st.removeIfDone()
+	return err
+}
+
+// Close sends FIN if it has not been sent yet, and discards the data
+// from the peer. The stream is removed from the session without waiting
+// for FIN from the peer, and the data which arrives later is rejected by
+// RST.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	st.localClosed = true
+	st.readBuf.Reset()
+	st.mu.Unlock()
+	notify(st.readNotify)
+	err := st.CloseWrite()
+	st.session.removeStream(st.id)
+	return err
+}
+
+func (st *Stream) removeIfDone() {
+	st.mu.Lock()
+	done := st.resetErr != nil || (st.finSent && st.finReceived)
+	st.mu.Unlock()
+	if done {
+		st.session.removeStream(st.id)
+	}
+}
+
+func (st *Stream) handleACK() {
+	if st.ackCh == nil {
+		return
+	}
+	select {
+	case st.ackCh <- nil:
+	default:
+	}
+}
+
+func (st *Stream) handleReset(err error) {
+	st.mu.Lock()
+	if st.resetErr == nil {
+		st.resetErr = err
+	}
+	st.readBuf.Reset()
+	st.mu.Unlock()
+	if st.ackCh != nil {
+		select {
+		case st.ackCh <- err:
+		default:
+		}
+	}
+	notify(st.readNotify)
+	notify(st.writeNotify)
+	st.session.removeStream(st.id)
+}
+
+func (st *Stream) handleData(payload []byte) error {
+	st.mu.Lock()
+	if uint32(len(payload)) > st.recvWindow {
+		st.mu.Unlock()
+		return fmt.Errorf("mux: stream %d exceeds the receive window", st.id)
+	}
+	if st.localClosed {
+		st.mu.Unlock()
+		// nobody reads it anymore.
+		st.reset(0, streamClosedReason)
+		return nil
+	}
+	st.recvWindow -= uint32(len(payload))
+	st.readBuf.Write(payload)
+	st.mu.Unlock()
+	notify(st.readNotify)
+	return nil
+}
+
+func (st *Stream) handleWindowUpdate(increment uint32) error {
+	st.mu.Lock()
+	if uint64(st.sendWindow)+uint64(increment) > maxWindow {
+		st.mu.Unlock()
+		return fmt.Errorf("mux: stream %d overflows the send window", st.id)
+	}
+	st.sendWindow += increment
+	st.mu.Unlock()
+	notify(st.writeNotify)
+	return nil
+}
+
+func (st *Stream) handleFIN() {
+	st.mu.Lock()
+	st.finReceived = true
+	st.mu.Unlock()
+	notify(st.readNotify)
+	st.removeIfDone()
+}
+
+func (st *Stream) LocalAddr() net.Addr  { return st.session.conn.LocalAddr() }
+func (st *Stream) RemoteAddr() net.Addr { return st.session.conn.RemoteAddr() }
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	st.SetWriteDeadline(t)
+	return nil
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readNotify)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writeNotify)
+	return nil
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait waits for the notification until deadline.
+func wait(ch <-chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
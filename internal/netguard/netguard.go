@@ -0,0 +1,266 @@
+package netguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ErrBlocked is returned when the destination address is blocked.
+var ErrBlocked = errors.New("destination address is blocked")
+
+// DialContextFunc is the same signature as net.Dialer.DialContext.
+type DialContextFunc = func(ctx context.Context, network string, address string) (net.Conn, error)
+
+// Config is a config to protect bridge from SSRF.
+//
+// Link-local (including cloud metadata servers), loopback, unspecified,
+// multicast addresses and addresses of the bridge itself are always
+// blocked unless they are included in AllowedCIDRs.
+//
+// Unix domain sockets are also on the bridge itself, so that they are
+// blocked unless they are included in AllowedSockets.
+type Config struct {
+	// BlockPrivate blocks private address ranges (RFC 1918, RFC 4193 and RFC 6598).
+	BlockPrivate bool `json:"blockPrivate"`
+	// BlockedCIDRs is additional ranges to block.
+	BlockedCIDRs []string `json:"blockedCIDRs"`
+	// AllowedCIDRs is exceptions. The addresses in these ranges are allowed
+	// even if they are blocked by other settings.
+	AllowedCIDRs []string `json:"allowedCIDRs"`
+	// AllowedSockets is a list of path globs of unix domain sockets which
+	// are allowed to dial, e.g. "/var/run/postgresql/.s.PGSQL.*".
+	AllowedSockets []string `json:"allowedSockets"`
+}
+
+var defaultBlockedCIDRs = []string{
+	"0.0.0.0/8",          // "this" network
+	"127.0.0.0/8",        // loopback
+	"169.254.0.0/16",     // link-local, includes metadata servers (169.254.169.254)
+	"224.0.0.0/4",        // multicast
+	"255.255.255.255/32", // broadcast
+	"::/128",             // unspecified
+	"::1/128",            // loopback
+	"fe80::/10",          // link-local
+	"fd00:ec2::254/128",  // AWS metadata server (IPv6)
+	"ff00::/8",           // multicast
+}
+
+var privateCIDRs = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10", // carrier-grade NAT
+	"fc00::/7",
+}
+
+// Guard checks the destination addresses before dialing.
+type Guard struct {
+	blocked  []netip.Prefix
+	allowed  []netip.Prefix
+	sockets  []string
+	resolver *net.Resolver
+}
+
+// New creates a new guard. If c is nil, the default settings is used.
+func New(c *Config) (*Guard, error) {
+	if c == nil {
+		c = &Config{}
+	}
+	blockedCIDRs := append([]string{}, defaultBlockedCIDRs...)
+	if c.BlockPrivate {
+		blockedCIDRs = append(blockedCIDRs, privateCIDRs...)
+	}
+	blockedCIDRs = append(blockedCIDRs, c.BlockedCIDRs...)
+
+	blocked, err := parsePrefixes(blockedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	selfAddrs, err := interfacePrefixes()
+	if err != nil {
+		return nil, err
+	}
+	blocked = append(blocked, selfAddrs...)
+
+	allowed, err := parsePrefixes(c.AllowedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	for _, pattern := range c.AllowedSockets {
+		// validates the pattern
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid socket pattern %q: %w", pattern, err)
+		}
+	}
+	return &Guard{
+		blocked:  blocked,
+		allowed:  allowed,
+		sockets:  c.AllowedSockets,
+		resolver: net.DefaultResolver,
+	}, nil
+}
+
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	ret := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q: %w", cidr, err)
+		}
+		ret = append(ret, prefix.Masked())
+	}
+	return ret, nil
+}
+
+// interfacePrefixes returns addresses assigned to the bridge itself.
+func interfacePrefixes() ([]netip.Prefix, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get interface addresses: %w", err)
+	}
+	ret := make([]netip.Prefix, 0, len(addrs))
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(ipnet.IP)
+		if !ok {
+			continue
+		}
+		ip = ip.Unmap()
+		ret = append(ret, netip.PrefixFrom(ip, ip.BitLen()))
+	}
+	return ret, nil
+}
+
+// Check returns an error wrapping ErrBlocked if addr is blocked.
+func (g *Guard) Check(addr netip.Addr) error {
+	// the zoned address never matches the prefixes, e.g. "::1%lo".
+	addr = addr.WithZone("").Unmap()
+	for _, prefix := range g.allowed {
+		if prefix.Contains(addr) {
+			return nil
+		}
+	}
+	for _, prefix := range g.blocked {
+		if prefix.Contains(addr) {
+			return fmt.Errorf("%s is in %s: %w", addr, prefix, ErrBlocked)
+		}
+	}
+	return nil
+}
+
+// CheckSocket returns an error wrapping ErrBlocked if the unix domain
+// socket of name is not allowed.
+func (g *Guard) CheckSocket(name string) error {
+	name = path.Clean(name)
+	for _, pattern := range g.sockets {
+		if ok, _ := path.Match(pattern, name); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("socket %q is not allowed: %w", name, ErrBlocked)
+}
+
+// Resolve resolves host only once and checks the all resolved addresses.
+// If any of them is blocked, returns an error wrapping ErrBlocked.
+func (g *Guard) Resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		addrs = []netip.Addr{addr}
+	} else {
+		addrs, err = g.resolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %q: %w", host, err)
+		}
+	}
+	for _, addr := range addrs {
+		if err := g.Check(addr); err != nil {
+			return nil, fmt.Errorf("%q is resolved to blocked address: %w", host, err)
+		}
+	}
+	return addrs, nil
+}
+
+// DialContextFunc wraps dial. The returned function dials to the validated
+// addresses instead of the hostname, so that the second DNS answer cannot
+// be used to bypass the guard (DNS rebinding).
+//
+// The unix domain sockets are dialed only if they are allowed. The other
+// networks than "tcp", "udp" and "unix" families are passed through.
+func (g *Guard) DialContextFunc(dial DialContextFunc) DialContextFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if isUnixNetwork(network) {
+			if err := g.CheckSocket(address); err != nil {
+				return nil, err
+			}
+			return dial(ctx, network, path.Clean(address))
+		}
+		if !isIPNetwork(network) {
+			return dial(ctx, network, address)
+		}
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := g.Resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var firstErr error
+		for _, addr := range filterAddrs(network, addrs) {
+			conn, err := dial(ctx, network, net.JoinHostPort(addr.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("no suitable address found for %q", address)
+		}
+		return nil, firstErr
+	}
+}
+
+func isIPNetwork(network string) bool {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+		return true
+	}
+	return false
+}
+
+func isUnixNetwork(network string) bool {
+	switch network {
+	case "unix", "unixgram", "unixpacket":
+		return true
+	}
+	return false
+}
+
+func filterAddrs(network string, addrs []netip.Addr) []netip.Addr {
+	suffix := network[len(network)-1:]
+	if _, err := strconv.Atoi(suffix); err != nil {
+		return addrs
+	}
+	ret := make([]netip.Addr, 0, len(addrs))
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if (suffix == "4") == addr.Is4() {
+			ret = append(ret, addr)
+		}
+	}
+	return ret
+}
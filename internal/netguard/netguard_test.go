@@ -0,0 +1,180 @@
+package netguard
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestGuard_Check(t *testing.T) {
+	cases := []struct {
+		name    string
+		config  *Config
+		addr    string
+		wantErr bool
+	}{
+		{name: "metadata server", addr: "169.254.169.254", wantErr: true},
+		{name: "loopback", addr: "127.0.0.1", wantErr: true},
+		{name: "loopback (IPv6)", addr: "::1", wantErr: true},
+		{name: "IPv4-mapped loopback", addr: "::ffff:127.0.0.1", wantErr: true},
+		{name: "zoned loopback", addr: "::1%lo", wantErr: true},
+		{name: "zoned link-local", addr: "fe80::1%eth0", wantErr: true},
+		{name: "unspecified", addr: "0.0.0.0", wantErr: true},
+		{name: "metadata server (IPv6)", addr: "fd00:ec2::254", wantErr: true},
+		{name: "public", addr: "192.0.2.10", wantErr: false},
+		{name: "private is allowed by default", addr: "10.123.45.67", wantErr: false},
+		{
+			name:    "block private",
+			config:  &Config{BlockPrivate: true},
+			addr:    "10.123.45.67",
+			wantErr: true,
+		},
+		{
+			name:    "block private (IPv6)",
+			config:  &Config{BlockPrivate: true},
+			addr:    "fd12:3456::1",
+			wantErr: true,
+		},
+		{
+			name:    "blocked cidrs",
+			config:  &Config{BlockedCIDRs: []string{"192.0.2.0/24"}},
+			addr:    "192.0.2.10",
+			wantErr: true,
+		},
+		{
+			name:    "allowed cidrs",
+			config:  &Config{BlockPrivate: true, AllowedCIDRs: []string{"10.123.0.0/16", "127.0.0.1/32"}},
+			addr:    "10.123.45.67",
+			wantErr: false,
+		},
+		{
+			name:    "allowed cidrs (loopback)",
+			config:  &Config{AllowedCIDRs: []string{"127.0.0.1/32"}},
+			addr:    "127.0.0.1",
+			wantErr: false,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			g, err := New(tc.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = g.Check(netip.MustParseAddr(tc.addr))
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("wantErr %v, but got err: %v", tc.wantErr, err)
+			}
+			if err != nil && !errors.Is(err, ErrBlocked) {
+				t.Fatalf("want error %v, but got %v", ErrBlocked, err)
+			}
+		})
+	}
+}
+
+func TestNew_invalid(t *testing.T) {
+	if _, err := New(&Config{BlockedCIDRs: []string{"invalid"}}); err == nil {
+		t.Fatal("want error")
+	}
+	if _, err := New(&Config{AllowedCIDRs: []string{"10.0.0.0/33"}}); err == nil {
+		t.Fatal("want error")
+	}
+	if _, err := New(&Config{AllowedSockets: []string{"/var/run/["}}); err == nil {
+		t.Fatal("want error")
+	}
+}
+
+func TestGuard_DialContextFunc(t *testing.T) {
+	errDialed := errors.New("dialed")
+	var dialed []string
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+		return nil, errDialed
+	}
+
+	cases := []struct {
+		name       string
+		config     *Config
+		network    string
+		address    string
+		wantErr    error
+		wantDialed []string
+	}{
+		{
+			name:    "blocked hostname",
+			network: "tcp",
+			address: "localhost:5432",
+			wantErr: ErrBlocked,
+		},
+		{
+			name:    "blocked address",
+			network: "tcp",
+			address: "169.254.169.254:80",
+			wantErr: ErrBlocked,
+		},
+		{
+			name:    "blocked zoned address",
+			network: "tcp",
+			address: "[::1%lo]:5432",
+			wantErr: ErrBlocked,
+		},
+		{
+			name:       "dials to the validated address instead of the hostname",
+			config:     &Config{AllowedCIDRs: []string{"127.0.0.0/8", "::1/128"}},
+			network:    "tcp4",
+			address:    "localhost:5432",
+			wantErr:    errDialed,
+			wantDialed: []string{"127.0.0.1:5432"},
+		},
+		{
+			name:    "blocked socket",
+			network: "unix",
+			address: "/var/run/docker.sock",
+			wantErr: ErrBlocked,
+		},
+		{
+			name:       "allowed socket",
+			config:     &Config{AllowedSockets: []string{"/var/run/postgresql/.s.PGSQL.*"}},
+			network:    "unix",
+			address:    "/var/run/postgresql/.s.PGSQL.5432",
+			wantErr:    errDialed,
+			wantDialed: []string{"/var/run/postgresql/.s.PGSQL.5432"},
+		},
+		{
+			name:    "socket path is cleaned",
+			config:  &Config{AllowedSockets: []string{"/var/run/postgresql/.s.PGSQL.*"}},
+			network: "unix",
+			address: "/var/run/postgresql/../docker.sock",
+			wantErr: ErrBlocked,
+		},
+		{
+			name:       "not ip network",
+			network:    "ip4:icmp",
+			address:    "192.0.2.1",
+			wantErr:    errDialed,
+			wantDialed: []string{"192.0.2.1"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dialed = nil
+			g, err := New(tc.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = g.DialContextFunc(dial)(context.Background(), tc.network, tc.address)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("want error %v, but got %v", tc.wantErr, err)
+			}
+			if len(dialed) != len(tc.wantDialed) {
+				t.Fatalf("want dialed %v, but got %v", tc.wantDialed, dialed)
+			}
+			for i := range dialed {
+				if dialed[i] != tc.wantDialed[i] {
+					t.Fatalf("want dialed %v, but got %v", tc.wantDialed, dialed)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,386 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ErrDenied is returned when the target is not allowed by the policy.
+var ErrDenied = errors.New("target is not allowed by policy")
+
+// Config is a destination policy which is loaded from the config file.
+//
+// A target is rejected if it matches any of Deny rules. Otherwise it must
+// match at least one of Allow rules.
+type Config struct {
+	Allow []Rule `json:"allow"`
+	Deny  []Rule `json:"deny"`
+}
+
+// Rule matches targets. Empty fields match anything.
+type Rule struct {
+	// Schemes is a list of URL schemes, e.g. "tcp", "https".
+	Schemes []string `json:"schemes"`
+	// Hosts is a list of hostname globs, e.g. "*.internal.example.com".
+	Hosts []string `json:"hosts"`
+	// CIDRs is a list of IP ranges, e.g. "10.0.0.0/8".
+	//
+	// The targets which are specified by hostname are checked against
+	// these when they are dialed, with the addresses which the hostname is
+	// resolved to. So that a hostname only matches allow rules by Hosts
+	// before it is resolved, and the deny rules are enforced at dial time.
+	// The targets dialed through a bastion are resolved by the bastion, so
+	// that they are not checked against these.
+	CIDRs []string `json:"cidrs"`
+	// Ports is a list of ports or port ranges, e.g. "5432", "8000-8999".
+	Ports []string `json:"ports"`
+}
+
+// Policy decides whether bridge can proxy to the target or not.
+type Policy struct {
+	allow    []*rule
+	deny     []*rule
+	resolver *net.Resolver
+}
+
+// New creates a new policy from c. If c is nil, returns nil
+// which allows any targets.
+func New(c *Config) (*Policy, error) {
+	if c == nil {
+		return nil, nil
+	}
+	allow, err := compileRules(c.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allow rule: %w", err)
+	}
+	deny, err := compileRules(c.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("invalid deny rule: %w", err)
+	}
+	return &Policy{
+		allow:    allow,
+		deny:     deny,
+		resolver: net.DefaultResolver,
+	}, nil
+}
+
+// Check returns an error wrapping ErrDenied if target is not allowed.
+func (p *Policy) Check(target *url.URL) error {
+	if p == nil {
+		return nil
+	}
+	return p.check(target, newDestination(target))
+}
+
+func (p *Policy) check(target *url.URL, d *destination) error {
+	for _, r := range p.deny {
+		if r.match(d) {
+			return fmt.Errorf("%q matches deny rule: %w", target.Redacted(), ErrDenied)
+		}
+	}
+	for _, r := range p.allow {
+		if r.match(d) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q does not match any allow rules: %w", target.Redacted(), ErrDenied)
+}
+
+type targetContextKey struct{}
+
+// WithTarget returns a copy of ctx which carries target, so that the
+// addresses which are dialed for target are checked against the rules.
+func WithTarget(ctx context.Context, target *url.URL) context.Context {
+	return context.WithValue(ctx, targetContextKey{}, target)
+}
+
+func targetFromContext(ctx context.Context) *url.URL {
+	u, _ := ctx.Value(targetContextKey{}).(*url.URL)
+	return u
+}
+
+// CheckAddr returns an error wrapping ErrDenied if the target in ctx is not
+// allowed when its host is resolved to addr. If ctx has no target, any
+// addresses are allowed.
+func (p *Policy) CheckAddr(ctx context.Context, addr netip.Addr) error {
+	target := targetFromContext(ctx)
+	if p == nil || target == nil {
+		return nil
+	}
+	d := newDestination(target)
+	d.addr = addr.WithZone("").Unmap()
+	return p.check(target, d)
+}
+
+// hasCIDRs reports whether any rules depend on the addresses.
+func (p *Policy) hasCIDRs() bool {
+	for _, rules := range [][]*rule{p.allow, p.deny} {
+		for _, r := range rules {
+			if len(r.cidrs) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Resolve resolves host of the target in ctx and checks the all resolved
+// addresses. If any of them is not allowed, returns an error wrapping
+// ErrDenied.
+func (p *Policy) Resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		addrs = []netip.Addr{addr}
+	} else {
+		addrs, err = p.resolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %q: %w", host, err)
+		}
+	}
+	return addrs, p.checkAddrs(ctx, host, addrs)
+}
+
+func (p *Policy) checkAddrs(ctx context.Context, host string, addrs []netip.Addr) error {
+	for _, addr := range addrs {
+		if err := p.CheckAddr(ctx, addr); err != nil {
+			return fmt.Errorf("%q is resolved to %s: %w", host, addr, err)
+		}
+	}
+	return nil
+}
+
+// ResolveFunc wraps resolve, which may be nil, so that the resolved
+// addresses are checked against the rules too.
+func (p *Policy) ResolveFunc(resolve func(ctx context.Context, host string) ([]netip.Addr, error)) func(ctx context.Context, host string) ([]netip.Addr, error) {
+	if p == nil || !p.hasCIDRs() {
+		return resolve
+	}
+	if resolve == nil {
+		return p.Resolve
+	}
+	return func(ctx context.Context, host string) ([]netip.Addr, error) {
+		addrs, err := resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		return addrs, p.checkAddrs(ctx, host, addrs)
+	}
+}
+
+// DialContextFunc wraps dial. The returned function resolves the host of
+// the target in ctx and dials to the checked addresses, as the dial guard
+// does. The other networks than "tcp" and "udp" families are passed
+// through.
+func (p *Policy) DialContextFunc(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	if p == nil || !p.hasCIDRs() {
+		return dial
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		switch network {
+		case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+		default:
+			return dial(ctx, network, address)
+		}
+		if targetFromContext(ctx) == nil {
+			return dial(ctx, network, address)
+		}
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := p.Resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var firstErr error
+		for _, addr := range addrs {
+			if (network[len(network)-1] == '4' && !addr.Unmap().Is4()) ||
+				(network[len(network)-1] == '6' && addr.Unmap().Is4()) {
+				continue
+			}
+			conn, err := dial(ctx, network, net.JoinHostPort(addr.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("no suitable address found for %q", address)
+		}
+		return nil, firstErr
+	}
+}
+
+type destination struct {
+	scheme string
+	host   string
+	addr   netip.Addr // invalid if host is not an IP address
+	port   int
+}
+
+// defaultPorts is used when the port is omitted in the target URL.
+var defaultPorts = map[string]int{
+	"http":  80,
+	"https": 443,
+}
+
+func newDestination(u *url.URL) *destination {
+	d := &destination{
+		scheme: strings.ToLower(u.Scheme),
+		host:   strings.ToLower(strings.TrimSuffix(u.Hostname(), ".")),
+	}
+	if addr, err := netip.ParseAddr(d.host); err == nil {
+		// the zone is dropped, or the zoned address never matches CIDRs.
+		d.addr = addr.WithZone("").Unmap()
+	}
+	if port, err := strconv.Atoi(u.Port()); err == nil {
+		d.port = port
+	} else {
+		d.port = defaultPorts[d.scheme]
+	}
+	return d
+}
+
+type portRange struct {
+	from, to int
+}
+
+type rule struct {
+	schemes []string
+	hosts   []string
+	cidrs   []netip.Prefix
+	ports   []portRange
+}
+
+func compileRules(rules []Rule) ([]*rule, error) {
+	ret := make([]*rule, 0, len(rules))
+	for i, r := range rules {
+		compiled, err := compileRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d]: %w", i, err)
+		}
+		ret = append(ret, compiled)
+	}
+	return ret, nil
+}
+
+func compileRule(r Rule) (*rule, error) {
+	ret := &rule{}
+	for _, scheme := range r.Schemes {
+		ret.schemes = append(ret.schemes, strings.ToLower(scheme))
+	}
+	for _, host := range r.Hosts {
+		host = strings.ToLower(host)
+		// validates the pattern
+		if _, err := path.Match(host, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q: %w", host, err)
+		}
+		ret.hosts = append(ret.hosts, host)
+	}
+	for _, cidr := range r.CIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q: %w", cidr, err)
+		}
+		ret.cidrs = append(ret.cidrs, prefix.Masked())
+	}
+	for _, port := range r.Ports {
+		pr, err := parsePortRange(port)
+		if err != nil {
+			return nil, err
+		}
+		ret.ports = append(ret.ports, pr)
+	}
+	return ret, nil
+}
+
+func parsePortRange(s string) (portRange, error) {
+	from, to, found := strings.Cut(s, "-")
+	if !found {
+		to = from
+	}
+	f, err := parsePort(from)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port %q: %w", s, err)
+	}
+	t, err := parsePort(to)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port %q: %w", s, err)
+	}
+	if f > t {
+		return portRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return portRange{from: f, to: t}, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	if port < 0 || port > 65535 {
+		return 0, errors.New("out of range")
+	}
+	return port, nil
+}
+
+func (r *rule) match(d *destination) bool {
+	return r.matchScheme(d) && r.matchHost(d) && r.matchPort(d)
+}
+
+func (r *rule) matchScheme(d *destination) bool {
+	if len(r.schemes) == 0 {
+		return true
+	}
+	for _, scheme := range r.schemes {
+		if scheme == d.scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHost reports whether the host matches either of hosts or cidrs.
+func (r *rule) matchHost(d *destination) bool {
+	if len(r.hosts) == 0 && len(r.cidrs) == 0 {
+		return true
+	}
+	for _, pattern := range r.hosts {
+		if ok, _ := path.Match(pattern, d.host); ok {
+			return true
+		}
+	}
+	if !d.addr.IsValid() {
+		return false
+	}
+	for _, prefix := range r.cidrs {
+		if prefix.Contains(d.addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) matchPort(d *destination) bool {
+	if len(r.ports) == 0 {
+		return true
+	}
+	for _, pr := range r.ports {
+		if pr.from <= d.port && d.port <= pr.to {
+			return true
+		}
+	}
+	return false
+}
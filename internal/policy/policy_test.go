@@ -0,0 +1,219 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"net/url"
+	"testing"
+)
+
+func mustParseURL(rawURL string) *url.URL {
+	u, err := url.ParseRequestURI(rawURL)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+func TestPolicy_Check(t *testing.T) {
+	p, err := New(&Config{
+		Allow: []Rule{
+			{
+				Schemes: []string{"tcp"},
+				CIDRs:   []string{"10.1.0.0/16"},
+				Ports:   []string{"5432", "6379"},
+			},
+			{
+				Schemes: []string{"https"},
+				Hosts:   []string{"*.internal.example.com"},
+			},
+			{
+				Schemes: []string{"http"},
+				Hosts:   []string{"reporting"},
+				Ports:   []string{"8000-8999"},
+			},
+		},
+		Deny: []Rule{
+			{
+				Hosts: []string{"secret.internal.example.com"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		target  string
+		wantErr bool
+	}{
+		{target: "tcp://10.1.2.3:5432", wantErr: false},
+		{target: "tcp://10.1.2.3:6379", wantErr: false},
+		{target: "tcp://10.1.2.3:3306", wantErr: true},
+		{target: "tcp://10.2.2.3:5432", wantErr: true},
+		{target: "http://10.1.2.3:5432", wantErr: true},
+		{target: "https://api.internal.example.com/v1/users", wantErr: false},
+		{target: "https://API.Internal.Example.com./v1/users", wantErr: false},
+		{target: "https://secret.internal.example.com/", wantErr: true},
+		{target: "https://internal.example.com/", wantErr: true},
+		{target: "http://reporting:8080/", wantErr: false},
+		{target: "http://reporting/", wantErr: true},
+		{target: "tcp://db.internal.example.com:5432", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.target, func(t *testing.T) {
+			err := p.Check(mustParseURL(tc.target))
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("wantErr %v, but got err: %v", tc.wantErr, err)
+			}
+			if err != nil && !errors.Is(err, ErrDenied) {
+				t.Fatalf("want error %v, but got %v", ErrDenied, err)
+			}
+		})
+	}
+}
+
+func TestPolicy_Check_nil(t *testing.T) {
+	p, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Check(mustParseURL("tcp://127.0.0.1:5432")); err != nil {
+		t.Fatalf("want nil policy allows any targets, but got %v", err)
+	}
+}
+
+func TestNew_invalid(t *testing.T) {
+	cases := []struct {
+		name string
+		rule Rule
+	}{
+		{name: "invalid cidr", rule: Rule{CIDRs: []string{"10.0.0.0/33"}}},
+		{name: "invalid host pattern", rule: Rule{Hosts: []string{"[a-"}}},
+		{name: "invalid port", rule: Rule{Ports: []string{"http"}}},
+		{name: "invalid port range", rule: Rule{Ports: []string{"9000-8000"}}},
+		{name: "out of range port", rule: Rule{Ports: []string{"65536"}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := New(&Config{Allow: []Rule{tc.rule}}); err == nil {
+				t.Fatal("want error")
+			}
+		})
+	}
+}
+
+func TestPolicy_DialContextFunc(t *testing.T) {
+	p, err := New(&Config{
+		Allow: []Rule{
+			{Hosts: []string{"localhost", "*.internal.example.com"}},
+			{CIDRs: []string{"192.0.2.0/24"}},
+		},
+		Deny: []Rule{
+			{CIDRs: []string{"127.0.0.0/8", "::1/128", "fe80::/10"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errDialed := errors.New("dialed")
+	var dialed []string
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+		return nil, errDialed
+	}
+
+	cases := []struct {
+		name       string
+		target     string
+		network    string
+		address    string
+		wantErr    error
+		wantDialed []string
+	}{
+		{
+			name:    "hostname resolved into denied cidr",
+			target:  "tcp://localhost:5432",
+			network: "tcp",
+			address: "localhost:5432",
+			wantErr: ErrDenied,
+		},
+		{
+			name:    "denied address",
+			target:  "tcp://localhost:5432",
+			network: "tcp",
+			address: "127.0.0.1:5432",
+			wantErr: ErrDenied,
+		},
+		{
+			name:    "zoned address",
+			target:  "tcp://localhost:5432",
+			network: "tcp",
+			address: "[fe80::1%eth0]:5432",
+			wantErr: ErrDenied,
+		},
+		{
+			name:       "allowed address",
+			target:     "tcp://db.internal.example.com:5432",
+			network:    "tcp",
+			address:    "192.0.2.10:5432",
+			wantErr:    errDialed,
+			wantDialed: []string{"192.0.2.10:5432"},
+		},
+		{
+			name:       "no target",
+			network:    "tcp",
+			address:    "localhost:5432",
+			wantErr:    errDialed,
+			wantDialed: []string{"localhost:5432"},
+		},
+		{
+			name:       "unix domain socket",
+			target:     "tcp://localhost:5432",
+			network:    "unix",
+			address:    "/var/run/postgresql/.s.PGSQL.5432",
+			wantErr:    errDialed,
+			wantDialed: []string{"/var/run/postgresql/.s.PGSQL.5432"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dialed = nil
+			ctx := context.Background()
+			if tc.target != "" {
+				ctx = WithTarget(ctx, mustParseURL(tc.target))
+			}
+			_, err := p.DialContextFunc(dial)(ctx, tc.network, tc.address)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("want error %v, but got %v", tc.wantErr, err)
+			}
+			if len(dialed) != len(tc.wantDialed) {
+				t.Fatalf("want dialed %v, but got %v", tc.wantDialed, dialed)
+			}
+			for i := range dialed {
+				if dialed[i] != tc.wantDialed[i] {
+					t.Fatalf("want dialed %v, but got %v", tc.wantDialed, dialed)
+				}
+			}
+		})
+	}
+}
+
+func TestPolicy_ResolveFunc(t *testing.T) {
+	p, err := New(&Config{
+		Allow: []Rule{{Hosts: []string{"*"}}},
+		Deny:  []Rule{{CIDRs: []string{"10.0.0.0/8"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolve := p.ResolveFunc(func(ctx context.Context, host string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("192.0.2.10"), netip.MustParseAddr("10.1.2.3")}, nil
+	})
+	ctx := WithTarget(context.Background(), mustParseURL("https://api.internal.example.com/"))
+	if _, err := resolve(ctx, "api.internal.example.com"); !errors.Is(err, ErrDenied) {
+		t.Fatalf("want error %v, but got %v", ErrDenied, err)
+	}
+}
@@ -0,0 +1,128 @@
+// Package mysql inspects the tunnels of the MySQL client/server protocol.
+//
+// See: https://dev.mysql.com/doc/dev/mysql-server/latest/PAGE_PROTOCOL.html
+package mysql
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxPayloadSize is the max size of the payload of a packet. The larger
+// payload is split into the packets of this size followed by the shorter
+// one.
+const maxPayloadSize = 1<<24 - 1
+
+// Capability flags.
+const (
+	clientCompress        = 1 << 5
+	clientProtocol41      = 1 << 9
+	clientSSL             = 1 << 11
+	clientMultiStatements = 1 << 16
+	clientZstdCompression = 1 << 26
+	clientQueryAttributes = 1 << 27
+)
+
+// Commands.
+const (
+	comQuit             = 0x01
+	comInitDB           = 0x02
+	comQuery            = 0x03
+	comFieldList        = 0x04
+	comStatistics       = 0x09
+	comPing             = 0x0e
+	comStmtPrepare      = 0x16
+	comStmtExecute      = 0x17
+	comStmtSendLongData = 0x18
+	comStmtClose        = 0x19
+	comStmtReset        = 0x1a
+	comSetOption        = 0x1b
+	comStmtFetch        = 0x1c
+	comResetConnection  = 0x1f
+)
+
+const (
+	okPacket  = 0x00
+	errPacket = 0xff
+
+	// authSwitchRequest and authMoreData are sent by the server during
+	// the authentication. The client answers them except for
+	// fastAuthSuccess of caching_sha2_password.
+	authSwitchRequest = 0xfe
+	authMoreData      = 0x01
+	fastAuthSuccess   = 0x03
+
+	// setOptionMultiStatementsOn is the option of COM_SET_OPTION.
+	setOptionMultiStatementsOn = 0
+)
+
+var errMalformed = errors.New("malformed packet")
+
+// readPacket reads a packet and returns its sequence id and payload.
+func readPacket(r io.Reader) (byte, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return header[3], payload, nil
+}
+
+// appendPackets appends payload as the packets which start with seq. It
+// splits payload in the same way as the sender.
+func appendPackets(b []byte, seq byte, payload []byte) []byte {
+	for {
+		n := min(len(payload), maxPayloadSize)
+		b = append(b, byte(n), byte(n>>8), byte(n>>16), seq)
+		b = append(b, payload[:n]...)
+		payload = payload[n:]
+		seq++
+		if n < maxPayloadSize {
+			return b
+		}
+	}
+}
+
+// errorPacket returns ERR_Packet of the protocol 4.1.
+func errorPacket(seq byte, code uint16, sqlState, message string) []byte {
+	payload := []byte{errPacket}
+	payload = binary.LittleEndian.AppendUint16(payload, code)
+	payload = append(payload, '#')
+	payload = append(payload, sqlState...)
+	payload = append(payload, message...)
+	return appendPackets(nil, seq, payload)
+}
+
+// greetingCapabilities returns the offsets of the lower and the upper 2
+// bytes of the capability flags in the initial handshake packet. upper is
+// -1 if the packet has no upper bytes.
+func greetingCapabilities(payload []byte) (lower, upper int, err error) {
+	if len(payload) == 0 || payload[0] != 10 {
+		return 0, 0, fmt.Errorf("unsupported handshake protocol: %w", errMalformed)
+	}
+	i := 1
+	// server version
+	for i < len(payload) && payload[i] != 0 {
+		i++
+	}
+	// null terminator, connection id, auth-plugin-data-part-1, filler
+	lower = i + 1 + 4 + 8 + 1
+	if len(payload) < lower+2 {
+		return 0, 0, fmt.Errorf("short handshake: %w", errMalformed)
+	}
+	// character set and status flags
+	upper = lower + 2 + 1 + 2
+	if len(payload) < upper+2 {
+		upper = -1
+	}
+	return lower, upper, nil
+}
@@ -0,0 +1,373 @@
+package mysql
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/basemachina/bridge/internal/protocol"
+	"github.com/go-logr/logr"
+)
+
+const (
+	// maxStatementSize limits the statement which is buffered to check. It
+	// is the default max_allowed_packet of MySQL 8.0.
+	maxStatementSize = 64 << 20
+
+	// erOptionPreventsStatement is the error code which the server
+	// responds in the read-only mode.
+	erOptionPreventsStatement = 1290
+	sqlStateGeneral           = "HY000"
+)
+
+var (
+	errNotAllowedCommand = errors.New("command is not allowed")
+	errTooLarge          = errors.New("statement is too large to check")
+	errCapability        = errors.New("unsupported client capability")
+	errUnexpectedPacket  = errors.New("unexpected packet before authentication")
+)
+
+// allowedCommands are the commands which do not write anything by
+// themselves. COM_QUERY, COM_STMT_PREPARE and COM_SET_OPTION are checked
+// further.
+var allowedCommands = map[byte]bool{
+	comQuit:             true,
+	comInitDB:           true,
+	comQuery:            true,
+	comFieldList:        true,
+	comStatistics:       true,
+	comPing:             true,
+	comStmtPrepare:      true,
+	comStmtExecute:      true,
+	comStmtSendLongData: true,
+	comStmtClose:        true,
+	comStmtReset:        true,
+	comSetOption:        true,
+	comStmtFetch:        true,
+	comResetConnection:  true,
+}
+
+// ReadOnlyFilter rejects the statements which are not read-only in the
+// tunnels. Only a single SELECT, SHOW or EXPLAIN statement is forwarded by
+// COM_QUERY and COM_STMT_PREPARE. The other statements and the commands
+// which may change the server are answered with ERR_Packet by bridge, and
+// the connection is kept usable.
+//
+// To inspect the commands, it removes the capabilities of TLS, compression
+// and query attributes from the initial handshake, and the capability of
+// multiple statements from the handshake response. Before the server
+// accepts the authentication, only the packets which answer the requests
+// of the server are forwarded, and the others are held until it.
+//
+// The filter cannot know what the stored functions called by SELECT do, so
+// the database user should be read-only as well.
+type ReadOnlyFilter struct {
+	logger logr.Logger
+}
+
+var _ protocol.Interceptor = (*ReadOnlyFilter)(nil)
+
+// NewReadOnlyFilter creates a new filter which logs the rejected commands
+// to logger.
+func NewReadOnlyFilter(logger logr.Logger) *ReadOnlyFilter {
+	return &ReadOnlyFilter{logger: logger}
+}
+
+// Intercept implements protocol.Interceptor.
+func (f *ReadOnlyFilter) Intercept(s *protocol.Session, client, target net.Conn) (net.Conn, net.Conn, error) {
+	rs := &readOnlySession{
+		logger: f.logger.WithValues("tenant", s.TenantID, "target", s.Target),
+		client: protocol.NewSyncWriter(client),
+	}
+	rs.cond = sync.NewCond(&rs.mu)
+	return &protocol.Conn{
+			Conn:   client,
+			Reader: &commandReader{s: rs, r: bufio.NewReader(client)},
+			Writer: rs.client,
+		},
+		&protocol.Conn{
+			Conn:   target,
+			Reader: &handshakeReader{s: rs, r: bufio.NewReader(target)},
+		},
+		nil
+}
+
+type readOnlySession struct {
+	logger logr.Logger
+	client *protocol.SyncWriter
+	// commandPhase is set when the server accepts the authentication.
+	commandPhase atomic.Bool
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// authPending is set while the server waits for the client to answer
+	// with the packet of authSeq.
+	authPending bool
+	authSeq     byte
+	// authErr is set when the server is closed before the authentication
+	// is accepted.
+	authErr error
+}
+
+// requestAuth is called when the server sends the packet of seq which the
+// client answers.
+func (s *readOnlySession) requestAuth(seq byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authPending, s.authSeq = true, seq+1
+	s.cond.Broadcast()
+}
+
+// acceptAuth is called when the server accepts the authentication.
+func (s *readOnlySession) acceptAuth() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authPending = false
+	s.commandPhase.Store(true)
+	s.cond.Broadcast()
+}
+
+// closeAuth is called when the server is closed before the authentication
+// is accepted.
+func (s *readOnlySession) closeAuth(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.authErr == nil {
+		s.authErr = err
+	}
+	s.cond.Broadcast()
+}
+
+// awaitAuth blocks until the server requests the client to answer, or
+// accepts the authentication. If the request is pending, it returns the
+// sequence id of the answer and true. Otherwise, the next packet is the
+// command after the authentication.
+func (s *readOnlySession) awaitAuth() (byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.authPending && !s.commandPhase.Load() && s.authErr == nil {
+		s.cond.Wait()
+	}
+	switch {
+	case s.authPending:
+		s.authPending = false
+		return s.authSeq, true, nil
+	case s.commandPhase.Load():
+		return 0, false, nil
+	}
+	return 0, false, s.authErr
+}
+
+// reject responds ERR_Packet to the client.
+func (s *readOnlySession) reject(seq byte, err error) error {
+	_, werr := s.client.Write(errorPacket(seq, erOptionPreventsStatement, sqlStateGeneral, "bridge: "+err.Error()))
+	return werr
+}
+
+// commandReader reads the packets from the client and returns the ones
+// which are allowed.
+type commandReader struct {
+	s         *readOnlySession
+	r         *bufio.Reader
+	responded bool // the handshake response is read
+	continued bool // the previous packet is continued to the next one
+	out       []byte
+}
+
+func (r *commandReader) Read(b []byte) (int, error) {
+	for len(r.out) == 0 {
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *commandReader) next() error {
+	seq, payload, err := readPacket(r.r)
+	if err != nil {
+		return err
+	}
+	continued := r.continued
+	r.continued = len(payload) == maxPayloadSize
+	if !continued && !r.s.commandPhase.Load() {
+		// the commands must not be pipelined before the authentication
+		// is accepted, so that the packet is held until the server
+		// requests it.
+		authSeq, auth, err := r.s.awaitAuth()
+		if err != nil {
+			return err
+		}
+		if auth {
+			switch {
+			case seq != authSeq:
+				err = errUnexpectedPacket
+			case r.continued:
+				err = errMalformed
+			case !r.responded:
+				r.responded = true
+				err = checkHandshakeResponse(payload)
+			}
+			if err != nil {
+				r.s.logger.Info("rejected connection", "reason", err.Error())
+				r.s.reject(seq+1, err)
+				return err
+			}
+			r.out = appendPackets(r.out[:0], seq, payload)
+			return nil
+		}
+	}
+	switch {
+	case continued:
+		// the rest of the command which is allowed
+	default:
+		if r.continued {
+			seq, payload, err = r.readLarge(seq, payload)
+			if err != nil {
+				return err
+			}
+		}
+		if err := checkCommand(payload); err != nil {
+			r.s.logger.Info("rejected command", "statement", statementOf(payload), "reason", err.Error())
+			return r.s.reject(seq+1, err)
+		}
+		r.out = appendPackets(r.out[:0], seq-byte(len(payload)/maxPayloadSize), payload)
+		return nil
+	}
+	r.out = appendPackets(r.out[:0], seq, payload)
+	return nil
+}
+
+// readLarge reads the rest of the command which is split into multiple
+// packets, and returns the last sequence id and the whole payload. If the
+// command is too large to check, it is discarded and the payload is nil.
+func (r *commandReader) readLarge(seq byte, payload []byte) (byte, []byte, error) {
+	for r.continued {
+		next, p, err := readPacket(r.r)
+		if err != nil {
+			return 0, nil, err
+		}
+		seq = next
+		r.continued = len(p) == maxPayloadSize
+		if payload != nil && len(payload)+len(p) <= maxStatementSize {
+			payload = append(payload, p...)
+		} else {
+			payload = nil
+		}
+	}
+	return seq, payload, nil
+}
+
+// checkHandshakeResponse checks the capabilities of the client, and clears
+// the capability of multiple statements in place.
+func checkHandshakeResponse(payload []byte) error {
+	if len(payload) < 4 {
+		return errMalformed
+	}
+	flags := binary.LittleEndian.Uint32(payload)
+	switch {
+	case flags&clientProtocol41 == 0:
+		return fmt.Errorf("protocol 4.1 is required: %w", errCapability)
+	case flags&clientSSL != 0:
+		return fmt.Errorf("TLS cannot be inspected: %w", errCapability)
+	case flags&(clientCompress|clientZstdCompression) != 0:
+		return fmt.Errorf("compression cannot be inspected: %w", errCapability)
+	case flags&clientQueryAttributes != 0:
+		return fmt.Errorf("query attributes cannot be inspected: %w", errCapability)
+	}
+	binary.LittleEndian.PutUint32(payload, flags&^clientMultiStatements)
+	return nil
+}
+
+// checkCommand returns an error if the command is not allowed.
+func checkCommand(payload []byte) error {
+	if payload == nil {
+		return errTooLarge
+	}
+	if len(payload) == 0 {
+		return errMalformed
+	}
+	cmd := payload[0]
+	if !allowedCommands[cmd] {
+		return fmt.Errorf("0x%02x: %w", cmd, errNotAllowedCommand)
+	}
+	switch cmd {
+	case comQuery, comStmtPrepare:
+		return checkStatement(string(payload[1:]))
+	case comSetOption:
+		if len(payload) >= 3 && binary.LittleEndian.Uint16(payload[1:]) == setOptionMultiStatementsOn {
+			return errMultiStatements
+		}
+	}
+	return nil
+}
+
+func statementOf(payload []byte) string {
+	if len(payload) == 0 || (payload[0] != comQuery && payload[0] != comStmtPrepare) {
+		return ""
+	}
+	return string(payload[1:])
+}
+
+// handshakeReader reads the packets from the server and removes the
+// capabilities which cannot be inspected from the initial handshake. The
+// packets after the authentication are read as is.
+type handshakeReader struct {
+	s       *readOnlySession
+	r       *bufio.Reader
+	greeted bool
+	out     []byte
+}
+
+func (r *handshakeReader) Read(b []byte) (int, error) {
+	if len(r.out) == 0 && r.s.commandPhase.Load() {
+		return r.r.Read(b)
+	}
+	for len(r.out) == 0 {
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *handshakeReader) next() error {
+	seq, payload, err := readPacket(r.r)
+	if err != nil {
+		r.s.closeAuth(err)
+		return err
+	}
+	switch {
+	case len(payload) > 0 && payload[0] == errPacket:
+	case !r.greeted:
+		r.greeted = true
+		r.s.requestAuth(seq)
+		lower, upper, err := greetingCapabilities(payload)
+		if err != nil {
+			return err
+		}
+		flags := binary.LittleEndian.Uint16(payload[lower:])
+		binary.LittleEndian.PutUint16(payload[lower:], flags&^clientSSL&^clientCompress)
+		if upper >= 0 {
+			const mask = (clientZstdCompression | clientQueryAttributes) >> 16
+			flags := binary.LittleEndian.Uint16(payload[upper:])
+			binary.LittleEndian.PutUint16(payload[upper:], flags&^mask)
+		}
+	case len(payload) > 0 && payload[0] == okPacket:
+		r.s.acceptAuth()
+	case len(payload) > 0 && payload[0] == authSwitchRequest,
+		len(payload) > 0 && payload[0] == authMoreData && !bytes.Equal(payload, []byte{authMoreData, fastAuthSuccess}):
+		r.s.requestAuth(seq)
+	}
+	r.out = appendPackets(r.out[:0], seq, payload)
+	return nil
+}
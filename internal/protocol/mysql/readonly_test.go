@@ -0,0 +1,245 @@
+package mysql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/basemachina/bridge/internal/protocol"
+	"github.com/basemachina/bridge/internal/testlogr"
+)
+
+// startFilter returns the client and the server which are connected through
+// the filter.
+func startFilter(t *testing.T) (clientPeer, serverPeer net.Conn) {
+	t.Helper()
+	client, clientPeer := net.Pipe()
+	target, serverPeer := net.Pipe()
+	c, tc, err := NewReadOnlyFilter(testlogr.Logger).Intercept(&protocol.Session{Target: "tcp://db:3306"}, client, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		io.Copy(tc, c)
+		tc.Close()
+	}()
+	go func() {
+		io.Copy(c, tc)
+		c.Close()
+	}()
+	deadline := time.Now().Add(3 * time.Second)
+	clientPeer.SetDeadline(deadline)
+	serverPeer.SetDeadline(deadline)
+	t.Cleanup(func() {
+		clientPeer.Close()
+		serverPeer.Close()
+	})
+	return clientPeer, serverPeer
+}
+
+func writePacket(t *testing.T, conn net.Conn, seq byte, payload []byte) {
+	t.Helper()
+	if _, err := conn.Write(appendPackets(nil, seq, payload)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectPacket(t *testing.T, conn net.Conn, wantSeq byte) []byte {
+	t.Helper()
+	seq, payload, err := readPacket(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != wantSeq {
+		t.Fatalf("want sequence id %d, but got %d", wantSeq, seq)
+	}
+	return payload
+}
+
+func expectError(t *testing.T, conn net.Conn, wantSeq byte) {
+	t.Helper()
+	payload := expectPacket(t, conn, wantSeq)
+	if payload[0] != errPacket || binary.LittleEndian.Uint16(payload[1:]) != erOptionPreventsStatement {
+		t.Fatalf("want ERR_Packet, but got %q", payload)
+	}
+}
+
+func greeting(flags uint32) []byte {
+	b := []byte{10}
+	b = append(b, "8.0.36\x00"...)
+	b = binary.LittleEndian.AppendUint32(b, 1)
+	b = append(b, "12345678"...)
+	b = append(b, 0)
+	b = binary.LittleEndian.AppendUint16(b, uint16(flags))
+	b = append(b, 0xff, 2, 0)
+	b = binary.LittleEndian.AppendUint16(b, uint16(flags>>16))
+	b = append(b, 21)
+	b = append(b, make([]byte, 10)...)
+	b = append(b, "901234567890\x00mysql_native_password\x00"...)
+	return b
+}
+
+func handshakeResponse(flags uint32) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, flags)
+	b = binary.LittleEndian.AppendUint32(b, 1<<24)
+	b = append(b, 0xff)
+	b = append(b, make([]byte, 23)...)
+	b = append(b, "reader\x00"...)
+	return b
+}
+
+func query(cmd byte, q string) []byte {
+	return append([]byte{cmd}, q...)
+}
+
+func handshake(t *testing.T, client, server net.Conn) {
+	t.Helper()
+	writePacket(t, server, 0, greeting(clientProtocol41|clientSSL|clientCompress|clientMultiStatements|clientQueryAttributes))
+	g := expectPacket(t, client, 0)
+	lower, upper, err := greetingCapabilities(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := uint32(binary.LittleEndian.Uint16(g[lower:])) | uint32(binary.LittleEndian.Uint16(g[upper:]))<<16
+	if want := uint32(clientProtocol41 | clientMultiStatements); flags != want {
+		t.Fatalf("want capabilities 0x%x, but got 0x%x", want, flags)
+	}
+
+	writePacket(t, client, 1, handshakeResponse(clientProtocol41|clientMultiStatements))
+	resp := expectPacket(t, server, 1)
+	if got := binary.LittleEndian.Uint32(resp); got != clientProtocol41 {
+		t.Fatalf("want capabilities 0x%x, but got 0x%x", clientProtocol41, got)
+	}
+	writePacket(t, server, 2, []byte{okPacket, 0, 0, 2, 0, 0, 0})
+	expectPacket(t, client, 2)
+}
+
+func TestReadOnlyFilter(t *testing.T) {
+	client, server := startFilter(t)
+	handshake(t, client, server)
+
+	// rejected without forwarding to the server.
+	writePacket(t, client, 0, query(comQuery, "DELETE FROM orders"))
+	expectError(t, client, 1)
+	writePacket(t, client, 0, query(comQuery, "SELECT 1; DROP TABLE orders"))
+	expectError(t, client, 1)
+	writePacket(t, client, 0, query(comStmtPrepare, "UPDATE orders SET paid = ?"))
+	expectError(t, client, 1)
+	writePacket(t, client, 0, []byte{comSetOption, setOptionMultiStatementsOn, 0})
+	expectError(t, client, 1)
+	// COM_CHANGE_USER
+	writePacket(t, client, 0, append([]byte{0x11}, "root\x00"...))
+	expectError(t, client, 1)
+
+	// the connection is still usable.
+	want := query(comQuery, "SELECT * FROM orders")
+	writePacket(t, client, 0, want)
+	if got := expectPacket(t, server, 0); !bytes.Equal(got, want) {
+		t.Fatalf("want %q, but got %q", want, got)
+	}
+	writePacket(t, server, 1, []byte{okPacket, 0, 0, 2, 0, 0, 0})
+	expectPacket(t, client, 1)
+
+	want = []byte{comPing}
+	writePacket(t, client, 0, want)
+	if got := expectPacket(t, server, 0); !bytes.Equal(got, want) {
+		t.Fatalf("want %q, but got %q", want, got)
+	}
+}
+
+func TestReadOnlyFilter_largeStatement(t *testing.T) {
+	client, server := startFilter(t)
+	handshake(t, client, server)
+
+	// the statement is split into 2 packets.
+	want := query(comQuery, "SELECT '"+string(bytes.Repeat([]byte{'a'}, maxPayloadSize))+"'")
+	go client.Write(appendPackets(nil, 0, want))
+	var got []byte
+	for seq := byte(0); ; seq++ {
+		p := expectPacket(t, server, seq)
+		got = append(got, p...)
+		if len(p) < maxPayloadSize {
+			break
+		}
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("want %d bytes, but got %d bytes", len(want), len(got))
+	}
+}
+
+func TestReadOnlyFilter_pipelined(t *testing.T) {
+	client, server := startFilter(t)
+	writePacket(t, server, 0, greeting(clientProtocol41))
+	expectPacket(t, client, 0)
+
+	// the commands are sent before the authentication is accepted.
+	written := make(chan error, 1)
+	go func() {
+		b := appendPackets(nil, 1, handshakeResponse(clientProtocol41))
+		b = appendPackets(b, 0, query(comQuery, "DROP TABLE orders"))
+		b = appendPackets(b, 0, query(comQuery, "SELECT 1"))
+		_, err := client.Write(b)
+		written <- err
+	}()
+	expectPacket(t, server, 1)
+
+	// the server switches the authentication method, and the client
+	// answers it.
+	writePacket(t, server, 2, append([]byte{authSwitchRequest}, "caching_sha2_password\x00"...))
+	expectPacket(t, client, 2)
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	// the pipelined command does not answer the request.
+	expectError(t, client, 1)
+	if _, _, err := readPacket(server); err != io.EOF {
+		t.Fatalf("want EOF, but got %v", err)
+	}
+}
+
+func TestReadOnlyFilter_heldCommand(t *testing.T) {
+	client, server := startFilter(t)
+	writePacket(t, server, 0, greeting(clientProtocol41))
+	expectPacket(t, client, 0)
+
+	written := make(chan error, 1)
+	go func() {
+		b := appendPackets(nil, 1, handshakeResponse(clientProtocol41))
+		b = appendPackets(b, 0, query(comQuery, "DROP TABLE orders"))
+		_, err := client.Write(b)
+		written <- err
+	}()
+	expectPacket(t, server, 1)
+	// the fast authentication of caching_sha2_password is not answered.
+	writePacket(t, server, 2, []byte{authMoreData, fastAuthSuccess})
+	expectPacket(t, client, 2)
+	writePacket(t, server, 3, []byte{okPacket, 0, 0, 2, 0, 0, 0})
+	expectPacket(t, client, 3)
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	// the held command is checked after the authentication.
+	expectError(t, client, 1)
+	want := []byte{comPing}
+	writePacket(t, client, 0, want)
+	if got := expectPacket(t, server, 0); !bytes.Equal(got, want) {
+		t.Fatalf("want %q, but got %q", want, got)
+	}
+}
+
+func TestReadOnlyFilter_tls(t *testing.T) {
+	client, server := startFilter(t)
+	writePacket(t, server, 0, greeting(clientProtocol41|clientSSL))
+	expectPacket(t, client, 0)
+
+	// SSLRequest
+	writePacket(t, client, 1, handshakeResponse(clientProtocol41 | clientSSL)[:32])
+	expectError(t, client, 2)
+	if _, _, err := readPacket(server); err != io.EOF {
+		t.Fatalf("want EOF, but got %v", err)
+	}
+}
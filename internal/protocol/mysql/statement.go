@@ -0,0 +1,156 @@
+package mysql
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	errNotReadOnly        = errors.New("statement is not read-only")
+	errMultiStatements    = errors.New("multiple statements are not allowed")
+	errExecutableComment  = errors.New("executable comment is not allowed")
+	errUnterminated       = errors.New("unterminated quote or comment")
+	errIntoFile           = errors.New("writing to file is not allowed")
+	errAnalyzeNotReadOnly = errors.New("EXPLAIN ANALYZE executes the statement which is not read-only")
+)
+
+// readOnlyKeywords are the first keywords of the statements which are
+// allowed.
+var readOnlyKeywords = map[string]bool{
+	"SELECT":  true,
+	"SHOW":    true,
+	"EXPLAIN": true,
+}
+
+// checkStatement returns an error if query is not a single read-only
+// statement.
+//
+// The server treats backslashes in strings as escape characters unless
+// NO_BACKSLASH_ESCAPES is set, and some multibyte character sets contain
+// the backslash byte. So the query is checked in both ways.
+func checkStatement(query string) error {
+	for _, backslash := range []bool{true, false} {
+		words, err := scanWords(query, backslash)
+		if err != nil {
+			return err
+		}
+		if err := checkWords(words); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkWords(words []string) error {
+	if len(words) == 0 {
+		// the server responds an error for the empty query.
+		return nil
+	}
+	if !readOnlyKeywords[words[0]] {
+		return errNotReadOnly
+	}
+	for _, w := range words {
+		if w == "OUTFILE" || w == "DUMPFILE" {
+			return errIntoFile
+		}
+	}
+	if words[0] == "EXPLAIN" && len(words) > 1 && words[1] == "ANALYZE" {
+		rest := words[2:]
+		if len(rest) > 1 && rest[0] == "FORMAT" {
+			rest = rest[2:]
+		}
+		if len(rest) == 0 || rest[0] != "SELECT" {
+			return errAnalyzeNotReadOnly
+		}
+	}
+	return nil
+}
+
+// scanWords returns the unquoted words in query in upper case. Quoted
+// strings, quoted identifiers and comments are skipped. If backslash is
+// true, backslashes in quoted strings escape the next character.
+func scanWords(query string, backslash bool) ([]string, error) {
+	var (
+		words []string
+		ended bool // the first statement is terminated by ";"
+	)
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			i++
+			continue
+		case c == '#' || (c == '-' && strings.HasPrefix(query[i:], "--") && (i+2 == len(query) || query[i+2] <= ' ')):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				return words, nil
+			}
+			i += end + 1
+			continue
+		case strings.HasPrefix(query[i:], "/*"):
+			if strings.HasPrefix(query[i+2:], "!") || strings.HasPrefix(query[i+2:], "M!") {
+				// MySQL and MariaDB execute the content of the comment.
+				return nil, errExecutableComment
+			}
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return nil, errUnterminated
+			}
+			i += 2 + end + 2
+			continue
+		}
+
+		if ended {
+			return nil, errMultiStatements
+		}
+		switch {
+		case c == ';':
+			ended = true
+			i++
+		case c == '\'' || c == '"' || c == '`':
+			end, err := skipQuoted(query, i, backslash && c != '`')
+			if err != nil {
+				return nil, err
+			}
+			i = end
+		case isWordChar(c):
+			start := i
+			for i < len(query) && isWordChar(query[i]) {
+				i++
+			}
+			words = append(words, strings.ToUpper(query[start:i]))
+		default:
+			i++
+		}
+	}
+	return words, nil
+}
+
+// skipQuoted returns the index after the quoted part which starts at
+// query[start]. The quote is escaped by doubling it.
+func skipQuoted(query string, start int, backslash bool) (int, error) {
+	quote := query[start]
+	for i := start + 1; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			if backslash {
+				i++
+			}
+		case quote:
+			if i+1 < len(query) && query[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1, nil
+		}
+	}
+	return 0, errUnterminated
+}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' ||
+		c >= 'A' && c <= 'Z' ||
+		c >= '0' && c <= '9' ||
+		c == '_' || c == '$' || c == '@' ||
+		c >= 0x80
+}
@@ -0,0 +1,49 @@
+package mysql
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckStatement(t *testing.T) {
+	cases := []struct {
+		query   string
+		wantErr error
+	}{
+		{query: "SELECT * FROM orders"},
+		{query: "  select id from orders where note = 'DELETE FROM orders';"},
+		{query: "SHOW TABLES"},
+		{query: "EXPLAIN UPDATE orders SET paid = 1"},
+		{query: "EXPLAIN ANALYZE SELECT * FROM orders"},
+		{query: "EXPLAIN ANALYZE FORMAT=TREE SELECT * FROM orders"},
+		{query: "/* comment */ SELECT 1 -- trailing comment"},
+		{query: "# comment\nSELECT 1;  # done"},
+		{query: "SELECT /*+ MAX_EXECUTION_TIME(1000) */ 1"},
+		{query: "SELECT 'it''s', \"a\"\"b\", `weird``name` FROM t"},
+		{query: "SELECT 1 --1"},
+		{query: ""},
+		{query: "DELETE FROM orders", wantErr: errNotReadOnly},
+		{query: "update orders set paid = 1", wantErr: errNotReadOnly},
+		{query: "WITH x AS (SELECT 1) DELETE FROM orders", wantErr: errNotReadOnly},
+		{query: "-- SELECT\nDROP TABLE orders", wantErr: errNotReadOnly},
+		{query: "SELECT 1; DELETE FROM orders", wantErr: errMultiStatements},
+		{query: "SELECT 1; SELECT 2", wantErr: errMultiStatements},
+		{query: "SELECT 1 --1; DELETE FROM orders", wantErr: errMultiStatements},
+		{query: "SELECT * FROM orders INTO OUTFILE '/tmp/orders'", wantErr: errIntoFile},
+		{query: "SELECT 1 /*!50000 INTO DUMPFILE '/tmp/x' */", wantErr: errExecutableComment},
+		{query: "/*!DELETE FROM orders*/", wantErr: errExecutableComment},
+		{query: "EXPLAIN ANALYZE DELETE FROM orders", wantErr: errAnalyzeNotReadOnly},
+		{query: "SELECT 'unterminated", wantErr: errUnterminated},
+		{query: "SELECT 1 /* unterminated", wantErr: errUnterminated},
+		// the server without NO_BACKSLASH_ESCAPES sees a single statement,
+		// but the one with it sees two statements.
+		{query: `SELECT 'a\'; DELETE FROM orders; -- '`, wantErr: errMultiStatements},
+	}
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			if err := checkStatement(tc.query); !errors.Is(err, tc.wantErr) {
+				t.Fatalf("want error %v, but got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,346 @@
+package postgres
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/basemachina/bridge/internal/protocol"
+	"github.com/go-logr/logr"
+)
+
+const (
+	// maxStatements limits the prepared statements and the portals which
+	// are remembered per connection.
+	maxStatements = 1024
+	// maxPending limits the requests which are waiting for the responses.
+	maxPending = 10000
+)
+
+// Auditor emits the audit events of the queries in the tunnels. It only
+// observes the bytes and never changes them.
+//
+// The events are logged with the message "query" and the keys "user",
+// "database", "statement", "rows", "duration" and "error" if failed.
+type Auditor struct {
+	logger logr.Logger
+}
+
+var _ protocol.Interceptor = (*Auditor)(nil)
+
+// NewAuditor creates a new auditor which logs the events to logger.
+func NewAuditor(logger logr.Logger) *Auditor {
+	return &Auditor{logger: logger}
+}
+
+// Intercept implements protocol.Interceptor.
+func (a *Auditor) Intercept(s *protocol.Session, client, target net.Conn) (net.Conn, net.Conn, error) {
+	as := newAuditSession(a.logger.WithValues("tenant", s.TenantID, "target", s.Target))
+	return &protocol.Conn{Conn: client, Reader: io.TeeReader(client, feedFunc(as.feedFrontend))},
+		&protocol.Conn{Conn: target, Reader: io.TeeReader(target, feedFunc(as.feedBackend))},
+		nil
+}
+
+// feedFunc is an io.Writer which never fails, so that the failure of the
+// audit does not break the tunnel.
+type feedFunc func(p []byte)
+
+func (f feedFunc) Write(p []byte) (int, error) {
+	f(p)
+	return len(p), nil
+}
+
+type requestKind int
+
+const (
+	requestQuery requestKind = iota
+	requestParse
+	requestBind
+	requestExecute
+	requestSync
+)
+
+// request is the message of the frontend which is waiting for the response.
+type request struct {
+	kind      requestKind
+	statement string
+	start     time.Time
+	rows      int64
+	err       string
+}
+
+// auditSession follows the messages of a connection.
+type auditSession struct {
+	logger logr.Logger
+
+	mu      sync.Mutex
+	stopped bool
+	// awaitingResponse is true while the frontend waits for the single
+	// byte response of SSLRequest or GSSENCRequest.
+	awaitingResponse bool
+	frontend         stream
+	backend          stream
+	authenticated    bool
+	user             string
+	database         string
+	statements       map[string]string
+	portals          map[string]string
+	pending          []*request
+}
+
+func newAuditSession(logger logr.Logger) *auditSession {
+	s := &auditSession{
+		logger:     logger,
+		statements: make(map[string]string),
+		portals:    make(map[string]string),
+	}
+	s.frontend = stream{
+		untyped: true,
+		want: func(typ byte) bool {
+			return strings.IndexByte("QPBESC", typ) >= 0
+		},
+		handle: s.handleFrontend,
+	}
+	s.backend = stream{
+		want: func(typ byte) bool {
+			return strings.IndexByte("R12CIsEZ", typ) >= 0
+		},
+		handle: s.handleBackend,
+	}
+	return s
+}
+
+func (s *auditSession) feedFrontend(p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	if err := s.frontend.feed(p); err != nil {
+		s.fail(err)
+	}
+}
+
+func (s *auditSession) feedBackend(p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped || len(p) == 0 {
+		return
+	}
+	if s.awaitingResponse {
+		s.awaitingResponse = false
+		if p[0] != 'N' {
+			// the rest of the connection is encrypted.
+			s.logger.Info("skipped audit of encrypted connection")
+			s.stopped = true
+			return
+		}
+		p = p[1:]
+	}
+	if err := s.backend.feed(p); err != nil {
+		s.fail(err)
+	}
+}
+
+// fail stops the audit of the connection. The tunnel is kept as is.
+func (s *auditSession) fail(err error) {
+	s.logger.Error(err, "stopped audit of connection")
+	s.stopped = true
+}
+
+func (s *auditSession) handleFrontend(typ byte, body []byte) error {
+	if typ == 0 {
+		return s.handleStartup(body)
+	}
+	r := &reader{b: body}
+	switch typ {
+	case 'Q':
+		return s.push(requestQuery, r.string())
+	case 'P':
+		name := r.string()
+		query := r.string()
+		remember(s.statements, name, query)
+		return s.push(requestParse, query)
+	case 'B':
+		portal := r.string()
+		statement := s.statements[r.string()]
+		remember(s.portals, portal, statement)
+		return s.push(requestBind, statement)
+	case 'E':
+		return s.push(requestExecute, s.portals[r.string()])
+	case 'S':
+		return s.push(requestSync, "")
+	case 'C':
+		// Close
+		kind, name := r.byte(), r.string()
+		if kind == 'S' {
+			delete(s.statements, name)
+		} else {
+			delete(s.portals, name)
+		}
+	}
+	return r.err
+}
+
+func (s *auditSession) handleStartup(body []byte) error {
+	if len(body) < 4 {
+		return errMalformed
+	}
+	switch code := binary.BigEndian.Uint32(body); {
+	case code == sslRequestCode, code == gssEncRequestCode:
+		s.awaitingResponse = true
+	case code == cancelRequestCode:
+		// the connection is closed without any other messages.
+		s.stopped = true
+	case code>>16 == protocolVersion3>>16:
+		params, err := parseStartup(body)
+		if err != nil {
+			return err
+		}
+		s.user = params["user"]
+		s.database = params["database"]
+		if s.database == "" {
+			s.database = s.user
+		}
+		s.frontend.untyped = false
+	default:
+		return fmt.Errorf("unsupported protocol version %d.%d: %w", code>>16, code&0xffff, errMalformed)
+	}
+	return nil
+}
+
+func (s *auditSession) handleBackend(typ byte, body []byte) error {
+	r := &reader{b: body}
+	switch typ {
+	case 'R':
+		// AuthenticationOk
+		if r.int32() == 0 && r.err == nil {
+			s.authenticated = true
+			s.logger.Info("connected", "user", s.user, "database", s.database)
+		}
+	case '1':
+		s.complete(requestParse)
+	case '2':
+		s.complete(requestBind)
+	case 'C':
+		// CommandComplete
+		if req := s.head(); req != nil {
+			req.rows += rowsOf(r.string())
+			s.complete(requestExecute)
+		}
+	case 'I', 's':
+		// EmptyQueryResponse or PortalSuspended
+		s.complete(requestExecute)
+	case 'E':
+		s.handleError(parseError(body))
+	case 'Z':
+		// ReadyForQuery finishes the simple query or the extended query
+		// up to Sync.
+		for len(s.pending) > 0 {
+			req := s.pending[0]
+			s.pending = s.pending[1:]
+			if req.kind == requestQuery {
+				s.emit(req)
+				break
+			}
+			if req.kind == requestSync {
+				break
+			}
+		}
+	}
+	return r.err
+}
+
+func (s *auditSession) handleError(message string) {
+	req := s.head()
+	switch {
+	case req == nil && !s.authenticated:
+		s.logger.Info("rejected connection", "user", s.user, "database", s.database, "error", message)
+	case req == nil:
+		s.logger.Info("connection error", "user", s.user, "database", s.database, "error", message)
+	case req.kind == requestQuery:
+		// the rest of the query string is skipped until ReadyForQuery.
+		req.err = message
+	default:
+		// the backend skips the messages until Sync.
+		req.err = message
+		s.emit(req)
+		for len(s.pending) > 0 && s.pending[0].kind != requestSync {
+			s.pending = s.pending[1:]
+		}
+	}
+}
+
+func (s *auditSession) push(kind requestKind, statement string) error {
+	if len(s.pending) >= maxPending {
+		return errors.New("too many pending requests")
+	}
+	s.pending = append(s.pending, &request{
+		kind:      kind,
+		statement: statement,
+		start:     time.Now(),
+	})
+	return nil
+}
+
+// head returns the oldest request which is waiting for the response other
+// than Sync.
+func (s *auditSession) head() *request {
+	if len(s.pending) == 0 || s.pending[0].kind == requestSync {
+		return nil
+	}
+	return s.pending[0]
+}
+
+// complete pops the oldest request if it is kind. Execute is emitted.
+func (s *auditSession) complete(kind requestKind) {
+	req := s.head()
+	if req == nil || req.kind != kind {
+		return
+	}
+	s.pending = s.pending[1:]
+	if kind == requestExecute {
+		s.emit(req)
+	}
+}
+
+func (s *auditSession) emit(req *request) {
+	keysAndValues := []any{
+		"user", s.user,
+		"database", s.database,
+		"statement", req.statement,
+		"rows", req.rows,
+		"duration", time.Since(req.start),
+	}
+	if req.err != "" {
+		keysAndValues = append(keysAndValues, "error", req.err)
+	}
+	s.logger.Info("query", keysAndValues...)
+}
+
+// remember sets the value unless too many values are remembered.
+func remember(m map[string]string, key, value string) {
+	if _, ok := m[key]; ok || len(m) < maxStatements {
+		m[key] = value
+	}
+}
+
+// rowsOf returns the number of rows in the command tag such as "SELECT 5"
+// and "INSERT 0 1". It returns 0 if the tag has no number.
+func rowsOf(tag string) int64 {
+	i := strings.LastIndexByte(tag, ' ')
+	if i < 0 {
+		return 0
+	}
+	n, err := strconv.ParseInt(tag[i+1:], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,323 @@
+package postgres
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/basemachina/bridge/internal/protocol"
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+)
+
+// events records the log entries as JSON objects.
+type events struct {
+	mu      sync.Mutex
+	entries []map[string]any
+}
+
+func (e *events) logger(t *testing.T) logr.Logger {
+	return funcr.NewJSON(func(obj string) {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(obj), &entry); err != nil {
+			t.Error(err)
+			return
+		}
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		e.entries = append(e.entries, entry)
+	}, funcr.Options{})
+}
+
+// queries returns the query events without the duration.
+func (e *events) queries() []map[string]any {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var queries []map[string]any
+	for _, entry := range e.entries {
+		if entry["msg"] != "query" {
+			continue
+		}
+		if _, ok := entry["duration"]; !ok {
+			continue
+		}
+		q := map[string]any{
+			"statement": entry["statement"],
+			"rows":      entry["rows"],
+		}
+		if err, ok := entry["error"]; ok {
+			q["error"] = err
+		}
+		queries = append(queries, q)
+	}
+	return queries
+}
+
+func message(typ byte, fields ...[]byte) []byte {
+	body := bytes.Join(fields, nil)
+	b := []byte{typ}
+	b = binary.BigEndian.AppendUint32(b, uint32(len(body)+4))
+	return append(b, body...)
+}
+
+func cstring(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func int32Bytes(v int32) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(v))
+}
+
+func startup(params ...string) []byte {
+	body := int32Bytes(protocolVersion3)
+	for _, p := range params {
+		body = append(body, cstring(p)...)
+	}
+	body = append(body, 0)
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(body)+4)), body...)
+}
+
+func sslRequest() []byte {
+	return append(int32Bytes(8), int32Bytes(sslRequestCode)...)
+}
+
+func errorResponse(code, msg string) []byte {
+	return message('E', []byte{'S'}, cstring("ERROR"), []byte{'C'}, cstring(code), []byte{'M'}, cstring(msg), []byte{0})
+}
+
+var (
+	authOK        = message('R', int32Bytes(0))
+	readyForQuery = message('Z', []byte{'I'})
+	syncMessage   = message('S')
+)
+
+// step is the bytes sent by the frontend or the backend.
+type step struct {
+	frontend bool
+	data     []byte
+}
+
+func frontend(msgs ...[]byte) step { return step{frontend: true, data: bytes.Join(msgs, nil)} }
+func backend(msgs ...[]byte) step  { return step{data: bytes.Join(msgs, nil)} }
+
+func TestAuditSession(t *testing.T) {
+	login := []step{
+		frontend(startup("user", "alice", "database", "orders")),
+		backend(message('R', int32Bytes(3))),
+		frontend(message('p', cstring("secret"))),
+		backend(authOK, message('S', cstring("server_version"), cstring("16.0")), readyForQuery),
+	}
+	cases := []struct {
+		name  string
+		steps []step
+		want  []map[string]any
+	}{
+		{
+			name: "simple query",
+			steps: append(login,
+				frontend(message('Q', cstring("SELECT * FROM orders"))),
+				backend(message('T', int32Bytes(0)), message('D', int32Bytes(0)), message('C', cstring("SELECT 2")), readyForQuery),
+				frontend(message('Q', cstring("UPDATE orders SET paid = true; DELETE FROM carts"))),
+				backend(message('C', cstring("UPDATE 3")), message('C', cstring("DELETE 1")), readyForQuery),
+			),
+			want: []map[string]any{
+				{"statement": "SELECT * FROM orders", "rows": 2.0},
+				{"statement": "UPDATE orders SET paid = true; DELETE FROM carts", "rows": 4.0},
+			},
+		},
+		{
+			name: "simple query error",
+			steps: append(login,
+				frontend(message('Q', cstring("SELECT * FROM missing"))),
+				backend(errorResponse("42P01", `relation "missing" does not exist`), readyForQuery),
+			),
+			want: []map[string]any{
+				{"statement": "SELECT * FROM missing", "rows": 0.0, "error": `42P01: relation "missing" does not exist`},
+			},
+		},
+		{
+			name: "extended query",
+			steps: append(login,
+				frontend(
+					message('P', cstring("s1"), cstring("SELECT * FROM orders WHERE id = $1"), []byte{0, 0}),
+					message('B', cstring(""), cstring("s1"), []byte{0, 0, 0, 0, 0, 0}),
+					message('E', cstring(""), int32Bytes(0)),
+					message('B', cstring("p1"), cstring("s1"), []byte{0, 0, 0, 0, 0, 0}),
+					message('E', cstring("p1"), int32Bytes(1)),
+					syncMessage,
+				),
+				backend(
+					message('1'), message('2'), message('D', int32Bytes(0)), message('C', cstring("SELECT 1")),
+					message('2'), message('D', int32Bytes(0)), message('s'),
+					readyForQuery,
+				),
+				frontend(
+					message('P', cstring(""), cstring("INSERT INTO orders VALUES ($1)"), []byte{0, 0}),
+					message('B', cstring(""), cstring(""), []byte{0, 0, 0, 0, 0, 0}),
+					message('E', cstring(""), int32Bytes(0)),
+					syncMessage,
+				),
+				backend(message('1'), message('2'), message('C', cstring("INSERT 0 1")), readyForQuery),
+			),
+			want: []map[string]any{
+				{"statement": "SELECT * FROM orders WHERE id = $1", "rows": 1.0},
+				{"statement": "SELECT * FROM orders WHERE id = $1", "rows": 0.0},
+				{"statement": "INSERT INTO orders VALUES ($1)", "rows": 1.0},
+			},
+		},
+		{
+			name: "extended query error",
+			steps: append(login,
+				frontend(
+					message('P', cstring(""), cstring("SELEC 1"), []byte{0, 0}),
+					message('B', cstring(""), cstring(""), []byte{0, 0, 0, 0, 0, 0}),
+					message('E', cstring(""), int32Bytes(0)),
+					syncMessage,
+					message('P', cstring(""), cstring("SELECT 1"), []byte{0, 0}),
+					message('B', cstring(""), cstring(""), []byte{0, 0, 0, 0, 0, 0}),
+					message('E', cstring(""), int32Bytes(0)),
+					syncMessage,
+				),
+				// the backend skips Bind and Execute until Sync after the error.
+				backend(
+					errorResponse("42601", `syntax error at or near "SELEC"`), readyForQuery,
+					message('1'), message('2'), message('C', cstring("SELECT 1")), readyForQuery,
+				),
+			),
+			want: []map[string]any{
+				{"statement": "SELEC 1", "rows": 0.0, "error": `42601: syntax error at or near "SELEC"`},
+				{"statement": "SELECT 1", "rows": 1.0},
+			},
+		},
+		{
+			name: "ssl refused",
+			steps: []step{
+				frontend(sslRequest()),
+				backend([]byte{'N'}),
+				frontend(startup("user", "alice")),
+				backend(authOK, readyForQuery),
+				frontend(message('Q', cstring("SELECT 1"))),
+				backend(message('C', cstring("SELECT 1")), readyForQuery),
+			},
+			want: []map[string]any{
+				{"statement": "SELECT 1", "rows": 1.0},
+			},
+		},
+		{
+			name: "ssl accepted",
+			steps: []step{
+				frontend(sslRequest()),
+				backend([]byte{'S'}),
+				frontend([]byte("\x16\x03\x01 encrypted client hello")),
+				backend([]byte("\x16\x03\x03 encrypted server hello")),
+			},
+			want: nil,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, split := range []bool{false, true} {
+				var e events
+				s := newAuditSession(e.logger(t))
+				for _, st := range tc.steps {
+					feed := s.feedBackend
+					if st.frontend {
+						feed = s.feedFrontend
+					}
+					if !split {
+						feed(st.data)
+						continue
+					}
+					// feeds byte by byte to test the partial messages.
+					for i := range st.data {
+						feed(st.data[i : i+1])
+					}
+				}
+				if s.stopped != (tc.want == nil) {
+					t.Fatalf("want stopped %v, but got %v", tc.want == nil, s.stopped)
+				}
+				got := e.queries()
+				if len(got) != len(tc.want) {
+					t.Fatalf("want %v, but got %v", tc.want, got)
+				}
+				for i := range got {
+					for k, v := range tc.want[i] {
+						if got[i][k] != v {
+							t.Fatalf("event %d: want %v, but got %v", i, tc.want[i], got[i])
+						}
+					}
+					if len(got[i]) != len(tc.want[i]) {
+						t.Fatalf("event %d: want %v, but got %v", i, tc.want[i], got[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAuditSession_secrets(t *testing.T) {
+	var e events
+	s := newAuditSession(e.logger(t))
+	s.feedFrontend(startup("user", "alice", "database", "orders"))
+	s.feedBackend(message('R', int32Bytes(3)))
+	s.feedFrontend(message('p', cstring("secret")))
+	s.feedBackend(authOK)
+
+	b, err := json.Marshal(e.entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("secret")) {
+		t.Fatalf("password is logged: %s", b)
+	}
+	if len(e.entries) != 1 || e.entries[0]["msg"] != "connected" || e.entries[0]["user"] != "alice" || e.entries[0]["database"] != "orders" {
+		t.Fatalf("unexpected events: %v", e.entries)
+	}
+}
+
+func TestAuditor_Intercept(t *testing.T) {
+	var e events
+	a := NewAuditor(e.logger(t))
+
+	client, clientPeer := net.Pipe()
+	target, targetPeer := net.Pipe()
+	defer clientPeer.Close()
+	defer targetPeer.Close()
+	c, tc, err := a.Intercept(&protocol.Session{TenantID: "tenant-1", Target: "tcp://db:5432"}, client, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer tc.Close()
+
+	// relays the bytes like the tunnel.
+	go io.Copy(tc, c)
+	go io.Copy(c, tc)
+
+	exchange := func(w, r net.Conn, data []byte) {
+		t.Helper()
+		go w.Write(data)
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(r, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("want %q, but got %q", data, got)
+		}
+	}
+	exchange(clientPeer, targetPeer, startup("user", "alice"))
+	exchange(targetPeer, clientPeer, append(authOK, readyForQuery...))
+	exchange(clientPeer, targetPeer, message('Q', cstring("SELECT 1")))
+	exchange(targetPeer, clientPeer, append(message('C', cstring("SELECT 1")), readyForQuery...))
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	last := e.entries[len(e.entries)-1]
+	if last["msg"] != "query" || last["tenant"] != "tenant-1" || last["target"] != "tcp://db:5432" || last["user"] != "alice" || last["statement"] != "SELECT 1" {
+		t.Fatalf("unexpected event: %v", last)
+	}
+}
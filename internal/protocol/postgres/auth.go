@@ -0,0 +1,368 @@
+package postgres
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+
+	"github.com/basemachina/bridge/internal/protocol"
+	"github.com/go-logr/logr"
+)
+
+// Codes of the authentication request messages.
+const (
+	authenticationOK                = 0
+	authenticationCleartextPassword = 3
+	authenticationMD5Password       = 5
+	authenticationSASL              = 10
+	authenticationSASLContinue      = 11
+	authenticationSASLFinal         = 12
+)
+
+// SQLSTATE codes of the errors responded by bridge.
+const (
+	invalidAuthorizationSpecification = "28000"
+	protocolViolation                 = "08P01"
+)
+
+var errAuthentication = errors.New("authentication failed")
+
+// Authenticator authenticates the tunnels to the server with the
+// credentials which bridge holds. The user in the startup message of the
+// client is replaced, and the client gets AuthenticationOk without any
+// password like the "trust" authentication once bridge is authenticated.
+//
+// It supports SCRAM-SHA-256 without channel binding. MD5 and cleartext
+// password are used only if the credentials allow them, and cleartext
+// password is sent only over TLS. SSLRequest and GSSENCRequest of the
+// client are refused, so that the "tls://" target should be used to
+// encrypt the connection to the server.
+type Authenticator struct {
+	logger      logr.Logger
+	credentials *protocol.Credentials
+}
+
+var _ protocol.Interceptor = (*Authenticator)(nil)
+
+// NewAuthenticator creates a new authenticator which logs in as the user
+// of credentials.
+func NewAuthenticator(logger logr.Logger, credentials *protocol.Credentials) *Authenticator {
+	return &Authenticator{
+		logger:      logger,
+		credentials: credentials,
+	}
+}
+
+// Intercept implements protocol.Interceptor.
+func (a *Authenticator) Intercept(s *protocol.Session, client, target net.Conn) (net.Conn, net.Conn, error) {
+	password, err := a.credentials.Password()
+	if err != nil {
+		return nil, nil, err
+	}
+	as := &authSession{
+		logger:         a.logger.WithValues("tenant", s.TenantID, "target", s.Target),
+		user:           a.credentials.User,
+		password:       password,
+		allowMD5:       a.credentials.AllowMD5,
+		allowCleartext: a.credentials.AllowCleartext && s.TLS,
+		client:         protocol.NewSyncWriter(client),
+		target:         protocol.NewSyncWriter(target),
+		done:           make(chan struct{}),
+	}
+	return &protocol.Conn{
+			Conn:   client,
+			Reader: &startupReader{s: as, r: bufio.NewReader(client)},
+			Writer: as.client,
+		},
+		&protocol.Conn{
+			Conn:   target,
+			Reader: &authReader{s: as, r: bufio.NewReader(target)},
+			Writer: as.target,
+		},
+		nil
+}
+
+type authSession struct {
+	logger         logr.Logger
+	user           string
+	password       string
+	allowMD5       bool
+	allowCleartext bool
+	client         *protocol.SyncWriter
+	target         *protocol.SyncWriter
+
+	// done is closed when the authentication is finished. The client
+	// cannot send the messages until then.
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+func (s *authSession) finish(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.done)
+	})
+}
+
+// wait waits for the authentication and returns the error if failed.
+func (s *authSession) wait() error {
+	<-s.done
+	if s.err != nil {
+		return fmt.Errorf("%w: %w", errAuthentication, s.err)
+	}
+	return nil
+}
+
+// startupReader reads the startup message from the client and replaces
+// the user. The other messages are read as is after the authentication.
+type startupReader struct {
+	s       *authSession
+	r       *bufio.Reader
+	started bool
+	out     []byte
+}
+
+func (r *startupReader) Read(b []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.started {
+			if err := r.s.wait(); err != nil {
+				return 0, err
+			}
+			return r.r.Read(b)
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *startupReader) next() error {
+	var header [4]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		r.s.finish(err)
+		return err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if length < 8 || length > maxStartupLength {
+		err := fmt.Errorf("invalid startup message length %d: %w", length, errMalformed)
+		r.s.finish(err)
+		return err
+	}
+	body := make([]byte, length-4)
+	if _, err := io.ReadFull(r.r, body); err != nil {
+		r.s.finish(err)
+		return err
+	}
+
+	switch code := binary.BigEndian.Uint32(body); {
+	case code == sslRequestCode || code == gssEncRequestCode:
+		// the client may continue without encryption.
+		_, err := r.s.client.Write([]byte{'N'})
+		return err
+	case code == cancelRequestCode:
+		// it needs no authentication.
+		r.started = true
+		r.s.finish(nil)
+		r.out = append(header[:], body...)
+		return nil
+	case code>>16 != protocolVersion3>>16:
+		err := fmt.Errorf("unsupported protocol version %d.%d: %w", code>>16, code&0xffff, errMalformed)
+		r.s.client.Write(fatalError(protocolViolation, err.Error()))
+		r.s.finish(err)
+		return err
+	}
+
+	clientUser, msg, err := rewriteStartup(body, r.s.user)
+	if err != nil {
+		r.s.client.Write(fatalError(protocolViolation, err.Error()))
+		r.s.finish(err)
+		return err
+	}
+	r.s.logger.Info("injected credentials", "clientUser", clientUser, "user", r.s.user)
+	r.started = true
+	r.out = msg
+	return nil
+}
+
+// rewriteStartup returns the startup message whose user is replaced with
+// user, and the user of the client.
+func rewriteStartup(body []byte, user string) (string, []byte, error) {
+	msg := make([]byte, 4, len(body)+len(user)+4)
+	msg = append(msg, body[:4]...)
+	rd := &reader{b: body[4:]}
+	var clientUser string
+	for len(rd.b) > 0 && rd.b[0] != 0 {
+		name, value := rd.string(), rd.string()
+		if name == "user" {
+			clientUser = value
+			continue
+		}
+		msg = append(append(msg, name...), 0)
+		msg = append(append(msg, value...), 0)
+	}
+	if rd.err != nil || len(rd.b) != 1 {
+		return "", nil, fmt.Errorf("invalid startup message: %w", errMalformed)
+	}
+	msg = append(append(msg, "user\x00"...), user...)
+	msg = append(msg, 0, 0)
+	binary.BigEndian.PutUint32(msg, uint32(len(msg)))
+	return clientUser, msg, nil
+}
+
+// authReader reads the messages from the server and answers the
+// authentication requests with the credentials. The messages after
+// AuthenticationOk are read as is.
+type authReader struct {
+	s    *authSession
+	r    *bufio.Reader
+	done bool
+	out  []byte
+	// err is returned after out is read.
+	err   error
+	scram *scramClient
+}
+
+func (r *authReader) Read(b []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return r.r.Read(b)
+		}
+		if err := r.next(); err != nil {
+			r.s.finish(err)
+			return 0, err
+		}
+	}
+	n := copy(b, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *authReader) next() error {
+	var header [5]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		return err
+	}
+	typ, length := header[0], binary.BigEndian.Uint32(header[1:])
+	if length < 4 || length > maxBufferedMessage {
+		return fmt.Errorf("invalid length %d: %w", length, errMalformed)
+	}
+	body := make([]byte, length-4)
+	if _, err := io.ReadFull(r.r, body); err != nil {
+		return err
+	}
+	switch typ {
+	case 'R':
+	case 'E':
+		// the server closes the connection after the error.
+		r.done = true
+		r.s.logger.Info("rejected credentials", "error", parseError(body))
+		r.s.finish(errors.New(parseError(body)))
+		fallthrough
+	default:
+		// e.g. NegotiateProtocolVersion, NoticeResponse
+		r.out = append(header[:], body...)
+		return nil
+	}
+
+	if err := r.authenticate(body); err != nil {
+		r.s.logger.Info("failed to authenticate", "error", err.Error())
+		r.out = fatalError(invalidAuthorizationSpecification, "bridge: "+err.Error())
+		r.err = err
+		r.s.finish(err)
+		return nil
+	}
+	if r.done {
+		r.out = append(header[:], body...)
+	}
+	return nil
+}
+
+// authenticate answers the authentication request of the server.
+func (r *authReader) authenticate(body []byte) error {
+	rd := &reader{b: body}
+	code := rd.int32()
+	if rd.err != nil {
+		return rd.err
+	}
+	switch code {
+	case authenticationOK:
+		if r.scram != nil && !r.scram.verified {
+			return fmt.Errorf("SCRAM authentication is not completed: %w", errSCRAM)
+		}
+		r.done = true
+		r.s.finish(nil)
+		return nil
+	case authenticationCleartextPassword:
+		if !r.s.allowCleartext {
+			return errors.New("cleartext password authentication is not allowed")
+		}
+		return r.send(append([]byte(r.s.password), 0))
+	case authenticationMD5Password:
+		if !r.s.allowMD5 {
+			return errors.New("MD5 password authentication is not allowed")
+		}
+		if len(rd.b) != 4 {
+			return errMalformed
+		}
+		return r.send(append([]byte(md5Password(r.s.user, r.s.password, rd.b)), 0))
+	case authenticationSASL:
+		if !slices.Contains(saslMechanisms(rd.b), scramSHA256) {
+			return fmt.Errorf("unsupported SASL mechanisms %q", saslMechanisms(rd.b))
+		}
+		r.scram = newSCRAMClient(r.s.password)
+		first := r.scram.clientFirst()
+		msg := append([]byte(scramSHA256), 0)
+		msg = binary.BigEndian.AppendUint32(msg, uint32(len(first)))
+		return r.send(append(msg, first...))
+	case authenticationSASLContinue:
+		if r.scram == nil {
+			return fmt.Errorf("unexpected SASL continue: %w", errMalformed)
+		}
+		final, err := r.scram.clientFinal(rd.b)
+		if err != nil {
+			return err
+		}
+		return r.send(final)
+	case authenticationSASLFinal:
+		if r.scram == nil {
+			return fmt.Errorf("unexpected SASL final: %w", errMalformed)
+		}
+		return r.scram.verify(rd.b)
+	}
+	return fmt.Errorf("unsupported authentication method %d", code)
+}
+
+// send sends the response message of the authentication to the server.
+func (r *authReader) send(body []byte) error {
+	msg := binary.BigEndian.AppendUint32([]byte{'p'}, uint32(len(body)+4))
+	_, err := r.s.target.Write(append(msg, body...))
+	return err
+}
+
+// md5Password returns the password of the MD5 authentication.
+func md5Password(user, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+// fatalError returns ErrorResponse with the severity FATAL.
+func fatalError(code, message string) []byte {
+	body := []byte("SFATAL\x00VFATAL\x00C" + code + "\x00M" + message + "\x00\x00")
+	msg := binary.BigEndian.AppendUint32([]byte{'E'}, uint32(len(body)+4))
+	return append(msg, body...)
+}
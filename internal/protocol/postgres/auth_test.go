@@ -0,0 +1,279 @@
+package postgres
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/basemachina/bridge/internal/protocol"
+	"github.com/basemachina/bridge/internal/testlogr"
+)
+
+const testPassword = "s3cr3t-p@ss"
+
+// startAuthenticator returns the client and the server which are connected
+// through the authenticator with the default credentials.
+func startAuthenticator(t *testing.T) (clientPeer, serverPeer net.Conn) {
+	t.Helper()
+	return startAuthenticatorWith(t,
+		&protocol.Credentials{User: "app", PasswordEnv: "TEST_PG_PASSWORD"},
+		&protocol.Session{Target: "tcp://db:5432"},
+	)
+}
+
+func startAuthenticatorWith(t *testing.T, credentials *protocol.Credentials, s *protocol.Session) (clientPeer, serverPeer net.Conn) {
+	t.Helper()
+	t.Setenv("TEST_PG_PASSWORD", testPassword)
+	client, clientPeer := net.Pipe()
+	target, serverPeer := net.Pipe()
+	a := NewAuthenticator(testlogr.Logger, credentials)
+	c, tc, err := a.Intercept(s, client, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		io.Copy(tc, c)
+		tc.Close()
+	}()
+	go func() {
+		io.Copy(c, tc)
+		c.Close()
+	}()
+	deadline := time.Now().Add(3 * time.Second)
+	clientPeer.SetDeadline(deadline)
+	serverPeer.SetDeadline(deadline)
+	t.Cleanup(func() {
+		clientPeer.Close()
+		serverPeer.Close()
+	})
+	return clientPeer, serverPeer
+}
+
+// send writes b in background because net.Pipe blocks until it is read.
+func send(conn net.Conn, b ...[]byte) {
+	go conn.Write(bytes.Join(b, nil))
+}
+
+func expectBytes(t *testing.T, conn net.Conn, want []byte) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("want %q, but got error %v after %q", want, err, got)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("want %q, but got %q", want, got)
+	}
+}
+
+// readMessage reads the message of the type.
+func readMessage(t *testing.T, conn net.Conn, typ byte) []byte {
+	t.Helper()
+	var header [5]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != typ {
+		t.Fatalf("want message %q, but got %q", typ, header[0])
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[1:])-4)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// scramServer verifies the client of SCRAM-SHA-256 like PostgreSQL.
+func scramServer(t *testing.T, conn net.Conn, password string, tamper bool) {
+	t.Helper()
+	send(conn, message('R', int32Bytes(authenticationSASL), cstring("SCRAM-SHA-256-PLUS"), cstring(scramSHA256), []byte{0}))
+	r := &reader{b: readMessage(t, conn, 'p')}
+	if mechanism := r.string(); mechanism != scramSHA256 {
+		t.Fatalf("want %s, but got %s", scramSHA256, mechanism)
+	}
+	r.int32()
+	clientFirst := string(r.b)
+	clientFirstBare, ok := strings.CutPrefix(clientFirst, gs2Header)
+	if !ok {
+		t.Fatalf("unexpected client-first-message %q", clientFirst)
+	}
+
+	salt := []byte("0123456789abcdef")
+	serverFirst := "r=" + scramAttributes(clientFirstBare)["r"] + "server-nonce,s=" + base64.StdEncoding.EncodeToString(salt) + ",i=4096"
+	send(conn, message('R', int32Bytes(authenticationSASLContinue), []byte(serverFirst)))
+	clientFinal := string(readMessage(t, conn, 'p'))
+	withoutProof, proof, _ := strings.Cut(clientFinal, ",p=")
+
+	saltedPassword, err := pbkdf2.Key(sha256.New, password, salt, 4096, sha256.Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+	clientKey := hmacSHA256(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	wantProof := hmacSHA256(storedKey[:], authMessage)
+	for i := range wantProof {
+		wantProof[i] ^= clientKey[i]
+	}
+	if got, _ := base64.StdEncoding.DecodeString(proof); !hmac.Equal(got, wantProof) {
+		send(conn, errorResponse("28P01", `password authentication failed for user "app"`))
+		return
+	}
+	signature := hmacSHA256(hmacSHA256(saltedPassword, "Server Key"), authMessage)
+	if tamper {
+		signature[0] ^= 1
+	}
+	// it is written before the following messages.
+	if _, err := conn.Write(message('R', int32Bytes(authenticationSASLFinal), []byte("v="+base64.StdEncoding.EncodeToString(signature)))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	ready := bytes.Join([][]byte{
+		message('S', cstring("server_version"), cstring("16.0")),
+		message('K', int32Bytes(1), int32Bytes(2)),
+		readyForQuery,
+	}, nil)
+	cases := []struct {
+		name   string
+		server func(t *testing.T, conn net.Conn)
+	}{
+		{
+			name: "scram-sha-256",
+			server: func(t *testing.T, conn net.Conn) {
+				scramServer(t, conn, testPassword, false)
+			},
+		},
+		{
+			name: "md5",
+			server: func(t *testing.T, conn net.Conn) {
+				salt := []byte{1, 2, 3, 4}
+				send(conn, message('R', int32Bytes(authenticationMD5Password), salt))
+				want := cstring(md5Password("app", testPassword, salt))
+				if got := readMessage(t, conn, 'p'); !bytes.Equal(got, want) {
+					t.Fatalf("want %q, but got %q", want, got)
+				}
+			},
+		},
+		{
+			name: "cleartext",
+			server: func(t *testing.T, conn net.Conn) {
+				send(conn, message('R', int32Bytes(authenticationCleartextPassword)))
+				if got := readMessage(t, conn, 'p'); !bytes.Equal(got, cstring(testPassword)) {
+					t.Fatalf("want the password, but got %q", got)
+				}
+			},
+		},
+		{
+			name:   "trust",
+			server: func(t *testing.T, conn net.Conn) {},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// MD5 and cleartext password are allowed explicitly.
+			client, server := startAuthenticatorWith(t,
+				&protocol.Credentials{User: "app", PasswordEnv: "TEST_PG_PASSWORD", AllowMD5: true, AllowCleartext: true},
+				&protocol.Session{Target: "tls://db:5432", TLS: true},
+			)
+
+			// the client cannot encrypt the connection.
+			send(client, sslRequest())
+			expectBytes(t, client, []byte{'N'})
+
+			send(client, startup("user", "placeholder", "database", "orders"))
+			expectBytes(t, server, startup("database", "orders", "user", "app"))
+			tc.server(t, server)
+			send(server, authOK, ready)
+			expectBytes(t, client, append(authOK, ready...))
+
+			// the messages after the authentication are forwarded as is.
+			q := message('Q', cstring("SELECT 1"))
+			send(client, q)
+			expectBytes(t, server, q)
+		})
+	}
+}
+
+func TestAuthenticator_failure(t *testing.T) {
+	t.Run("wrong password", func(t *testing.T) {
+		client, server := startAuthenticator(t)
+		send(client, startup("user", "placeholder"))
+		expectBytes(t, server, startup("user", "app"))
+		scramServer(t, server, "wrong", false)
+		readMessage(t, client, 'E')
+	})
+
+	t.Run("server signature mismatch", func(t *testing.T) {
+		client, server := startAuthenticator(t)
+		send(client, startup("user", "placeholder"))
+		expectBytes(t, server, startup("user", "app"))
+		scramServer(t, server, testPassword, true)
+		// the client never gets AuthenticationOk from the server.
+		send(server, authOK, readyForQuery)
+		if msg := parseError(readMessage(t, client, 'E')); !strings.Contains(msg, "server signature mismatch") {
+			t.Fatalf("unexpected error %q", msg)
+		}
+	})
+
+	// the password is not sent unless the method is allowed.
+	insecure := []struct {
+		name        string
+		credentials *protocol.Credentials
+		session     *protocol.Session
+		request     []byte
+	}{
+		{
+			name:        "md5 by default",
+			credentials: &protocol.Credentials{User: "app", PasswordEnv: "TEST_PG_PASSWORD"},
+			session:     &protocol.Session{Target: "tls://db:5432", TLS: true},
+			request:     message('R', int32Bytes(authenticationMD5Password), []byte{1, 2, 3, 4}),
+		},
+		{
+			name:        "cleartext by default",
+			credentials: &protocol.Credentials{User: "app", PasswordEnv: "TEST_PG_PASSWORD"},
+			session:     &protocol.Session{Target: "tls://db:5432", TLS: true},
+			request:     message('R', int32Bytes(authenticationCleartextPassword)),
+		},
+		{
+			name:        "cleartext without tls",
+			credentials: &protocol.Credentials{User: "app", PasswordEnv: "TEST_PG_PASSWORD", AllowCleartext: true},
+			session:     &protocol.Session{Target: "tcp://db:5432"},
+			request:     message('R', int32Bytes(authenticationCleartextPassword)),
+		},
+	}
+	for _, tc := range insecure {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := startAuthenticatorWith(t, tc.credentials, tc.session)
+			send(client, startup("user", "placeholder"))
+			expectBytes(t, server, startup("user", "app"))
+			send(server, tc.request)
+			if msg := parseError(readMessage(t, client, 'E')); !strings.Contains(msg, "is not allowed") {
+				t.Fatalf("unexpected error %q", msg)
+			}
+			// the server gets nothing but EOF.
+			if n, err := server.Read(make([]byte, 1)); err == nil {
+				t.Fatalf("want no password message, but read %d bytes", n)
+			}
+		})
+	}
+
+	t.Run("unsupported method", func(t *testing.T) {
+		client, server := startAuthenticator(t)
+		send(client, startup("user", "placeholder"))
+		expectBytes(t, server, startup("user", "app"))
+		// AuthenticationGSS
+		send(server, message('R', int32Bytes(7)))
+		if msg := parseError(readMessage(t, client, 'E')); !strings.HasPrefix(msg, invalidAuthorizationSpecification) {
+			t.Fatalf("unexpected error %q", msg)
+		}
+	})
+}
@@ -0,0 +1,169 @@
+// Package postgres inspects the tunnels of the PostgreSQL frontend/backend
+// protocol version 3.
+//
+// See: https://www.postgresql.org/docs/current/protocol-message-formats.html
+package postgres
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Codes of the first message which has no type byte.
+const (
+	protocolVersion3   = 3 << 16
+	sslRequestCode     = 80877103
+	gssEncRequestCode  = 80877104
+	cancelRequestCode  = 80877102
+	maxStartupLength   = 10000
+	maxBufferedMessage = 1 << 20
+)
+
+var errMalformed = errors.New("malformed message")
+
+// stream splits the bytes of one direction into messages.
+type stream struct {
+	// untyped is true while the next message has no type byte, that is the
+	// startup message of the frontend.
+	untyped bool
+	// want reports whether the body of the message is needed. The bodies
+	// of the other messages are skipped without buffering.
+	want func(typ byte) bool
+	// handle is called for each message which is wanted. The body is
+	// truncated if it is larger than maxBufferedMessage.
+	handle func(typ byte, body []byte) error
+
+	header  [5]byte
+	headerN int
+	inBody  bool
+	typ     byte
+	left    int
+	keep    bool
+	body    []byte
+}
+
+// feed parses p which follows the previous bytes.
+func (s *stream) feed(p []byte) error {
+	for len(p) > 0 {
+		if !s.inBody {
+			size := 5
+			if s.untyped {
+				size = 4
+			}
+			n := copy(s.header[s.headerN:size], p)
+			s.headerN += n
+			p = p[n:]
+			if s.headerN < size {
+				return nil
+			}
+			s.headerN = 0
+
+			var length uint32
+			if s.untyped {
+				s.typ = 0
+				length = binary.BigEndian.Uint32(s.header[:4])
+				if length > maxStartupLength {
+					return fmt.Errorf("startup message is too large: %w", errMalformed)
+				}
+			} else {
+				s.typ = s.header[0]
+				length = binary.BigEndian.Uint32(s.header[1:5])
+			}
+			if length < 4 {
+				return fmt.Errorf("invalid length %d: %w", length, errMalformed)
+			}
+			s.left = int(length - 4)
+			s.keep = s.untyped || s.want(s.typ)
+			s.body = s.body[:0]
+			s.inBody = true
+		}
+
+		n := min(len(p), s.left)
+		if s.keep && len(s.body) < maxBufferedMessage {
+			s.body = append(s.body, p[:min(n, maxBufferedMessage-len(s.body))]...)
+		}
+		s.left -= n
+		p = p[n:]
+		if s.left > 0 {
+			return nil
+		}
+		s.inBody = false
+		if s.keep {
+			if err := s.handle(s.typ, s.body); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reader reads the fields of the message body.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) byte() byte {
+	if len(r.b) < 1 {
+		r.err = errMalformed
+		return 0
+	}
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *reader) int32() int32 {
+	if len(r.b) < 4 {
+		r.err = errMalformed
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return int32(v)
+}
+
+// string reads the null-terminated string. If the terminator is missing
+// because the body is truncated, it returns the rest.
+func (r *reader) string() string {
+	i := bytes.IndexByte(r.b, 0)
+	if i < 0 {
+		v := string(r.b)
+		r.b = nil
+		return v
+	}
+	v := string(r.b[:i])
+	r.b = r.b[i+1:]
+	return v
+}
+
+// parseStartup parses the parameters of the startup message.
+func parseStartup(body []byte) (map[string]string, error) {
+	r := &reader{b: body[4:]}
+	params := make(map[string]string)
+	for len(r.b) > 0 && r.b[0] != 0 {
+		name := r.string()
+		params[name] = r.string()
+	}
+	return params, r.err
+}
+
+// parseError returns the message of ErrorResponse.
+func parseError(body []byte) string {
+	r := &reader{b: body}
+	var code, message string
+	for len(r.b) > 0 && r.b[0] != 0 {
+		switch field, value := r.byte(), r.string(); field {
+		case 'C':
+			code = value
+		case 'M':
+			message = value
+		}
+	}
+	if code == "" {
+		return message
+	}
+	return code + ": " + message
+}
@@ -0,0 +1,130 @@
+package postgres
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/basemachina/bridge/internal/rand"
+)
+
+const (
+	scramSHA256 = "SCRAM-SHA-256"
+	// maxIterations limits the iteration count which the server requests,
+	// so that a broken server cannot make bridge busy.
+	maxIterations = 1 << 20
+	// gs2Header means that channel binding is not supported. The user name
+	// in the messages is ignored by PostgreSQL.
+	gs2Header = "n,,"
+)
+
+var errSCRAM = errors.New("SCRAM authentication failed")
+
+// scramClient is the client of SCRAM-SHA-256 without channel binding.
+//
+// The password is used without SASLprep, so that only the password which
+// SASLprep does not change is supported, e.g. ASCII printable characters.
+//
+// See: https://www.rfc-editor.org/rfc/rfc5802
+type scramClient struct {
+	password        string
+	nonce           string
+	clientFirstBare string
+	authMessage     string
+	saltedPassword  []byte
+	verified        bool
+}
+
+func newSCRAMClient(password string) *scramClient {
+	nonce := rand.String()
+	return &scramClient{
+		password:        password,
+		nonce:           nonce,
+		clientFirstBare: "n=,r=" + nonce,
+	}
+}
+
+// clientFirst returns the client-first-message.
+func (c *scramClient) clientFirst() []byte {
+	return []byte(gs2Header + c.clientFirstBare)
+}
+
+// clientFinal returns the client-final-message for the server-first-message.
+func (c *scramClient) clientFinal(serverFirst []byte) ([]byte, error) {
+	attrs := scramAttributes(string(serverFirst))
+	nonce, salt, iter := attrs["r"], attrs["s"], attrs["i"]
+	if !strings.HasPrefix(nonce, c.nonce) || len(nonce) == len(c.nonce) {
+		return nil, fmt.Errorf("invalid nonce: %w", errSCRAM)
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil || len(saltBytes) == 0 {
+		return nil, fmt.Errorf("invalid salt: %w", errSCRAM)
+	}
+	iterations, err := strconv.Atoi(iter)
+	if err != nil || iterations <= 0 || iterations > maxIterations {
+		return nil, fmt.Errorf("invalid iteration count %q: %w", iter, errSCRAM)
+	}
+	c.saltedPassword, err = pbkdf2.Key(sha256.New, c.password, saltBytes, iterations, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte(gs2Header)) + ",r=" + nonce
+	c.authMessage = c.clientFirstBare + "," + string(serverFirst) + "," + withoutProof
+	clientKey := hmacSHA256(c.saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	proof := hmacSHA256(storedKey[:], c.authMessage)
+	subtle.XORBytes(proof, proof, clientKey)
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verify verifies the server-final-message.
+func (c *scramClient) verify(serverFinal []byte) error {
+	attrs := scramAttributes(string(serverFinal))
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("%s: %w", e, errSCRAM)
+	}
+	signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || c.saltedPassword == nil {
+		return fmt.Errorf("invalid server signature: %w", errSCRAM)
+	}
+	serverKey := hmacSHA256(c.saltedPassword, "Server Key")
+	if !hmac.Equal(signature, hmacSHA256(serverKey, c.authMessage)) {
+		return fmt.Errorf("server signature mismatch: %w", errSCRAM)
+	}
+	c.verified = true
+	return nil
+}
+
+// scramAttributes parses the attributes of the message, e.g. "r=...,s=...".
+func scramAttributes(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(msg, ",") {
+		if name, value, ok := strings.Cut(attr, "="); ok && len(name) == 1 {
+			attrs[name] = value
+		}
+	}
+	return attrs
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+// saslMechanisms parses the body of AuthenticationSASL.
+func saslMechanisms(body []byte) []string {
+	var mechanisms []string
+	for _, m := range bytes.Split(bytes.TrimRight(body, "\x00"), []byte{0}) {
+		mechanisms = append(mechanisms, string(m))
+	}
+	return mechanisms
+}
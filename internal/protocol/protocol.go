@@ -0,0 +1,227 @@
+// Package protocol inspects the application protocols of tcp tunnels, e.g.
+// the wire protocols of databases.
+//
+// The inspection works only if the bytes in the tunnel are not encrypted
+// end to end, that is, the client sends plaintext to bridge and bridge
+// originates TLS to the target if needed.
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Supported protocols.
+const (
+	Postgres = "postgres"
+	MySQL    = "mysql"
+	Redis    = "redis"
+)
+
+// Config is a config of the application protocol of the target.
+type Config struct {
+	// Type is the protocol of the target. It is one of "postgres",
+	// "mysql" and "redis".
+	Type string `json:"type"`
+	// Audit emits the audit events of the queries in the tunnel. It does
+	// not change the bytes in the tunnel. It is supported by "postgres".
+	Audit bool `json:"audit"`
+	// ReadOnly rejects the statements which are not read-only in the
+	// tunnel. It is supported by "mysql".
+	ReadOnly bool `json:"readOnly"`
+	// AllowCommands and DenyCommands filter the commands in the tunnel,
+	// e.g. "GET", "CONFIG|GET". If AllowCommands is not empty, the other
+	// commands except AUTH, HELLO, PING and QUIT are denied. DenyCommands
+	// takes precedence. If DenyCommands is not empty, the scripting
+	// commands (EVAL, EVALSHA, FCALL, FUNCTION, SCRIPT and their read-only
+	// variants) are denied unless they are in AllowCommands, because the
+	// scripts can call the denied commands. They are supported by "redis".
+	AllowCommands []string `json:"allowCommands"`
+	DenyCommands  []string `json:"denyCommands"`
+	// Credentials makes bridge authenticate to the target instead of the
+	// client, so that the client does not need to know the password. It
+	// is supported by "postgres".
+	Credentials *Credentials `json:"credentials"`
+}
+
+// Credentials are the credentials of the target which bridge holds.
+type Credentials struct {
+	// User is a user name to log in.
+	User string `json:"user"`
+	// PasswordFile is a path to the file which has the password. The
+	// trailing newline is trimmed.
+	PasswordFile string `json:"passwordFile"`
+	// PasswordEnv is a name of the environment variable which has the
+	// password. Either PasswordFile or PasswordEnv is required.
+	PasswordEnv string `json:"passwordEnv"`
+	// AllowMD5 and AllowCleartext let bridge answer the MD5 and the
+	// cleartext password authentication of the target. Only SCRAM-SHA-256
+	// is used by default, so that the password is not sent to the server
+	// which only pretends to be the target. AllowCleartext requires the
+	// "tls://" target.
+	AllowMD5       bool `json:"allowMD5"`
+	AllowCleartext bool `json:"allowCleartext"`
+}
+
+// Password reads the password. It is read for each connection, so that
+// the rotated password is used without restarting bridge.
+func (c *Credentials) Password() (string, error) {
+	if c.PasswordEnv != "" {
+		password, ok := os.LookupEnv(c.PasswordEnv)
+		if !ok {
+			return "", fmt.Errorf("environment variable %q is not set", c.PasswordEnv)
+		}
+		return password, nil
+	}
+	b, err := os.ReadFile(c.PasswordFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password file: %w", err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+func (c *Credentials) validate() error {
+	if c.User == "" {
+		return errors.New("credentials: user is empty")
+	}
+	if (c.PasswordFile == "") == (c.PasswordEnv == "") {
+		return errors.New("credentials: either passwordFile or passwordEnv is required")
+	}
+	if _, err := c.Password(); err != nil {
+		return fmt.Errorf("credentials: %w", err)
+	}
+	return nil
+}
+
+// Validate validates the config.
+func (c *Config) Validate() error {
+	switch c.Type {
+	case Postgres, MySQL, Redis:
+	case "":
+		return errors.New("protocol type is required")
+	default:
+		return fmt.Errorf("unsupported protocol type: %q", c.Type)
+	}
+	if c.Audit && c.Type != Postgres {
+		return fmt.Errorf("audit is not supported for %q", c.Type)
+	}
+	if c.ReadOnly && c.Type != MySQL {
+		return fmt.Errorf("readOnly is not supported for %q", c.Type)
+	}
+	if (len(c.AllowCommands) > 0 || len(c.DenyCommands) > 0) && c.Type != Redis {
+		return fmt.Errorf("allowCommands and denyCommands are not supported for %q", c.Type)
+	}
+	for _, command := range append(c.AllowCommands, c.DenyCommands...) {
+		if command == "" || strings.ContainsAny(command, " \t\r\n") {
+			return fmt.Errorf("invalid command: %q", command)
+		}
+	}
+	if c.Credentials != nil {
+		if c.Type != Postgres {
+			return fmt.Errorf("credentials is not supported for %q", c.Type)
+		}
+		if err := c.Credentials.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Session is the tunnel which is intercepted.
+type Session struct {
+	// TenantID is the tenant which opened the tunnel. It is empty if the
+	// request is not authenticated.
+	TenantID string
+	// Alias is the alias of the target. It is empty if the target is not
+	// registered.
+	Alias string
+	// Target is the redacted URL of the target.
+	Target string
+	// TLS reports whether bridge originates TLS to the target.
+	TLS bool
+}
+
+// Interceptor intercepts the tunnels of the protocol.
+type Interceptor interface {
+	// Intercept returns the connections which are piped instead of client
+	// and target. The returned connections close the given ones.
+	Intercept(s *Session, client, target net.Conn) (net.Conn, net.Conn, error)
+}
+
+// Chain intercepts the tunnels by the interceptors in order. The first one
+// intercepts the given connections, and the next one intercepts the
+// connections returned by the previous one.
+type Chain []Interceptor
+
+// Intercept implements Interceptor.
+func (c Chain) Intercept(s *Session, client, target net.Conn) (net.Conn, net.Conn, error) {
+	for _, ic := range c {
+		var err error
+		client, target, err = ic.Intercept(s, client, target)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return client, target, nil
+}
+
+// Conn replaces the reader and the writer of the connection. It keeps the
+// half close of the connection available.
+type Conn struct {
+	net.Conn
+	// Reader is used instead of Conn.Read if not nil.
+	Reader io.Reader
+	// Writer is used instead of Conn.Write if not nil.
+	Writer io.Writer
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if c.Reader != nil {
+		return c.Reader.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.Writer != nil {
+		return c.Writer.Write(b)
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *Conn) CloseWrite() error {
+	if v, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return v.CloseWrite()
+	}
+	return nil
+}
+
+func (c *Conn) CloseRead() error {
+	if v, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return v.CloseRead()
+	}
+	return nil
+}
+
+// SyncWriter serializes the writes to the connection, so that the
+// interceptor can respond to the client between the writes of the tunnel.
+type SyncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewSyncWriter creates a new writer which serializes the writes to w.
+func NewSyncWriter(w io.Writer) *SyncWriter {
+	return &SyncWriter{w: w}
+}
+
+func (w *SyncWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(b)
+}
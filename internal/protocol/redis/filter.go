@@ -0,0 +1,449 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/basemachina/bridge/internal/protocol"
+	"github.com/go-logr/logr"
+)
+
+const (
+	// maxLineSize limits the line of a command. It is the max size of
+	// the inline command of Redis.
+	maxLineSize = 64 << 10
+	// maxNameSize limits the command name and the subcommand which are
+	// read to check. The larger argument is not a command.
+	maxNameSize = 1 << 10
+)
+
+// implicitCommands are allowed even if they are not in the allow list,
+// because clients use them to start the connection. They can be denied.
+var implicitCommands = map[string]bool{
+	"AUTH":  true,
+	"HELLO": true,
+	"PING":  true,
+	"QUIT":  true,
+}
+
+// scriptingCommands run the commands in the server, which the filter
+// cannot inspect. They are denied if the deny list is not empty, unless
+// they are in the allow list.
+var scriptingCommands = map[string]bool{
+	"EVAL":       true,
+	"EVAL_RO":    true,
+	"EVALSHA":    true,
+	"EVALSHA_RO": true,
+	"FCALL":      true,
+	"FCALL_RO":   true,
+	"FUNCTION":   true,
+	"SCRIPT":     true,
+}
+
+// untrackedCommands make the server send the messages which are not the
+// responses to the commands, or stop sending the responses.
+var untrackedCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"PSUBSCRIBE":   true,
+	"SSUBSCRIBE":   true,
+	"MONITOR":      true,
+	"SYNC":         true,
+	"PSYNC":        true,
+	"CLIENT|REPLY": true,
+}
+
+var (
+	discardCommand = []byte("*1\r\n$7\r\nDISCARD\r\n")
+	execAbortReply = []byte("-EXECABORT Transaction discarded because of previous errors.\r\n")
+)
+
+// CommandFilter allows or denies the commands in the tunnels. The denied
+// commands are answered with the error by bridge in the order of the
+// responses, and the connection is kept usable. If a command in MULTI is
+// denied, the following EXEC discards the transaction like Redis does.
+//
+// Commands are specified by the name, or by the name and the subcommand
+// joined with "|" like ACL of Redis, e.g. "GET", "CONFIG|GET".
+type CommandFilter struct {
+	logger logr.Logger
+	allow  map[string]bool
+	deny   map[string]bool
+}
+
+var _ protocol.Interceptor = (*CommandFilter)(nil)
+
+// NewCommandFilter creates a new filter. If allow is not empty, only the
+// commands in it and AUTH, HELLO, PING and QUIT are allowed. The commands
+// in deny are denied even if they are allowed. If deny is not empty, the
+// scripting commands such as EVAL and FCALL are denied as well unless they
+// are in allow, because the scripts can call the denied commands.
+func NewCommandFilter(logger logr.Logger, allow, deny []string) *CommandFilter {
+	return &CommandFilter{
+		logger: logger,
+		allow:  commandSet(allow),
+		deny:   commandSet(deny),
+	}
+}
+
+func commandSet(commands []string) map[string]bool {
+	set := make(map[string]bool, len(commands))
+	for _, c := range commands {
+		set[strings.ToUpper(strings.TrimSpace(c))] = true
+	}
+	return set
+}
+
+func (f *CommandFilter) allowed(name, sub string) bool {
+	full := name + "|" + sub
+	if f.deny[name] || f.deny[full] {
+		return false
+	}
+	if len(f.deny) > 0 && scriptingCommands[name] && !f.allow[name] && !f.allow[full] {
+		return false
+	}
+	return len(f.allow) == 0 || f.allow[name] || f.allow[full] || implicitCommands[name]
+}
+
+// Intercept implements protocol.Interceptor.
+func (f *CommandFilter) Intercept(s *protocol.Session, client, target net.Conn) (net.Conn, net.Conn, error) {
+	fs := &filterSession{
+		filter: f,
+		logger: f.logger.WithValues("tenant", s.TenantID, "target", s.Target),
+		client: client,
+	}
+	return &protocol.Conn{
+			Conn:   client,
+			Reader: &commandReader{s: fs, r: bufio.NewReaderSize(client, maxLineSize)},
+			Writer: &replyWriter{s: fs},
+		},
+		target,
+		nil
+}
+
+type slotKind int
+
+const (
+	// slotServer waits for the response from the server.
+	slotServer slotKind = iota
+	// slotReplace replaces the response from the server with reply.
+	slotReplace
+	// slotLocal is the reply from bridge.
+	slotLocal
+)
+
+// slot is the response which the client waits for.
+type slot struct {
+	kind  slotKind
+	reply []byte
+}
+
+type filterSession struct {
+	filter *CommandFilter
+	logger logr.Logger
+	client io.Writer
+
+	mu      sync.Mutex
+	replies replyParser
+	slots   []slot
+	// untracked is true if the responses cannot be matched to the
+	// commands, e.g. in the pub/sub mode.
+	untracked bool
+	multi     bool
+	dirty     bool // a command in MULTI is denied
+}
+
+// command checks the command. If the command is denied, the client gets
+// the error and denied is true. Otherwise, it returns the bytes to forward
+// instead of the command, or nil if the command is forwarded as is.
+func (s *filterSession) command(name, sub string) (replace []byte, denied bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name, sub = strings.ToUpper(name), strings.ToUpper(sub)
+	if !s.filter.allowed(name, sub) {
+		s.logger.Info("rejected command", "command", name)
+		reply := fmt.Sprintf("-NOPERM bridge: '%s' command is not allowed\r\n", sanitize(name))
+		return nil, true, s.deny([]byte(reply))
+	}
+
+	switch name {
+	case "MULTI":
+		s.multi, s.dirty = true, false
+	case "EXEC":
+		if s.multi && s.dirty {
+			// discards the transaction instead, and responds the error of
+			// EXEC.
+			replace = discardCommand
+			s.slots = append(s.slots, slot{kind: slotReplace, reply: execAbortReply})
+		}
+		s.multi, s.dirty = false, false
+	case "DISCARD", "RESET":
+		s.multi, s.dirty = false, false
+	}
+	if untrackedCommands[name] || untrackedCommands[name+"|"+sub] {
+		s.untracked = true
+	}
+	if replace == nil && !s.untracked {
+		s.slots = append(s.slots, slot{kind: slotServer})
+	}
+	return replace, false, nil
+}
+
+// deny sends the error reply from bridge after the pending responses. The
+// transaction is discarded if the command is in MULTI.
+func (s *filterSession) deny(reply []byte) error {
+	if s.multi {
+		s.dirty = true
+	}
+	if len(s.slots) == 0 && s.replies.idle() {
+		_, err := s.client.Write(reply)
+		return err
+	}
+	s.slots = append(s.slots, slot{kind: slotLocal, reply: reply})
+	return nil
+}
+
+// replyDone is called at the end of each reply from the server.
+func (s *filterSession) replyDone(push bool) error {
+	if !push && len(s.slots) > 0 && s.slots[0].kind != slotLocal {
+		sl := s.slots[0]
+		s.slots = s.slots[1:]
+		if sl.kind == slotReplace {
+			if _, err := s.client.Write(sl.reply); err != nil {
+				return err
+			}
+		}
+	}
+	for len(s.slots) > 0 && s.slots[0].kind == slotLocal {
+		if _, err := s.client.Write(s.slots[0].reply); err != nil {
+			return err
+		}
+		s.slots = s.slots[1:]
+	}
+	return nil
+}
+
+// sanitize makes the command name safe to be in the error line.
+func sanitize(name string) string {
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return '?'
+		}
+		return r
+	}, strings.ToLower(name))
+}
+
+// replyWriter writes the replies from the server to the client, and the
+// replies from bridge between them.
+type replyWriter struct {
+	s *filterSession
+}
+
+func (w *replyWriter) Write(p []byte) (int, error) {
+	s := w.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		n, end, push, err := s.replies.next(p)
+		if err != nil {
+			return written, err
+		}
+		skip := !push && len(s.slots) > 0 && s.slots[0].kind == slotReplace
+		if !skip {
+			if _, err := s.client.Write(p[:n]); err != nil {
+				return written, err
+			}
+		}
+		p = p[n:]
+		written += n
+		if end {
+			if err := s.replyDone(push); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// commandReader reads the commands from the client and returns the ones
+// which are allowed. The arguments after the subcommand are streamed.
+type commandReader struct {
+	s    *filterSession
+	r    *bufio.Reader
+	out  []byte
+	args int  // the arguments left to read the headers
+	bulk int  // the bytes left of the current argument including CRLF
+	drop bool // the rest of the command is discarded
+}
+
+func (r *commandReader) Read(b []byte) (int, error) {
+	for len(r.out) == 0 {
+		switch {
+		case r.bulk > 0 && !r.drop:
+			n, err := r.r.Read(b[:min(len(b), r.bulk)])
+			r.bulk -= n
+			return n, err
+		case r.bulk > 0:
+			n, err := r.r.Discard(min(r.bulk, maxLineSize))
+			r.bulk -= n
+			if err != nil {
+				return 0, err
+			}
+		case r.args > 0:
+			line, err := r.readLine()
+			if err != nil {
+				return 0, err
+			}
+			size, err := bulkSize(line)
+			if err != nil {
+				return 0, err
+			}
+			r.args--
+			r.bulk = size + 2
+			if !r.drop {
+				r.out = line
+			}
+		default:
+			if err := r.next(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	n := copy(b, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *commandReader) readLine() ([]byte, error) {
+	line, err := r.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, fmt.Errorf("too long line: %w", errMalformed)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), line...), nil
+}
+
+// next reads the command name and the subcommand of the next command, and
+// decides whether to forward it.
+func (r *commandReader) next() error {
+	r.drop = false
+	line, err := r.readLine()
+	if err != nil {
+		return err
+	}
+	if line[0] != '*' {
+		return r.inline(line)
+	}
+	n, err := arrayLength(line)
+	if err != nil {
+		return err
+	}
+	if n <= 0 {
+		// the server ignores the empty command.
+		r.out = line
+		return nil
+	}
+
+	raw := line
+	var args []string
+	r.args = n
+	for r.args > 0 && len(args) < 2 {
+		h, err := r.readLine()
+		if err != nil {
+			return err
+		}
+		size, err := bulkSize(h)
+		if err != nil {
+			return err
+		}
+		raw = append(raw, h...)
+		r.args--
+		if size > maxNameSize {
+			// neither a command name nor a subcommand
+			r.bulk = size + 2
+			if len(args) == 0 {
+				args = append(args, "")
+			}
+			break
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r.r, data); err != nil {
+			return err
+		}
+		raw = append(raw, data...)
+		args = append(args, string(data[:size]))
+	}
+	args = append(args, "")
+
+	replace, denied, err := r.s.command(args[0], args[1])
+	switch {
+	case err != nil:
+		return err
+	case denied:
+		r.drop = true
+	case replace != nil:
+		r.drop = true
+		r.out = replace
+	default:
+		r.out = raw
+	}
+	return nil
+}
+
+// inline handles the inline command which is separated by spaces.
+func (r *commandReader) inline(line []byte) error {
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		// the server ignores the empty line.
+		r.out = line
+		return nil
+	}
+	if strings.ContainsAny(fields[0], `"'`) || (len(fields) > 1 && strings.ContainsAny(fields[1], `"'`)) {
+		// the server unquotes them, so that they cannot be checked as is.
+		return r.s.quoted()
+	}
+	fields = append(fields, "")
+	replace, denied, err := r.s.command(fields[0], fields[1])
+	switch {
+	case err != nil:
+		return err
+	case denied:
+	case replace != nil:
+		r.out = replace
+	default:
+		r.out = line
+	}
+	return nil
+}
+
+// quoted denies the inline command which has quotes.
+func (s *filterSession) quoted() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logger.Info("rejected quoted inline command")
+	return s.deny([]byte("-ERR bridge: quoted inline command is not supported\r\n"))
+}
+
+func arrayLength(line []byte) (int, error) {
+	if len(line) < 4 || line[len(line)-2] != '\r' {
+		return 0, fmt.Errorf("invalid array: %w", errMalformed)
+	}
+	n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+	if err != nil {
+		return 0, fmt.Errorf("invalid array length: %w", errMalformed)
+	}
+	return n, nil
+}
@@ -0,0 +1,168 @@
+package redis
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/basemachina/bridge/internal/protocol"
+	"github.com/basemachina/bridge/internal/testlogr"
+)
+
+// startFilter returns the client and the server which are connected through
+// the filter.
+func startFilter(t *testing.T, allow, deny []string) (clientPeer, serverPeer net.Conn) {
+	t.Helper()
+	client, clientPeer := net.Pipe()
+	target, serverPeer := net.Pipe()
+	f := NewCommandFilter(testlogr.Logger, allow, deny)
+	c, tc, err := f.Intercept(&protocol.Session{Target: "tcp://cache:6379"}, client, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		io.Copy(tc, c)
+		tc.Close()
+	}()
+	go func() {
+		io.Copy(c, tc)
+		c.Close()
+	}()
+	deadline := time.Now().Add(3 * time.Second)
+	clientPeer.SetDeadline(deadline)
+	serverPeer.SetDeadline(deadline)
+	t.Cleanup(func() {
+		clientPeer.Close()
+		serverPeer.Close()
+	})
+	return clientPeer, serverPeer
+}
+
+func command(args ...string) string {
+	s := fmt.Sprintf("*%d\r\n", len(args))
+	for _, a := range args {
+		s += fmt.Sprintf("$%d\r\n%s\r\n", len(a), a)
+	}
+	return s
+}
+
+func noPerm(name string) string {
+	return fmt.Sprintf("-NOPERM bridge: '%s' command is not allowed\r\n", name)
+}
+
+// send writes s in background because net.Pipe blocks until it is read.
+func send(conn net.Conn, s string) {
+	go conn.Write([]byte(s))
+}
+
+func expect(t *testing.T, conn net.Conn, want string) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("want %q, but got error %v after %q", want, err, got)
+	}
+	if string(got) != want {
+		t.Fatalf("want %q, but got %q", want, got)
+	}
+}
+
+func TestCommandFilter(t *testing.T) {
+	client, server := startFilter(t, []string{"GET", "SCAN", "TTL", "config|get"}, nil)
+
+	// the error is responded in the order of the commands.
+	send(client, command("GET", "a")+command("FLUSHALL")+command("GET", "b"))
+	expect(t, server, command("GET", "a")+command("GET", "b"))
+	send(server, "$1\r\n1\r\n$1\r\n2\r\n")
+	expect(t, client, "$1\r\n1\r\n"+noPerm("flushall")+"$1\r\n2\r\n")
+
+	// the subcommand
+	send(client, command("config", "set", "maxmemory", "1"))
+	expect(t, client, noPerm("config"))
+	send(client, command("CONFIG", "GET", "maxmemory"))
+	expect(t, server, command("CONFIG", "GET", "maxmemory"))
+	send(server, "*2\r\n$9\r\nmaxmemory\r\n$1\r\n0\r\n")
+	expect(t, client, "*2\r\n$9\r\nmaxmemory\r\n$1\r\n0\r\n")
+
+	// the inline commands
+	send(client, "flushall\r\n")
+	expect(t, client, noPerm("flushall"))
+	send(client, "\"flushall\"\r\n")
+	expect(t, client, "-ERR bridge: quoted inline command is not supported\r\n")
+	send(client, "ttl a\r\n")
+	expect(t, server, "ttl a\r\n")
+	send(server, ":-2\r\n")
+	expect(t, client, ":-2\r\n")
+
+	// the implicit command
+	send(client, command("PING"))
+	expect(t, server, command("PING"))
+}
+
+func TestCommandFilter_multi(t *testing.T) {
+	client, server := startFilter(t, nil, []string{"FLUSHALL"})
+
+	send(client, command("MULTI")+command("SET", "a", "1")+command("FLUSHALL")+command("EXEC"))
+	// the transaction is discarded instead of EXEC.
+	expect(t, server, command("MULTI")+command("SET", "a", "1")+command("DISCARD"))
+	send(server, "+OK\r\n+QUEUED\r\n+OK\r\n")
+	expect(t, client, "+OK\r\n+QUEUED\r\n"+noPerm("flushall")+
+		"-EXECABORT Transaction discarded because of previous errors.\r\n")
+
+	// the connection is still usable.
+	send(client, command("MULTI")+command("SET", "a", "1")+command("EXEC"))
+	expect(t, server, command("MULTI")+command("SET", "a", "1")+command("EXEC"))
+	send(server, "+OK\r\n+QUEUED\r\n*1\r\n+OK\r\n")
+	expect(t, client, "+OK\r\n+QUEUED\r\n*1\r\n+OK\r\n")
+}
+
+func TestCommandFilter_scripting(t *testing.T) {
+	t.Run("deny list", func(t *testing.T) {
+		client, server := startFilter(t, nil, []string{"FLUSHALL"})
+
+		// the script can call the denied command.
+		send(client, command("EVAL", "return redis.call('FLUSHALL')", "0"))
+		expect(t, client, noPerm("eval"))
+		send(client, command("evalsha", "e0e1f9fabfc9d4800c877a703b823ac0578ff8db", "0"))
+		expect(t, client, noPerm("evalsha"))
+		send(client, command("FCALL", "flush", "0"))
+		expect(t, client, noPerm("fcall"))
+		send(client, command("FUNCTION", "LOAD", "#!lua name=lib\n"))
+		expect(t, client, noPerm("function"))
+
+		send(client, command("GET", "a"))
+		expect(t, server, command("GET", "a"))
+	})
+
+	t.Run("allowed explicitly", func(t *testing.T) {
+		client, server := startFilter(t, []string{"GET", "EVAL_RO"}, []string{"FLUSHALL"})
+
+		send(client, command("EVAL_RO", "return redis.call('GET', KEYS[1])", "1", "a"))
+		expect(t, server, command("EVAL_RO", "return redis.call('GET', KEYS[1])", "1", "a"))
+	})
+
+	t.Run("no deny list", func(t *testing.T) {
+		client, server := startFilter(t, nil, nil)
+
+		send(client, command("EVAL", "return 1", "0"))
+		expect(t, server, command("EVAL", "return 1", "0"))
+	})
+}
+
+func TestCommandFilter_largeArgument(t *testing.T) {
+	client, server := startFilter(t, []string{"SET"}, []string{"SET|KEEPTTL"})
+
+	value := strings.Repeat("a", 1<<20)
+	send(client, command("SET", "a", value))
+	expect(t, server, command("SET", "a", value))
+	send(server, "+OK\r\n")
+	expect(t, client, "+OK\r\n")
+
+	// the denied command is discarded.
+	send(client, command("SET", "keepttl", value)+command(value))
+	expect(t, client, noPerm("set")+noPerm(""))
+	send(client, command("SET", "b", "1"))
+	expect(t, server, command("SET", "b", "1"))
+}
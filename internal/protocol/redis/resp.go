@@ -0,0 +1,161 @@
+// Package redis inspects the tunnels of the Redis serialization protocol
+// (RESP2 and RESP3).
+//
+// See: https://redis.io/docs/latest/develop/reference/protocol-spec/
+package redis
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// maxLineLength limits the line of a reply which is buffered, e.g. simple
+// strings and errors.
+const maxLineLength = 1 << 20
+
+var errMalformed = errors.New("malformed message")
+
+// replyParser finds the end of each reply in the stream from the server.
+type replyParser struct {
+	line    []byte // the partial line
+	bulk    int    // the bytes left of the bulk string including CRLF
+	stack   []frame
+	started bool // a reply is being parsed
+	push    bool // the reply is a push which is not a response to a command
+}
+
+// frame is an aggregate type which is being parsed.
+type frame struct {
+	left int
+	// attr is true for the attribute which is followed by the value
+	// described by it.
+	attr bool
+}
+
+// next parses p and returns the length of its prefix which belongs to the
+// current reply. end reports whether the reply ends at p[n], and push
+// reports whether the reply is a push.
+func (rp *replyParser) next(p []byte) (n int, end, push bool, err error) {
+	for n < len(p) {
+		if rp.bulk > 0 {
+			k := min(rp.bulk, len(p)-n)
+			rp.bulk -= k
+			n += k
+			if rp.bulk == 0 && rp.complete() {
+				return n, true, rp.finish(), nil
+			}
+			continue
+		}
+		if !rp.started {
+			rp.started = true
+			rp.push = p[n] == '>'
+		}
+		i := bytes.IndexByte(p[n:], '\n')
+		if i < 0 {
+			if len(rp.line)+len(p)-n > maxLineLength {
+				return 0, false, false, fmt.Errorf("too long line: %w", errMalformed)
+			}
+			rp.line = append(rp.line, p[n:]...)
+			return len(p), false, rp.push, nil
+		}
+		line := p[n : n+i+1]
+		if len(rp.line) > 0 {
+			line = append(rp.line, line...)
+		}
+		n += i + 1
+		done, err := rp.handleLine(line)
+		rp.line = rp.line[:0]
+		if err != nil {
+			return 0, false, false, err
+		}
+		if done {
+			return n, true, rp.finish(), nil
+		}
+	}
+	return n, false, rp.push, nil
+}
+
+// idle reports whether the parser is between the replies.
+func (rp *replyParser) idle() bool {
+	return !rp.started
+}
+
+func (rp *replyParser) finish() bool {
+	push := rp.push
+	rp.started, rp.push = false, false
+	return push
+}
+
+// handleLine handles the line which has the type, and reports whether the
+// reply is completed.
+func (rp *replyParser) handleLine(line []byte) (bool, error) {
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return false, errMalformed
+	}
+	typ, body := line[0], line[1:len(line)-2]
+	switch typ {
+	case '+', '-', ':', '_', ',', '#', '(':
+		return rp.complete(), nil
+	case '$', '!', '=':
+		n, err := strconv.Atoi(string(body))
+		if err != nil {
+			return false, fmt.Errorf("invalid length %q: %w", body, errMalformed)
+		}
+		if n < 0 {
+			// null
+			return rp.complete(), nil
+		}
+		rp.bulk = n + 2
+		return false, nil
+	case '*', '~', '>', '%', '|':
+		n, err := strconv.Atoi(string(body))
+		if err != nil {
+			return false, fmt.Errorf("invalid length %q: %w", body, errMalformed)
+		}
+		if typ == '%' || typ == '|' {
+			n *= 2
+		}
+		if n > 0 {
+			rp.stack = append(rp.stack, frame{left: n, attr: typ == '|'})
+			return false, nil
+		}
+		if typ == '|' {
+			return false, nil
+		}
+		return rp.complete(), nil
+	}
+	return false, fmt.Errorf("unknown type %q: %w", typ, errMalformed)
+}
+
+// complete is called when a value is completed, and reports whether the
+// reply is completed.
+func (rp *replyParser) complete() bool {
+	for len(rp.stack) > 0 {
+		top := &rp.stack[len(rp.stack)-1]
+		top.left--
+		if top.left > 0 {
+			return false
+		}
+		attr := top.attr
+		rp.stack = rp.stack[:len(rp.stack)-1]
+		if attr {
+			// the attribute is not counted as an element.
+			return false
+		}
+	}
+	return true
+}
+
+// bulkSize parses the header of the bulk string in a command.
+func bulkSize(line []byte) (int, error) {
+	if len(line) < 4 || line[0] != '$' || line[len(line)-2] != '\r' {
+		return 0, fmt.Errorf("expected bulk string: %w", errMalformed)
+	}
+	n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid bulk length: %w", errMalformed)
+	}
+	return n, nil
+}
@@ -0,0 +1,98 @@
+package redis
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestReplyParser(t *testing.T) {
+	cases := []struct {
+		name     string
+		stream   string
+		want     []string
+		wantPush []bool
+	}{
+		{
+			name:     "simple",
+			stream:   "+OK\r\n-ERR unknown\r\n:1\r\n",
+			want:     []string{"+OK\r\n", "-ERR unknown\r\n", ":1\r\n"},
+			wantPush: []bool{false, false, false},
+		},
+		{
+			name:     "bulk string",
+			stream:   "$5\r\nhe\r\no\r\n$-1\r\n$0\r\n\r\n",
+			want:     []string{"$5\r\nhe\r\no\r\n", "$-1\r\n", "$0\r\n\r\n"},
+			wantPush: []bool{false, false, false},
+		},
+		{
+			name:     "array",
+			stream:   "*2\r\n$1\r\na\r\n*1\r\n:1\r\n*0\r\n*-1\r\n",
+			want:     []string{"*2\r\n$1\r\na\r\n*1\r\n:1\r\n", "*0\r\n", "*-1\r\n"},
+			wantPush: []bool{false, false, false},
+		},
+		{
+			name:     "resp3",
+			stream:   "%1\r\n+key\r\n~2\r\n_\r\n#t\r\n,1.5\r\n(12345678901234567890\r\n=7\r\ntxt:abc\r\n",
+			want:     []string{"%1\r\n+key\r\n~2\r\n_\r\n#t\r\n", ",1.5\r\n", "(12345678901234567890\r\n", "=7\r\ntxt:abc\r\n"},
+			wantPush: []bool{false, false, false, false},
+		},
+		{
+			name:     "attribute",
+			stream:   "|1\r\n+ttl\r\n:3600\r\n$1\r\na\r\n*1\r\n|1\r\n+key\r\n+value\r\n:1\r\n",
+			want:     []string{"|1\r\n+ttl\r\n:3600\r\n$1\r\na\r\n", "*1\r\n|1\r\n+key\r\n+value\r\n:1\r\n"},
+			wantPush: []bool{false, false},
+		},
+		{
+			name:     "push",
+			stream:   ">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n+OK\r\n",
+			want:     []string{">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n", "+OK\r\n"},
+			wantPush: []bool{true, false},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, size := range []int{len(tc.stream), 1} {
+				var rp replyParser
+				var got []string
+				var gotPush []bool
+				cur := ""
+				for p := []byte(tc.stream); len(p) > 0; {
+					chunk := p[:min(size, len(p))]
+					p = p[len(chunk):]
+					for len(chunk) > 0 {
+						n, end, push, err := rp.next(chunk)
+						if err != nil {
+							t.Fatal(err)
+						}
+						cur += string(chunk[:n])
+						chunk = chunk[n:]
+						if end {
+							got = append(got, cur)
+							gotPush = append(gotPush, push)
+							cur = ""
+						}
+					}
+				}
+				if cur != "" || !rp.idle() {
+					t.Fatalf("want idle, but got %q left", cur)
+				}
+				if !reflect.DeepEqual(got, tc.want) {
+					t.Fatalf("chunk size %d: want %q, but got %q", size, tc.want, got)
+				}
+				if !reflect.DeepEqual(gotPush, tc.wantPush) {
+					t.Fatalf("chunk size %d: want push %v, but got %v", size, tc.wantPush, gotPush)
+				}
+			}
+		})
+	}
+}
+
+func TestReplyParser_malformed(t *testing.T) {
+	for _, stream := range []string{"?\r\n", "$x\r\n", "+OK\n"} {
+		var rp replyParser
+		if _, _, _, err := rp.next([]byte(stream)); !errors.Is(err, errMalformed) {
+			t.Errorf("%q: want %v, but got %v", stream, errMalformed, err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// extendedConnectProtocol is the value of the :protocol pseudo header to open
+// tunnels by HTTP/2 extended CONNECT (RFC 8441).
+//
+// The server of net/http accepts extended CONNECT only if GODEBUG contains
+// "http2xconnect=1", which is set by importing internal/xconnect.
+const extendedConnectProtocol = "websocket"
+
+// isExtendedConnect reports whether req is HTTP/2 extended CONNECT.
+func isExtendedConnect(req *http.Request) bool {
+	return req.Method == http.MethodConnect &&
+		req.ProtoMajor == 2 &&
+		req.Header.Get(":protocol") == extendedConnectProtocol
+}
+
+// isTunnelRequest reports whether req can open the tunnel, by the websocket
+// upgrade on HTTP/1.1 or the extended CONNECT on HTTP/2.
+func isTunnelRequest(req *http.Request) bool {
+	return req.Method == http.MethodGet || isExtendedConnect(req)
+}
+
+// upgradable reports whether the tunnel can be opened over w.
+func upgradable(w http.ResponseWriter, req *http.Request) bool {
+	if req.Method == http.MethodConnect && req.ProtoMajor == 2 {
+		return true
+	}
+	_, ok := w.(http.Hijacker)
+	return ok
+}
+
+// acceptStream responds 200 to the CONNECT request on HTTP/2 and returns
+// the connection over the stream.
+func acceptStream(w http.ResponseWriter, req *http.Request) (net.Conn, error) {
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to flush response: %w", err)
+	}
+	localAddr, _ := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return &streamConn{
+		body:       req.Body,
+		w:          w,
+		rc:         rc,
+		localAddr:  localAddr,
+		remoteAddr: streamAddr(req.RemoteAddr),
+	}, nil
+}
+
+// streamConn is a connection over the HTTP/2 stream. It reads the request
+// body and writes the response body.
+type streamConn struct {
+	body       io.ReadCloser
+	w          io.Writer
+	rc         *http.ResponseController
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
+	mu          sync.Mutex
+	writeClosed bool
+	// idle closes the request body when the client sends nothing after
+	// CloseWrite.
+	idle atomic.Pointer[time.Timer]
+}
+
+// halfCloseTimeout is how long the half-closed stream waits for the client
+// to send the rest of the request body.
+const halfCloseTimeout = time.Second
+
+var _ interface {
+	net.Conn
+	closeReader
+	closeWriter
+} = (*streamConn)(nil)
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	n, err := c.body.Read(b)
+	if t := c.idle.Load(); t != nil && n > 0 {
+		t.Reset(halfCloseTimeout)
+	}
+	return n, err
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writeClosed {
+		return 0, net.ErrClosed
+	}
+	n, err := c.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, c.rc.Flush()
+}
+
+func (c *streamConn) CloseRead() error {
+	return c.body.Close()
+}
+
+// CloseWrite stops writing the response body and flushes it. The request
+// body is still readable. net/http cannot end the response stream until
+// the handler returns, so the stream ends when the client ends the request
+// body, or when the client sends nothing for halfCloseTimeout not to block
+// the client which waits for EOF.
+func (c *streamConn) CloseWrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writeClosed {
+		return nil
+	}
+	c.writeClosed = true
+	c.idle.Store(time.AfterFunc(halfCloseTimeout, func() { c.body.Close() }))
+	return c.rc.Flush()
+}
+
+func (c *streamConn) Close() error {
+	if t := c.idle.Load(); t != nil {
+		t.Stop()
+	}
+	return c.body.Close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.localAddr }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	if err := c.rc.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.rc.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return c.rc.SetReadDeadline(t) }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return c.rc.SetWriteDeadline(t) }
+
+// streamAddr is the remote address of the HTTP request.
+type streamAddr string
+
+func (a streamAddr) Network() string { return "tcp" }
+func (a streamAddr) String() string  { return string(a) }
@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/basemachina/bridge/internal/policy"
+	"github.com/basemachina/bridge/internal/testlogr"
+	"github.com/basemachina/bridge/internal/websocket"
+	_ "github.com/basemachina/bridge/internal/xconnect"
+	"golang.org/x/net/http2"
+)
+
+func TestTCPProxy_http2(t *testing.T) {
+	echoListener := newEchoListener()
+	t.Cleanup(func() { echoListener.Close() })
+	_, echoPort, err := net.SplitHostPort(echoListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the half-close listener writes first and closes its write side, then
+	// reads what the client sends until the client closes its write side.
+	halfCloseListener := newHalfCloseListener(t, "hello, half-close")
+	_, halfClosePort, err := net.SplitHostPort(halfCloseListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := policy.New(&policy.Config{
+		Allow: []policy.Rule{{Schemes: []string{"tcp"}, Ports: []string{echoPort, halfClosePort}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewProxy(&Config{
+		Logger: testlogr.Logger,
+		Policy: p,
+	})
+
+	h2cServer := httptest.NewUnstartedServer(h)
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	h2cServer.Config.Protocols = protocols
+	h2cServer.Start()
+	t.Cleanup(h2cServer.Close)
+
+	tlsServer := httptest.NewUnstartedServer(h)
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	t.Cleanup(tlsServer.Close)
+
+	servers := []struct {
+		name   string
+		server *httptest.Server
+		tls    bool
+	}{
+		{name: "h2c", server: h2cServer},
+		{name: "tls", server: tlsServer, tls: true},
+	}
+	for _, srv := range servers {
+		t.Run(srv.name, func(t *testing.T) {
+			u, err := url.Parse(srv.server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var dials atomic.Int32
+			newDialer := func(framed bool) *Dialer {
+				return &Dialer{
+					BridgeURL: u,
+					Tls:       srv.tls,
+					BaseDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+						dials.Add(1)
+						return (&net.Dialer{Timeout: 3 * time.Second}).DialContext(ctx, network, address)
+					},
+					Framed: framed,
+					HTTP2:  true,
+				}
+			}
+			dial := func(t *testing.T, d *Dialer, addr string) net.Conn {
+				t.Helper()
+				ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+				defer cancel()
+				conn, err := d.DialContext(ctx, addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { conn.Close() })
+				return conn
+			}
+
+			t.Run("shares connection", func(t *testing.T) {
+				dialer := newDialer(false)
+				before := dials.Load()
+				conns := make([]net.Conn, 3)
+				for i := range conns {
+					conns[i] = dial(t, dialer, echoListener.Addr().String())
+				}
+				if got := dials.Load() - before; got != 1 {
+					t.Fatalf("want 1 connection to bridge, but dialed %d", got)
+				}
+				testQuit(t, conns[0])
+				// the other tunnels are still available.
+				for i, conn := range conns[1:] {
+					testEcho(t, conn, fmt.Sprintf("hello, stream %d", i+1))
+				}
+			})
+
+			t.Run("framed", func(t *testing.T) {
+				conn := dial(t, newDialer(true), echoListener.Addr().String())
+				if _, ok := conn.(*websocket.Conn); !ok {
+					t.Fatalf("want websocket connection, but got %T", conn)
+				}
+				testEcho(t, conn, "hello, framed stream")
+			})
+
+			t.Run("session", func(t *testing.T) {
+				ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+				defer cancel()
+				session, err := newDialer(false).DialSession(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer session.Close()
+				conn, err := session.DialContext(ctx, echoListener.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				testEcho(t, conn, "hello, session over stream")
+			})
+
+			t.Run("half-close", func(t *testing.T) {
+				conn := dial(t, newDialer(false), halfCloseListener.Addr().String())
+				const want = "hello, half-close"
+				got := make([]byte, len(want))
+				if _, err := io.ReadFull(conn, got); err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != want {
+					t.Fatalf("want %q, but got %q", want, got)
+				}
+				// the target has closed its write side, but still reads.
+				if _, err := conn.Write([]byte("bye")); err != nil {
+					t.Fatal(err)
+				}
+				if err := conn.(closeWriter).CloseWrite(); err != nil {
+					t.Fatal(err)
+				}
+				select {
+				case got := <-halfCloseListener.received:
+					if got != "bye" {
+						t.Fatalf("want %q, but the target got %q", "bye", got)
+					}
+				case <-time.After(3 * time.Second):
+					t.Fatal("the target did not receive EOF")
+				}
+			})
+
+			t.Run("denied by policy", func(t *testing.T) {
+				ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+				defer cancel()
+				_, err := newDialer(false).DialContext(ctx, "127.0.0.1:1")
+				if err == nil || !strings.Contains(err.Error(), "403") {
+					t.Fatalf("want 403, but got %v", err)
+				}
+			})
+		})
+	}
+	t.Run("standard connect", func(t *testing.T) {
+		tr := &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		}
+		defer tr.CloseIdleConnections()
+
+		pr, pw := io.Pipe()
+		defer pw.Close()
+		req, err := http.NewRequest(http.MethodConnect, h2cServer.URL, pr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = echoListener.Addr().String()
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("want 200, but got %d", resp.StatusCode)
+		}
+
+		const want = "hello, h2 connect"
+		if _, err := pw.Write(append([]byte{byte(len(want))}, want...)); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(resp.Body, got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("want %q, but got %q", want, got)
+		}
+	})
+}
+
+type halfCloseListener struct {
+	net.Listener
+	received chan string
+}
+
+// newHalfCloseListener returns a listener which writes greeting to each
+// connection and closes the write side, then sends what it reads until EOF
+// to received.
+func newHalfCloseListener(t *testing.T, greeting string) *halfCloseListener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	l := &halfCloseListener{Listener: ln, received: make(chan string, 4)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := io.WriteString(conn, greeting); err != nil {
+					return
+				}
+				conn.(*net.TCPConn).CloseWrite()
+				b, _ := io.ReadAll(conn)
+				l.received <- string(b)
+			}()
+		}
+	}()
+	return l
+}
@@ -1,28 +1,184 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/basemachina/bridge/internal/bandwidth"
 	"golang.org/x/sync/errgroup"
 )
 
-func tcpPipe(c1, c2 net.Conn) error {
-	var eg errgroup.Group
+// TunnelLimits limits each tcp tunnel. The zero value of each field means
+// unlimited.
+type TunnelLimits struct {
+	// IdleTimeout closes the tunnel when no data is transferred in either
+	// direction for the duration.
+	IdleTimeout time.Duration
+	// MaxDuration closes the tunnel when the duration has passed since it
+	// was opened.
+	MaxDuration time.Duration
+	// MaxBytesToTarget closes the tunnel when the client sends more bytes
+	// than it to the target.
+	MaxBytesToTarget int64
+	// MaxBytesFromTarget closes the tunnel when the target sends more bytes
+	// than it to the client.
+	MaxBytesFromTarget int64
+}
+
+func (l TunnelLimits) unlimited() bool {
+	return l == TunnelLimits{}
+}
+
+// limitError is returned by tcpPipe when the tunnel is closed by the limits.
+type limitError struct {
+	reason string
+}
+
+func (e *limitError) Error() string {
+	return "tunnel is closed by " + e.reason
+}
+
+var errMaxBytes = errors.New("max bytes exceeded")
+
+// tcpPipe copies between the target c1 and the client c2 until both sides
+// are closed. If limits is hit, it closes both connections and returns
+// *limitError. If bucket is not nil, the copies in both directions are
+// shaped by it.
+func tcpPipe(c1, c2 net.Conn, limits TunnelLimits, bucket *bandwidth.Bucket) error {
+	if limits.unlimited() && bucket == nil {
+		// keeps io.Copy to use the fast path such as splice(2).
+		var eg errgroup.Group
+		eg.Go(func() error {
+			defer closeHalfConn(c1, c2)
+			io.Copy(c1, c2)
+			return nil
+		})
+		eg.Go(func() error {
+			defer closeHalfConn(c2, c1)
+			io.Copy(c2, c1)
+			return nil
+		})
+		return eg.Wait()
+	}
+
+	var (
+		once     sync.Once
+		closedBy error
+		active   atomic.Int64
+	)
+	// stops waiting for the bucket when the tunnel is finished.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	abort := func(reason string) {
+		once.Do(func() {
+			closedBy = &limitError{reason: reason}
+			cancel()
+			c1.Close()
+			c2.Close()
+		})
+	}
+	shape := func(r io.Reader) io.Reader {
+		if bucket == nil {
+			return r
+		}
+		return bucket.Reader(ctx, r)
+	}
+	active.Store(time.Now().UnixNano())
+
+	done := make(chan struct{})
+	defer close(done)
+	if limits.IdleTimeout > 0 || limits.MaxDuration > 0 {
+		go watchTunnel(done, limits, &active, abort)
+	}
 
+	var eg errgroup.Group
 	eg.Go(func() error {
 		defer closeHalfConn(c1, c2)
-		io.Copy(c1, c2)
+		r := shape(&tunnelReader{r: c2, max: limits.MaxBytesToTarget, active: &active})
+		if _, err := io.Copy(c1, r); errors.Is(err, errMaxBytes) {
+			abort("max bytes to target")
+		}
 		return nil
 	})
-
 	eg.Go(func() error {
 		defer closeHalfConn(c2, c1)
-		io.Copy(c2, c1)
+		r := shape(&tunnelReader{r: c1, max: limits.MaxBytesFromTarget, active: &active})
+		if _, err := io.Copy(c2, r); errors.Is(err, errMaxBytes) {
+			abort("max bytes from target")
+		}
 		return nil
 	})
+	eg.Wait()
+
+	// prevents the watcher from closing the finished tunnel, and waits for
+	// closedBy to be set if it is closing.
+	once.Do(func() {})
+	return closedBy
+}
 
-	return eg.Wait()
+// watchTunnel calls abort when the tunnel is idle or lives longer than limits
+// until done is closed.
+func watchTunnel(done <-chan struct{}, limits TunnelLimits, active *atomic.Int64, abort func(reason string)) {
+	var maxDuration, idle <-chan time.Time
+	if limits.MaxDuration > 0 {
+		timer := time.NewTimer(limits.MaxDuration)
+		defer timer.Stop()
+		maxDuration = timer.C
+	}
+	var idleTimer *time.Timer
+	if limits.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(limits.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+	for {
+		select {
+		case <-done:
+			return
+		case <-maxDuration:
+			abort("max duration")
+			return
+		case <-idle:
+			elapsed := time.Since(time.Unix(0, active.Load()))
+			if elapsed >= limits.IdleTimeout {
+				abort("idle timeout")
+				return
+			}
+			idleTimer.Reset(limits.IdleTimeout - elapsed)
+		}
+	}
+}
+
+// tunnelReader records the time of the last read, and returns errMaxBytes
+// when more than max bytes are read.
+type tunnelReader struct {
+	r      io.Reader
+	max    int64 // zero means unlimited
+	n      int64
+	active *atomic.Int64
+}
+
+func (r *tunnelReader) Read(b []byte) (int, error) {
+	if r.max > 0 && int64(len(b)) > r.max-r.n+1 {
+		// reads one more byte to know whether it exceeds.
+		b = b[:r.max-r.n+1]
+	}
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.active.Store(time.Now().UnixNano())
+	}
+	if r.max > 0 && r.n+int64(n) > r.max {
+		n = int(r.max - r.n)
+		r.n = r.max
+		return n, errMaxBytes
+	}
+	r.n += int64(n)
+	return n, err
 }
 
 type (
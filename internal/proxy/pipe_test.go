@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/basemachina/bridge/internal/bandwidth"
+)
+
+// startPipe starts tcpPipe between the pipes and returns the other ends of
+// the client and the target.
+func startPipe(t *testing.T, limits TunnelLimits) (client, target net.Conn, done <-chan error) {
+	t.Helper()
+	return startShapedPipe(t, limits, nil)
+}
+
+func startShapedPipe(t *testing.T, limits TunnelLimits, bucket *bandwidth.Bucket) (client, target net.Conn, done <-chan error) {
+	t.Helper()
+	clientConn, client := net.Pipe()
+	targetConn, target := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		target.Close()
+	})
+	errCh := make(chan error, 1)
+	go func() { errCh <- tcpPipe(targetConn, clientConn, limits, bucket) }()
+	return client, target, errCh
+}
+
+func waitPipe(t *testing.T, done <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(3 * time.Second):
+		t.Fatal("pipe is not finished")
+		return nil
+	}
+}
+
+func wantLimitError(t *testing.T, err error, reason string) {
+	t.Helper()
+	var limitErr *limitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("want limitError, but got %v", err)
+	}
+	if limitErr.reason != reason {
+		t.Fatalf("want reason %q, but got %q", reason, limitErr.reason)
+	}
+}
+
+func TestTCPPipe(t *testing.T) {
+	t.Run("unlimited", func(t *testing.T) {
+		client, target, done := startPipe(t, TunnelLimits{})
+		go client.Write([]byte("hello"))
+		got := make([]byte, 5)
+		if _, err := io.ReadFull(target, got); err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+		target.Close()
+		if err := waitPipe(t, done); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		client, target, done := startPipe(t, TunnelLimits{IdleTimeout: 100 * time.Millisecond})
+		// keeps the tunnel active longer than the idle timeout.
+		for range 5 {
+			go client.Write([]byte("a"))
+			if _, err := io.ReadFull(target, make([]byte, 1)); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(40 * time.Millisecond)
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("closed while active: %v", err)
+		default:
+		}
+		wantLimitError(t, waitPipe(t, done), "idle timeout")
+		if _, err := client.Read(make([]byte, 1)); err == nil {
+			t.Fatal("want the client is closed")
+		}
+	})
+
+	t.Run("max duration", func(t *testing.T) {
+		_, target, done := startPipe(t, TunnelLimits{MaxDuration: 100 * time.Millisecond})
+		wantLimitError(t, waitPipe(t, done), "max duration")
+		if _, err := target.Read(make([]byte, 1)); err == nil {
+			t.Fatal("want the target is closed")
+		}
+	})
+
+	t.Run("max bytes to target", func(t *testing.T) {
+		client, target, done := startPipe(t, TunnelLimits{MaxBytesToTarget: 5})
+		go client.Write([]byte("hello, world"))
+		got, _ := io.ReadAll(target)
+		if string(got) != "hello" {
+			t.Fatalf("want %q, but got %q", "hello", got)
+		}
+		wantLimitError(t, waitPipe(t, done), "max bytes to target")
+	})
+
+	t.Run("shaped", func(t *testing.T) {
+		shaper, err := bandwidth.New(&bandwidth.Config{
+			Global: &bandwidth.Limit{BytesPerSecond: 10 * 1024, Burst: 1024},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bucket := shaper.Bucket("", "")
+		client, target, done := startShapedPipe(t, TunnelLimits{}, bucket)
+
+		// 1KiB is allowed by the burst and the rest takes 200ms.
+		payload := bytes.Repeat([]byte("a"), 3*1024)
+		go target.Write(payload)
+		start := time.Now()
+		got := make([]byte, len(payload))
+		if _, err := io.ReadFull(client, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(payload, got) {
+			t.Fatal("unexpected payload")
+		}
+		if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+			t.Fatalf("want throttled, but finished in %v", elapsed)
+		}
+		if bucket.Throttled() <= 0 {
+			t.Fatal("want throttled time is recorded")
+		}
+		client.Close()
+		target.Close()
+		if err := waitPipe(t, done); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("max bytes from target", func(t *testing.T) {
+		client, target, done := startPipe(t, TunnelLimits{MaxBytesFromTarget: 5})
+		go target.Write([]byte("hello, world"))
+		got, _ := io.ReadAll(client)
+		if string(got) != "hello" {
+			t.Fatalf("want %q, but got %q", "hello", got)
+		}
+		wantLimitError(t, waitPipe(t, done), "max bytes from target")
+	})
+}
@@ -1,10 +1,28 @@
 package proxy
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
+	"time"
 
+	"github.com/basemachina/bridge/bridgehttp"
+	"github.com/basemachina/bridge/internal/auth"
+	"github.com/basemachina/bridge/internal/bandwidth"
+	"github.com/basemachina/bridge/internal/bastion"
+	"github.com/basemachina/bridge/internal/concurrency"
+	"github.com/basemachina/bridge/internal/credential"
+	"github.com/basemachina/bridge/internal/drain"
+	"github.com/basemachina/bridge/internal/egress"
+	"github.com/basemachina/bridge/internal/netguard"
+	"github.com/basemachina/bridge/internal/policy"
+	"github.com/basemachina/bridge/internal/target"
 	"github.com/go-logr/logr"
 )
 
@@ -12,17 +30,119 @@ const (
 	// TargetURLHeaderKey is header key to specify target URL
 	TargetURLHeaderKey = "X-Bridge-Target-URL"
 
+	// MuxHeaderKey is header key to upgrade to the multiplexed session
+	// instead of the tunnel to a single target. Each stream in the session
+	// specifies its target URL.
+	MuxHeaderKey = "X-Bridge-Mux"
+
 	// https://httpstatuses.com/499
 	httpStatusClientClosedRequest = 499
 )
 
-func NewProxy(logger logr.Logger) *Proxy {
+// Config is a config to create Proxy.
+type Config struct {
+	Logger logr.Logger
+
+	// Policy is an optional. If nil, any targets are allowed.
+	Policy *policy.Policy
+
+	// Targets is an optional. If nil, any aliases cannot be resolved.
+	Targets *target.Registry
+
+	// CheckConnectionServerAddr is an address of the server which is used in
+	// connection check from API. It is always allowed regardless of Policy
+	// and DialGuard.
+	CheckConnectionServerAddr string
+
+	// DialGuard is an optional. If specified, both of tcp proxy and
+	// http proxy dial to only the addresses validated by it.
+	DialGuard *netguard.Guard
+
+	// Transport is an optional. If nil, DefaultTransportConfig is used.
+	Transport *TransportConfig
+
+	// EgressProxy is an optional. If specified, both of tcp proxy and
+	// http proxy dial through it.
+	EgressProxy *egress.Proxy
+
+	// Bastions is an optional. It is required to dial to the targets
+	// which specify the bastion.
+	Bastions *bastion.Pool
+
+	// UDPIdleTimeout is an idle timeout of each udp relay session.
+	// If zero, DefaultUDPIdleTimeout is used.
+	UDPIdleTimeout time.Duration
+
+	// TunnelLimits is an optional. If nil, tcp tunnels are not limited.
+	TunnelLimits *TunnelLimits
+
+	// Tunnels is an optional. If specified, tcp tunnels are tracked by it
+	// to be drained on shutdown.
+	Tunnels *drain.Tracker
+
+	// Shaper is an optional. If specified, tcp tunnels and HTTP bodies
+	// are shaped by it.
+	Shaper *bandwidth.Shaper
+
+	// Concurrency is an optional. If specified, it limits the number of
+	// in-flight HTTP requests and tcp tunnels.
+	Concurrency *concurrency.Limiter
+}
+
+func NewProxy(c *Config) *Proxy {
+	logger := c.Logger
 	httpLogger := logger.WithName("http")
+
+	transportConfig := c.Transport
+	if transportConfig == nil {
+		transportConfig = DefaultTransportConfig()
+	}
+
+	dialContext := newDialContextFunc(c, transportConfig.DialTimeout)
+	transport := newTransport(transportConfig, dialContext)
+	if c.EgressProxy != nil {
+		// dials through the egress proxy instead of the proxy of environment.
+		transport.Proxy = nil
+	}
+
+	tcpProxy := NewTCPProxy(logger.WithName("tcp"), dialContext)
+	if c.UDPIdleTimeout > 0 {
+		tcpProxy.udpIdleTimeout = c.UDPIdleTimeout
+	}
+	if c.TunnelLimits != nil {
+		tcpProxy.tunnelLimits = *c.TunnelLimits
+	}
+	if c.Tunnels != nil {
+		tcpProxy.tunnels = c.Tunnels
+	}
+	tcpProxy.shaper = c.Shaper
+	tcpProxy.concurrency = c.Concurrency
+	targetTransport := newTargetTransport(transport)
+
 	return &Proxy{
-		logger:   logger,
-		tcpProxy: NewTCPProxy(logger.WithName("tcp")),
+		logger:                    logger,
+		policy:                    c.Policy,
+		targets:                   c.Targets,
+		checkConnectionServerAddr: c.CheckConnectionServerAddr,
+		shaper:                    c.Shaper,
+		concurrency:               c.Concurrency,
+		tcpProxy:                  tcpProxy,
+		transport:                 targetTransport,
 		httpProxy: &httputil.ReverseProxy{
-			Director: func(*http.Request) {},
+			Director:      func(*http.Request) {},
+			Transport:     targetTransport,
+			FlushInterval: transportConfig.FlushInterval,
+			ModifyResponse: func(resp *http.Response) error {
+				// the upgraded body must be kept as io.ReadWriteCloser.
+				if resp.StatusCode == http.StatusSwitchingProtocols {
+					return nil
+				}
+				ctx := resp.Request.Context()
+				if bucket := bucketFromContext(ctx); bucket != nil {
+					resp.Body = bucket.ReadCloser(ctx, resp.Body)
+				}
+				return nil
+			},
 			ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
 				// If the client is closed the connection, this proxy will respond
 				// 499 HTTP status.
@@ -37,6 +157,22 @@ func NewProxy(logger logr.Logger) *Proxy {
 				default:
 				}
 
+				if errors.Is(err, netguard.ErrBlocked) {
+					httpLogger.Info("rejected by dial guard", "reason", err.Error())
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				if errors.Is(err, policy.ErrDenied) {
+					httpLogger.Info("rejected by policy", "reason", err.Error())
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				if errors.Is(err, target.ErrAliasRequired) {
+					httpLogger.Info("rejected unregistered target", "reason", err.Error())
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+
 				httpLogger.Error(err, "unhandled error")
 				w.WriteHeader(http.StatusBadGateway)
 			},
@@ -47,16 +183,123 @@ func NewProxy(logger logr.Logger) *Proxy {
 // Proxy represents a bridge which proxies the connection
 // between basemachina API and any data sources in tenants.
 type Proxy struct {
-	logger    logr.Logger
-	httpProxy *httputil.ReverseProxy
-	tcpProxy  *TCPProxy
+	logger                    logr.Logger
+	policy                    *policy.Policy
+	targets                   *target.Registry
+	checkConnectionServerAddr string
+	shaper                    *bandwidth.Shaper
+	concurrency               *concurrency.Limiter
+	transport                 *targetTransport
+	httpProxy                 *httputil.ReverseProxy
+	tcpProxy                  *TCPProxy
+}
+
+// newDialContextFunc creates a function to dial to targets. It dials through
+// the bastion or the egress proxy and guards dial except for the check
+// connection server which is listening on the bridge itself.
+func newDialContextFunc(c *Config, timeout time.Duration) DialContextFunc {
+	dial := (&net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+
+	// the policy checks the addresses which are validated by the guard, and
+	// the registry checks the addresses which are allowed by the policy.
+	dialContext := c.Policy.DialContextFunc(c.Targets.DialContextFunc(dial))
+	var resolve egress.ResolveFunc
+	if c.DialGuard != nil {
+		dialContext = c.DialGuard.DialContextFunc(dialContext)
+		resolve = c.DialGuard.Resolve
+	}
+	resolve = c.Targets.ResolveFunc(c.Policy.ResolveFunc(resolve))
+	if c.EgressProxy != nil {
+		dialContext = c.EgressProxy.DialContextFunc(dialContext, dial, resolve)
+	}
+	if c.Bastions != nil {
+		dialContext = c.Bastions.DialContextFunc(dialContext)
+	}
+	if c.CheckConnectionServerAddr == "" {
+		return dialContext
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address == c.CheckConnectionServerAddr {
+			return dial(ctx, network, address)
+		}
+		return dialContext(ctx, network, address)
+	}
+}
+
+func (p *Proxy) isCheckConnectionServer(target *url.URL) bool {
+	return p.checkConnectionServerAddr != "" && target.Host == p.checkConnectionServerAddr
+}
+
+func (p *Proxy) checkPolicy(target *url.URL) error {
+	if p.isCheckConnectionServer(target) {
+		return nil
+	}
+	return p.policy.Check(target)
+}
+
+// resolveTarget resolves the target URL and checks it with the policy.
+func (p *Proxy) resolveTarget(targetURL string) (*target.Target, error) {
+	u, err := url.ParseRequestURI(targetURL)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected target url format: %w", err)
+	}
+
+	// resolves the alias before choosing the HTTP or TCP path
+	t, err := p.targets.Resolve(u)
+	if err != nil {
+		return nil, err
+	}
+
+	// rejects before dialing to the target
+	if err := p.checkPolicy(t.URL); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// forwardProxyTarget returns the target URL of the standard proxy request.
+func forwardProxyTarget(req *http.Request) string {
+	if req.Method == http.MethodConnect {
+		return TCPScheme + "://" + req.URL.Host
+	}
+	return req.URL.String()
 }
 
 func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	ctx := req.Context()
+
+	// forwards many tcp connections over a HTTP connection
+	if isTunnelRequest(req) && req.Header.Get(MuxHeaderKey) != "" {
+		p.tcpProxy.ServeSession(rw, req, p.resolveTarget)
+		return
+	}
+
 	targetURL := req.Header.Get(TargetURLHeaderKey)
-	target, err := url.ParseRequestURI(targetURL)
-	if err != nil {
+	// accepts the standard proxy requests for the clients which cannot
+	// specify the target by the header, e.g. HTTP_PROXY.
+	forwardProxy := bridgehttp.IsForwardProxyRequest(req)
+	if forwardProxy {
+		targetURL = forwardProxyTarget(req)
+	}
+	t, err := p.resolveTarget(targetURL)
+	switch {
+	case errors.Is(err, target.ErrUnknownAlias):
+		p.logger.Info("failed to resolve target",
+			"target", targetURL,
+			"reason", err.Error(),
+		)
+		http.Error(rw, target.ErrUnknownAlias.Error(), http.StatusBadGateway)
+		return
+	case errors.Is(err, policy.ErrDenied):
+		p.logger.Info("rejected by policy",
+			"reason", err.Error(),
+		)
+		http.Error(rw, policy.ErrDenied.Error(), http.StatusForbidden)
+		return
+	case err != nil:
 		p.logger.Error(err,
 			"unexpected target url format",
 			"target", targetURL,
@@ -64,23 +307,97 @@ func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		rw.WriteHeader(http.StatusBadGateway)
 		return
 	}
+	target := t.URL
+
+	// holds the slot until the request or the tunnel is finished
+	release, err := p.concurrency.Acquire(ctx, auth.TenantIDFromContext(ctx), t.Alias)
+	if errors.Is(err, concurrency.ErrLimited) {
+		p.logger.Info("rejected by concurrency limit",
+			"target", target.Redacted(),
+		)
+		rw.Header().Set("Retry-After", retryAfter(p.concurrency.RetryAfter()))
+		http.Error(rw, concurrency.ErrLimited.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		// the client is gone while waiting
+		rw.WriteHeader(httpStatusClientClosedRequest)
+		return
+	}
+	defer release()
+
+	// forwards tcp for CONNECT host:port
+	if forwardProxy && req.Method == http.MethodConnect {
+		p.tcpProxy.ServeConnect(rw, req, t)
+		return
+	}
 
 	// forwards tcp over HTTP
-	if req.Method == http.MethodGet &&
-		// forwards to tcp over HTTP if target URL schema is "tcp://"
-		target.Scheme == TCPScheme {
-		p.tcpProxy.ServeWebSocket(rw, req, target)
+	if isTunnelRequest(req) &&
+		// forwards to tcp over HTTP if target URL schema is "tcp://", "tls://", "unix://" or "udp://"
+		isTunnelScheme(target.Scheme) {
+		p.tcpProxy.ServeWebSocket(rw, req, t)
 		return
 	}
 
 	// because also forward this
 	req.Header.Del(TargetURLHeaderKey)
 
+	// shapes both of the request and the response bodies
+	bucket := p.shaper.Bucket(auth.TenantIDFromContext(ctx), t.Alias)
+	outctx := withTarget(targetDialContext(ctx, t), t)
+	if bucket != nil {
+		outctx = withBucket(outctx, bucket)
+	}
+	if t.Credentials != nil {
+		outctx = credential.WithTransport(outctx, &tokenTransport{transports: p.transport, target: t})
+		outctx = logr.NewContext(outctx, p.logger.WithName("credentials").WithValues("target", t.Alias))
+	}
+
 	// swap to target URL
-	outreq := req.Clone(ctx)
+	outreq := req.Clone(outctx)
 	outreq.URL = target
-	outreq.Host = target.Host
-	outreq.RequestURI = target.Path
+	if target.Scheme == HTTPUnixScheme {
+		// the transport for the target dials to the socket instead of the host.
+		outreq.URL, err = unixRequestURL(target)
+		if err != nil {
+			p.logger.Error(err,
+				"unexpected target url format",
+				"target", targetURL,
+			)
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+	}
+	outreq.Host = outreq.URL.Host
+	outreq.RequestURI = outreq.URL.Path
+	// shapes the body before the credentials read it to sign.
+	if bucket != nil && outreq.Body != nil && outreq.Body != http.NoBody {
+		outreq.Body = bucket.ReadCloser(ctx, outreq.Body)
+	}
+	if t.Credentials != nil {
+		if err := t.Credentials.Inject(outreq); err != nil {
+			if ctx.Err() != nil {
+				// the client is gone while waiting for the token
+				rw.WriteHeader(httpStatusClientClosedRequest)
+				return
+			}
+			if errors.Is(err, credential.ErrBodyTooLarge) {
+				p.logger.Info("rejected request body",
+					"target", target.Redacted(),
+					"reason", err.Error(),
+				)
+				http.Error(rw, credential.ErrBodyTooLarge.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			p.logger.Error(err,
+				"failed to inject credentials",
+				"target", target.Redacted(),
+			)
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+	}
 
 	if _, ok := req.Header["User-Agent"]; !ok {
 		// explicitly disable User-Agent so it's not set to default value
@@ -88,4 +405,27 @@ func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	p.httpProxy.ServeHTTP(rw, outreq)
+
+	if bucket != nil && bucket.Throttled() > 0 {
+		p.logger.Info("throttled request",
+			"target", target.Redacted(),
+			"throttled", bucket.Throttled(),
+		)
+	}
+}
+
+// retryAfter formats d as the value of Retry-After header in seconds.
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(max(1, int(math.Ceil(d.Seconds()))))
+}
+
+type bucketContextKey struct{}
+
+func withBucket(ctx context.Context, b *bandwidth.Bucket) context.Context {
+	return context.WithValue(ctx, bucketContextKey{}, b)
+}
+
+func bucketFromContext(ctx context.Context) *bandwidth.Bucket {
+	b, _ := ctx.Value(bucketContextKey{}).(*bandwidth.Bucket)
+	return b
 }
@@ -6,21 +6,51 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
+	"time"
+
+	"github.com/basemachina/bridge/internal/mux"
+	"github.com/basemachina/bridge/internal/websocket"
+	"golang.org/x/net/http2"
 )
 
 type Dialer struct {
 	BridgeURL       *url.URL
 	Tls             bool
 	BaseDialContext DialContextFunc
+	// Framed negotiates the tunnel which exchanges real websocket frames.
+	Framed bool
+	// HTTP2 opens tunnels as HTTP/2 extended CONNECT (RFC 8441) streams.
+	// The tunnels share the HTTP/2 connection to bridge.
+	HTTP2 bool
+
+	h2Once      sync.Once
+	h2Transport *http2.Transport
 }
 
-func attachRequestHeaders(req *http.Request, addr string) (nonce string) {
+// attachTunnelHeaders attaches the headers to specify the tunnel. If
+// targetURL is empty, it requests the multiplexed session.
+func attachTunnelHeaders(req *http.Request, targetURL string, framed bool) {
 	// from bridge server to tcp server
 	// bridge <--> tcp server
-	req.Header.Set(TargetURLHeaderKey, "tcp://"+addr)
+	if targetURL != "" {
+		req.Header.Set(TargetURLHeaderKey, targetURL)
+	} else {
+		req.Header.Set(MuxHeaderKey, "1")
+	}
+	if framed {
+		req.Header.Set(secWebSocketProtocolKey, FramedSubprotocol)
+		req.Header.Set(secWebSocketVersionKey, "13")
+	}
+}
+
+// attachRequestHeaders attaches the headers to upgrade.
+func attachRequestHeaders(req *http.Request, targetURL string, framed bool) (nonce string) {
+	attachTunnelHeaders(req, targetURL, framed)
 
 	// To connect to google cloud run as bi-directional streaming,
 	// we have to use websocket upgrade header.
@@ -33,13 +63,70 @@ func attachRequestHeaders(req *http.Request, addr string) (nonce string) {
 }
 
 func (d *Dialer) DialContext(ctx context.Context, addr string) (conn net.Conn, err error) {
+	return d.dialTunnel(ctx, "tcp://"+addr)
+}
+
+// DialPacketContext connects to the udp target of addr through bridge.
+func (d *Dialer) DialPacketContext(ctx context.Context, addr string) (*PacketConn, error) {
+	conn, err := d.dialTunnel(ctx, "udp://"+addr)
+	if err != nil {
+		return nil, err
+	}
+	return newPacketConn(conn, addr), nil
+}
+
+// DialSession connects to bridge with the multiplexed session. The
+// connections dialed by the session share one connection to bridge.
+func (d *Dialer) DialSession(ctx context.Context) (*Session, error) {
+	conn, err := d.dialTunnel(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	return &Session{session: mux.Client(conn)}, nil
+}
+
+// Session multiplexes the connections to targets over one connection
+// to bridge.
+type Session struct {
+	session *mux.Session
+}
+
+// DialContext opens a new stream to the tcp target of addr. If bridge
+// rejects it, returns *mux.StreamError which has the HTTP status code.
+func (s *Session) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	stream, err := s.session.Open(ctx, []byte("tcp://"+addr))
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// DialPacketContext opens a new stream to the udp target of addr.
+func (s *Session) DialPacketContext(ctx context.Context, addr string) (*PacketConn, error) {
+	stream, err := s.session.Open(ctx, []byte("udp://"+addr))
+	if err != nil {
+		return nil, err
+	}
+	return newPacketConn(stream, addr), nil
+}
+
+// Close closes the session and all connections dialed by it.
+func (s *Session) Close() error {
+	return s.session.Close()
+}
+
+func (d *Dialer) dialTunnel(ctx context.Context, targetURL string) (conn net.Conn, err error) {
+	if d.HTTP2 {
+		return d.dialStream(ctx, targetURL)
+	}
+
 	// Create a request message to connect bridge server.
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.BridgeURL.String(), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	nonce := attachRequestHeaders(req, addr)
+	nonce := attachRequestHeaders(req, targetURL, d.Framed)
 
 	// to bridge HTTP server
 	// api <--> bridge
@@ -89,10 +176,200 @@ func (d *Dialer) DialContext(ctx context.Context, addr string) (conn net.Conn, e
 	}
 
 	expectedAccept := getNonceAccept(nonce)
+	if d.Framed {
+		expectedAccept = websocket.AcceptKey(nonce)
+	}
 	if resp.Header.Get(secWebSocketAcceptKey) != expectedAccept {
 		err = errors.New("unexpected challenge response")
 		return
 	}
 
+	if d.Framed {
+		if resp.Header.Get(secWebSocketProtocolKey) != FramedSubprotocol {
+			err = errors.New("framed tunnel is not supported by bridge")
+			return
+		}
+		conn = websocket.NewConn(conn, true)
+	}
+
 	return
 }
+
+// dialStream opens the tunnel by HTTP/2 extended CONNECT.
+func (d *Dialer) dialStream(ctx context.Context, targetURL string) (net.Conn, error) {
+	d.h2Once.Do(func() {
+		d.h2Transport = &http2.Transport{
+			AllowHTTP: !d.Tls,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				conn, err := d.BaseDialContext(ctx, network, addr)
+				if err != nil || !d.Tls {
+					return conn, err
+				}
+				tlsConn := tls.Client(conn, cfg)
+				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return tlsConn, nil
+			},
+			TLSClientConfig: &tls.Config{
+				ServerName:         d.BridgeURL.Hostname(),
+				InsecureSkipVerify: true,
+			},
+		}
+	})
+
+	u := *d.BridgeURL
+	u.Scheme = "http"
+	if d.Tls {
+		u.Scheme = "https"
+	}
+
+	// ctx is used only to open the stream. The stream lives until the
+	// connection is closed.
+	streamCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, cancel)
+	defer stop()
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(streamCtx, http.MethodConnect, u.String(), pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set(":protocol", extendedConnectProtocol)
+	attachTunnelHeaders(req, targetURL, d.Framed)
+
+	resp, err := d.h2Transport.RoundTrip(req)
+	if err != nil {
+		cancel()
+		pw.Close()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+	var conn net.Conn = &clientStreamConn{
+		body:   resp.Body,
+		pw:     pw,
+		cancel: cancel,
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	if d.Framed {
+		if resp.Header.Get(secWebSocketProtocolKey) != FramedSubprotocol {
+			conn.Close()
+			return nil, errors.New("framed tunnel is not supported by bridge")
+		}
+		conn = websocket.NewConn(conn, true)
+	}
+	return conn, nil
+}
+
+// clientStreamConn is a connection over the HTTP/2 stream. It writes the
+// request body and reads the response body.
+type clientStreamConn struct {
+	body   io.ReadCloser
+	pw     *io.PipeWriter
+	cancel context.CancelFunc
+}
+
+var _ interface {
+	net.Conn
+	closeWriter
+} = (*clientStreamConn)(nil)
+
+func (c *clientStreamConn) Read(b []byte) (int, error)  { return c.body.Read(b) }
+func (c *clientStreamConn) Write(b []byte) (int, error) { return c.pw.Write(b) }
+
+// CloseWrite ends the request body.
+func (c *clientStreamConn) CloseWrite() error {
+	return c.pw.Close()
+}
+
+// Close resets the stream.
+func (c *clientStreamConn) Close() error {
+	c.pw.Close()
+	c.cancel()
+	return c.body.Close()
+}
+
+func (c *clientStreamConn) LocalAddr() net.Addr  { return nil }
+func (c *clientStreamConn) RemoteAddr() net.Addr { return nil }
+
+// Deadlines are not supported because the stream has no way to cancel the
+// blocking Read and Write but Close.
+func (c *clientStreamConn) SetDeadline(t time.Time) error      { return errors.ErrUnsupported }
+func (c *clientStreamConn) SetReadDeadline(t time.Time) error  { return errors.ErrUnsupported }
+func (c *clientStreamConn) SetWriteDeadline(t time.Time) error { return errors.ErrUnsupported }
+
+// PacketConn is a connection to the udp target through bridge. Each Read
+// and Write transfers a single datagram like *net.UDPConn.
+type PacketConn struct {
+	conn  net.Conn
+	raddr packetAddr
+
+	rmu  sync.Mutex
+	rbuf []byte
+}
+
+var _ interface {
+	net.Conn
+	net.PacketConn
+} = (*PacketConn)(nil)
+
+// Read reads a datagram into b. If b is too small, the rest of the
+// datagram is discarded.
+func (c *PacketConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	n, err := readDatagram(c.conn, c.rbuf)
+	if err != nil {
+		return 0, err
+	}
+	return copy(b, c.rbuf[:n]), nil
+}
+
+// Write writes b as a datagram.
+func (c *PacketConn) Write(b []byte) (int, error) {
+	if err := writeDatagram(c.conn, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.raddr, err
+}
+
+// WriteTo writes b as a datagram. addr must be the target address.
+func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if addr != nil && addr.String() != c.raddr.String() {
+		return 0, fmt.Errorf("unexpected destination %q: connected to %q", addr, c.raddr)
+	}
+	return c.Write(b)
+}
+
+func (c *PacketConn) Close() error                       { return c.conn.Close() }
+func (c *PacketConn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *PacketConn) RemoteAddr() net.Addr               { return c.raddr }
+func (c *PacketConn) SetDeadline(t time.Time) error      { return c.conn.SetDeadline(t) }
+func (c *PacketConn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *PacketConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+func newPacketConn(conn net.Conn, addr string) *PacketConn {
+	return &PacketConn{
+		conn:  conn,
+		raddr: packetAddr(addr),
+		rbuf:  make([]byte, maxDatagramSize),
+	}
+}
+
+// packetAddr is an address of the udp target.
+type packetAddr string
+
+func (a packetAddr) Network() string { return "udp" }
+func (a packetAddr) String() string  { return string(a) }
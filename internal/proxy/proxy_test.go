@@ -1,12 +1,28 @@
 package proxy
 
 import (
+	"bufio"
 	"context"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/basemachina/bridge/internal/auth"
+	"github.com/basemachina/bridge/internal/bandwidth"
+	"github.com/basemachina/bridge/internal/concurrency"
+	"github.com/basemachina/bridge/internal/credential"
+	"github.com/basemachina/bridge/internal/egress"
+	"github.com/basemachina/bridge/internal/jsontime"
+	"github.com/basemachina/bridge/internal/netguard"
+	"github.com/basemachina/bridge/internal/policy"
+	"github.com/basemachina/bridge/internal/target"
 	"github.com/basemachina/bridge/internal/testlogr"
 )
 
@@ -16,7 +32,7 @@ func TestNewReverseProxy(t *testing.T) {
 	}))
 	defer targetSrv.Close()
 
-	proxyHandler := NewProxy(testlogr.Logger)
+	proxyHandler := NewProxy(&Config{Logger: testlogr.Logger})
 
 	cases := []struct {
 		name       string
@@ -58,6 +74,877 @@ func TestNewReverseProxy(t *testing.T) {
 	}
 }
 
+func TestProxyPolicy(t *testing.T) {
+	targetSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetSrv.Close()
+
+	p, err := policy.New(&policy.Config{
+		Allow: []policy.Rule{
+			{
+				Schemes: []string{"http"},
+				CIDRs:   []string{"127.0.0.0/8"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkConnectionSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer checkConnectionSrv.Close()
+
+	proxyHandler := NewProxy(&Config{
+		Logger:                    testlogr.Logger,
+		Policy:                    p,
+		CheckConnectionServerAddr: checkConnectionSrv.Listener.Addr().String(),
+	})
+
+	cases := []struct {
+		name       string
+		target     string
+		wantStatus int
+	}{
+		{
+			name:       "allowed",
+			target:     targetSrv.URL,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "not allowed scheme",
+			target:     "tcp://" + targetSrv.Listener.Addr().String(),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "not allowed host",
+			target:     "http://192.0.2.1:8080",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "check connection server is always allowed",
+			target:     "tcp://" + checkConnectionSrv.Listener.Addr().String(),
+			wantStatus: http.StatusBadGateway, // passes the policy, but the recorder is not hijackable
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(TargetURLHeaderKey, tc.target)
+			req.Header.Set(secWebSocketKey, generateNonce())
+			resp := httptest.NewRecorder()
+			proxyHandler.ServeHTTP(resp, req)
+
+			if got := resp.Result().StatusCode; tc.wantStatus != got {
+				t.Errorf("status code, want %d, but got %d", tc.wantStatus, got)
+			}
+		})
+	}
+}
+
+func TestProxyPolicy_resolvedAddress(t *testing.T) {
+	targetSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetSrv.Close()
+
+	p, err := policy.New(&policy.Config{
+		Allow: []policy.Rule{{Hosts: []string{"localhost"}}},
+		Deny:  []policy.Rule{{CIDRs: []string{"127.0.0.0/8", "::1/128"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyHandler := NewProxy(&Config{
+		Logger: testlogr.Logger,
+		Policy: p,
+	})
+	testServer := httptest.NewServer(proxyHandler)
+	defer testServer.Close()
+
+	_, port, _ := net.SplitHostPort(targetSrv.Listener.Addr().String())
+	for _, target := range []string{
+		"http://localhost:" + port,
+		"tcp://localhost:" + port,
+	} {
+		t.Run(target, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, testServer.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set(TargetURLHeaderKey, target)
+			req.Header.Set(secWebSocketKey, generateNonce())
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if want := http.StatusForbidden; want != resp.StatusCode {
+				t.Errorf("status code, want %d, but got %d", want, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestProxyDialGuard(t *testing.T) {
+	targetSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetSrv.Close()
+
+	guard, err := netguard.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyHandler := NewProxy(&Config{
+		Logger:    testlogr.Logger,
+		DialGuard: guard,
+	})
+	testServer := httptest.NewServer(proxyHandler)
+	defer testServer.Close()
+
+	cases := []struct {
+		name   string
+		target string
+	}{
+		{
+			name:   "http",
+			target: targetSrv.URL,
+		},
+		{
+			name:   "http (hostname)",
+			target: strings.Replace(targetSrv.URL, "127.0.0.1", "localhost", 1),
+		},
+		{
+			name:   "tcp",
+			target: "tcp://" + targetSrv.Listener.Addr().String(),
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", testServer.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set(TargetURLHeaderKey, tc.target)
+			req.Header.Set(secWebSocketKey, generateNonce())
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if want := http.StatusForbidden; want != resp.StatusCode {
+				t.Errorf("status code, want %d, but got %d", want, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestProxyAlias(t *testing.T) {
+	targetSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.URL.RequestURI()))
+	}))
+	defer targetSrv.Close()
+
+	targets, err := target.NewRegistry(map[string]*target.Config{
+		"internal-api": {URL: targetSrv.URL + "/api"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := policy.New(&policy.Config{
+		Allow: []policy.Rule{{Schemes: []string{"http"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyHandler := NewProxy(&Config{
+		Logger:  testlogr.Logger,
+		Policy:  p,
+		Targets: targets,
+	})
+
+	cases := []struct {
+		name       string
+		target     string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "valid alias",
+			target:     "alias://internal-api/v1/users?id=1",
+			wantStatus: http.StatusOK,
+			wantBody:   "/api/v1/users?id=1",
+		},
+		{
+			name:       "unknown alias",
+			target:     "alias://unknown-api/v1/users",
+			wantStatus: http.StatusBadGateway,
+			wantBody:   target.ErrUnknownAlias.Error() + "\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(TargetURLHeaderKey, tc.target)
+			resp := httptest.NewRecorder()
+			proxyHandler.ServeHTTP(resp, req)
+
+			if got := resp.Code; tc.wantStatus != got {
+				t.Errorf("status code, want %d, but got %d", tc.wantStatus, got)
+			}
+			if got := resp.Body.String(); tc.wantBody != got {
+				t.Errorf("body, want %q, but got %q", tc.wantBody, got)
+			}
+		})
+	}
+}
+
+func TestProxyCredentials(t *testing.T) {
+	targetSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Header.Get("Authorization")))
+	}))
+	defer targetSrv.Close()
+
+	t.Setenv("TEST_INTERNAL_API_TOKEN", "secret")
+	targets, err := target.NewRegistry(map[string]*target.Config{
+		"internal-api": {
+			URL: targetSrv.URL,
+			Credentials: &credential.Config{
+				Type:   credential.Bearer,
+				Secret: &credential.Secret{Env: "TEST_INTERNAL_API_TOKEN"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyHandler := NewProxy(&Config{
+		Logger:  testlogr.Logger,
+		Targets: targets,
+	})
+
+	cases := []struct {
+		name   string
+		target string
+		want   string
+	}{
+		{name: "alias", target: "alias://internal-api/v1/users", want: "Bearer secret"},
+		// the credentials are only attached to the requests through the alias.
+		{name: "url of the target", target: targetSrv.URL + "/v1/users", want: "Bearer client"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(TargetURLHeaderKey, tc.target)
+			req.Header.Set("Authorization", "Bearer client")
+			resp := httptest.NewRecorder()
+			proxyHandler.ServeHTTP(resp, req)
+
+			if got := resp.Code; got != http.StatusOK {
+				t.Fatalf("want 200, but got %d", got)
+			}
+			if got := resp.Body.String(); got != tc.want {
+				t.Errorf("want %q, but got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestProxyCredentials_oauth2(t *testing.T) {
+	targetSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// closes the tunnel of the egress proxy after the response
+		w.Header().Set("Connection", "close")
+		w.Write([]byte(req.Header.Get("Authorization")))
+	}))
+	defer targetSrv.Close()
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Connection", "close")
+		if id, secret, _ := req.BasicAuth(); id != "bridge" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"token-1","token_type":"Bearer","expires_in":120}`)
+	}))
+	defer tokenSrv.Close()
+
+	connected := make(chan string, 2)
+	egressProxy, err := egress.New(&egress.Config{URL: newConnectServer(t, connected).URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_CLIENT_SECRET", "s3cret")
+	tokenURL := strings.Replace(tokenSrv.URL, "127.0.0.1", "localhost", 1)
+	targets, err := target.NewRegistry(map[string]*target.Config{
+		"internal-api": {
+			URL: strings.Replace(targetSrv.URL, "127.0.0.1", "localhost", 1),
+			Credentials: &credential.Config{
+				Type:     credential.OAuth2,
+				TokenURL: tokenURL + "/oauth2/token",
+				ClientID: "bridge",
+				Secret:   &credential.Secret{Env: "TEST_CLIENT_SECRET"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyHandler := NewProxy(&Config{
+		Logger:      testlogr.Logger,
+		Targets:     targets,
+		EgressProxy: egressProxy,
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(TargetURLHeaderKey, "alias://internal-api/v1/users")
+	req.Header.Set("Authorization", "Bearer client")
+	resp := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(resp, req)
+
+	if got := resp.Code; got != http.StatusOK {
+		t.Fatalf("want 200, but got %d", got)
+	}
+	if got, want := resp.Body.String(), "Bearer token-1"; got != want {
+		t.Errorf("want %q, but got %q", want, got)
+	}
+	// the token endpoint is requested through the egress proxy as well
+	// as the target.
+	if got, want := <-connected, strings.TrimPrefix(tokenURL, "http://"); got != want {
+		t.Errorf("want %q is connected first, but got %q", want, got)
+	}
+}
+
+func TestProxyCredentials_sigV4(t *testing.T) {
+	targetSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		// the streaming body is sent with the length after it is hashed.
+		fmt.Fprintf(w, "%d:", req.ContentLength)
+		io.Copy(w, req.Body)
+	}))
+	defer targetSrv.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	targets, err := target.NewRegistry(map[string]*target.Config{
+		"internal-api": {
+			URL: targetSrv.URL + "/",
+			Credentials: &credential.Config{
+				Type:    credential.SigV4,
+				Region:  "ap-northeast-1",
+				Service: "execute-api",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyHandler := NewProxy(&Config{
+		Logger:  testlogr.Logger,
+		Targets: targets,
+	})
+
+	req := httptest.NewRequest("POST", "/", io.MultiReader(strings.NewReader("hello, "), strings.NewReader("bridge")))
+	req.ContentLength = -1
+	req.Header.Set(TargetURLHeaderKey, "alias://internal-api/v1/users")
+	resp := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(resp, req)
+
+	if got := resp.Code; got != http.StatusOK {
+		t.Fatalf("want 200, but got %d", got)
+	}
+	if got, want := resp.Body.String(), "13:hello, bridge"; got != want {
+		t.Errorf("want %q, but got %q", want, got)
+	}
+}
+
+func TestProxyBandwidth(t *testing.T) {
+	targetSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		w.Write(body)
+	}))
+	defer targetSrv.Close()
+
+	// 1KiB is allowed by the burst, so 3KiB of the request and the
+	// response bodies take 300ms.
+	shaper, err := bandwidth.New(&bandwidth.Config{
+		Tenants: map[string]*bandwidth.Limit{
+			"tenant-a": {BytesPerSecond: 10 * 1024, Burst: 1024},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyHandler := NewProxy(&Config{
+		Logger: testlogr.Logger,
+		Shaper: shaper,
+	})
+
+	cases := []struct {
+		name          string
+		tenantID      string
+		wantThrottled bool
+	}{
+		{name: "limited tenant", tenantID: "tenant-a", wantThrottled: true},
+		{name: "other tenant", tenantID: "tenant-b"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			payload := strings.Repeat("a", 2*1024)
+			req := httptest.NewRequest("POST", "/", strings.NewReader(payload))
+			req = req.WithContext(auth.WithTenantID(req.Context(), tc.tenantID))
+			req.Header.Set(TargetURLHeaderKey, targetSrv.URL)
+			resp := httptest.NewRecorder()
+
+			start := time.Now()
+			proxyHandler.ServeHTTP(resp, req)
+			elapsed := time.Since(start)
+
+			if got := resp.Code; got != http.StatusOK {
+				t.Fatalf("status code, want %d, but got %d", http.StatusOK, got)
+			}
+			if got := resp.Body.String(); got != payload {
+				t.Fatalf("unexpected body of %d bytes", len(got))
+			}
+			if tc.wantThrottled && elapsed < 200*time.Millisecond {
+				t.Fatalf("want throttled, but finished in %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestProxyConcurrency(t *testing.T) {
+	received := make(chan struct{})
+	unblock := make(chan struct{})
+	targetSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			received <- struct{}{}
+			<-unblock
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetSrv.Close()
+
+	limiter, err := concurrency.New(&concurrency.Config{
+		Global:     1,
+		RetryAfter: jsontime.Duration(1500 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyHandler := NewProxy(&Config{
+		Logger:      testlogr.Logger,
+		Concurrency: limiter,
+	})
+	serve := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(TargetURLHeaderKey, targetSrv.URL+path)
+		resp := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	done := make(chan int, 1)
+	go func() { done <- serve("/slow").Code }()
+	<-received
+
+	resp := serve("/")
+	if got := resp.Code; got != http.StatusServiceUnavailable {
+		t.Fatalf("status code, want %d, but got %d", http.StatusServiceUnavailable, got)
+	}
+	if got := resp.Header().Get("Retry-After"); got != "2" {
+		t.Fatalf("Retry-After, want %q, but got %q", "2", got)
+	}
+
+	close(unblock)
+	if got := <-done; got != http.StatusOK {
+		t.Fatalf("status code, want %d, but got %d", http.StatusOK, got)
+	}
+	// the slot is released
+	if got := serve("/").Code; got != http.StatusOK {
+		t.Fatalf("status code, want %d, but got %d", http.StatusOK, got)
+	}
+}
+
+func TestProxyResponseHeaderTimeout(t *testing.T) {
+	targetSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetSrv.Close()
+
+	targets, err := target.NewRegistry(map[string]*target.Config{
+		"slow-api": {
+			URL:                   targetSrv.URL,
+			ResponseHeaderTimeout: jsontime.Duration(time.Second),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := DefaultTransportConfig()
+	transport.ResponseHeaderTimeout = 50 * time.Millisecond
+	proxyHandler := NewProxy(&Config{
+		Logger:    testlogr.Logger,
+		Targets:   targets,
+		Transport: transport,
+	})
+
+	cases := []struct {
+		name       string
+		target     string
+		wantStatus int
+	}{
+		{
+			name:       "global timeout",
+			target:     strings.Replace(targetSrv.URL, "127.0.0.1", "localhost", 1),
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name:       "overridden by target",
+			target:     "alias://slow-api",
+			wantStatus: http.StatusOK,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(TargetURLHeaderKey, tc.target)
+			resp := httptest.NewRecorder()
+			proxyHandler.ServeHTTP(resp, req)
+
+			if got := resp.Code; tc.wantStatus != got {
+				t.Errorf("status code, want %d, but got %d", tc.wantStatus, got)
+			}
+		})
+	}
+}
+
+// newConnectServer starts HTTP CONNECT proxy which records the requested
+// addresses to connected.
+func newConnectServer(t *testing.T, connected chan<- string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		upstream, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+		connected <- req.Host
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		tcpPipe(upstream, &bufConn{rawConn: conn, reader: brw.Reader}, TunnelLimits{}, nil)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestProxyEgressProxy(t *testing.T) {
+	targetSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// closes the tunnel of the egress proxy after the response
+		w.Header().Set("Connection", "close")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetSrv.Close()
+
+	connected := make(chan string, 1)
+	egressProxy, err := egress.New(&egress.Config{URL: newConnectServer(t, connected).URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, err := target.NewRegistry(map[string]*target.Config{
+		"direct-api": {URL: targetSrv.URL, BypassEgressProxy: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyHandler := NewProxy(&Config{
+		Logger:      testlogr.Logger,
+		Targets:     targets,
+		EgressProxy: egressProxy,
+	})
+
+	cases := []struct {
+		name          string
+		target        string
+		wantConnected bool
+	}{
+		{name: "through egress proxy", target: strings.Replace(targetSrv.URL, "127.0.0.1", "localhost", 1), wantConnected: true},
+		{name: "bypass", target: "alias://direct-api", wantConnected: false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(TargetURLHeaderKey, tc.target)
+			resp := httptest.NewRecorder()
+			proxyHandler.ServeHTTP(resp, req)
+
+			if resp.Code != http.StatusOK {
+				t.Fatalf("status code, want %d, but got %d", http.StatusOK, resp.Code)
+			}
+			select {
+			case <-connected:
+				if !tc.wantConnected {
+					t.Fatal("want to bypass the egress proxy")
+				}
+			default:
+				if tc.wantConnected {
+					t.Fatal("want to connect through the egress proxy")
+				}
+			}
+		})
+	}
+}
+
+func TestProxyUnixSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	echoListener, err := net.Listen("unix", filepath.Join(dir, "echo.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	go func() {
+		for {
+			conn, err := echoListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serverEcho(conn)
+			}()
+		}
+	}()
+
+	httpListener, err := net.Listen("unix", filepath.Join(dir, "http.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetSrv := &httptest.Server{
+		Listener: httpListener,
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(req.URL.RequestURI()))
+		})},
+	}
+	targetSrv.Start()
+	defer targetSrv.Close()
+
+	guard, err := netguard.New(&netguard.Config{
+		AllowedSockets: []string{filepath.Join(dir, "*.sock")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testServer := httptest.NewServer(NewProxy(&Config{
+		Logger:    testlogr.Logger,
+		DialGuard: guard,
+	}))
+	defer testServer.Close()
+
+	t.Run("tunnel", func(t *testing.T) {
+		conn, status := upgradeTunnel(t, testServer, "unix://"+echoListener.Addr().String())
+		defer conn.Close()
+		if status != http.StatusSwitchingProtocols {
+			t.Fatalf("want 101, but got %d", status)
+		}
+		testEcho(t, conn, "hello, unix")
+	})
+
+	t.Run("tunnel (blocked)", func(t *testing.T) {
+		conn, status := upgradeTunnel(t, testServer, "unix:///var/run/docker.sock")
+		defer conn.Close()
+		if status != http.StatusForbidden {
+			t.Fatalf("want 403, but got %d", status)
+		}
+	})
+
+	cases := []struct {
+		name     string
+		target   string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "http",
+			target:   "http+unix://" + httpListener.Addr().String() + ":/v1/users?id=1",
+			wantCode: http.StatusOK,
+			wantBody: "/v1/users?id=1",
+		},
+		{
+			name:     "http (without request path)",
+			target:   "http+unix://" + httpListener.Addr().String(),
+			wantCode: http.StatusOK,
+			wantBody: "/",
+		},
+		{
+			name:     "http (blocked)",
+			target:   "http+unix:///var/run/docker.sock:/containers/json",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "http (with host)",
+			target:   "http+unix://localhost/v1/users",
+			wantCode: http.StatusBadGateway,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", testServer.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set(TargetURLHeaderKey, tc.target)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantCode != resp.StatusCode {
+				t.Fatalf("status code, want %d, but got %d", tc.wantCode, resp.StatusCode)
+			}
+			if tc.wantBody != "" && tc.wantBody != string(body) {
+				t.Errorf("body, want %q, but got %q", tc.wantBody, body)
+			}
+		})
+	}
+}
+
+func TestProxyForwardProxy(t *testing.T) {
+	echoListener := newEchoListener()
+	t.Cleanup(func() { echoListener.Close() })
+	_, echoPort, err := net.SplitHostPort(echoListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, req.URL.RequestURI())
+	}))
+	defer targetSrv.Close()
+
+	p, err := policy.New(&policy.Config{
+		Allow: []policy.Rule{
+			{Schemes: []string{"tcp"}, Ports: []string{echoPort}},
+			{Schemes: []string{"http"}, CIDRs: []string{"127.0.0.0/8"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxySrv := httptest.NewServer(NewProxy(&Config{
+		Logger: testlogr.Logger,
+		Policy: p,
+	}))
+	defer proxySrv.Close()
+
+	connect := func(t *testing.T, addr string) (net.Conn, int) {
+		t.Helper()
+		conn, err := net.Dial("tcp", proxySrv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if err := req.Write(conn); err != nil {
+			conn.Close()
+			t.Fatal(err)
+		}
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			conn.Close()
+			t.Fatal(err)
+		}
+		return &bufConn{rawConn: conn, reader: br}, resp.StatusCode
+	}
+
+	t.Run("connect", func(t *testing.T) {
+		conn, status := connect(t, echoListener.Addr().String())
+		defer conn.Close()
+		if status != http.StatusOK {
+			t.Fatalf("want 200, but got %d", status)
+		}
+		testEcho(t, conn, "hello, connect")
+	})
+
+	t.Run("connect denied by policy", func(t *testing.T) {
+		conn, status := connect(t, "127.0.0.1:1")
+		defer conn.Close()
+		if status != http.StatusForbidden {
+			t.Fatalf("want 403, but got %d", status)
+		}
+	})
+
+	proxyURL, err := url.Parse(proxySrv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+	}
+	cases := []struct {
+		name       string
+		url        string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "absolute form",
+			url:        targetSrv.URL + "/v1/users?limit=1",
+			wantStatus: http.StatusOK,
+			wantBody:   "/v1/users?limit=1",
+		},
+		{
+			name:       "absolute form denied by policy",
+			url:        "http://192.0.2.1:8080/",
+			wantStatus: http.StatusForbidden,
+			wantBody:   policy.ErrDenied.Error() + "\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := client.Get(tc.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantStatus != resp.StatusCode {
+				t.Errorf("status code, want %d, but got %d", tc.wantStatus, resp.StatusCode)
+			}
+			if tc.wantBody != string(body) {
+				t.Errorf("body, want %q, but got %q", tc.wantBody, body)
+			}
+		})
+	}
+}
+
 func TestNewHTTPReverseProxyClientClose(t *testing.T) {
 	waitUntilCanceled := make(chan struct{})
 	targetSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -66,7 +953,7 @@ func TestNewHTTPReverseProxyClientClose(t *testing.T) {
 	}))
 	defer targetSrv.Close()
 
-	proxyHandler := NewProxy(testlogr.Logger)
+	proxyHandler := NewProxy(&Config{Logger: testlogr.Logger})
 
 	req := httptest.NewRequest("POST", "/", nil)
 	req.Header.Set(TargetURLHeaderKey, "https://basemachina.com")
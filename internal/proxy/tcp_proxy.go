@@ -4,20 +4,54 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha1"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
+	"github.com/basemachina/bridge/internal/auth"
+	"github.com/basemachina/bridge/internal/bandwidth"
+	"github.com/basemachina/bridge/internal/concurrency"
+	"github.com/basemachina/bridge/internal/drain"
+	"github.com/basemachina/bridge/internal/mux"
+	"github.com/basemachina/bridge/internal/netguard"
+	"github.com/basemachina/bridge/internal/policy"
+	"github.com/basemachina/bridge/internal/protocol"
+	"github.com/basemachina/bridge/internal/protocol/mysql"
+	"github.com/basemachina/bridge/internal/protocol/postgres"
+	"github.com/basemachina/bridge/internal/protocol/redis"
 	"github.com/basemachina/bridge/internal/rand"
+	"github.com/basemachina/bridge/internal/target"
+	"github.com/basemachina/bridge/internal/websocket"
 	"github.com/go-logr/logr"
 )
 
-// tcp means disable tls, tcp://
-const TCPScheme = "tcp"
+const (
+	// tcp means disable tls, tcp://
+	TCPScheme = "tcp"
+	// tls means bridge wraps the connection to the target in tls, tls://
+	TLSScheme = "tls"
+	// unix means unix domain socket, unix:///var/run/postgresql/.s.PGSQL.5432
+	UnixScheme = "unix"
+	// http+unix means HTTP over unix domain socket, http+unix:///var/run/admin.sock:/v1/users
+	HTTPUnixScheme = "http+unix"
+	// udp means bridge relays datagrams framed with length prefixes, udp://
+	UDPScheme = "udp"
+)
+
+func isTunnelScheme(scheme string) bool {
+	switch scheme {
+	case TCPScheme, TLSScheme, UnixScheme, UDPScheme:
+		return true
+	}
+	return false
+}
 
 // DialContextFunc is a type alias of the net.DialContext
 type DialContextFunc = func(ctx context.Context, network string, address string) (net.Conn, error)
@@ -31,41 +65,73 @@ var (
 type TCPProxy struct {
 	logger          logr.Logger
 	dialContextFunc DialContextFunc
+	udpIdleTimeout  time.Duration
+	tunnelLimits    TunnelLimits
+	tunnels         *drain.Tracker
+	shaper          *bandwidth.Shaper
+	concurrency     *concurrency.Limiter
 }
 
-// NewTCPProxy creates a new tcp proxy.
-func NewTCPProxy(logger logr.Logger) *TCPProxy {
+// NewTCPProxy creates a new tcp proxy which dials to targets with dialContextFunc.
+func NewTCPProxy(logger logr.Logger, dialContextFunc DialContextFunc) *TCPProxy {
 	return &TCPProxy{
-		logger: logger,
-		// the same as DefaultTransport
-		dialContextFunc: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
+		logger:          logger,
+		dialContextFunc: dialContextFunc,
+		udpIdleTimeout:  DefaultUDPIdleTimeout,
+		tunnels:         drain.New(),
 	}
 }
 
 // ServeWebSocket serves tcp proxy over websocket.
-func (p *TCPProxy) ServeWebSocket(w http.ResponseWriter, req *http.Request, target *url.URL) {
-	err := p.proxy(w, req, target)
-	if err != nil {
-		// see: NewReverseProxy
-		select {
-		case <-req.Context().Done():
-			w.WriteHeader(httpStatusClientClosedRequest)
-			return
-		default:
-		}
+func (p *TCPProxy) ServeWebSocket(w http.ResponseWriter, req *http.Request, t *target.Target) {
+	if err := p.proxy(w, req, t); err != nil {
+		p.handleError(w, req, err)
+	}
+}
 
-		if errors.Is(err, ErrBadRequest) {
-			p.logger.Error(err, "invalid request")
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		p.logger.Error(err, "unexpected error")
-		w.WriteHeader(http.StatusBadGateway)
+// ServeConnect serves tcp proxy for the standard CONNECT request.
+func (p *TCPProxy) ServeConnect(w http.ResponseWriter, req *http.Request, t *target.Target) {
+	if err := p.connect(w, req, t); err != nil {
+		p.handleError(w, req, err)
+	}
+}
+
+func (p *TCPProxy) handleError(w http.ResponseWriter, req *http.Request, err error) {
+	// see: NewReverseProxy
+	select {
+	case <-req.Context().Done():
+		w.WriteHeader(httpStatusClientClosedRequest)
+		return
+	default:
+	}
+
+	if errors.Is(err, drain.ErrDraining) {
+		p.logger.Info("rejected tunnel while draining")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, netguard.ErrBlocked) {
+		p.logger.Info("rejected by dial guard", "reason", err.Error())
+		w.WriteHeader(http.StatusForbidden)
 		return
 	}
+	if errors.Is(err, policy.ErrDenied) {
+		p.logger.Info("rejected by policy", "reason", err.Error())
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, target.ErrAliasRequired) {
+		p.logger.Info("rejected unregistered target", "reason", err.Error())
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, ErrBadRequest) {
+		p.logger.Error(err, "invalid request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	p.logger.Error(err, "unexpected error")
+	w.WriteHeader(http.StatusBadGateway)
 }
 
 // Basically, connection is coming from the API is forwarded as is.
@@ -78,22 +144,221 @@ func (p *TCPProxy) ServeWebSocket(w http.ResponseWriter, req *http.Request, targ
 //   - "sql driver (api)" <- [tls over tcp] -> "tcp proxy (api)" <- [tls over HTTP] -> "bridge" <- [tls over tcp] -> DB
 // 2. enabled tls sql driver and bridge
 //   - "sql driver (api)" <- [tls over tcp] -> "tcp proxy (api)" <- [tls over HTTPS] -> "bridge" <- [tls over tcp] -> DB
-func (p *TCPProxy) proxy(w http.ResponseWriter, req *http.Request, target *url.URL) error {
-	if err := validateAndGetTarget(req, target); err != nil {
+//
+// If target URL schema is "tls://", the bridge originates tls to the target instead.
+//
+//   - "driver (api)" <- [tcp] -> "tcp proxy (api)" <- [tcp over HTTPS] -> "bridge" <- [tls over tcp] -> data source
+func (p *TCPProxy) proxy(w http.ResponseWriter, req *http.Request, t *target.Target) error {
+	if err := validateAndGetTarget(req, t.URL); err != nil {
 		return err
 	}
 
-	hijacker, ok := w.(http.Hijacker)
-	if !ok {
+	if !upgradable(w, req) {
 		return errors.New("unexpected response writer")
 	}
 
-	conn, err := p.dialContextFunc(req.Context(), "tcp", target.Host)
+	tunnelCtx, done, err := p.tunnels.Track()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	conn, err := p.dialTarget(req.Context(), t)
 	if err != nil {
-		return fmt.Errorf("failed to dial to host %q: %w", target.Host, err)
+		return err
 	}
 	defer conn.Close()
 
+	clientConn, closeConn, err := p.upgrade(w, req)
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+
+	// From this point on, it is a tcp proxy world.
+	// We should not handle HTTP's context.Context and
+	// should not do for any other http-related operations.
+	return p.pipe(tunnelCtx, conn, clientConn, t, auth.TenantIDFromContext(req.Context()))
+}
+
+// connect forwards the connection of the CONNECT request to t. On HTTP/1.1,
+// it hijacks the connection. On HTTP/2, it uses the stream.
+func (p *TCPProxy) connect(w http.ResponseWriter, req *http.Request, t *target.Target) error {
+	if t.URL.Scheme != TCPScheme {
+		return fmt.Errorf("unexpected schema %q: %w", t.URL.Scheme, ErrBadRequest)
+	}
+	if _, _, err := net.SplitHostPort(t.URL.Host); err != nil {
+		return fmt.Errorf("connect to host:port only: %w", ErrBadRequest)
+	}
+	if !upgradable(w, req) {
+		return errors.New("unexpected response writer")
+	}
+
+	tunnelCtx, done, err := p.tunnels.Track()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	conn, err := p.dialTarget(req.Context(), t)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var clientConn net.Conn
+	if req.ProtoMajor == 2 {
+		clientConn, err = acceptStream(w, req)
+	} else {
+		clientConn, err = hijackConnect(w)
+	}
+	if err != nil {
+		return err
+	}
+	defer clientConn.Close()
+
+	return p.pipe(tunnelCtx, conn, clientConn, t, auth.TenantIDFromContext(req.Context()))
+}
+
+func hijackConnect(w http.ResponseWriter) (net.Conn, error) {
+	hijackedConn, brw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to hijack connection: %w", err)
+	}
+	// net/http does not write the status after the connection is hijacked.
+	if _, err := io.WriteString(hijackedConn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		hijackedConn.Close()
+		return nil, fmt.Errorf("failed to write response: %w", err)
+	}
+	return &bufConn{
+		rawConn: hijackedConn,
+		reader:  brw.Reader,
+	}, nil
+}
+
+// interceptor returns the interceptor of the application protocol of t.
+// It returns nil if the protocol is not inspected.
+func (p *TCPProxy) interceptor(t *target.Target) protocol.Interceptor {
+	c := t.Protocol
+	if c == nil {
+		return nil
+	}
+	switch c.Type {
+	case protocol.Postgres:
+		// the authenticator intercepts first, so that the auditor sees the
+		// messages which the client sends and receives.
+		var chain protocol.Chain
+		if c.Credentials != nil {
+			chain = append(chain, postgres.NewAuthenticator(p.logger.WithName("credentials"), c.Credentials))
+		}
+		if c.Audit {
+			chain = append(chain, postgres.NewAuditor(p.logger.WithName("audit")))
+		}
+		if len(chain) > 0 {
+			return chain
+		}
+	case protocol.MySQL:
+		if c.ReadOnly {
+			return mysql.NewReadOnlyFilter(p.logger.WithName("readonly"))
+		}
+	case protocol.Redis:
+		if len(c.AllowCommands) > 0 || len(c.DenyCommands) > 0 {
+			return redis.NewCommandFilter(p.logger.WithName("redis"), c.AllowCommands, c.DenyCommands)
+		}
+	}
+	return nil
+}
+
+// pipe forwards the connection between the target and the client of the
+// tenant. Both connections are closed when ctx is done. The tcp tunnel is
+// shaped by the bucket of the tenant and inspected by the interceptor of t.
+func (p *TCPProxy) pipe(ctx context.Context, conn, clientConn net.Conn, t *target.Target, tenantID string) error {
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+		clientConn.Close()
+	})
+	defer stop()
+
+	if t.URL.Scheme == UDPScheme {
+		return udpPipe(conn, clientConn, p.udpIdleTimeout)
+	}
+	if ic := p.interceptor(t); ic != nil {
+		var err error
+		clientConn, conn, err = ic.Intercept(&protocol.Session{
+			TenantID: tenantID,
+			Alias:    t.Alias,
+			Target:   t.URL.Redacted(),
+			TLS:      t.URL.Scheme == TLSScheme,
+		}, clientConn, conn)
+		if err != nil {
+			return err
+		}
+	}
+	bucket := p.shaper.Bucket(tenantID, t.Alias)
+	err := tcpPipe(conn, clientConn, p.tunnelLimits, bucket)
+	if bucket != nil && bucket.Throttled() > 0 {
+		p.logger.Info("throttled tunnel",
+			"target", t.URL.Redacted(),
+			"throttled", bucket.Throttled(),
+		)
+	}
+	if ctx.Err() != nil {
+		p.logger.Info("closed tunnel",
+			"target", t.URL.Redacted(),
+			"reason", "drain timeout",
+		)
+		return nil
+	}
+	var limitErr *limitError
+	if errors.As(err, &limitErr) {
+		p.logger.Info("closed tunnel",
+			"target", t.URL.Redacted(),
+			"reason", limitErr.reason,
+		)
+		return nil
+	}
+	return err
+}
+
+// upgrade opens the tunnel to the client. On HTTP/1.1, it responds 101
+// Switching Protocols and hijacks the connection. On HTTP/2, it responds
+// 200 to the extended CONNECT and uses the stream.
+// The returned connection exchanges websocket frames if it is negotiated.
+func (p *TCPProxy) upgrade(w http.ResponseWriter, req *http.Request) (net.Conn, func(), error) {
+	framed := isFramedRequest(req)
+	if framed {
+		w.Header().Set(secWebSocketProtocolKey, FramedSubprotocol)
+	}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if isExtendedConnect(req) {
+		conn, err = acceptStream(w, req)
+	} else {
+		conn, err = hijackUpgrade(w, req, framed)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !framed {
+		return conn, func() { conn.Close() }, nil
+	}
+	wsConn := websocket.NewConn(conn, false)
+	stop := wsConn.KeepAlive(framedPingInterval)
+	return wsConn, func() {
+		stop()
+		wsConn.Close()
+	}, nil
+}
+
+func hijackUpgrade(w http.ResponseWriter, req *http.Request, framed bool) (net.Conn, error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("unexpected response writer")
+	}
+
 	// start forwards tcp connection over HTTP
 	//
 	// We have to treat the HTTP connection as websocket to do bi-directional stream
@@ -101,44 +366,236 @@ func (p *TCPProxy) proxy(w http.ResponseWriter, req *http.Request, target *url.U
 	w.Header().Set("Upgrade", "websocket")
 	w.Header().Set("Connection", "Upgrade")
 	nonce := req.Header.Get(secWebSocketKey)
-	w.Header().Set(secWebSocketAcceptKey, getNonceAccept(nonce))
+	if framed {
+		w.Header().Set(secWebSocketAcceptKey, websocket.AcceptKey(nonce))
+	} else {
+		w.Header().Set(secWebSocketAcceptKey, getNonceAccept(nonce))
+	}
 	w.WriteHeader(http.StatusSwitchingProtocols)
 
 	hijackedConn, brw, err := hijacker.Hijack()
 	if err != nil {
-		return fmt.Errorf("failed to hijack connection: %w", err)
+		return nil, fmt.Errorf("failed to hijack connection: %w", err)
 	}
-	defer hijackedConn.Close()
-
-	hijackedConn = &bufConn{
+	return &bufConn{
 		rawConn: hijackedConn,
 		reader:  brw.Reader,
+	}, nil
+}
+
+// ResolveFunc resolves the target URL to the target which is allowed to proxy.
+type ResolveFunc = func(targetURL string) (*target.Target, error)
+
+// ServeSession serves the multiplexed session over websocket. Each stream
+// in the session is forwarded to the target specified by its metadata.
+func (p *TCPProxy) ServeSession(w http.ResponseWriter, req *http.Request, resolve ResolveFunc) {
+	if err := validateUpgrade(req); err != nil {
+		p.logger.Error(err, "invalid request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
+	if !upgradable(w, req) {
+		p.logger.Error(errors.New("unexpected response writer"), "unexpected error")
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	sessionCtx, done, err := p.tunnels.Track()
+	if err != nil {
+		p.logger.Info("rejected session while draining")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer done()
+	conn, closeConn, err := p.upgrade(w, req)
+	if err != nil {
+		p.logger.Error(err, "unexpected error")
+		return
+	}
+	defer closeConn()
 
-	// From this point on, it is a tcp proxy world.
-	// We should not handle HTTP's context.Context and
-	// should not do for any other http-related operations.
-	return tcpPipe(conn, hijackedConn)
+	session := mux.Server(conn)
+	defer session.Close()
+	// the session is tracked as a tunnel, and its streams are tracked in
+	// the session. While draining, the session is closed after its streams
+	// are finished, or the drain times out.
+	streams := drain.New()
+	go func() {
+		select {
+		case <-p.tunnels.Stopped():
+		case <-session.Done():
+			return
+		}
+		streams.Drain(sessionCtx)
+		session.Close()
+	}()
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+		go p.serveStream(req.Context(), stream, streams, resolve)
+	}
+}
+
+func (p *TCPProxy) serveStream(ctx context.Context, stream *mux.Stream, streams *drain.Tracker, resolve ResolveFunc) {
+	targetURL := string(stream.Metadata())
+	tunnelCtx, done, err := streams.Track()
+	if err == nil {
+		defer done()
+	}
+	var t *target.Target
+	if err == nil {
+		t, err = resolve(targetURL)
+	}
+	if err == nil && !isTunnelScheme(t.URL.Scheme) {
+		err = fmt.Errorf("unexpected schema %q: %w", t.URL.Scheme, ErrBadRequest)
+	}
+	if err == nil {
+		var release func()
+		release, err = p.concurrency.Acquire(ctx, auth.TenantIDFromContext(ctx), t.Alias)
+		if err == nil {
+			defer release()
+		}
+	}
+	var conn net.Conn
+	if err == nil {
+		conn, err = p.dialTarget(ctx, t)
+	}
+	if err != nil {
+		code, reason := streamErrorStatus(err)
+		p.logger.Info("rejected stream",
+			"target", targetURL,
+			"status", code,
+			"reason", err.Error(),
+		)
+		stream.Reject(code, reason)
+		return
+	}
+	defer conn.Close()
+	defer stream.Close()
+
+	if err := stream.Ack(); err != nil {
+		return
+	}
+	if err := p.pipe(tunnelCtx, conn, stream, t, auth.TenantIDFromContext(ctx)); err != nil {
+		p.logger.Error(err, "unexpected error", "target", targetURL)
+	}
+}
+
+// streamErrorStatus returns the HTTP status code and the reason to reject
+// the stream. The reason does not contain the details of the error.
+func streamErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, target.ErrUnknownAlias):
+		return http.StatusBadGateway, target.ErrUnknownAlias.Error()
+	case errors.Is(err, policy.ErrDenied):
+		return http.StatusForbidden, policy.ErrDenied.Error()
+	case errors.Is(err, netguard.ErrBlocked):
+		return http.StatusForbidden, netguard.ErrBlocked.Error()
+	case errors.Is(err, target.ErrAliasRequired):
+		return http.StatusForbidden, target.ErrAliasRequired.Error()
+	case errors.Is(err, ErrBadRequest):
+		return http.StatusBadRequest, http.StatusText(http.StatusBadRequest)
+	case errors.Is(err, drain.ErrDraining):
+		return http.StatusServiceUnavailable, drain.ErrDraining.Error()
+	case errors.Is(err, concurrency.ErrLimited):
+		return http.StatusServiceUnavailable, concurrency.ErrLimited.Error()
+	}
+	return http.StatusBadGateway, http.StatusText(http.StatusBadGateway)
+}
+
+func (p *TCPProxy) dialTarget(ctx context.Context, t *target.Target) (net.Conn, error) {
+	network, host := "tcp", t.URL.Host
+	if t.URL.Scheme == UDPScheme {
+		network = "udp"
+	}
+	if t.URL.Scheme == UnixScheme {
+		socket, _, err := splitUnixURL(t.URL)
+		if err != nil {
+			return nil, err
+		}
+		network, host = "unix", socket
+	}
+	conn, err := p.dialContextFunc(targetDialContext(ctx, t), network, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial to host %q: %w", host, err)
+	}
+	if t.URL.Scheme != TLSScheme {
+		return conn, nil
+	}
+
+	var cfg *tls.Config
+	if t.TLSConfig != nil {
+		cfg = t.TLSConfig.Clone()
+	} else {
+		cfg = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = t.URL.Hostname()
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to handshake tls with host %q: %w", host, err)
+	}
+	return tlsConn, nil
 }
 
 func validateAndGetTarget(req *http.Request, target *url.URL) error {
-	if req.Method != http.MethodGet {
+	if err := validateUpgrade(req); err != nil {
+		return err
+	}
+	if !isTunnelScheme(target.Scheme) {
+		return fmt.Errorf("unexpected schema %q: %w", target.Scheme, ErrBadRequest)
+	}
+	if target.Scheme == UnixScheme {
+		if _, _, err := splitUnixURL(target); err != nil {
+			return fmt.Errorf("%w: %w", err, ErrBadRequest)
+		}
+	}
+	return nil
+}
+
+func validateUpgrade(req *http.Request) error {
+	if !isTunnelRequest(req) {
 		return fmt.Errorf("connect only: %w", ErrBadRequest)
 	}
-	if req.Header.Get(secWebSocketKey) == "" {
+	// the challenge is not used by extended CONNECT (RFC 8441 section 5)
+	if !isExtendedConnect(req) && req.Header.Get(secWebSocketKey) == "" {
 		return fmt.Errorf("challenge is failed: %w", ErrBadRequest)
 	}
-	if target.Scheme != TCPScheme {
-		return fmt.Errorf("unexpected schema %q: %w", target.Scheme, ErrBadRequest)
+	if isFramedRequest(req) && req.Header.Get(secWebSocketVersionKey) != "13" {
+		return fmt.Errorf("unsupported websocket version %q: %w", req.Header.Get(secWebSocketVersionKey), ErrBadRequest)
 	}
 	return nil
 }
 
 const (
-	secWebSocketKey       = "Sec-Websocket-Key"
-	secWebSocketAcceptKey = "Sec-WebSocket-Accept"
+	secWebSocketKey         = "Sec-Websocket-Key"
+	secWebSocketAcceptKey   = "Sec-WebSocket-Accept"
+	secWebSocketProtocolKey = "Sec-WebSocket-Protocol"
+	secWebSocketVersionKey  = "Sec-WebSocket-Version"
 )
 
+// FramedSubprotocol is the websocket subprotocol to negotiate the tunnel
+// which exchanges real websocket frames (RFC 6455) instead of raw bytes.
+// Without it, the tunnel pipes raw bytes after the upgrade.
+const FramedSubprotocol = "bridge-framed"
+
+// framedPingInterval is an interval to send ping frames in the framed tunnel.
+const framedPingInterval = 30 * time.Second
+
+func isFramedRequest(req *http.Request) bool {
+	for _, v := range req.Header.Values(secWebSocketProtocolKey) {
+		for _, protocol := range strings.Split(v, ",") {
+			if strings.TrimSpace(protocol) == FramedSubprotocol {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // getNonceAccept computes the base64-encoded SHA-1 of the concatenation of
 // the nonce ("Sec-WebSocket-Key" value) with the websocket GUID string.
 func getNonceAccept(nonce string) string {
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
@@ -14,7 +15,13 @@ import (
 	"testing"
 	"time"
 
+	"github.com/basemachina/bridge/internal/drain"
+	"github.com/basemachina/bridge/internal/mux"
+	"github.com/basemachina/bridge/internal/policy"
+	"github.com/basemachina/bridge/internal/protocol"
+	"github.com/basemachina/bridge/internal/target"
 	"github.com/basemachina/bridge/internal/testlogr"
+	"github.com/basemachina/bridge/internal/websocket"
 )
 
 func MustParseRequestURI(rawURL string) *url.URL {
@@ -59,6 +66,30 @@ func TestProxy_validateAndGetTarget(t *testing.T) {
 			}(),
 			wantErr: true,
 		},
+		{
+			name:   "invalid Sec-WebSocket-Version",
+			target: MustParseRequestURI("tcp://127.0.0.1:80"),
+			req: func() *http.Request {
+				req := httptest.NewRequest("GET", "/", nil)
+				req.Header.Set(secWebSocketKey, "hello")
+				req.Header.Set(secWebSocketProtocolKey, FramedSubprotocol)
+				req.Header.Set(secWebSocketVersionKey, "8")
+				return req
+			}(),
+			wantErr: true,
+		},
+		{
+			name:   "valid (framed)",
+			target: MustParseRequestURI("tcp://127.0.0.1:80"),
+			req: func() *http.Request {
+				req := httptest.NewRequest("GET", "/", nil)
+				req.Header.Set(secWebSocketKey, "hello")
+				req.Header.Set(secWebSocketProtocolKey, "chat, "+FramedSubprotocol)
+				req.Header.Set(secWebSocketVersionKey, "13")
+				return req
+			}(),
+			wantErr: false,
+		},
 		{
 			name:   "valid",
 			target: MustParseRequestURI("tcp://127.0.0.1:80"),
@@ -87,7 +118,7 @@ func TestTCPProxy_proxy(t *testing.T) {
 	echoListener := newEchoListener()
 	t.Cleanup(func() { echoListener.Close() })
 
-	h := NewProxy(testlogr.Logger)
+	h := NewProxy(&Config{Logger: testlogr.Logger})
 	testServer := httptest.NewServer(h)
 	t.Cleanup(testServer.Close) // Listener も close してくれる
 
@@ -194,11 +225,200 @@ func TestTCPProxy_proxy(t *testing.T) {
 		}
 	})
 
+	t.Run("check echo over HTTP using own dialer (framed)", func(t *testing.T) {
+		t.Parallel()
+
+		u, err := url.Parse(testServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dialer := &Dialer{
+			BridgeURL: u,
+			BaseDialContext: (&net.Dialer{
+				Timeout: 3 * time.Second,
+			}).DialContext,
+			Framed: true,
+		}
+
+		cases := []struct {
+			name string
+			run  func(t *testing.T, conn net.Conn)
+		}{
+			{
+				name: "check echo",
+				run: func(t *testing.T, conn net.Conn) {
+					if _, ok := conn.(*websocket.Conn); !ok {
+						t.Fatalf("want websocket connection, but got %T", conn)
+					}
+					testEcho(t, conn, "hello, framed bridge client")
+				},
+			},
+			{
+				name: "check EOF",
+				run:  testQuit,
+			},
+		}
+		for _, tc := range cases {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				ctx := context.Background()
+				ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+				defer cancel()
+
+				conn, err := dialer.DialContext(ctx, echoListener.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				tc.run(t, conn)
+			})
+		}
+	})
+
+	t.Run("check echo over HTTP with alias", func(t *testing.T) {
+		t.Parallel()
+
+		targets, err := target.NewRegistry(map[string]*target.Config{
+			"echo": {URL: "tcp://" + echoListener.Addr().String()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		aliasTestServer := httptest.NewServer(NewProxy(&Config{
+			Logger:  testlogr.Logger,
+			Targets: targets,
+		}))
+		defer aliasTestServer.Close()
+
+		conn, status := upgradeTunnel(t, aliasTestServer, "alias://echo")
+		defer conn.Close()
+		if status != http.StatusSwitchingProtocols {
+			t.Fatalf("want 101, but got %d", status)
+		}
+		testEcho(t, conn, "hello, alias")
+	})
+
+	t.Run("check echo with protocol audit", func(t *testing.T) {
+		t.Parallel()
+
+		// the echo protocol is not postgres, so the audit stops but the
+		// tunnel keeps forwarding the bytes as is.
+		targets, err := target.NewRegistry(map[string]*target.Config{
+			"echo": {
+				URL:      "tcp://" + echoListener.Addr().String(),
+				Protocol: &protocol.Config{Type: protocol.Postgres, Audit: true},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		auditTestServer := httptest.NewServer(NewProxy(&Config{
+			Logger:  testlogr.Logger,
+			Targets: targets,
+		}))
+		defer auditTestServer.Close()
+
+		conn, status := upgradeTunnel(t, auditTestServer, "alias://echo")
+		defer conn.Close()
+		if status != http.StatusSwitchingProtocols {
+			t.Fatalf("want 101, but got %d", status)
+		}
+		testEcho(t, conn, "hello, audit")
+	})
+
+	t.Run("check redis command filter", func(t *testing.T) {
+		t.Parallel()
+
+		targets, err := target.NewRegistry(map[string]*target.Config{
+			"echo": {
+				URL:      "tcp://" + echoListener.Addr().String(),
+				Protocol: &protocol.Config{Type: protocol.Redis, AllowCommands: []string{"GET"}},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		redisTestServer := httptest.NewServer(NewProxy(&Config{
+			Logger:  testlogr.Logger,
+			Targets: targets,
+		}))
+		defer redisTestServer.Close()
+
+		conn, status := upgradeTunnel(t, redisTestServer, "alias://echo")
+		defer conn.Close()
+		if status != http.StatusSwitchingProtocols {
+			t.Fatalf("want 101, but got %d", status)
+		}
+		// the denied command is answered by bridge.
+		conn.SetDeadline(time.Now().Add(3 * time.Second))
+		if _, err := conn.Write([]byte("*1\r\n$8\r\nFLUSHALL\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		want := "-NOPERM bridge: 'flushall' command is not allowed\r\n"
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if want != string(got) {
+			t.Fatalf("want %q, but got %q", want, got)
+		}
+	})
+
+	t.Run("check inspected target without alias", func(t *testing.T) {
+		t.Parallel()
+
+		_, port, err := net.SplitHostPort(echoListener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		targets, err := target.NewRegistry(map[string]*target.Config{
+			"echo": {
+				URL:      "tcp://localhost:" + port,
+				Protocol: &protocol.Config{Type: protocol.Redis, AllowCommands: []string{"GET"}},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		inspectTestServer := httptest.NewServer(NewProxy(&Config{
+			Logger:  testlogr.Logger,
+			Targets: targets,
+		}))
+		defer inspectTestServer.Close()
+
+		// the IP address of the inspected target is rejected.
+		conn, status := upgradeTunnel(t, inspectTestServer, "tcp://"+echoListener.Addr().String())
+		conn.Close()
+		if status != http.StatusForbidden {
+			t.Fatalf("want 403, but got %d", status)
+		}
+
+		// the same host in another case is inspected.
+		conn, status = upgradeTunnel(t, inspectTestServer, "tcp://LOCALHOST:"+port)
+		defer conn.Close()
+		if status != http.StatusSwitchingProtocols {
+			t.Fatalf("want 101, but got %d", status)
+		}
+		conn.SetDeadline(time.Now().Add(3 * time.Second))
+		if _, err := conn.Write([]byte("*1\r\n$8\r\nFLUSHALL\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		want := "-NOPERM bridge: 'flushall' command is not allowed\r\n"
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if want != string(got) {
+			t.Fatalf("want %q, but got %q", want, got)
+		}
+	})
+
 	t.Run("check echo over HTTP using own dialer (tls)", func(t *testing.T) {
 		t.Parallel()
 
 		// create a new listner for tls
-		h := NewProxy(testlogr.Logger)
+		h := NewProxy(&Config{Logger: testlogr.Logger})
 		tlsTestServer := httptest.NewTLSServer(h)
 		defer tlsTestServer.Close()
 
@@ -249,6 +469,448 @@ func TestTCPProxy_proxy(t *testing.T) {
 	})
 }
 
+// upgradeTunnel sends an upgrade request to srv and returns the connection
+// and the response status.
+func TestTCPProxy_udp(t *testing.T) {
+	udpEcho, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { udpEcho.Close() })
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := udpEcho.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udpEcho.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	const idleTimeout = 300 * time.Millisecond
+	testServer := httptest.NewServer(NewProxy(&Config{
+		Logger:         testlogr.Logger,
+		UDPIdleTimeout: idleTimeout,
+	}))
+	t.Cleanup(testServer.Close)
+
+	u, err := url.Parse(testServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := &Dialer{
+		BridgeURL: u,
+		BaseDialContext: (&net.Dialer{
+			Timeout: 3 * time.Second,
+		}).DialContext,
+	}
+	dial := func(t *testing.T) *PacketConn {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		conn, err := dialer.DialPacketContext(ctx, udpEcho.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(3 * time.Second))
+		return conn
+	}
+
+	t.Run("keeps datagram boundaries", func(t *testing.T) {
+		conn := dial(t)
+		datagrams := []string{"hello", "", strings.Repeat("x", 9000), "world"}
+		for _, want := range datagrams {
+			if _, err := conn.WriteTo([]byte(want), conn.RemoteAddr()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		buf := make([]byte, maxDatagramSize)
+		for _, want := range datagrams {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(buf[:n]); got != want {
+				t.Fatalf("want %d bytes datagram, but got %d bytes", len(want), len(got))
+			}
+			if addr.String() != udpEcho.LocalAddr().String() {
+				t.Fatalf("want address %q, but got %q", udpEcho.LocalAddr(), addr)
+			}
+		}
+	})
+
+	t.Run("truncates datagram", func(t *testing.T) {
+		conn := dial(t)
+		if _, err := conn.Write([]byte("hello, world")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write([]byte("next")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		for _, want := range []string{"hello", "next"} {
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(buf[:n]); got != want {
+				t.Fatalf("want %q, but got %q", want, got)
+			}
+		}
+	})
+
+	t.Run("closes idle session", func(t *testing.T) {
+		conn := dial(t)
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, maxDatagramSize)
+		if _, err := conn.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		if _, err := conn.Read(buf); err != io.EOF {
+			t.Fatalf("want EOF, but got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < idleTimeout/2 {
+			t.Fatalf("closed too early: %s", elapsed)
+		}
+	})
+
+	t.Run("framed", func(t *testing.T) {
+		framedDialer := &Dialer{
+			BridgeURL:       dialer.BridgeURL,
+			BaseDialContext: dialer.BaseDialContext,
+			Framed:          true,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		conn, err := framedDialer.DialPacketContext(ctx, udpEcho.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+		for _, want := range []string{"hello", "world"} {
+			if _, err := conn.Write([]byte(want)); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, maxDatagramSize)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(buf[:n]); got != want {
+				t.Fatalf("want %q, but got %q", want, got)
+			}
+		}
+	})
+
+	t.Run("wrong destination", func(t *testing.T) {
+		conn := dial(t)
+		if _, err := conn.WriteTo([]byte("hello"), &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53}); err == nil {
+			t.Fatal("want error")
+		}
+	})
+}
+
+func TestTCPProxy_session(t *testing.T) {
+	echoListener := newEchoListener()
+	t.Cleanup(func() { echoListener.Close() })
+	_, echoPort, err := net.SplitHostPort(echoListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := policy.New(&policy.Config{
+		Allow: []policy.Rule{{Schemes: []string{"tcp"}, Ports: []string{echoPort}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testServer := httptest.NewServer(NewProxy(&Config{
+		Logger: testlogr.Logger,
+		Policy: p,
+	}))
+	t.Cleanup(testServer.Close)
+
+	u, err := url.Parse(testServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, framed := range []bool{false, true} {
+		name := "plain"
+		if framed {
+			name = "framed"
+		}
+		t.Run(name, func(t *testing.T) {
+			dialer := &Dialer{
+				BridgeURL: u,
+				BaseDialContext: (&net.Dialer{
+					Timeout: 3 * time.Second,
+				}).DialContext,
+				Framed: framed,
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			session, err := dialer.DialSession(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+
+			t.Run("many streams", func(t *testing.T) {
+				const n = 16
+				errs := make(chan error, n)
+				for i := 0; i < n; i++ {
+					go func() {
+						conn, err := session.DialContext(ctx, echoListener.Addr().String())
+						if err != nil {
+							errs <- err
+							return
+						}
+						defer conn.Close()
+						conn.SetDeadline(time.Now().Add(3 * time.Second))
+						want := fmt.Sprintf("hello, stream %d", i)
+						if _, err := conn.Write(append([]byte{byte(len(want))}, want...)); err != nil {
+							errs <- err
+							return
+						}
+						got := make([]byte, len(want))
+						if _, err := io.ReadFull(conn, got); err != nil {
+							errs <- err
+							return
+						}
+						if string(got) != want {
+							errs <- fmt.Errorf("want %q, but got %q", want, got)
+							return
+						}
+						errs <- nil
+					}()
+				}
+				for i := 0; i < n; i++ {
+					if err := <-errs; err != nil {
+						t.Fatal(err)
+					}
+				}
+			})
+
+			t.Run("rejected streams", func(t *testing.T) {
+				// keeps a stream open to check it is not affected by the rejections.
+				conn, err := session.DialContext(ctx, echoListener.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+
+				cases := []struct {
+					name     string
+					addr     string
+					wantCode int
+				}{
+					{
+						name:     "denied by policy",
+						addr:     "127.0.0.1:1",
+						wantCode: http.StatusForbidden,
+					},
+					{
+						name:     "invalid address",
+						addr:     "%",
+						wantCode: http.StatusBadGateway,
+					},
+				}
+				for _, tc := range cases {
+					_, err := session.DialContext(ctx, tc.addr)
+					var streamErr *mux.StreamError
+					if !errors.As(err, &streamErr) {
+						t.Fatalf("%s: want StreamError, but got %v", tc.name, err)
+					}
+					if streamErr.Code != tc.wantCode {
+						t.Fatalf("%s: want %d, but got %d", tc.name, tc.wantCode, streamErr.Code)
+					}
+				}
+				testEcho(t, conn, "hello, after rejections")
+				testQuit(t, conn)
+			})
+		})
+	}
+}
+
+// newCopyListener echoes until the client closes, unlike newEchoListener.
+func newCopyListener(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestTCPProxy_drain(t *testing.T) {
+	targetURL := "tcp://" + newCopyListener(t).Addr().String()
+
+	tunnels := drain.New()
+	testServer := httptest.NewServer(NewProxy(&Config{
+		Logger:  testlogr.Logger,
+		Tunnels: tunnels,
+	}))
+	t.Cleanup(testServer.Close)
+
+	conn, code := upgradeTunnel(t, testServer, targetURL)
+	defer conn.Close()
+	if code != http.StatusSwitchingProtocols {
+		t.Fatalf("want 101, but got %d", code)
+	}
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	echo := func(want string) error {
+		if _, err := io.WriteString(conn, want); err != nil {
+			return err
+		}
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			return err
+		}
+		if string(got) != want {
+			return fmt.Errorf("want %q, but got %q", want, got)
+		}
+		return nil
+	}
+	if err := echo("before draining"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	drained := make(chan error, 1)
+	go func() { drained <- tunnels.Drain(ctx) }()
+	for !tunnels.Draining() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// rejects new tunnels.
+	newConn, code := upgradeTunnel(t, testServer, targetURL)
+	newConn.Close()
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("want 503, but got %d", code)
+	}
+
+	// the live tunnel is still available until the drain timeout.
+	if err := echo("while draining"); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-drained; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want DeadlineExceeded, but got %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("want the tunnel is closed after the drain timeout")
+	}
+}
+
+func TestTCPProxy_drainSession(t *testing.T) {
+	ln := newCopyListener(t)
+	tunnels := drain.New()
+	testServer := httptest.NewServer(NewProxy(&Config{
+		Logger:  testlogr.Logger,
+		Tunnels: tunnels,
+	}))
+	t.Cleanup(testServer.Close)
+	u, err := url.Parse(testServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	session, err := (&Dialer{BridgeURL: u, BaseDialContext: (&net.Dialer{}).DialContext}).DialSession(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	conn, err := session.DialContext(ctx, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if got := tunnels.Len(); got != 1 {
+		t.Fatalf("want the session is tracked, but got %d tunnels", got)
+	}
+
+	drained := make(chan error, 1)
+	go func() { drained <- tunnels.Drain(ctx) }()
+	for !tunnels.Draining() {
+		time.Sleep(time.Millisecond)
+	}
+	// the live stream is still available until it is closed.
+	if _, err := io.WriteString(conn, "while draining"); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len("while draining"))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-drained:
+		t.Fatalf("drained before the stream is closed: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	conn.Close()
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("not drained")
+	}
+	if _, err := session.DialContext(ctx, ln.Addr().String()); err == nil {
+		t.Fatal("want the session is closed after the drain")
+	}
+}
+
+func upgradeTunnel(t *testing.T, srv *httptest.Server, target string) (net.Conn, int) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(TargetURLHeaderKey, target)
+	req.Header.Set(secWebSocketKey, generateNonce())
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	return &bufConn{rawConn: conn, reader: br}, resp.StatusCode
+}
+
 func newEchoListener() net.Listener {
 	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
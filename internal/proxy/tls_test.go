@@ -0,0 +1,285 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/basemachina/bridge/internal/target"
+	"github.com/basemachina/bridge/internal/testlogr"
+)
+
+// testPKI is a private PKI for testing.
+type testPKI struct {
+	caCert     *x509.Certificate
+	caKey      *ecdsa.PrivateKey
+	caFile     string
+	serverCert tls.Certificate
+	clientCert string
+	clientKey  string
+}
+
+// serverName is a name in the certificate of the server. The server
+// is listening on 127.0.0.1, so that the client has to override SNI.
+const testServerName = "data-source.internal"
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	dir := t.TempDir()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "bridge test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pki := &testPKI{
+		caCert: caCert,
+		caKey:  caKey,
+		caFile: filepath.Join(dir, "ca.pem"),
+	}
+	writePEM(t, pki.caFile, "CERTIFICATE", caDER)
+
+	serverDER, serverKey := pki.issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: testServerName},
+		DNSNames:     []string{testServerName},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	pki.serverCert = tls.Certificate{
+		Certificate: [][]byte{serverDER},
+		PrivateKey:  serverKey,
+	}
+
+	clientDER, clientKey := pki.issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "bridge"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	pki.clientCert = filepath.Join(dir, "client.pem")
+	pki.clientKey = filepath.Join(dir, "client-key.pem")
+	writePEM(t, pki.clientCert, "CERTIFICATE", clientDER)
+	keyDER, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, pki.clientKey, "EC PRIVATE KEY", keyDER)
+	return pki
+}
+
+func (pki *testPKI) issue(t *testing.T, template *x509.Certificate) ([]byte, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, template, pki.caCert, &key.PublicKey, pki.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der, key
+}
+
+// serverTLSConfig requires the client certificate issued by the CA.
+func (pki *testPKI) serverTLSConfig() *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(pki.caCert)
+	return &tls.Config{
+		Certificates: []tls.Certificate{pki.serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	t.Helper()
+	b := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTLSEchoListener(t *testing.T, config *tls.Config) net.Listener {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				panic(err)
+			}
+			go func() {
+				defer conn.Close()
+				if err := serverEcho(conn); err != nil && err != io.EOF {
+					log.Printf("server Echo error: %+v\n", err)
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestTCPProxy_tlsOrigination(t *testing.T) {
+	pki := newTestPKI(t)
+	echoListener := newTLSEchoListener(t, pki.serverTLSConfig())
+	t.Cleanup(func() { echoListener.Close() })
+
+	targets, err := target.NewRegistry(map[string]*target.Config{
+		"mtls-db": {
+			URL: "tls://" + echoListener.Addr().String(),
+			TLS: &target.TLSConfig{
+				CAFile:     pki.caFile,
+				CertFile:   pki.clientCert,
+				KeyFile:    pki.clientKey,
+				ServerName: testServerName,
+			},
+		},
+		"no-client-cert-db": {
+			URL: "tls://" + echoListener.Addr().String(),
+			TLS: &target.TLSConfig{
+				CAFile:     pki.caFile,
+				ServerName: testServerName,
+			},
+		},
+		"untrusted-db": {
+			URL: "tls://" + echoListener.Addr().String(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testServer := httptest.NewServer(NewProxy(&Config{
+		Logger:  testlogr.Logger,
+		Targets: targets,
+	}))
+	t.Cleanup(testServer.Close)
+
+	t.Run("valid", func(t *testing.T) {
+		conn, status := upgradeTunnel(t, testServer, "alias://mtls-db")
+		if status != http.StatusSwitchingProtocols {
+			t.Fatalf("want 101, but got %d", status)
+		}
+		defer conn.Close()
+		testEcho(t, conn, "hello, tls")
+	})
+
+	t.Run("untrusted server certificate", func(t *testing.T) {
+		conn, status := upgradeTunnel(t, testServer, "alias://untrusted-db")
+		defer conn.Close()
+		if status != http.StatusBadGateway {
+			t.Fatalf("want 502, but got %d", status)
+		}
+	})
+
+	t.Run("without client certificate", func(t *testing.T) {
+		conn, status := upgradeTunnel(t, testServer, "alias://no-client-cert-db")
+		defer conn.Close()
+		// In TLS 1.3, the client certificate is verified after the client
+		// finishes the handshake, so the tunnel is closed by the server.
+		if status == http.StatusSwitchingProtocols {
+			conn.SetDeadline(time.Now().Add(3 * time.Second))
+			conn.Write([]byte{1, 'a'})
+			if _, err := conn.Read(make([]byte, 1)); err == nil {
+				t.Fatal("want the tunnel is closed")
+			}
+			return
+		}
+		if status != http.StatusBadGateway {
+			t.Fatalf("want 502, but got %d", status)
+		}
+	})
+}
+
+func TestProxy_httpsWithTargetTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	targetSrv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	targetSrv.TLS = pki.serverTLSConfig()
+	targetSrv.StartTLS()
+	t.Cleanup(targetSrv.Close)
+
+	targets, err := target.NewRegistry(map[string]*target.Config{
+		"internal-api": {
+			URL: targetSrv.URL,
+			TLS: &target.TLSConfig{
+				CAFile:     pki.caFile,
+				CertFile:   pki.clientCert,
+				KeyFile:    pki.clientKey,
+				ServerName: testServerName,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyHandler := NewProxy(&Config{
+		Logger:  testlogr.Logger,
+		Targets: targets,
+	})
+
+	cases := []struct {
+		name       string
+		target     string
+		wantStatus int
+	}{
+		{name: "alias", target: "alias://internal-api/", wantStatus: http.StatusOK},
+		// the client certificate is only used for the alias.
+		{name: "registered url", target: targetSrv.URL + "/", wantStatus: http.StatusBadGateway},
+		{name: "not registered url", target: "https://localhost:" + targetSrv.URL[len("https://127.0.0.1:"):], wantStatus: http.StatusBadGateway},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(TargetURLHeaderKey, tc.target)
+			resp := httptest.NewRecorder()
+			proxyHandler.ServeHTTP(resp, req)
+
+			if resp.Code != tc.wantStatus {
+				t.Fatalf("status code, want %d, but got %d", tc.wantStatus, resp.Code)
+			}
+			if resp.Code == http.StatusOK && resp.Body.String() != "bridge" {
+				t.Fatalf("want client certificate %q, but got %q", "bridge", resp.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/basemachina/bridge/internal/bastion"
+	"github.com/basemachina/bridge/internal/egress"
+	"github.com/basemachina/bridge/internal/policy"
+	"github.com/basemachina/bridge/internal/target"
+)
+
+// TransportConfig is settings of the transport which is used to
+// proxy to HTTP targets.
+type TransportConfig struct {
+	// DialTimeout is also used to dial to tcp targets.
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	IdleConnTimeout       time.Duration
+	EnableHTTP2           bool
+	// FlushInterval is the same as httputil.ReverseProxy's one.
+	// A negative value means to flush immediately after each write.
+	FlushInterval time.Duration
+}
+
+// DefaultTransportConfig returns the same settings as http.DefaultTransport.
+func DefaultTransportConfig() *TransportConfig {
+	return &TransportConfig{
+		DialTimeout:         30 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: http.DefaultMaxIdleConnsPerHost,
+		IdleConnTimeout:     90 * time.Second,
+		EnableHTTP2:         true,
+	}
+}
+
+func newTransport(c *TransportConfig, dialContext DialContextFunc) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialContext
+	transport.TLSHandshakeTimeout = c.TLSHandshakeTimeout
+	transport.ResponseHeaderTimeout = c.ResponseHeaderTimeout
+	transport.MaxIdleConns = c.MaxIdleConns
+	transport.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = c.IdleConnTimeout
+	transport.ForceAttemptHTTP2 = c.EnableHTTP2
+	if !c.EnableHTTP2 {
+		// a non-nil empty map disables HTTP/2
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport
+}
+
+type targetContextKey struct{}
+
+func withTarget(ctx context.Context, t *target.Target) context.Context {
+	return context.WithValue(ctx, targetContextKey{}, t)
+}
+
+// targetDialContext returns a copy of ctx which carries the settings of
+// the target to dial.
+func targetDialContext(ctx context.Context, t *target.Target) context.Context {
+	ctx = policy.WithTarget(ctx, t.URL)
+	if t.Alias == "" {
+		ctx = target.WithUnregistered(ctx, t.URL)
+	}
+	if t.BypassEgressProxy {
+		ctx = egress.WithBypass(ctx)
+	}
+	if t.Bastion != "" {
+		ctx = bastion.WithName(ctx, t.Bastion)
+	}
+	return ctx
+}
+
+func targetFromContext(ctx context.Context) *target.Target {
+	t, _ := ctx.Value(targetContextKey{}).(*target.Target)
+	return t
+}
+
+// targetTransport routes the request to the transport for the target
+// which is stored in the request context.
+type targetTransport struct {
+	base *http.Transport
+
+	mu         sync.Mutex
+	transports map[transportKey]*http.Transport
+}
+
+// transportKey is the settings of each target which requires its own transport.
+type transportKey struct {
+	tlsConfig             *tls.Config
+	responseHeaderTimeout time.Duration
+	// bastion is required because the connections must not be shared
+	// with the targets which are dialed directly.
+	bastion string
+	// socket is a path of the unix domain socket for "http+unix://" targets.
+	socket string
+}
+
+var _ http.RoundTripper = (*targetTransport)(nil)
+
+func newTargetTransport(base *http.Transport) *targetTransport {
+	return &targetTransport{
+		base:       base,
+		transports: make(map[transportKey]*http.Transport),
+	}
+}
+
+func (tt *targetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return tt.transportFor(targetFromContext(req.Context())).RoundTrip(req)
+}
+
+func (tt *targetTransport) transportFor(t *target.Target) http.RoundTripper {
+	if t == nil {
+		return tt.base
+	}
+	var socket string
+	if t.URL.Scheme == HTTPUnixScheme {
+		// ServeHTTP has already validated the URL.
+		socket, _, _ = splitUnixURL(t.URL)
+	}
+	if t.TLSConfig == nil && t.ResponseHeaderTimeout == 0 && t.Bastion == "" && socket == "" {
+		return tt.base
+	}
+	key := transportKey{
+		tlsConfig:             t.TLSConfig,
+		responseHeaderTimeout: t.ResponseHeaderTimeout,
+		bastion:               t.Bastion,
+		socket:                socket,
+	}
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	tr, ok := tt.transports[key]
+	if !ok {
+		tr = tt.base.Clone()
+		if t.TLSConfig != nil {
+			tr.TLSClientConfig = t.TLSConfig.Clone()
+		}
+		if t.ResponseHeaderTimeout != 0 {
+			tr.ResponseHeaderTimeout = t.ResponseHeaderTimeout
+		}
+		if socket != "" {
+			dial := tt.base.DialContext
+			tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dial(ctx, "unix", socket)
+			}
+			tr.Proxy = nil
+		}
+		tt.transports[key] = tr
+	}
+	return tr
+}
+
+// tokenTransport requests the token endpoints of the credentials of the
+// target, e.g. "oauth2". They are dialed through the same egress proxy and
+// bastion as the target, but the TLS settings of the target are not used.
+type tokenTransport struct {
+	transports *targetTransport
+	target     *target.Target
+}
+
+var _ http.RoundTripper = (*tokenTransport)(nil)
+
+func (tt *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if tt.target.BypassEgressProxy {
+		ctx = egress.WithBypass(ctx)
+	}
+	if tt.target.Bastion != "" {
+		ctx = bastion.WithName(ctx, tt.target.Bastion)
+	}
+	t := &target.Target{URL: req.URL, Bastion: tt.target.Bastion}
+	return tt.transports.transportFor(t).RoundTrip(req.WithContext(ctx))
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// DefaultUDPIdleTimeout is used if the idle timeout of udp relay is not specified.
+const DefaultUDPIdleTimeout = 60 * time.Second
+
+// maxDatagramSize is the maximum size of the datagram which can be
+// framed with the 2-byte length prefix.
+const maxDatagramSize = 0xffff
+
+// writeDatagram writes b as a frame which has the 2-byte big endian
+// length prefix.
+func writeDatagram(w io.Writer, b []byte) error {
+	if len(b) > maxDatagramSize {
+		return fmt.Errorf("datagram is too large: %d bytes", len(b))
+	}
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readDatagram reads a frame written by writeDatagram into buf.
+// buf must be at least maxDatagramSize bytes.
+func readDatagram(r io.Reader, buf []byte) (int, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(header[:]))
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	return n, nil
+}
+
+// udpPipe relays datagrams between udpConn and the framed stream. Both
+// connections are closed if no datagram is relayed in idleTimeout.
+func udpPipe(udpConn, stream net.Conn, idleTimeout time.Duration) error {
+	var once sync.Once
+	closeAll := func() {
+		once.Do(func() {
+			udpConn.Close()
+			stream.Close()
+		})
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultUDPIdleTimeout
+	}
+	timer := time.AfterFunc(idleTimeout, closeAll)
+	defer timer.Stop()
+
+	var eg errgroup.Group
+
+	eg.Go(func() error {
+		defer closeAll()
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, err := readDatagram(stream, buf)
+			if err != nil {
+				return nil
+			}
+			timer.Reset(idleTimeout)
+			if _, err := udpConn.Write(buf[:n]); err != nil && !errors.Is(err, syscall.ECONNREFUSED) {
+				return nil
+			}
+		}
+	})
+
+	eg.Go(func() error {
+		defer closeAll()
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, err := udpConn.Read(buf)
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				// ICMP port unreachable of the previous datagram.
+				continue
+			}
+			if err != nil {
+				return nil
+			}
+			timer.Reset(idleTimeout)
+			if err := writeDatagram(stream, buf[:n]); err != nil {
+				return nil
+			}
+		}
+	})
+
+	return eg.Wait()
+}
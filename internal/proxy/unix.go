@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// splitUnixURL splits the path of "unix://" or "http+unix://" URL into
+// the socket path and the escaped request path.
+//
+// Like "proxy_pass http://unix:/path/to/socket:/uri" of nginx, the first
+// ":" separates the request path from the socket path in "http+unix://",
+// e.g. "http+unix:///var/run/admin.sock:/v1/users". "unix://" does not
+// have the request path.
+func splitUnixURL(u *url.URL) (socket, reqPath string, err error) {
+	if u.Host != "" {
+		return "", "", fmt.Errorf("unix socket url must not have host: %q", u.Host)
+	}
+	escaped := u.EscapedPath()
+	if u.Scheme == HTTPUnixScheme {
+		escaped, reqPath, _ = strings.Cut(escaped, ":")
+		if reqPath == "" {
+			reqPath = "/"
+		}
+	}
+	socket, err = url.PathUnescape(escaped)
+	if err != nil {
+		return "", "", err
+	}
+	if socket == "" || socket == "/" {
+		return "", "", fmt.Errorf("unix socket path is empty: %q", u.Redacted())
+	}
+	return socket, reqPath, nil
+}
+
+// unixRequestURL converts "http+unix://" URL to the URL of the request
+// which is sent over the socket.
+func unixRequestURL(u *url.URL) (*url.URL, error) {
+	_, reqPath, err := splitUnixURL(u)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := url.Parse(reqPath)
+	if err != nil {
+		return nil, err
+	}
+	ret.Scheme = "http"
+	ret.Host = "localhost"
+	ret.RawQuery = u.RawQuery
+	return ret, nil
+}
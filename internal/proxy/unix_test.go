@@ -0,0 +1,35 @@
+package proxy
+
+import "testing"
+
+func TestSplitUnixURL(t *testing.T) {
+	cases := []struct {
+		target      string
+		wantSocket  string
+		wantReqPath string
+		wantErr     bool
+	}{
+		{target: "unix:///var/run/postgresql/.s.PGSQL.5432", wantSocket: "/var/run/postgresql/.s.PGSQL.5432"},
+		{target: "http+unix:///var/run/admin.sock:/v1/users", wantSocket: "/var/run/admin.sock", wantReqPath: "/v1/users"},
+		{target: "http+unix:///var/run/admin.sock:/v1/a%2Fb", wantSocket: "/var/run/admin.sock", wantReqPath: "/v1/a%2Fb"},
+		{target: "http+unix:///var/run/admin.sock", wantSocket: "/var/run/admin.sock", wantReqPath: "/"},
+		{target: "http+unix:///var/run/admin%20api.sock:/", wantSocket: "/var/run/admin api.sock", wantReqPath: "/"},
+		{target: "unix://localhost/var/run/admin.sock", wantErr: true},
+		{target: "unix:///", wantErr: true},
+		{target: "http+unix://:/v1/users", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.target, func(t *testing.T) {
+			socket, reqPath, err := splitUnixURL(MustParseRequestURI(tc.target))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("want error %v, but got %v", tc.wantErr, err)
+			}
+			if socket != tc.wantSocket {
+				t.Errorf("want socket %q, but got %q", tc.wantSocket, socket)
+			}
+			if reqPath != tc.wantReqPath {
+				t.Errorf("want request path %q, but got %q", tc.wantReqPath, reqPath)
+			}
+		})
+	}
+}
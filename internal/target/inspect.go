@@ -0,0 +1,198 @@
+package target
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// ErrAliasRequired is returned when the target which is not registered is
+// dialed to the address of the target whose protocol is inspected, e.g.
+// "tcp://10.1.2.3:5432" for "tcp://orders-db:5432".
+var ErrAliasRequired = errors.New("inspected target must be specified by alias")
+
+// DialContextFunc is the same signature as net.Dialer.DialContext.
+type DialContextFunc = func(ctx context.Context, network, address string) (net.Conn, error)
+
+// ResolveFunc resolves host to addresses.
+type ResolveFunc = func(ctx context.Context, host string) ([]netip.Addr, error)
+
+type unregisteredContextKey struct{}
+
+// WithUnregistered returns a copy of ctx which carries target which is not
+// registered, so that the addresses which are dialed for target are
+// checked not to belong to the inspected targets.
+func WithUnregistered(ctx context.Context, target *url.URL) context.Context {
+	return context.WithValue(ctx, unregisteredContextKey{}, target)
+}
+
+func unregisteredFromContext(ctx context.Context) *url.URL {
+	u, _ := ctx.Value(unregisteredContextKey{}).(*url.URL)
+	return u
+}
+
+// CheckAddr returns an error wrapping ErrAliasRequired if the target in ctx
+// is resolved to addr and the port of the inspected target. If ctx has no
+// target, any addresses are allowed.
+//
+// The hosts of the inspected targets are resolved every time, so that
+// it follows the change of their addresses. If they cannot be resolved,
+// it returns the error not to let the target through.
+func (r *Registry) CheckAddr(ctx context.Context, addr netip.Addr) error {
+	target := unregisteredFromContext(ctx)
+	if r == nil || target == nil {
+		return nil
+	}
+	addr = addr.WithZone("").Unmap()
+	port := portOf(target)
+	for _, e := range r.inspected {
+		if e.url.Host == "" {
+			continue
+		}
+		if p := portOf(e.url); p != "" && port != "" && p != port {
+			continue
+		}
+		addrs, err := r.resolveHost(ctx, e.url.Hostname())
+		if err != nil {
+			return fmt.Errorf("target %q: %w", e.alias, err)
+		}
+		for _, a := range addrs {
+			if a.WithZone("").Unmap() == addr {
+				return fmt.Errorf("%q is the address of target %q: %w", target.Redacted(), e.alias, ErrAliasRequired)
+			}
+		}
+	}
+	return nil
+}
+
+// CheckSocket returns an error wrapping ErrAliasRequired if the target in
+// ctx is the unix domain socket of name which the inspected target uses.
+func (r *Registry) CheckSocket(ctx context.Context, name string) error {
+	target := unregisteredFromContext(ctx)
+	if r == nil || target == nil {
+		return nil
+	}
+	name = path.Clean(name)
+	for _, e := range r.inspected {
+		if e.url.Scheme == "unix" && path.Clean(e.url.Path) == name {
+			return fmt.Errorf("%q is the socket of target %q: %w", target.Redacted(), e.alias, ErrAliasRequired)
+		}
+	}
+	return nil
+}
+
+func (r *Registry) resolveHost(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+	addrs, err := r.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %q: %w", host, err)
+	}
+	return addrs, nil
+}
+
+func (r *Registry) checkAddrs(ctx context.Context, host string, addrs []netip.Addr) error {
+	for _, addr := range addrs {
+		if err := r.CheckAddr(ctx, addr); err != nil {
+			return fmt.Errorf("%q is resolved to %s: %w", host, addr, err)
+		}
+	}
+	return nil
+}
+
+// ResolveFunc wraps resolve, which may be nil, so that the resolved
+// addresses are checked not to belong to the inspected targets too.
+func (r *Registry) ResolveFunc(resolve ResolveFunc) ResolveFunc {
+	if r == nil || len(r.inspected) == 0 {
+		return resolve
+	}
+	if resolve == nil {
+		resolve = r.resolveHost
+	}
+	return func(ctx context.Context, host string) ([]netip.Addr, error) {
+		addrs, err := resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		return addrs, r.checkAddrs(ctx, host, addrs)
+	}
+}
+
+// DialContextFunc wraps dial. The returned function resolves the host of
+// the target in ctx and dials to the checked addresses, so that the target
+// which is not registered cannot reach the inspected targets by the IP
+// address or another hostname. The other networks than "tcp", "udp" and
+// "unix" families are passed through.
+func (r *Registry) DialContextFunc(dial DialContextFunc) DialContextFunc {
+	if r == nil || len(r.inspected) == 0 {
+		return dial
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if unregisteredFromContext(ctx) == nil {
+			return dial(ctx, network, address)
+		}
+		switch network {
+		case "unix", "unixgram", "unixpacket":
+			if err := r.CheckSocket(ctx, address); err != nil {
+				return nil, err
+			}
+			return dial(ctx, network, address)
+		case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+		default:
+			return dial(ctx, network, address)
+		}
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := r.resolveHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.checkAddrs(ctx, host, addrs); err != nil {
+			return nil, err
+		}
+		var firstErr error
+		for _, addr := range addrs {
+			if (network[len(network)-1] == '4' && !addr.Unmap().Is4()) ||
+				(network[len(network)-1] == '6' && addr.Unmap().Is4()) {
+				continue
+			}
+			conn, err := dial(ctx, network, net.JoinHostPort(addr.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("no suitable address found for %q", address)
+		}
+		return nil, firstErr
+	}
+}
+
+// portOf returns the port of u. It is empty if the port is omitted and the
+// scheme has no default port.
+func portOf(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http":
+		return "80"
+	case "https":
+		return "443"
+	}
+	return ""
+}
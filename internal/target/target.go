@@ -0,0 +1,301 @@
+package target
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/basemachina/bridge/internal/credential"
+	"github.com/basemachina/bridge/internal/jsontime"
+	"github.com/basemachina/bridge/internal/protocol"
+)
+
+// AliasScheme is a scheme to specify the target by alias, e.g. "alias://orders-db".
+const AliasScheme = "alias"
+
+// ErrUnknownAlias is returned when the alias is not registered.
+var ErrUnknownAlias = errors.New("unknown target alias")
+
+// ErrInvalidPath is returned when the path of the alias escapes the path
+// of the real URL, e.g. "alias://internal-api/../admin".
+var ErrInvalidPath = errors.New("path escapes the target alias")
+
+// Config is a config of the target which is registered with an alias.
+type Config struct {
+	// URL is a real URL of the target, e.g. "tcp://10.1.2.3:5432", "https://internal-api/".
+	URL string `json:"url"`
+	// TLS is an optional. It is used for "https://" and "tls://" targets.
+	TLS *TLSConfig `json:"tls"`
+	// ResponseHeaderTimeout overrides UPSTREAM_RESPONSE_HEADER_TIMEOUT
+	// for this HTTP target.
+	ResponseHeaderTimeout jsontime.Duration `json:"responseHeaderTimeout"`
+	// BypassEgressProxy makes bridge dial to this target directly even if
+	// the egress proxy is configured.
+	BypassEgressProxy bool `json:"bypassEgressProxy"`
+	// Bastion is a name of the SSH bastion which bridge dials to this
+	// target through. It is the only way to select a bastion; the
+	// "ssh+tcp://" form of URL is not supported.
+	Bastion string `json:"bastion"`
+	// Protocol is an optional. It makes bridge inspect the application
+	// protocol of the "tcp://", "tls://" and "unix://" target.
+	//
+	// The URL which has the same scheme and host as this target is
+	// inspected too. The other URLs which are not specified by alias are
+	// rejected when they are dialed to the address of this target, e.g.
+	// the IP address of the hostname, so that the inspection is not
+	// bypassed. The target which is dialed through a bastion is resolved
+	// by the bastion, so that it is not protected in this way.
+	Protocol *protocol.Config `json:"protocol"`
+	// Credentials is an optional. It makes bridge attach the credentials
+	// to the requests to the "http://", "https://" and "http+unix://"
+	// target.
+	Credentials *credential.Config `json:"credentials"`
+}
+
+// Target is a destination resolved by Registry.
+type Target struct {
+	// Alias is the name of the registered target. It is empty if the
+	// target is not registered.
+	Alias string
+	// URL is a real URL of the target.
+	URL *url.URL
+	// TLSConfig is TLS settings to connect to the target. If nil, the
+	// default settings is used.
+	TLSConfig *tls.Config
+	// ResponseHeaderTimeout is zero if it is not overridden.
+	ResponseHeaderTimeout time.Duration
+	// BypassEgressProxy reports whether the target is dialed directly.
+	BypassEgressProxy bool
+	// Bastion is a name of the SSH bastion to dial through. It is empty
+	// if the target is dialed directly.
+	Bastion string
+	// Protocol is nil if the application protocol is not inspected.
+	Protocol *protocol.Config
+	// Credentials is nil if bridge does not attach the credentials.
+	Credentials credential.Injector
+}
+
+type entry struct {
+	alias                 string
+	url                   *url.URL
+	tlsConfig             *tls.Config
+	responseHeaderTimeout time.Duration
+	bypassEgressProxy     bool
+	bastion               string
+	protocol              *protocol.Config
+	credentials           credential.Injector
+}
+
+// Registry maps aliases to real targets.
+type Registry struct {
+	entries map[string]*entry
+	// byHost is keyed by scheme and host of the real URL.
+	byHost map[string]*entry
+	// inspected is the targets whose protocol is inspected.
+	inspected []*entry
+	resolver  *net.Resolver
+}
+
+// NewRegistry creates a new registry from configs keyed by alias.
+func NewRegistry(configs map[string]*Config) (*Registry, error) {
+	entries := make(map[string]*entry, len(configs))
+	for alias, c := range configs {
+		if alias == "" {
+			return nil, errors.New("alias must not be empty")
+		}
+		if c == nil {
+			return nil, fmt.Errorf("target %q: config is empty", alias)
+		}
+		u, err := url.ParseRequestURI(c.URL)
+		if err != nil {
+			return nil, fmt.Errorf("target %q: invalid url: %w", alias, err)
+		}
+		if u.Scheme == AliasScheme {
+			return nil, fmt.Errorf("target %q: alias cannot refer to another alias", alias)
+		}
+		if u.Scheme == "ssh+tcp" {
+			return nil, fmt.Errorf("target %q: %q is not supported, use bastion instead", alias, u.Scheme)
+		}
+		e := &entry{
+			alias:                 alias,
+			url:                   u,
+			responseHeaderTimeout: time.Duration(c.ResponseHeaderTimeout),
+			bypassEgressProxy:     c.BypassEgressProxy,
+			bastion:               c.Bastion,
+			protocol:              c.Protocol,
+		}
+		if c.TLS != nil {
+			e.tlsConfig, err = c.TLS.build()
+			if err != nil {
+				return nil, fmt.Errorf("target %q: invalid tls config: %w", alias, err)
+			}
+		}
+		if c.Protocol != nil {
+			if err := c.Protocol.Validate(); err != nil {
+				return nil, fmt.Errorf("target %q: %w", alias, err)
+			}
+			switch u.Scheme {
+			case "tcp", "tls", "unix":
+			default:
+				return nil, fmt.Errorf("target %q: protocol is not supported for %q", alias, u.Scheme)
+			}
+			if c.Protocol.Credentials != nil && c.Protocol.Credentials.AllowCleartext && u.Scheme != "tls" {
+				return nil, fmt.Errorf("target %q: allowCleartext is not supported for %q", alias, u.Scheme)
+			}
+		}
+		if c.Credentials != nil {
+			switch u.Scheme {
+			case "http", "https", "http+unix":
+			default:
+				return nil, fmt.Errorf("target %q: credentials is not supported for %q", alias, u.Scheme)
+			}
+			e.credentials, err = credential.New(c.Credentials)
+			if err != nil {
+				return nil, fmt.Errorf("target %q: invalid credentials: %w", alias, err)
+			}
+		}
+		entries[alias] = e
+	}
+	// If some targets have the same scheme and host, the first one in
+	// alphabetical order of aliases is used.
+	aliases := make([]string, 0, len(entries))
+	for alias := range entries {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	byHost := make(map[string]*entry, len(entries))
+	var inspected []*entry
+	for _, alias := range aliases {
+		e := entries[alias]
+		if e.protocol != nil && e.bastion == "" {
+			inspected = append(inspected, e)
+		}
+		if e.url.Host == "" {
+			// e.g. "unix:///var/run/postgresql/.s.PGSQL.5432"
+			continue
+		}
+		key := hostKey(e.url)
+		if _, ok := byHost[key]; !ok {
+			byHost[key] = e
+		}
+	}
+	return &Registry{
+		entries:   entries,
+		byHost:    byHost,
+		inspected: inspected,
+		resolver:  net.DefaultResolver,
+	}, nil
+}
+
+// hostKey normalizes the case and the trailing dot of the host, so that
+// "tcp://ORDERS-DB.:5432" has the same key as "tcp://orders-db:5432".
+func hostKey(u *url.URL) string {
+	host := strings.TrimSuffix(u.Hostname(), ".")
+	if port := u.Port(); port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+	return strings.ToLower(u.Scheme + "://" + host)
+}
+
+// Resolve resolves u to the real target if u is specified by alias.
+// Otherwise, returns the target of u with the settings of the registered
+// target which has the same scheme and host, if any. The TLS settings and
+// the credentials are only used for the targets specified by alias. The
+// host is compared without the case and the trailing dot; the other forms
+// of the host are checked by DialContextFunc when they are dialed.
+//
+// The path and the query of u are appended to the real URL, so that
+// "alias://internal-api/v1/users?id=1" is resolved to
+// "https://internal-api/v1/users?id=1".
+func (r *Registry) Resolve(u *url.URL) (*Target, error) {
+	if u.Scheme != AliasScheme {
+		if e := r.lookup(u); e != nil {
+			t := e.target(u)
+			// the client certificate and the credentials are not lent
+			// to the URL which is specified by the client.
+			t.TLSConfig, t.Credentials = nil, nil
+			return t, nil
+		}
+		return &Target{URL: u}, nil
+	}
+	alias := u.Host
+	var e *entry
+	if r != nil {
+		e = r.entries[alias]
+	}
+	if e == nil {
+		return nil, fmt.Errorf("%q: %w", alias, ErrUnknownAlias)
+	}
+	resolved, err := joinPath(e.url, u)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", u.Redacted(), err)
+	}
+	resolved.RawQuery = joinQuery(e.url.RawQuery, u.RawQuery)
+	return e.target(resolved), nil
+}
+
+// joinPath appends the path of u to the path of base. The escaped path of
+// u is joined, so that it is not unescaped twice. The result must be under
+// the path of base even if the path of u has "..", and the segments which
+// are encoded twice to hide "." or "/" are rejected.
+func joinPath(base, u *url.URL) (*url.URL, error) {
+	if u.Path == "" {
+		// JoinPath cleans the path, so that keeps the path as is.
+		joined := *base
+		return &joined, nil
+	}
+	for _, segment := range strings.Split(u.Path, "/") {
+		s, err := url.PathUnescape(segment)
+		if err == nil && s != segment && (s == "." || s == ".." || strings.Contains(s, "/")) {
+			return nil, ErrInvalidPath
+		}
+	}
+	b := *base
+	if !strings.HasPrefix(b.Path, "/") {
+		// JoinPath returns the relative path if the base has no path.
+		b.Path, b.RawPath = "/"+b.Path, ""
+	}
+	joined := b.JoinPath(u.EscapedPath())
+	dir, p := path.Clean(b.Path), path.Clean(joined.Path)
+	if p != dir && !strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/") {
+		return nil, ErrInvalidPath
+	}
+	return joined, nil
+}
+
+// lookup finds the registered target which has the same scheme and host as u.
+func (r *Registry) lookup(u *url.URL) *entry {
+	if r == nil || u.Host == "" {
+		return nil
+	}
+	return r.byHost[hostKey(u)]
+}
+
+func (e *entry) target(u *url.URL) *Target {
+	return &Target{
+		Alias:                 e.alias,
+		URL:                   u,
+		TLSConfig:             e.tlsConfig,
+		ResponseHeaderTimeout: e.responseHeaderTimeout,
+		BypassEgressProxy:     e.bypassEgressProxy,
+		Bastion:               e.bastion,
+		Protocol:              e.protocol,
+		Credentials:           e.credentials,
+	}
+}
+
+func joinQuery(q1, q2 string) string {
+	if q1 == "" {
+		return q2
+	}
+	if q2 == "" {
+		return q1
+	}
+	return q1 + "&" + q2
+}
@@ -0,0 +1,230 @@
+package target
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/basemachina/bridge/internal/credential"
+	"github.com/basemachina/bridge/internal/protocol"
+)
+
+func mustParseURL(rawURL string) *url.URL {
+	u, err := url.ParseRequestURI(rawURL)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+func TestRegistry_Resolve(t *testing.T) {
+	r, err := NewRegistry(map[string]*Config{
+		"orders-db":    {URL: "tcp://10.1.2.3:5432"},
+		"internal-api": {URL: "https://internal-api/"},
+		"reporting":    {URL: "http://reporting:8080/api?tenant=a"},
+		"local-pg":     {URL: "unix:///var/run/postgresql/.s.PGSQL.5432"},
+		"admin-api":    {URL: "http+unix:///var/run/admin.sock:/"},
+		"legacy-api":   {URL: "http://legacy-api:8080"},
+		"search-api":   {URL: "https://search-api/base/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		target    string
+		wantAlias string
+		wantURL   string
+		wantErr   error
+	}{
+		{target: "alias://orders-db", wantAlias: "orders-db", wantURL: "tcp://10.1.2.3:5432"},
+		{target: "alias://internal-api", wantAlias: "internal-api", wantURL: "https://internal-api/"},
+		{target: "alias://internal-api/v1/users?id=1", wantAlias: "internal-api", wantURL: "https://internal-api/v1/users?id=1"},
+		{target: "alias://reporting/v1/", wantAlias: "reporting", wantURL: "http://reporting:8080/api/v1/?tenant=a"},
+		{target: "alias://reporting?from=2020", wantAlias: "reporting", wantURL: "http://reporting:8080/api?tenant=a&from=2020"},
+		{target: "tcp://10.1.2.3:5432", wantAlias: "orders-db", wantURL: "tcp://10.1.2.3:5432"},
+		{target: "https://INTERNAL-API/v1/users", wantAlias: "internal-api", wantURL: "https://INTERNAL-API/v1/users"},
+		{target: "https://internal-api./v1/users", wantAlias: "internal-api", wantURL: "https://internal-api./v1/users"},
+		{target: "tcp://10.1.2.4:5432", wantAlias: "", wantURL: "tcp://10.1.2.4:5432"},
+		{target: "alias://local-pg", wantAlias: "local-pg", wantURL: "unix:///var/run/postgresql/.s.PGSQL.5432"},
+		{target: "alias://admin-api/v1/users", wantAlias: "admin-api", wantURL: "http+unix:///var/run/admin.sock:/v1/users"},
+		{target: "unix:///var/run/other.sock", wantAlias: "", wantURL: "unix:///var/run/other.sock"},
+		{target: "alias://legacy-api", wantAlias: "legacy-api", wantURL: "http://legacy-api:8080"},
+		{target: "alias://legacy-api/v1/users", wantAlias: "legacy-api", wantURL: "http://legacy-api:8080/v1/users"},
+		{target: "alias://search-api/v1/../users", wantAlias: "search-api", wantURL: "https://search-api/base/users"},
+		{target: "alias://search-api/v1/..", wantAlias: "search-api", wantURL: "https://search-api/base"},
+		{target: "alias://search-api/v1/../../etc", wantErr: ErrInvalidPath},
+		{target: "alias://search-api/v1/%2e%2e/%2E%2E/etc", wantErr: ErrInvalidPath},
+		{target: "alias://search-api/../base2", wantErr: ErrInvalidPath},
+		{target: "alias://admin-api/../../run/docker.sock:/", wantErr: ErrInvalidPath},
+		{target: "alias://search-api/%252e%252e/admin", wantErr: ErrInvalidPath},
+		{target: "alias://search-api/v1/%252E/users", wantErr: ErrInvalidPath},
+		{target: "alias://search-api/v1%252f..%252f..%252fadmin", wantErr: ErrInvalidPath},
+		{target: "alias://search-api/v1%2f..%2f..%2fadmin", wantErr: ErrInvalidPath},
+		{target: "alias://search-api/v1/a%2fb", wantAlias: "search-api", wantURL: "https://search-api/base/v1/a%2fb"},
+		{target: "alias://search-api/v1/%2e%2e/users", wantAlias: "search-api", wantURL: "https://search-api/base/v1/%2e%2e/users"},
+		{target: "alias://unknown", wantErr: ErrUnknownAlias},
+	}
+	for _, tc := range cases {
+		t.Run(tc.target, func(t *testing.T) {
+			got, err := r.Resolve(mustParseURL(tc.target))
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("want error %v, but got %v", tc.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if got.Alias != tc.wantAlias {
+				t.Errorf("want alias %q, but got %q", tc.wantAlias, got.Alias)
+			}
+			if got.URL.String() != tc.wantURL {
+				t.Errorf("want url %q, but got %q", tc.wantURL, got.URL)
+			}
+		})
+	}
+}
+
+func TestRegistry_Resolve_aliasOnlySettings(t *testing.T) {
+	t.Setenv("TEST_INTERNAL_API_TOKEN", "token")
+	r, err := NewRegistry(map[string]*Config{
+		"internal-api": {
+			URL:         "https://internal-api/",
+			TLS:         &TLSConfig{ServerName: "internal-api.example.com"},
+			Credentials: &credential.Config{Type: credential.Bearer, Secret: &credential.Secret{Env: "TEST_INTERNAL_API_TOKEN"}},
+			Bastion:     "legacy",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := r.Resolve(mustParseURL("alias://internal-api/v1/users"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.TLSConfig == nil || got.Credentials == nil {
+		t.Errorf("want the tls config and the credentials for the alias, but got %v and %v", got.TLSConfig, got.Credentials)
+	}
+
+	got, err = r.Resolve(mustParseURL("https://internal-api/v1/users"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.TLSConfig != nil || got.Credentials != nil {
+		t.Errorf("want no tls config and credentials for the url, but got %v and %v", got.TLSConfig, got.Credentials)
+	}
+	if got.Bastion != "legacy" {
+		t.Errorf("want bastion %q, but got %q", "legacy", got.Bastion)
+	}
+}
+
+func TestRegistry_DialContextFunc(t *testing.T) {
+	r, err := NewRegistry(map[string]*Config{
+		"orders-db": {URL: "tcp://localhost:5432", Protocol: &protocol.Config{Type: protocol.MySQL, ReadOnly: true}},
+		"local-pg":  {URL: "unix:///var/run/postgresql/.s.PGSQL.5432", Protocol: &protocol.Config{Type: protocol.Postgres, Audit: true}},
+		"legacy-db": {URL: "tcp://10.1.2.3:3306", Bastion: "legacy", Protocol: &protocol.Config{Type: protocol.MySQL, ReadOnly: true}},
+		"web-db":    {URL: "tcp://127.0.0.1:3306"},
+		"audit-db":  {URL: "tcp://localhost:5433", Protocol: &protocol.Config{Type: protocol.Postgres, Audit: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dialed string
+	dial := r.DialContextFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = address
+		return nil, errors.New("dialed")
+	})
+
+	cases := []struct {
+		name    string
+		network string
+		target  string
+		wantErr error
+	}{
+		{name: "ip of inspected target", network: "tcp", target: "tcp://127.0.0.1:5432", wantErr: ErrAliasRequired},
+		{name: "socket of inspected target", network: "unix", target: "unix:///var/run/postgresql/../postgresql/.s.PGSQL.5432", wantErr: ErrAliasRequired},
+		{name: "ip of audited target", network: "tcp", target: "tcp://127.0.0.1:5433", wantErr: ErrAliasRequired},
+		{name: "other port", network: "tcp", target: "tcp://127.0.0.1:3306"},
+		{name: "target behind bastion", network: "tcp", target: "tcp://10.1.2.3:3306"},
+		{name: "other socket", network: "unix", target: "unix:///var/run/other.sock"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dialed = ""
+			u := mustParseURL(tc.target)
+			address := u.Host
+			if tc.network == "unix" {
+				address = u.Path
+			}
+			_, err := dial(WithUnregistered(context.Background(), u), tc.network, address)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("want error %v, but got %v", tc.wantErr, err)
+				}
+				if dialed != "" {
+					t.Fatalf("want not to dial, but dialed to %q", dialed)
+				}
+				return
+			}
+			if dialed == "" {
+				t.Fatalf("want to dial, but got %v", err)
+			}
+		})
+	}
+
+	t.Run("registered target", func(t *testing.T) {
+		dialed = ""
+		// the target resolved by alias is dialed without the mark.
+		dial(context.Background(), "tcp", "127.0.0.1:5432")
+		if dialed != "127.0.0.1:5432" {
+			t.Fatalf("want to dial to %q, but dialed to %q", "127.0.0.1:5432", dialed)
+		}
+	})
+}
+
+func TestRegistry_Resolve_nil(t *testing.T) {
+	var r *Registry
+	if _, err := r.Resolve(mustParseURL("alias://orders-db")); !errors.Is(err, ErrUnknownAlias) {
+		t.Fatalf("want error %v, but got %v", ErrUnknownAlias, err)
+	}
+	got, err := r.Resolve(mustParseURL("https://internal-api/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.URL.String() != "https://internal-api/" {
+		t.Fatalf("unexpected url: %q", got.URL)
+	}
+}
+
+func TestNewRegistry_invalid(t *testing.T) {
+	cases := []struct {
+		name    string
+		configs map[string]*Config
+	}{
+		{name: "empty alias", configs: map[string]*Config{"": {URL: "tcp://10.1.2.3:5432"}}},
+		{name: "nil config", configs: map[string]*Config{"orders-db": nil}},
+		{name: "invalid url", configs: map[string]*Config{"orders-db": {URL: "10.1.2.3:5432"}}},
+		{name: "alias of alias", configs: map[string]*Config{"orders-db": {URL: "alias://other-db"}}},
+		{name: "ssh+tcp", configs: map[string]*Config{"legacy-db": {URL: "ssh+tcp://10.1.2.3:5432"}}},
+		{name: "ca file not found", configs: map[string]*Config{"orders-db": {URL: "tls://10.1.2.3:5432", TLS: &TLSConfig{CAFile: "not_found.pem"}}}},
+		{name: "cert without key", configs: map[string]*Config{"orders-db": {URL: "tls://10.1.2.3:5432", TLS: &TLSConfig{CertFile: "client.pem"}}}},
+		{name: "unknown protocol", configs: map[string]*Config{"orders-db": {URL: "tcp://10.1.2.3:5432", Protocol: &protocol.Config{Type: "oracle"}}}},
+		{name: "read-only postgres", configs: map[string]*Config{"orders-db": {URL: "tcp://10.1.2.3:5432", Protocol: &protocol.Config{Type: protocol.Postgres, ReadOnly: true}}}},
+		{name: "invalid redis command", configs: map[string]*Config{"cache": {URL: "tcp://10.1.2.4:6379", Protocol: &protocol.Config{Type: protocol.Redis, DenyCommands: []string{"CONFIG SET"}}}}},
+		{name: "credentials of mysql", configs: map[string]*Config{"orders-db": {URL: "tcp://10.1.2.3:3306", Protocol: &protocol.Config{Type: protocol.MySQL, Credentials: &protocol.Credentials{User: "app", PasswordEnv: "PATH"}}}}},
+		{name: "cleartext without tls", configs: map[string]*Config{"orders-db": {URL: "tcp://10.1.2.3:5432", Protocol: &protocol.Config{Type: protocol.Postgres, Credentials: &protocol.Credentials{User: "app", PasswordEnv: "PATH", AllowCleartext: true}}}}},
+		{name: "missing password file", configs: map[string]*Config{"orders-db": {URL: "tcp://10.1.2.3:5432", Protocol: &protocol.Config{Type: protocol.Postgres, Credentials: &protocol.Credentials{User: "app", PasswordFile: "testdata/missing"}}}}},
+		{name: "invalid credentials", configs: map[string]*Config{"internal-api": {URL: "https://internal-api/", Credentials: &credential.Config{Type: credential.Bearer}}}},
+		{name: "credentials of tcp target", configs: map[string]*Config{"orders-db": {URL: "tcp://10.1.2.3:5432", Credentials: &credential.Config{Type: credential.Bearer, Secret: &credential.Secret{Env: "PATH"}}}}},
+		{name: "protocol of http target", configs: map[string]*Config{"internal-api": {URL: "https://internal-api/", Protocol: &protocol.Config{Type: protocol.Postgres}}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewRegistry(tc.configs); err == nil {
+				t.Fatal("want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package target
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// TLSConfig is TLS settings which bridge uses to connect to the target.
+type TLSConfig struct {
+	// CAFile is a path to PEM encoded CA certificates to verify the target.
+	// If empty, the system's certificates are used.
+	CAFile string `json:"caFile"`
+	// CertFile and KeyFile are paths to PEM encoded client certificate and key
+	// for mutual TLS.
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// ServerName overrides the server name for SNI and verification.
+	ServerName string `json:"serverName"`
+	// InsecureSkipVerify disables the verification of the target's certificate.
+	InsecureSkipVerify bool `json:"insecureSkipVerify"`
+}
+
+func (c *TLSConfig) build() (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", c.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, errors.New("both of certFile and keyFile must be specified")
+		}
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
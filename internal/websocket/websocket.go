@@ -0,0 +1,403 @@
+// Package websocket implements the framing of RFC 6455 on top of the
+// connection which has been upgraded already.
+package websocket
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Close codes defined in RFC 6455 section 7.4.1.
+const (
+	CloseNormalClosure    = 1000
+	CloseGoingAway        = 1001
+	CloseProtocolError    = 1002
+	CloseUnsupportedData  = 1003
+	CloseNoStatusReceived = 1005
+	CloseInternalError    = 1011
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+
+	finBit  = 0x80
+	rsvBits = 0x70
+	maskBit = 0x80
+
+	maxControlPayload = 125
+)
+
+// ErrCloseSent is returned when writing after the close frame is sent.
+var ErrCloseSent = errors.New("websocket: close frame has been sent")
+
+// CloseError is returned by Read when the peer closes the connection
+// with other than the normal closure.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("websocket: close %d", e.Code)
+	}
+	return fmt.Sprintf("websocket: close %d: %s", e.Code, e.Reason)
+}
+
+// AcceptKey computes the value of "Sec-WebSocket-Accept" from the value
+// of "Sec-WebSocket-Key".
+func AcceptKey(key string) string {
+	const guid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	sum := sha1.Sum([]byte(key + guid))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Conn sends and receives binary messages over the upgraded connection.
+// It implements net.Conn, so that the stream is split into messages
+// on Write and the messages are joined into the stream on Read.
+//
+// Ping frames are answered automatically. Read returns io.EOF when the
+// normal close frame is received.
+type Conn struct {
+	conn net.Conn
+	// client masks the frames to send, and the server requires the
+	// received frames to be masked.
+	client bool
+
+	rmu       sync.Mutex
+	remaining uint64
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+	readErr   error
+	// fragmented reports whether the continuation frames of the message
+	// are expected.
+	fragmented bool
+
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+var _ interface {
+	net.Conn
+	CloseWrite() error
+} = (*Conn)(nil)
+
+// NewConn creates a new connection. client must be true if the
+// connection is the client side of the websocket.
+func NewConn(conn net.Conn, client bool) *Conn {
+	return &Conn{
+		conn:   conn,
+		client: client,
+	}
+}
+
+type header struct {
+	fin    bool
+	opcode byte
+	masked bool
+	mask   [4]byte
+	length uint64
+}
+
+func (c *Conn) readHeader() (*header, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(c.conn, b[:2]); err != nil {
+		return nil, err
+	}
+	h := &header{
+		fin:    b[0]&finBit != 0,
+		opcode: b[0] & 0x0f,
+		masked: b[1]&maskBit != 0,
+		length: uint64(b[1] & 0x7f),
+	}
+	if b[0]&rsvBits != 0 {
+		return nil, c.fail(CloseProtocolError, "reserved bits are set")
+	}
+	switch h.length {
+	case 126:
+		if _, err := io.ReadFull(c.conn, b[:2]); err != nil {
+			return nil, err
+		}
+		h.length = uint64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		if _, err := io.ReadFull(c.conn, b[:8]); err != nil {
+			return nil, err
+		}
+		h.length = binary.BigEndian.Uint64(b[:8])
+		if h.length>>63 != 0 {
+			return nil, c.fail(CloseProtocolError, "invalid payload length")
+		}
+	}
+	if h.masked {
+		if _, err := io.ReadFull(c.conn, h.mask[:]); err != nil {
+			return nil, err
+		}
+	}
+	// RFC 6455 section 5.1: the client masks all frames and the server
+	// does not mask any frames.
+	if h.masked == c.client {
+		return nil, c.fail(CloseProtocolError, "unexpected masking")
+	}
+	return h, nil
+}
+
+// Read reads the payload of binary messages.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for c.remaining == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if err := c.nextFrame(); err != nil {
+			c.readErr = err
+			return 0, err
+		}
+	}
+	if uint64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.conn.Read(b)
+	if c.masked {
+		for i := range b[:n] {
+			b[i] ^= c.mask[c.maskPos&3]
+			c.maskPos++
+		}
+	}
+	c.remaining -= uint64(n)
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// nextFrame reads frames until the data frame is found. The control
+// frames are handled in it.
+func (c *Conn) nextFrame() error {
+	for {
+		h, err := c.readHeader()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		switch h.opcode {
+		case opBinary, opContinuation:
+			// RFC 6455 section 5.4: the continuation frames follow the
+			// data frame without FIN, and the other data frames must not
+			// be interleaved with them.
+			if h.opcode == opContinuation && !c.fragmented {
+				return c.fail(CloseProtocolError, "unexpected continuation frame")
+			}
+			if h.opcode != opContinuation && c.fragmented {
+				return c.fail(CloseProtocolError, "continuation frame is expected")
+			}
+			c.fragmented = !h.fin
+			c.remaining = h.length
+			c.mask, c.masked, c.maskPos = h.mask, h.masked, 0
+			if c.remaining > 0 {
+				return nil
+			}
+			continue
+		case opText:
+			return c.fail(CloseUnsupportedData, "text message is not supported")
+		case opPing, opPong, opClose:
+		default:
+			return c.fail(CloseProtocolError, fmt.Sprintf("unknown opcode %d", h.opcode))
+		}
+
+		if !h.fin || h.length > maxControlPayload {
+			return c.fail(CloseProtocolError, "invalid control frame")
+		}
+		payload := make([]byte, h.length)
+		if _, err := io.ReadFull(c.conn, payload); err != nil {
+			return err
+		}
+		if h.masked {
+			for i := range payload {
+				payload[i] ^= h.mask[i&3]
+			}
+		}
+		switch h.opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil && !errors.Is(err, ErrCloseSent) {
+				return err
+			}
+		case opClose:
+			return closeErrorFromPayload(payload)
+		}
+	}
+}
+
+func closeErrorFromPayload(payload []byte) error {
+	if len(payload) < 2 {
+		return io.EOF
+	}
+	code := int(binary.BigEndian.Uint16(payload))
+	if code == CloseNormalClosure || code == CloseGoingAway {
+		return io.EOF
+	}
+	return &CloseError{
+		Code:   code,
+		Reason: string(payload[2:]),
+	}
+}
+
+// fail sends the close frame with code and returns the error.
+func (c *Conn) fail(code int, reason string) error {
+	c.WriteClose(code, reason)
+	return &CloseError{Code: code, Reason: reason}
+}
+
+// Write writes b as a binary message.
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(opBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Ping sends a ping frame. The peer answers it with a pong frame, which
+// is discarded by Read.
+func (c *Conn) Ping(payload []byte) error {
+	if len(payload) > maxControlPayload {
+		return errors.New("websocket: ping payload is too large")
+	}
+	return c.writeFrame(opPing, payload)
+}
+
+// WriteClose sends the close frame with code and reason. No more messages
+// can be written after it, but messages from the peer can be read until
+// the peer sends the close frame.
+func (c *Conn) WriteClose(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+	return c.writeFrame(opClose, payload)
+}
+
+// CloseWrite sends the normal close frame. It is called by the pipe when
+// the other side of the pipe is closed.
+func (c *Conn) CloseWrite() error {
+	err := c.WriteClose(CloseNormalClosure, "")
+	if errors.Is(err, ErrCloseSent) {
+		return nil
+	}
+	return err
+}
+
+// closeTimeout is a timeout to send the close frame in Close.
+const closeTimeout = time.Second
+
+// Close sends the normal close frame if it has not been sent yet, and
+// closes the underlying connection. It does not wait for the blocked
+// Write to send the close frame.
+func (c *Conn) Close() error {
+	if c.wmu.TryLock() {
+		if !c.closeSent {
+			c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+			c.writeFrameLocked(opClose, []byte{CloseNormalClosure >> 8, CloseNormalClosure & 0xff})
+		}
+		c.wmu.Unlock()
+	}
+	return c.conn.Close()
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.writeFrameLocked(opcode, payload)
+}
+
+func (c *Conn) writeFrameLocked(opcode byte, payload []byte) error {
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, finBit|opcode)
+	var maskFlag byte
+	if c.client {
+		maskFlag = maskBit
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, maskFlag|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskFlag|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, maskFlag|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if !c.client {
+		frame = append(frame, payload...)
+		_, err := c.conn.Write(frame)
+		return err
+	}
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	frame = append(frame, mask[:]...)
+	offset := len(frame)
+	frame = append(frame, payload...)
+	for i := range frame[offset:] {
+		frame[offset+i] ^= mask[i&3]
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func (c *Conn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *Conn) RemoteAddr() net.Addr               { return c.conn.RemoteAddr() }
+func (c *Conn) SetDeadline(t time.Time) error      { return c.conn.SetDeadline(t) }
+func (c *Conn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *Conn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+// KeepAlive sends ping frames at interval until stop is called or it
+// fails to send. It keeps the intermediaries from closing the idle
+// connection.
+func (c *Conn) KeepAlive(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if err := c.Ping(nil); err != nil {
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
@@ -0,0 +1,260 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newPair returns the connected client and server raw connections.
+func newPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	client, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = <-accepted
+	if server == nil {
+		t.Fatal("failed to accept")
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	client.SetDeadline(deadline)
+	server.SetDeadline(deadline)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestAcceptKey(t *testing.T) {
+	// https://datatracker.ietf.org/doc/html/rfc6455#section-1.3
+	got := AcceptKey("dGhlIHNhbXBsZSBub25jZQ==")
+	if want := "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; want != got {
+		t.Fatalf("want %q, but got %q", want, got)
+	}
+}
+
+func TestConn_messages(t *testing.T) {
+	rawClient, rawServer := newPair(t)
+	client, server := NewConn(rawClient, true), NewConn(rawServer, false)
+
+	messages := [][]byte{
+		[]byte("hello"),
+		bytes.Repeat([]byte("a"), 200),   // 16-bit length
+		bytes.Repeat([]byte("b"), 70000), // 64-bit length
+		[]byte{},                         // empty message is skipped
+		[]byte("world"),
+	}
+	var want []byte
+	for _, m := range messages {
+		want = append(want, m...)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		src, dst *Conn
+	}{
+		{name: "client to server", src: client, dst: server},
+		{name: "server to client", src: server, dst: client},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			go func() {
+				for _, m := range messages {
+					tc.src.Write(m)
+				}
+			}()
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(tc.dst, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(want, got) {
+				t.Fatal("unexpected payload")
+			}
+		})
+	}
+}
+
+func TestConn_fragmented(t *testing.T) {
+	rawClient, rawServer := newPair(t)
+	server := NewConn(rawServer, false)
+
+	frames := []byte{
+		opBinary, maskBit | 2, 0, 0, 0, 0, 'h', 'e',
+		// the control frames can be injected in the fragmented message.
+		finBit | opPing, maskBit | 0, 0, 0, 0, 0,
+		opContinuation, maskBit | 2, 0, 0, 0, 0, 'l', 'l',
+		finBit | opContinuation, maskBit | 1, 0, 0, 0, 0, 'o',
+		finBit | opBinary, maskBit | 1, 0, 0, 0, 0, '!',
+	}
+	if _, err := rawClient.Write(frames); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len("hello!"))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello!" {
+		t.Fatalf("want %q, but got %q", "hello!", got)
+	}
+}
+
+func TestConn_ping(t *testing.T) {
+	rawClient, rawServer := newPair(t)
+	client, server := NewConn(rawClient, true), NewConn(rawServer, false)
+
+	// the server answers the ping while reading.
+	go io.Copy(io.Discard, server)
+
+	if err := client.Ping([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	// reads the pong frame directly.
+	frame := make([]byte, 2+len("ping"))
+	if _, err := io.ReadFull(rawClient, frame); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{finBit | opPong, 4, 'p', 'i', 'n', 'g'}; !bytes.Equal(want, frame) {
+		t.Fatalf("want pong frame %v, but got %v", want, frame)
+	}
+}
+
+func TestConn_close(t *testing.T) {
+	t.Run("normal closure", func(t *testing.T) {
+		rawClient, rawServer := newPair(t)
+		client, server := NewConn(rawClient, true), NewConn(rawServer, false)
+
+		if _, err := server.Write([]byte("bye")); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.CloseWrite(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := server.Write([]byte("more")); !errors.Is(err, ErrCloseSent) {
+			t.Fatalf("want ErrCloseSent, but got %v", err)
+		}
+		got, err := io.ReadAll(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "bye" {
+			t.Fatalf("want %q, but got %q", "bye", got)
+		}
+
+		// the client can still send messages until it sends the close frame.
+		if _, err := client.Write([]byte("ack")); err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+		got, err = io.ReadAll(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "ack" {
+			t.Fatalf("want %q, but got %q", "ack", got)
+		}
+	})
+
+	t.Run("close code", func(t *testing.T) {
+		rawClient, rawServer := newPair(t)
+		client, server := NewConn(rawClient, true), NewConn(rawServer, false)
+
+		if err := server.WriteClose(CloseInternalError, "target is gone"); err != nil {
+			t.Fatal(err)
+		}
+		_, err := client.Read(make([]byte, 1))
+		var closeErr *CloseError
+		if !errors.As(err, &closeErr) {
+			t.Fatalf("want CloseError, but got %v", err)
+		}
+		if closeErr.Code != CloseInternalError || closeErr.Reason != "target is gone" {
+			t.Fatalf("unexpected close error: %+v", closeErr)
+		}
+	})
+}
+
+func TestConn_protocolError(t *testing.T) {
+	cases := []struct {
+		name     string
+		frame    []byte
+		wantCode int
+	}{
+		{
+			name:     "unmasked frame from client",
+			frame:    []byte{finBit | opBinary, 1, 'a'},
+			wantCode: CloseProtocolError,
+		},
+		{
+			name:     "text message",
+			frame:    []byte{finBit | opText, maskBit | 1, 0, 0, 0, 0, 'a'},
+			wantCode: CloseUnsupportedData,
+		},
+		{
+			name:     "reserved bits",
+			frame:    []byte{finBit | 0x40 | opBinary, maskBit | 1, 0, 0, 0, 0, 'a'},
+			wantCode: CloseProtocolError,
+		},
+		{
+			name:     "fragmented control frame",
+			frame:    []byte{opPing, maskBit | 0, 0, 0, 0, 0},
+			wantCode: CloseProtocolError,
+		},
+		{
+			name:     "continuation without message",
+			frame:    []byte{finBit | opContinuation, maskBit | 1, 0, 0, 0, 0, 'a'},
+			wantCode: CloseProtocolError,
+		},
+		{
+			name: "new message in fragmented message",
+			frame: []byte{
+				opBinary, maskBit | 0, 0, 0, 0, 0,
+				finBit | opBinary, maskBit | 1, 0, 0, 0, 0, 'a',
+			},
+			wantCode: CloseProtocolError,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rawClient, rawServer := newPair(t)
+			server := NewConn(rawServer, false)
+
+			if _, err := rawClient.Write(tc.frame); err != nil {
+				t.Fatal(err)
+			}
+			_, err := server.Read(make([]byte, 1))
+			var closeErr *CloseError
+			if !errors.As(err, &closeErr) || closeErr.Code != tc.wantCode {
+				t.Fatalf("want close code %d, but got %v", tc.wantCode, err)
+			}
+
+			// the server sends the close frame with the code.
+			header := make([]byte, 4)
+			if _, err := io.ReadFull(rawClient, header); err != nil {
+				t.Fatal(err)
+			}
+			if header[0] != finBit|opClose {
+				t.Fatalf("want close frame, but got %x", header[0])
+			}
+			if code := int(header[2])<<8 | int(header[3]); code != tc.wantCode {
+				t.Fatalf("want close code %d, but got %d", tc.wantCode, code)
+			}
+		})
+	}
+}
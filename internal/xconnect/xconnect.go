@@ -0,0 +1,32 @@
+// Package xconnect enables HTTP/2 extended CONNECT (RFC 8441) on the
+// servers of net/http, which bridge uses to open tunnels.
+//
+// net/http reads "http2xconnect=1" only from the GODEBUG environment
+// variable when it is initialized, and the setting cannot be specified by
+// the //go:debug directive. So that this package sets it in init. It must
+// be imported by the main package (or the test) with a blank import:
+//
+//	import _ "github.com/basemachina/bridge/internal/xconnect"
+//
+// Go initializes the packages in the order of their import paths as long
+// as their dependencies are initialized. This package only depends on os
+// and strings, so that it is initialized before net/http.
+package xconnect
+
+import (
+	"os"
+	"strings"
+)
+
+const setting = "http2xconnect=1"
+
+func init() {
+	godebug := os.Getenv("GODEBUG")
+	if strings.Contains(godebug, setting) {
+		return
+	}
+	if godebug != "" {
+		godebug += ","
+	}
+	os.Setenv("GODEBUG", godebug+setting)
+}